@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+)
+
+/*
+ * Pool utilization alerts
+ *
+ * Each subnet has a set of utilization thresholds in percent (100
+ * meaning exhausted).  As leases are allocated and reaped the current
+ * level is recomputed and, when it crosses a threshold in either
+ * direction, a pool.utilization event is published.  Like any other
+ * event it goes to the event stream and the webhook queue, where the
+ * alerts.webhook URLs are endpoints of their own.
+ */
+
+var defaultAlertThresholds = []int{80, 95, 100}
+
+type PoolUtilization struct {
+	Threshold         int     `json:"threshold"`
+	PreviousThreshold int     `json:"previous_threshold"`
+	Rising            bool    `json:"rising"`
+	Exhausted         bool    `json:"exhausted"`
+	Used              uint    `json:"used"`
+	Size              uint    `json:"size"`
+	Percent           float64 `json:"percent"`
+}
+
+type Alerter struct {
+	lock       sync.Mutex
+	thresholds []int          // Defaults for subnets without their own
+	levels     map[string]int // subnet -> last threshold crossed
+}
+
+func NewAlerter(thresholds []int) *Alerter {
+	return &Alerter{
+		thresholds: thresholds,
+		levels:     make(map[string]int),
+	}
+}
+
+// alertEndpoints makes a webhook endpoint of each alerts.webhook URL.
+// Names are stable across restarts so queued alerts survive them.
+func alertEndpoints(urls []string, retries int) []*WebhookEndpoint {
+	endpoints := make([]*WebhookEndpoint, 0, len(urls))
+	for i, url := range urls {
+		endpoints = append(endpoints, &WebhookEndpoint{
+			Name:     fmt.Sprintf("alerts.webhook.%d", i),
+			Url:      url,
+			Events:   []string{EventPoolUtilization},
+			Attempts: retries + 1,
+		})
+	}
+	return endpoints
+}
+
+// level returns the highest threshold at or below pct, or 0.
+func level(thresholds []int, pct float64) int {
+	sorted := append([]int{}, thresholds...)
+	sort.Ints(sorted)
+	l := 0
+	for _, t := range sorted {
+		if pct >= float64(t) {
+			l = t
+		}
+	}
+	return l
+}
+
+// measure returns the subnet's current level.  ok is false when it
+// has no pool or no thresholds.
+func (a *Alerter) measure(subnet *Subnet) (u *PoolUtilization, ok bool) {
+	subnet.lock.RLock()
+	used, size := subnet.utilization()
+	thresholds := subnet.AlertThresholds
+	subnet.lock.RUnlock()
+
+	if len(thresholds) == 0 {
+		thresholds = a.thresholds
+	}
+	if size == 0 || len(thresholds) == 0 {
+		return nil, false
+	}
+	pct := float64(used) * 100 / float64(size)
+	return &PoolUtilization{
+		Threshold: level(thresholds, pct),
+		Exhausted: used >= size,
+		Used:      used,
+		Size:      size,
+		Percent:   pct,
+	}, true
+}
+
+// Seed records every subnet's current level without alerting, so a
+// restart doesn't repeat alerts for thresholds already crossed.
+func (a *Alerter) Seed(dt *DataTracker) {
+	if a == nil {
+		return
+	}
+	dt.Lock()
+	subnets := make([]*Subnet, 0, len(dt.Subnets))
+	for _, s := range dt.Subnets {
+		subnets = append(subnets, s)
+	}
+	dt.Unlock()
+
+	for _, s := range subnets {
+		if u, ok := a.measure(s); ok {
+			a.lock.Lock()
+			a.levels[s.Name] = u.Threshold
+			a.lock.Unlock()
+		}
+	}
+}
+
+// Forget drops a removed subnet's level.
+func (a *Alerter) Forget(name string) {
+	if a == nil {
+		return
+	}
+	a.lock.Lock()
+	delete(a.levels, name)
+	a.lock.Unlock()
+}
+
+// Check records the subnet's utilization and publishes an event if it
+// moved across a threshold.
+func (a *Alerter) Check(dt *DataTracker, subnet *Subnet) {
+	if a == nil {
+		return
+	}
+	u, ok := a.measure(subnet)
+	if !ok {
+		return
+	}
+
+	a.lock.Lock()
+	prev := a.levels[subnet.Name]
+	a.levels[subnet.Name] = u.Threshold
+	a.lock.Unlock()
+
+	if u.Threshold == prev {
+		return
+	}
+	u.PreviousThreshold = prev
+	u.Rising = u.Threshold > prev
+	log.Printf("Subnet %s utilization %.1f%% crossed threshold %d (was %d)", subnet.Name, u.Percent, u.Threshold, prev)
+	dt.emit(&Event{Type: EventPoolUtilization, Subnet: subnet.Name, Utilization: u})
+}
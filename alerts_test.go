@@ -0,0 +1,108 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/willf/bitset"
+)
+
+func alertReceiver(t *testing.T, failures int32, retries int) (*Webhooks, chan webhookReceived, func()) {
+	ts, received := webhookReceiver(t, failures)
+	path := webhookQueuePath(t)
+	wh, err := NewWebhooks(path, alertEndpoints([]string{ts.URL}, retries))
+	assert.Nil(t, err)
+	wh.backoff = time.Millisecond
+	stop := make(chan struct{})
+	go wh.Run(stop)
+	return wh, received, func() {
+		close(stop)
+		ts.Close()
+		os.RemoveAll(filepath.Dir(path))
+	}
+}
+
+func waitAlert(t *testing.T, received chan webhookReceived) *PoolUtilization {
+	r := waitWebhook(t, received)
+	assert.Equal(t, EventPoolUtilization, r.event.Type)
+	return r.event.Utilization
+}
+
+func TestLevel(t *testing.T) {
+	assert.Equal(t, 0, level([]int{80, 95, 100}, 50))
+	assert.Equal(t, 80, level([]int{100, 80, 95}, 80))
+	assert.Equal(t, 95, level([]int{80, 95, 100}, 99.9))
+	assert.Equal(t, 100, level([]int{80, 95, 100}, 100))
+}
+
+func TestAlertOnExhaustionAndRecovery(t *testing.T) {
+	wh, received, done := alertReceiver(t, 0, 0)
+	defer done()
+
+	dt, s := tempSetup(t)
+	s.ActiveEnd = s.ActiveStart // A pool of one
+	s.ActiveBits = bitset.New(1)
+	s.AlertThresholds = []int{100}
+	dt.webhooks = wh
+	dt.alerter = NewAlerter(nil)
+
+	lease, _ := s.find_or_get_info(dt, "aa:bb:cc:dd:ee:ff", nil)
+	assert.NotNil(t, lease)
+	s.update_lease_time(dt, lease, time.Hour)
+
+	r := waitWebhook(t, received)
+	assert.Equal(t, EventPoolUtilization, r.event.Type)
+	assert.Equal(t, "fred", r.event.Subnet)
+	u := r.event.Utilization
+	assert.Equal(t, 100, u.Threshold)
+	assert.True(t, u.Rising)
+	assert.True(t, u.Exhausted)
+	assert.Equal(t, uint(1), u.Used)
+	assert.Equal(t, uint(1), u.Size)
+
+	// Another client finds the pool exhausted, but the level is unchanged.
+	lease, _ = s.find_or_get_info(dt, "11:22:33:44:55:66", nil)
+	assert.Nil(t, lease)
+
+	s.free_lease(dt, "aa:bb:cc:dd:ee:ff", EventLeaseReleased)
+	u = waitAlert(t, received)
+	assert.Equal(t, 0, u.Threshold)
+	assert.Equal(t, 100, u.PreviousThreshold)
+	assert.False(t, u.Rising)
+	assert.False(t, u.Exhausted)
+	assert.Equal(t, 0, len(received))
+}
+
+func TestAlertRetriesWebhook(t *testing.T) {
+	wh, received, done := alertReceiver(t, 2, 3)
+	defer done()
+
+	dt, s := tempSetup(t)
+	s.ActiveBits = bitset.New(21)
+	dt.webhooks = wh
+	dt.alerter = NewAlerter([]int{1})
+
+	s.find_or_get_info(dt, "aa:bb:cc:dd:ee:ff", nil)
+
+	assert.Equal(t, 1, waitAlert(t, received).Threshold)
+}
+
+func TestAlertSeedAndForget(t *testing.T) {
+	dt, s := tempSetup(t)
+	s.ActiveBits = bitset.New(21)
+	dt.alerter = NewAlerter([]int{1})
+	s.find_or_get_info(dt, "aa:bb:cc:dd:ee:ff", nil)
+
+	// A restarted alerter knows the level without alerting again.
+	a := NewAlerter([]int{1})
+	a.Seed(dt)
+	assert.Equal(t, 1, a.levels["fred"])
+
+	dt.alerter = a
+	dt.RemoveSubnet("fred")
+	_, ok := a.levels["fred"]
+	assert.False(t, ok)
+}
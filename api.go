@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/ant0ine/go-json-rest/rest"
@@ -22,16 +25,27 @@ import (
  * Includes bind and unbind actions.
  */
 type ApiSubnet struct {
-	Name              string     `json:"name"`
-	Subnet            string     `json:"subnet"`
-	NextServer        *string    `json:"next_server,omitempty"`
-	ActiveStart       string     `json:"active_start"`
-	ActiveEnd         string     `json:"active_end"`
-	ActiveLeaseTime   int        `json:"active_lease_time"`
-	ReservedLeaseTime int        `json:"reserved_lease_time"`
-	Leases            []*Lease   `json:"leases,omitempty"`
-	Bindings          []*Binding `json:"bindings,omitempty"`
-	Options           []*Option  `json:"options,omitempty"`
+	Name               string            `json:"name"`
+	Subnet             string            `json:"subnet"`
+	NextServer         *string           `json:"next_server,omitempty"`
+	ActiveStart        string            `json:"active_start"`
+	ActiveEnd          string            `json:"active_end"`
+	ActiveLeaseTime    int               `json:"active_lease_time"`
+	ReservedLeaseTime  int               `json:"reserved_lease_time"`
+	AlertThresholds    []int             `json:"alert_thresholds,omitempty"`
+	ForwardZone        string            `json:"forward_zone,omitempty"`
+	ReverseZone        string            `json:"reverse_zone,omitempty"`
+	HostnameTemplate   string            `json:"hostname_template,omitempty"`
+	TftpRoot           string            `json:"tftp_root,omitempty"`
+	BootTemplate       string            `json:"boot_template,omitempty"`
+	BootClassTemplates map[string]string `json:"boot_class_templates,omitempty"`
+	DelegatedPrefix    string            `json:"delegated_prefix,omitempty"` // IPv6 pool for IA_PD
+	DelegatedLength    int               `json:"delegated_length,omitempty"` // Prefix length handed out
+	Leases             []*Lease          `json:"leases,omitempty"`
+	Bindings           []*Binding        `json:"bindings,omitempty"`
+	Delegations        []*Lease          `json:"delegations,omitempty"`
+	Options            []*Option         `json:"options,omitempty"`
+	Revision           uint64            `json:"revision,omitempty"` // Set by the server, see ETags
 }
 
 // Option id number from DHCP RFC 2132 and 2131
@@ -46,13 +60,34 @@ type Lease struct {
 	Mac        string    `json:"mac"`
 	Valid      bool      `json:"valid"`
 	ExpireTime time.Time `json:"expire_time"`
+	// Names sent by the client in option 12 and option 81
+	Hostname        string `json:"hostname,omitempty"`
+	ClientFQDN      string `json:"client_fqdn,omitempty"`
+	ClientFQDNFlags byte   `json:"client_fqdn_flags,omitempty"`
+	ClientFQDNSent  bool   `json:"client_fqdn_sent,omitempty"`
+	// Option 60 and 77, used to pick boot templates
+	VendorClass string `json:"vendor_class,omitempty"`
+	UserClass   string `json:"user_class,omitempty"`
+	// DHCPv6 leases are keyed by client DUID.  Mac is then the link
+	// layer address from the DUID, if it has one.
+	Duid      string `json:"duid,omitempty"`
+	Iaid      uint32 `json:"iaid,omitempty"`
+	PrefixLen int    `json:"prefix_len,omitempty"` // Set on delegated prefixes
+	// Option 61 in hex, and the relay the last request came through
+	ClientId  string `json:"client_id,omitempty"`
+	RelayAddr net.IP `json:"relay_addr,omitempty"`
+	CircuitId string `json:"circuit_id,omitempty"`
+	RemoteId  string `json:"remote_id,omitempty"`
 }
 
 type Binding struct {
-	Ip         net.IP    `json:"ip"`
-	Mac        string    `json:"mac"`
-	Options    []*Option `json:"options,omitempty"`
-	NextServer *string   `json:"next_server,omitempty"`
+	Ip           net.IP    `json:"ip"`
+	Mac          string    `json:"mac"`
+	Duid         string    `json:"duid,omitempty"` // Required in IPv6 subnets
+	Options      []*Option `json:"options,omitempty"`
+	NextServer   *string   `json:"next_server,omitempty"`
+	Hostname     string    `json:"hostname,omitempty"` // Returned as option 12/81
+	BootTemplate string    `json:"boot_template,omitempty"`
 }
 
 type NextServer struct {
@@ -77,21 +112,33 @@ func NewBinding() *Binding {
  * Structure for the front end with a pointer to the backend
  */
 type Frontend struct {
-	DhcpInfo *DataTracker
-	data_dir string
-	cert_pem string
-	key_pem  string
-	cfg      Config
+	DhcpInfo    *DataTracker
+	data_dir    string
+	cert_pem    string
+	key_pem     string
+	config_path string
+
+	cfgLock sync.RWMutex // Guards cfg and server across reloads
+	cfg     Config
+	handler http.Handler
+	server  *http.Server
+	audit   *AuditLog
+	auth    *Auth
+
+	writeLock sync.Mutex // Holds If-Match checks through the change
 }
 
 func NewFrontend(cert_pem, key_pem string, cfg Config, store LoadSaver) *Frontend {
 	fe := &Frontend{
-		data_dir: data_dir,
-		cert_pem: cert_pem,
-		key_pem:  key_pem,
-		cfg:      cfg,
-		DhcpInfo: NewDataTracker(store),
+		data_dir:    data_dir,
+		cert_pem:    cert_pem,
+		key_pem:     key_pem,
+		config_path: config_path,
+		cfg:         cfg,
+		DhcpInfo:    NewDataTracker(store),
 	}
+	fe.audit, _ = NewAuditLog("")
+	fe.auth, _ = NewAuth("")
 
 	fe.DhcpInfo.load_data()
 
@@ -100,13 +147,18 @@ func NewFrontend(cert_pem, key_pem string, cfg Config, store LoadSaver) *Fronten
 
 // List function
 func (fe *Frontend) GetAllSubnets(w rest.ResponseWriter, r *rest.Request) {
-	nets := make([]*ApiSubnet, 0)
+	nets := make([]*Subnet, 0)
+	sc := scopeOf(r)
 
+	// Subnets encode themselves under their lock.
 	for _, s := range fe.DhcpInfo.Subnets {
-		as := convertSubnetToApiSubnet(s)
-		nets = append(nets, as)
+		if !fe.inScope(sc, s.Name, nil) {
+			continue
+		}
+		nets = append(nets, s)
 	}
 
+	w.Header().Set("ETag", subnetsETag(nets))
 	w.WriteJson(nets)
 }
 
@@ -115,11 +167,12 @@ func (fe *Frontend) GetSubnet(w rest.ResponseWriter, r *rest.Request) {
 	subnetName := r.PathParam("id")
 
 	subnet := fe.DhcpInfo.Subnets[subnetName]
-	if subnet == nil {
+	if subnet == nil || fe.hidden(r, subnetName) {
 		rest.Error(w, "Not Found", http.StatusNotFound)
 		return
 	}
-	w.WriteJson(convertSubnetToApiSubnet(subnet))
+	w.Header().Set("ETag", subnetETag(subnet.Revision))
+	w.WriteJson(subnet)
 }
 
 // Create function
@@ -141,13 +194,20 @@ func (fe *Frontend) CreateSubnet(w rest.ResponseWriter, r *rest.Request) {
 		rest.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if !scopeOf(r).allows(subnet.Name, subnet.Subnet.IPNet) {
+		rest.Error(w, "Subnet is outside your subnets", http.StatusForbidden)
+		return
+	}
 
 	err, code := fe.DhcpInfo.AddSubnet(subnet)
+	fe.audit.Record(r, AuditSubnetCreate, subnet.Name, "", nil, fe.auditSubnet(subnet.Name), err, code)
 	if err != nil {
 		rest.Error(w, err.Error(), code)
 		return
 	}
 
+	apisubnet.Revision = subnet.Revision
+	w.Header().Set("ETag", subnetETag(subnet.Revision))
 	w.WriteJson(apisubnet)
 }
 
@@ -171,21 +231,51 @@ func (fe *Frontend) UpdateSubnet(w rest.ResponseWriter, r *rest.Request) {
 		rest.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if fe.hidden(r, subnetName) {
+		rest.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	if !scopeOf(r).allows(subnet.Name, subnet.Subnet.IPNet) {
+		rest.Error(w, "Subnet is outside your subnets", http.StatusForbidden)
+		return
+	}
 
+	fe.writeLock.Lock()
+	defer fe.writeLock.Unlock()
+	if !fe.ifMatch(w, r, subnetName) {
+		return
+	}
+
+	before := fe.auditSubnet(subnetName)
 	err, code := fe.DhcpInfo.ReplaceSubnet(subnetName, subnet)
+	fe.audit.Record(r, AuditSubnetUpdate, subnetName, "", before, fe.auditSubnet(subnet.Name), err, code)
 	if err != nil {
 		rest.Error(w, err.Error(), code)
 		return
 	}
 
+	apisubnet.Revision = subnet.Revision
+	w.Header().Set("ETag", subnetETag(subnet.Revision))
 	w.WriteJson(apisubnet)
 }
 
 // Delete function
 func (fe *Frontend) DeleteSubnet(w rest.ResponseWriter, r *rest.Request) {
 	subnetName := r.PathParam("id")
+	if fe.hidden(r, subnetName) {
+		rest.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	fe.writeLock.Lock()
+	defer fe.writeLock.Unlock()
+	if !fe.ifMatch(w, r, subnetName) {
+		return
+	}
 
+	before := fe.auditSubnet(subnetName)
 	err, code := fe.DhcpInfo.RemoveSubnet(subnetName)
+	fe.audit.Record(r, AuditSubnetDelete, subnetName, "", before, nil, err, code)
 	if err != nil {
 		rest.Error(w, err.Error(), code)
 		return
@@ -208,25 +298,54 @@ func (fe *Frontend) BindSubnet(w rest.ResponseWriter, r *rest.Request) {
 		return
 	}
 
+	if fe.hidden(r, subnetName) {
+		rest.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	fe.writeLock.Lock()
+	defer fe.writeLock.Unlock()
+	if !fe.ifMatch(w, r, subnetName) {
+		return
+	}
+
+	key := fe.auditBindingKey(subnetName, binding.key())
+	before := fe.auditBinding(subnetName, key)
 	err, code := fe.DhcpInfo.AddBinding(subnetName, binding)
+	fe.audit.Record(r, AuditBind, subnetName, key, before, fe.auditBinding(subnetName, key), err, code)
 	if err != nil {
 		rest.Error(w, err.Error(), code)
 		return
 	}
 
+	fe.setETag(w, subnetName)
 	w.WriteJson(binding)
 }
 
 func (fe *Frontend) UnbindSubnet(w rest.ResponseWriter, r *rest.Request) {
 	subnetName := r.PathParam("id")
 	mac := r.PathParam("mac")
+	if fe.hidden(r, subnetName) {
+		rest.Error(w, "Subnet Not Found", http.StatusNotFound)
+		return
+	}
 
+	fe.writeLock.Lock()
+	defer fe.writeLock.Unlock()
+	if !fe.ifMatch(w, r, subnetName) {
+		return
+	}
+
+	key := fe.auditBindingKey(subnetName, mac)
+	before := fe.auditBinding(subnetName, key)
 	err, code := fe.DhcpInfo.DeleteBinding(subnetName, mac)
+	fe.audit.Record(r, AuditUnbind, subnetName, key, before, nil, err, code)
 	if err != nil {
 		rest.Error(w, err.Error(), code)
 		return
 	}
 
+	fe.setETag(w, subnetName)
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -245,52 +364,165 @@ func (fe *Frontend) NextServer(w rest.ResponseWriter, r *rest.Request) {
 	}
 
 	ip := net.ParseIP(r.PathParam("ip"))
+	if fe.hidden(r, subnetName) {
+		rest.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	fe.writeLock.Lock()
+	defer fe.writeLock.Unlock()
+	if !fe.ifMatch(w, r, subnetName) {
+		return
+	}
 
+	before := fe.auditBindingsAt(subnetName, ip)
 	err, code := fe.DhcpInfo.SetNextServer(subnetName, ip, nextServer)
+	fe.audit.Record(r, AuditNextServer, subnetName, r.PathParam("ip"), before, fe.auditBindingsAt(subnetName, ip), err, code)
 	if err != nil {
 		rest.Error(w, err.Error(), code)
 		return
 	}
 
+	fe.setETag(w, subnetName)
 	w.WriteJson(nextServer)
 }
 
+// config returns a copy of the running config.
+func (fe *Frontend) config() Config {
+	fe.cfgLock.RLock()
+	defer fe.cfgLock.RUnlock()
+	return fe.cfg
+}
+
+// ReloadConfig re-reads the config file and seed directory and applies
+// them.  Credentials take effect on the next request.  Nothing changes
+// unless the config and every seed are valid and the seeded subnets
+// fit alongside the others.  A port change brings up the new listener
+// before the old one is closed, so a bind failure also keeps the
+// running config.  Seeds go through ReplaceSubnet, so leases are kept.
+// writeLock is held throughout so API changes don't interleave.
+func (fe *Frontend) ReloadConfig() error {
+	cfg, err := readConfig(fe.config_path)
+	if err != nil {
+		return err
+	}
+	seeds, err := readSeedDir(cfg.Seed.Dir)
+	if err != nil {
+		return err
+	}
+
+	fe.writeLock.Lock()
+	defer fe.writeLock.Unlock()
+	if err := fe.DhcpInfo.CheckSeeds(seeds, cfg.Seed.Prune); err != nil {
+		return err
+	}
+
+	fe.cfgLock.Lock()
+	if fe.server != nil && cfg.Network.Port != fe.cfg.Network.Port {
+		if err := fe.listen(cfg.Network.Port); err != nil {
+			fe.cfgLock.Unlock()
+			return err
+		}
+	}
+	fe.cfg = cfg
+	fe.cfgLock.Unlock()
+	log.Println("Reloaded config from", fe.config_path)
+
+	return fe.DhcpInfo.ReconcileSeeds(seeds, cfg.Seed.Prune)
+}
+
+func (fe *Frontend) AdminReload(w rest.ResponseWriter, r *rest.Request) {
+	if err := fe.ReloadConfig(); err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// listen starts serving on port and retires any previous listener.
+// Assumes cfgLock is held.
+func (fe *Frontend) listen(port int) error {
+	var tlsConfig *tls.Config
+	if fe.cert_pem != "" && fe.key_pem != "" {
+		var err error
+		if tlsConfig, err = fe.tlsConfig(); err != nil {
+			return err
+		}
+	}
+	connStr := fmt.Sprintf(":%d", port)
+	ln, err := net.Listen("tcp", connStr)
+	if err != nil {
+		return err
+	}
+	log.Println("Web Interface Using", connStr)
+
+	srv := &http.Server{Addr: connStr, Handler: fe.handler, TLSConfig: tlsConfig}
+	go func() {
+		var err error
+		if tlsConfig == nil {
+			err = srv.Serve(ln)
+		} else {
+			err = srv.ServeTLS(ln, "", "")
+		}
+		if err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	// Shutdown waits for in-flight requests, which may include the
+	// reload request itself, so don't block on it.
+	if old := fe.server; old != nil {
+		go old.Shutdown(context.Background())
+	}
+	fe.server = srv
+	return nil
+}
+
 func (fe *Frontend) RunServer(blocking bool) http.Handler {
 	api := rest.NewApi()
-	api.Use(&rest.AuthBasicMiddleware{
-		Realm: "test zone",
-		Authenticator: func(userId string, password string) bool {
-			if userId == fe.cfg.Network.Username &&
-				password == fe.cfg.Network.Password {
-				return true
-			}
-			return false
-		},
-	})
+	api.Use(rest.MiddlewareSimple(apiMetricsMiddleware), &rest.RecorderMiddleware{})
+	api.Use(rest.MiddlewareSimple(fe.authMiddleware))
 	api.Use(rest.DefaultDevStack...)
 	router, err := rest.MakeRouter(
-		rest.Get("/subnets", fe.GetAllSubnets),
-		rest.Get("/subnets/#id", fe.GetSubnet),
-		rest.Post("/subnets", fe.CreateSubnet),
-		rest.Put("/subnets/#id", fe.UpdateSubnet),
-		rest.Delete("/subnets/#id", fe.DeleteSubnet),
-		rest.Post("/subnets/#id/bind", fe.BindSubnet),
-		rest.Delete("/subnets/#id/bind/#mac", fe.UnbindSubnet),
-		rest.Put("/subnets/#id/next_server/#ip", fe.NextServer),
+		rest.Get("/subnets", allow(RoleReadOnly, fe.GetAllSubnets)),
+		rest.Get("/subnets/#id", allow(RoleReadOnly, fe.GetSubnet)),
+		rest.Post("/subnets", allow(RoleAdmin, fe.CreateSubnet)),
+		rest.Put("/subnets/#id", allow(RoleAdmin, fe.UpdateSubnet)),
+		rest.Delete("/subnets/#id", allow(RoleAdmin, fe.DeleteSubnet)),
+		rest.Post("/subnets/#id/bind", allow(RoleOperator, fe.BindSubnet)),
+		rest.Delete("/subnets/#id/bind/#mac", allow(RoleOperator, fe.UnbindSubnet)),
+		rest.Put("/subnets/#id/next_server/#ip", allow(RoleAdmin, fe.NextServer)),
+		rest.Post("/admin/reload", allow(RoleAdmin, unscoped(fe.AdminReload))),
+		rest.Get("/admin/users", allow(RoleAdmin, unscoped(fe.GetUsers))),
+		rest.Post("/admin/users", allow(RoleAdmin, unscoped(fe.CreateUser))),
+		rest.Put("/admin/users/#name", allow(RoleAdmin, unscoped(fe.UpdateUser))),
+		rest.Delete("/admin/users/#name", allow(RoleAdmin, unscoped(fe.DeleteUser))),
+		rest.Get("/admin/tokens", allow(RoleAdmin, unscoped(fe.GetTokens))),
+		rest.Post("/admin/tokens", allow(RoleAdmin, unscoped(fe.CreateToken))),
+		rest.Delete("/admin/tokens/#id", allow(RoleAdmin, unscoped(fe.DeleteToken))),
+		rest.Get("/metrics", allow(RoleReadOnly, fe.metricsHandler())),
+		rest.Get("/events", allow(RoleReadOnly, fe.StreamEvents)),
+		rest.Get("/hosts", allow(RoleReadOnly, fe.GetHosts)),
+		rest.Get("/zones", allow(RoleReadOnly, fe.GetZones)),
+		rest.Get("/zones/#zone", allow(RoleReadOnly, fe.GetZone)),
+		rest.Get("/boot/#mac", allow(RoleReadOnly, fe.GetBootScript)),
+		rest.Get("/history", allow(RoleReadOnly, fe.GetHistory)),
+		rest.Get("/audit", allow(RoleAdmin, unscoped(fe.GetAudit))),
 	)
 	if err != nil {
 		log.Fatal(err)
 	}
 	api.SetApp(router)
 
-	connStr := fmt.Sprintf(":%d", fe.cfg.Network.Port)
-	log.Println("Web Interface Using", connStr)
+	fe.cfgLock.Lock()
+	fe.handler = api.MakeHandler()
 	if blocking {
-		if fe.cert_pem == "" || fe.key_pem == "" {
-			log.Fatal(http.ListenAndServe(connStr, api.MakeHandler()))
-		} else {
-			log.Fatal(http.ListenAndServeTLS(connStr, fe.cert_pem, fe.key_pem, api.MakeHandler()))
+		if err := fe.listen(fe.cfg.Network.Port); err != nil {
+			log.Fatal(err)
 		}
+		fe.cfgLock.Unlock()
+		select {}
 	}
-	return api.MakeHandler()
+	fe.cfgLock.Unlock()
+	return fe.handler
 }
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"strings"
 	"testing"
 
@@ -415,3 +417,78 @@ func TestPutNextServerMissingSubnet(t *testing.T) {
 	assert.Equal(t, 404, recorder.Code)
 	assert.Equal(t, "{\n  \"Error\": \"Not Found\"\n}", recorder.Body.String(), "Expected Not Found, but got %s", recorder.Body.String())
 }
+
+func write_config(t *testing.T, contents string) string {
+	f, err := ioutil.TempFile("", "rebar-dhcp-config")
+	assert.Nil(t, err)
+	_, err = f.WriteString(contents)
+	assert.Nil(t, err)
+	f.Close()
+	return f.Name()
+}
+
+func TestReloadConfigChangesCredentials(t *testing.T) {
+	fe, handler := get_frontend()
+	fe.config_path = write_config(t, "[network]\nport = 6755\nusername = greg\npassword = drools\n")
+	defer os.Remove(fe.config_path)
+
+	recorder := httptest.NewRecorder()
+	req, err := http.NewRequest("POST", base_url("/admin/reload"), nil)
+	assert.Nil(t, err)
+	req.SetBasicAuth("fred", "rules")
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, 200, recorder.Code)
+
+	// Old credentials are rejected, new ones accepted.
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", base_url("/subnets"), nil)
+	req.SetBasicAuth("fred", "rules")
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, 401, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", base_url("/subnets"), nil)
+	req.SetBasicAuth("greg", "drools")
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, 200, recorder.Code)
+}
+
+func TestReloadConfigInvalidKeepsConfig(t *testing.T) {
+	fe, handler := get_frontend()
+	fe.config_path = write_config(t, "[network]\nport = 0\nusername = greg\npassword = drools\n")
+	defer os.Remove(fe.config_path)
+
+	recorder := httptest.NewRecorder()
+	req, err := http.NewRequest("POST", base_url("/admin/reload"), nil)
+	assert.Nil(t, err)
+	req.SetBasicAuth("fred", "rules")
+	handler.ServeHTTP(recorder, req)
+
+	assert.Equal(t, 400, recorder.Code)
+	assert.Equal(t, "{\n  \"Error\": \"network.port must be between 1 and 65535\"\n}", recorder.Body.String())
+	assert.Equal(t, "fred", fe.config().Network.Username)
+	assert.Equal(t, 6755, fe.config().Network.Port)
+}
+
+func TestReloadConfigBadSeedsKeepConfig(t *testing.T) {
+	fe, handler := get_frontend()
+	dir := seed_dir(t, map[string]string{
+		"barney.yml": seedYaml,
+		"wilma.yml":  strings.Replace(seedYaml, "name: barney", "name: wilma", 1),
+	})
+	defer os.RemoveAll(dir)
+	fe.config_path = write_config(t, "[network]\nport = 6755\nusername = greg\npassword = drools\n[seed]\ndir = "+dir+"\n")
+	defer os.Remove(fe.config_path)
+
+	recorder := httptest.NewRecorder()
+	req, err := http.NewRequest("POST", base_url("/admin/reload"), nil)
+	assert.Nil(t, err)
+	req.SetBasicAuth("fred", "rules")
+	handler.ServeHTTP(recorder, req)
+
+	assert.Equal(t, 400, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "barney: overlaps with subnet wilma")
+	assert.Equal(t, "fred", fe.config().Network.Username)
+	assert.Nil(t, fe.DhcpInfo.Subnets["barney"], "no seed is half applied")
+	assert.Nil(t, fe.DhcpInfo.Subnets["wilma"])
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ant0ine/go-json-rest/rest"
+)
+
+/*
+ * Audit log
+ *
+ * Every mutating API call is recorded with the user, the client
+ * address and the subnet or binding before and after the change.  The
+ * last auditBacklog records are kept for GET /audit.  With a file they
+ * are also appended there as JSON lines, and reloaded at start.
+ */
+
+// Audit actions
+const (
+	AuditSubnetCreate = "subnet.create"
+	AuditSubnetUpdate = "subnet.update"
+	AuditSubnetDelete = "subnet.delete"
+	AuditBind         = "binding.bind"
+	AuditUnbind       = "binding.unbind"
+	AuditNextServer   = "binding.next_server"
+	AuditUserCreate   = "user.create"
+	AuditUserUpdate   = "user.update"
+	AuditUserDelete   = "user.delete"
+	AuditTokenCreate  = "token.create"
+	AuditTokenDelete  = "token.delete"
+)
+
+const auditBacklog = 10000
+
+type AuditRecord struct {
+	Seq     uint64          `json:"seq"`
+	Time    time.Time       `json:"time"`
+	User    string          `json:"user"`
+	Source  string          `json:"source"` // Client IP
+	Action  string          `json:"action"`
+	Subnet  string          `json:"subnet"`
+	Key     string          `json:"key,omitempty"` // Binding MAC or DUID, next server IP, user or token id
+	Code    int             `json:"code"`
+	Error   string          `json:"error,omitempty"`
+	Before  json.RawMessage `json:"before,omitempty"`
+	After   json.RawMessage `json:"after,omitempty"`
+	Changed []string        `json:"changed,omitempty"` // Fields that differ between before and after
+}
+
+type AuditLog struct {
+	lock    sync.Mutex
+	seq     uint64
+	records []*AuditRecord
+	file    *os.File // nil keeps records in memory only
+}
+
+// NewAuditLog appends to path, unless it is empty.
+func NewAuditLog(path string) (*AuditLog, error) {
+	a := &AuditLog{records: make([]*AuditRecord, 0)}
+	if path == "" {
+		return a, nil
+	}
+	if err := a.load(path); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	a.file = f
+	return a, nil
+}
+
+// load reads back the tail of an existing audit file.
+func (a *AuditLog) load(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 16<<20) // Whole subnets before and after
+	for scanner.Scan() {
+		r := &AuditRecord{}
+		if json.Unmarshal(scanner.Bytes(), r) != nil {
+			continue // Torn write
+		}
+		a.add(r)
+		if r.Seq > a.seq {
+			a.seq = r.Seq
+		}
+	}
+	return scanner.Err()
+}
+
+// add assumes the lock is held.
+func (a *AuditLog) add(r *AuditRecord) {
+	a.records = append(a.records, r)
+	if len(a.records) > auditBacklog {
+		a.records = append(a.records[:0:0], a.records[len(a.records)-auditBacklog:]...)
+	}
+}
+
+// Record notes a call.  before and after are snapshots of what it
+// changed, nil when there was nothing.  after is dropped on failure.
+func (a *AuditLog) Record(r *rest.Request, action, subnet, key string, before, after interface{}, err error, code int) {
+	if a == nil {
+		return
+	}
+	rec := &AuditRecord{
+		Time:   time.Now(),
+		Action: action,
+		Subnet: subnet,
+		Key:    key,
+		Code:   code,
+		Before: auditJson(before),
+	}
+	rec.User, _ = r.Env["REMOTE_USER"].(string)
+	rec.Source = r.RemoteAddr
+	if host, _, e := net.SplitHostPort(r.RemoteAddr); e == nil {
+		rec.Source = host
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	} else {
+		rec.After = auditJson(after)
+		rec.Changed = auditChanged(rec.Before, rec.After)
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.seq++
+	rec.Seq = a.seq
+	a.add(rec)
+	if a.file == nil {
+		return
+	}
+	data, e := json.Marshal(rec)
+	if e == nil {
+		_, e = a.file.Write(append(data, '\n'))
+	}
+	if e != nil {
+		log.Println("Audit: ", e)
+	}
+}
+
+func auditJson(v interface{}) json.RawMessage {
+	data, err := json.Marshal(v)
+	if err != nil || string(data) == "null" {
+		return nil
+	}
+	return data
+}
+
+// auditChanged lists the top level fields that differ.
+func auditChanged(before, after json.RawMessage) []string {
+	if before == nil || after == nil {
+		return nil
+	}
+	var b, a map[string]json.RawMessage
+	if json.Unmarshal(before, &b) != nil || json.Unmarshal(after, &a) != nil {
+		return nil
+	}
+	changed := make([]string, 0)
+	for k, v := range a {
+		if !bytes.Equal(v, b[k]) {
+			changed = append(changed, k)
+		}
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			changed = append(changed, k)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+type AuditQuery struct {
+	User   string
+	Subnet string
+	Action string
+	From   time.Time // Zero for no limit
+	To     time.Time
+}
+
+// Query returns the matching records, oldest first.
+func (a *AuditLog) Query(q AuditQuery) []*AuditRecord {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	records := make([]*AuditRecord, 0)
+	for _, r := range a.records {
+		if (q.User != "" && q.User != r.User) ||
+			(q.Subnet != "" && q.Subnet != r.Subnet) ||
+			(q.Action != "" && q.Action != r.Action) ||
+			(!q.From.IsZero() && r.Time.Before(q.From)) ||
+			(!q.To.IsZero() && r.Time.After(q.To)) {
+			continue
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+func (a *AuditLog) Close() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.file == nil {
+		return nil
+	}
+	err := a.file.Close()
+	a.file = nil
+	return err
+}
+
+/*
+ * Snapshots of what the API changes
+ */
+
+// auditSubnet is the subnet's configuration.  Leases and the revision
+// are left out, and bindings and options sorted, so unchanged fields
+// compare equal.
+func (fe *Frontend) auditSubnet(name string) *ApiSubnet {
+	s := fe.DhcpInfo.Subnets[name]
+	if s == nil {
+		return nil
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	as := convertSubnetToApiSubnet(s)
+	as.Leases = nil
+	as.Delegations = nil
+	as.Revision = 0
+	bindings := make([]*Binding, 0, len(as.Bindings))
+	for _, b := range as.Bindings {
+		c := *b
+		bindings = append(bindings, &c)
+	}
+	sort.Slice(bindings, func(i, j int) bool { return bindings[i].key() < bindings[j].key() })
+	as.Bindings = bindings
+	sort.Slice(as.Options, func(i, j int) bool { return as.Options[i].Code < as.Options[j].Code })
+	return as
+}
+
+// auditBindingKey is key as the subnet files it.
+func (fe *Frontend) auditBindingKey(subnet, key string) string {
+	if s := fe.DhcpInfo.Subnets[subnet]; s != nil && s.v6() {
+		if duid, err := parseDuid(key); err == nil {
+			return duid
+		}
+	}
+	return key
+}
+
+func (fe *Frontend) auditBinding(subnet, key string) *Binding {
+	s := fe.DhcpInfo.Subnets[subnet]
+	if s == nil {
+		return nil
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if b := s.Bindings[key]; b != nil {
+		c := *b
+		return &c
+	}
+	return nil
+}
+
+// auditBindingsAt copies the bindings for ip.
+func (fe *Frontend) auditBindingsAt(subnet string, ip net.IP) []*Binding {
+	s := fe.DhcpInfo.Subnets[subnet]
+	if s == nil {
+		return nil
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	bindings := make([]*Binding, 0)
+	for _, b := range s.Bindings {
+		if b.Ip.Equal(ip) {
+			c := *b
+			bindings = append(bindings, &c)
+		}
+	}
+	sort.Slice(bindings, func(i, j int) bool { return bindings[i].key() < bindings[j].key() })
+	return bindings
+}
+
+/*
+ * API
+ */
+
+func (fe *Frontend) GetAudit(w rest.ResponseWriter, r *rest.Request) {
+	v := r.URL.Query()
+	q := AuditQuery{User: v.Get("user"), Subnet: v.Get("subnet"), Action: v.Get("action")}
+	for _, t := range []struct {
+		name string
+		dest *time.Time
+	}{{"from", &q.From}, {"to", &q.To}} {
+		s := v.Get(t.name)
+		if s == "" {
+			continue
+		}
+		var err error
+		if *t.dest, err = time.Parse(time.RFC3339, s); err != nil {
+			rest.Error(w, "Invalid "+t.name+" time, use RFC 3339: "+s, http.StatusBadRequest)
+			return
+		}
+	}
+	w.WriteJson(fe.audit.Query(q))
+}
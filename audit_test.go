@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func auditFrontend(t *testing.T) (*Frontend, http.Handler, string) {
+	dir, err := ioutil.TempDir("", "rebar-dhcp-audit")
+	assert.Nil(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	cfg := Config{}
+	cfg.Network.Username = "fred"
+	cfg.Network.Password = "rules"
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "database.json"), []byte("{}"), 0600))
+	fs, err := NewFileStore(filepath.Join(dir, "database.json"))
+	assert.Nil(t, err)
+	fe := NewFrontend("", "", cfg, fs)
+	path := filepath.Join(dir, "audit.log")
+	fe.audit, err = NewAuditLog(path)
+	assert.Nil(t, err)
+	t.Cleanup(func() { fe.audit.Close() })
+	return fe, fe.RunServer(false), path
+}
+
+func apiCall(handler http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, base_url(path), strings.NewReader(body))
+	req.SetBasicAuth("fred", "rules")
+	req.Header.Add("Content-Type", "application/json")
+	req.RemoteAddr = "10.0.0.7:41000"
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestAuditLog(t *testing.T) {
+	fe, handler, path := auditFrontend(t)
+
+	subnet := `{"name": "fred", "subnet": "192.168.128.0/24", "active_start": "192.168.128.10",
+		"active_end": "192.168.128.20", "active_lease_time": 3600, "reserved_lease_time": 7200}`
+	assert.Equal(t, 200, apiCall(handler, "POST", "/subnets", subnet).Code)
+	assert.Equal(t, 200, apiCall(handler, "PUT", "/subnets/fred",
+		strings.Replace(subnet, "3600", "600", 1)).Code)
+	assert.Equal(t, 200, apiCall(handler, "POST", "/subnets/fred/bind",
+		`{"mac": "52:54:00:00:00:01", "ip": "192.168.128.5"}`).Code)
+	assert.Equal(t, 200, apiCall(handler, "PUT", "/subnets/fred/next_server/192.168.128.5",
+		`{"next_server": "192.168.128.2"}`).Code)
+	assert.Equal(t, 200, apiCall(handler, "DELETE", "/subnets/fred/bind/52:54:00:00:00:01", "").Code)
+	assert.Equal(t, 404, apiCall(handler, "DELETE", "/subnets/barney", "").Code)
+	assert.Equal(t, 200, apiCall(handler, "DELETE", "/subnets/fred", "").Code)
+	apiCall(handler, "GET", "/subnets", "")
+
+	records := fe.audit.Query(AuditQuery{})
+	assert.Equal(t, 7, len(records))
+	actions := make([]string, 0)
+	for _, r := range records {
+		actions = append(actions, r.Action)
+		assert.Equal(t, "fred", r.User)
+		assert.Equal(t, "10.0.0.7", r.Source)
+	}
+	assert.Equal(t, []string{AuditSubnetCreate, AuditSubnetUpdate, AuditBind, AuditNextServer,
+		AuditUnbind, AuditSubnetDelete, AuditSubnetDelete}, actions)
+
+	assert.Nil(t, records[0].Before)
+	assert.Equal(t, []string{"active_lease_time"}, records[1].Changed)
+	assert.Equal(t, "52:54:00:00:00:01", records[2].Key)
+	assert.Nil(t, records[2].Before)
+	b := Binding{}
+	assert.Nil(t, json.Unmarshal(records[2].After, &b))
+	assert.Equal(t, "192.168.128.5", b.Ip.String())
+	assert.Equal(t, "192.168.128.5", records[3].Key)
+	assert.Contains(t, string(records[3].After), "192.168.128.2")
+	assert.NotNil(t, records[4].Before)
+	assert.Nil(t, records[4].After)
+	assert.Equal(t, 404, records[5].Code)
+	assert.Equal(t, "Not Found", records[5].Error)
+
+	// The file is read back at start.
+	fe.audit.Close()
+	a, err := NewAuditLog(path)
+	assert.Nil(t, err)
+	defer a.Close()
+	assert.Equal(t, 2, len(a.Query(AuditQuery{Action: AuditSubnetDelete})))
+	assert.Equal(t, 0, len(a.Query(AuditQuery{User: "barney"})))
+	assert.Equal(t, uint64(7), a.seq)
+}
+
+func TestGetAudit(t *testing.T) {
+	_, handler, _ := auditFrontend(t)
+	apiCall(handler, "DELETE", "/subnets/barney", "")
+
+	recorder := apiCall(handler, "GET", "/audit?subnet=barney&from=2015-07-14T12:00:00Z", "")
+	assert.Equal(t, 200, recorder.Code)
+	records := make([]*AuditRecord, 0)
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &records))
+	assert.Equal(t, 1, len(records))
+
+	assert.Equal(t, 400, apiCall(handler, "GET", "/audit?to=yesterday", "").Code)
+}
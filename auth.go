@@ -0,0 +1,598 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ant0ine/go-json-rest/rest"
+	"golang.org/x/crypto/bcrypt"
+)
+
+/*
+ * API users, roles and tokens
+ *
+ * Users come from [user "name"] config sections, the network
+ * username/password pair (an admin), and the admin API.  Passwords are
+ * bcrypt hashes.  Bearer tokens belong to a user and carry that user's
+ * role until they expire or are revoked.  Users and tokens made
+ * through the API are kept in data-dir/auth.json.
+ */
+
+// Roles, each allowed everything the ones before it are.
+const (
+	RoleReadOnly = "read-only"
+	RoleOperator = "binding-operator" // May also bind and unbind
+	RoleAdmin    = "admin"
+)
+
+var roleRank = map[string]int{RoleReadOnly: 1, RoleOperator: 2, RoleAdmin: 3}
+
+const defaultTokenLifetime = 30 * 24 * time.Hour
+
+type UserConfig struct {
+	PasswordHash string `gcfg:"password-hash"` // bcrypt, optional with certs
+	Role         string
+	CertSubject  []string `gcfg:"cert-subject"` // Client cert subject or common name
+	CertSan      []string `gcfg:"cert-san"`     // Client cert DNS, email, IP or URI name
+	Subnet       []string // Subnet names or CIDR ranges the user may use, all if none
+}
+
+type User struct {
+	Name         string   `json:"name"`
+	PasswordHash string   `json:"password_hash"`
+	Role         string   `json:"role"`
+	Subnets      []string `json:"subnets,omitempty"`
+}
+
+// ApiUser is a user as the admin API takes and shows it.
+type ApiUser struct {
+	Name     string   `json:"name"`
+	Role     string   `json:"role"`
+	Password string   `json:"password,omitempty"` // Taken, never shown
+	Source   string   `json:"source,omitempty"`   // config or api
+	Subnets  []string `json:"subnets,omitempty"`  // Names or CIDR ranges, all if none
+}
+
+type ApiToken struct {
+	Id          string    `json:"id"`
+	User        string    `json:"user"`
+	Hash        string    `json:"hash,omitempty"` // SHA-256 of the secret
+	Expires     time.Time `json:"expires"`
+	Description string    `json:"description,omitempty"`
+	Token       string    `json:"token,omitempty"` // Only in the reply that creates it
+	ExpiresIn   int       `json:"expires_in,omitempty"`
+	Subnets     []string  `json:"subnets,omitempty"` // Narrows the user's subnets
+}
+
+// Identity is who a request authenticated as.
+type Identity struct {
+	User  string
+	Role  string
+	Scope subnetScope
+}
+
+type Auth struct {
+	path string // Empty keeps API users and tokens in memory
+
+	lock     sync.Mutex
+	users    map[string]*User
+	tokens   map[string]*ApiToken
+	verified map[string][sha256.Size]byte // User -> password and hash that passed bcrypt
+}
+
+type authState struct {
+	Users  []*User     `json:"users"`
+	Tokens []*ApiToken `json:"tokens"`
+}
+
+// NewAuth loads the users and tokens saved at path, unless it is empty.
+func NewAuth(path string) (*Auth, error) {
+	a := &Auth{
+		path:     path,
+		users:    make(map[string]*User),
+		tokens:   make(map[string]*ApiToken),
+		verified: make(map[string][sha256.Size]byte),
+	}
+	if path == "" {
+		return a, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil && len(data) > 0 {
+		state := authState{}
+		if err := json.Unmarshal(data, &state); err != nil {
+			return nil, err
+		}
+		for _, u := range state.Users {
+			a.users[u.Name] = u
+		}
+		for _, t := range state.Tokens {
+			a.tokens[t.Id] = t
+		}
+	}
+	return a, nil
+}
+
+// save writes users and tokens atomically.  Assumes lock is held
+func (a *Auth) save() error {
+	if a.path == "" {
+		return nil
+	}
+	state := authState{Users: make([]*User, 0), Tokens: make([]*ApiToken, 0)}
+	for _, u := range a.users {
+		state.Users = append(state.Users, u)
+	}
+	for _, t := range a.tokens {
+		state.Tokens = append(state.Tokens, t)
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp := a.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, a.path)
+}
+
+func isBcrypt(s string) bool {
+	_, err := bcrypt.Cost([]byte(s))
+	return err == nil
+}
+
+// check compares a password against a bcrypt hash.  bcrypt is slow on
+// purpose, so a pair that passed is remembered for the next request.
+func (a *Auth) check(name, hash, password string) bool {
+	sum := sha256.Sum256([]byte(hash + "\x00" + password))
+	a.lock.Lock()
+	last, ok := a.verified[name]
+	a.lock.Unlock()
+	if ok && subtle.ConstantTimeCompare(last[:], sum[:]) == 1 {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return false
+	}
+	a.lock.Lock()
+	a.verified[name] = sum
+	a.lock.Unlock()
+	return true
+}
+
+// identity finds a user's role and subnets, from the config first.
+func (a *Auth) identity(cfg Config, name string) (*Identity, bool) {
+	if name == "" {
+		return nil, false
+	}
+	if name == cfg.Network.Username {
+		return &Identity{User: name, Role: RoleAdmin}, true
+	}
+	if uc := cfg.User[name]; uc != nil {
+		return &Identity{User: name, Role: uc.Role, Scope: subnetScope{uc.Subnet}}, true
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if u := a.users[name]; u != nil {
+		return &Identity{User: name, Role: u.Role, Scope: subnetScope{u.Subnets}}, true
+	}
+	return nil, false
+}
+
+// Authenticate checks a Basic or Bearer Authorization header.
+func (a *Auth) Authenticate(cfg Config, header string) (*Identity, bool) {
+	parts := strings.SplitN(header, " ", 2)
+	if len(parts) != 2 {
+		return nil, false
+	}
+	switch strings.ToLower(parts[0]) {
+	case "basic":
+		if cfg.Network.DisableBasicAuth {
+			return nil, false
+		}
+		dec, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return nil, false
+		}
+		pair := strings.SplitN(string(dec), ":", 2)
+		if len(pair) != 2 || !a.password(cfg, pair[0], pair[1]) {
+			return nil, false
+		}
+		return a.identity(cfg, pair[0])
+	case "bearer":
+		t := a.token(parts[1])
+		if t == nil {
+			return nil, false
+		}
+		id, ok := a.identity(cfg, t.User)
+		if ok {
+			id.Scope = append(id.Scope, t.Subnets)
+		}
+		return id, ok
+	}
+	return nil, false
+}
+
+func (a *Auth) password(cfg Config, name, password string) bool {
+	if name == cfg.Network.Username && name != "" {
+		if isBcrypt(cfg.Network.Password) {
+			return a.check(name, cfg.Network.Password, password)
+		}
+		return subtle.ConstantTimeCompare([]byte(password), []byte(cfg.Network.Password)) == 1
+	}
+	if uc := cfg.User[name]; uc != nil {
+		return a.check(name, uc.PasswordHash, password)
+	}
+	a.lock.Lock()
+	u := a.users[name]
+	a.lock.Unlock()
+	return u != nil && a.check(name, u.PasswordHash, password)
+}
+
+// token finds a live token.
+func (a *Auth) token(token string) *ApiToken {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return nil
+	}
+	sum := sha256.Sum256([]byte(parts[1]))
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	t := a.tokens[parts[0]]
+	if t == nil || time.Now().After(t.Expires) ||
+		subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(t.Hash)) != 1 {
+		return nil
+	}
+	c := *t
+	return &c
+}
+
+func (a *Auth) Users(cfg Config) []*ApiUser {
+	users := make([]*ApiUser, 0)
+	if cfg.Network.Username != "" {
+		users = append(users, &ApiUser{Name: cfg.Network.Username, Role: RoleAdmin, Source: "config"})
+	}
+	for name, uc := range cfg.User {
+		users = append(users, &ApiUser{Name: name, Role: uc.Role, Source: "config", Subnets: uc.Subnet})
+	}
+	a.lock.Lock()
+	for _, u := range a.users {
+		users = append(users, &ApiUser{Name: u.Name, Role: u.Role, Source: "api", Subnets: u.Subnets})
+	}
+	a.lock.Unlock()
+	sort.Slice(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+	return users
+}
+
+func validUser(u *ApiUser, create bool) error {
+	if create && u.Name == "" {
+		return errors.New("name is required")
+	}
+	if create && u.Password == "" {
+		return errors.New("password is required")
+	}
+	if (create || u.Role != "") && roleRank[u.Role] == 0 {
+		return errors.New("role must be read-only, binding-operator or admin")
+	}
+	return validScope(u.Subnets)
+}
+
+func (a *Auth) AddUser(cfg Config, u *ApiUser) (error, int) {
+	if err := validUser(u, true); err != nil {
+		return err, http.StatusBadRequest
+	}
+	if _, ok := a.identity(cfg, u.Name); ok {
+		return errors.New("Already exists"), http.StatusConflict
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(u.Password), bcrypt.DefaultCost)
+	if err != nil {
+		return err, http.StatusInternalServerError
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.users[u.Name] = &User{Name: u.Name, PasswordHash: string(hash), Role: u.Role, Subnets: u.Subnets}
+	return a.saved()
+}
+
+// UpdateUser changes the password, role or subnets given.  An empty
+// subnets list allows every subnet.
+func (a *Auth) UpdateUser(cfg Config, name string, u *ApiUser) (error, int) {
+	if err := validUser(u, false); err != nil {
+		return err, http.StatusBadRequest
+	}
+	if name == cfg.Network.Username || cfg.User[name] != nil {
+		return errors.New("Defined in the config"), http.StatusConflict
+	}
+	hash := ""
+	if u.Password != "" {
+		h, err := bcrypt.GenerateFromPassword([]byte(u.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return err, http.StatusInternalServerError
+		}
+		hash = string(h)
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	lu := a.users[name]
+	if lu == nil {
+		return errors.New("Not Found"), http.StatusNotFound
+	}
+	if hash != "" {
+		lu.PasswordHash = hash
+	}
+	if u.Role != "" {
+		lu.Role = u.Role
+	}
+	if u.Subnets != nil {
+		lu.Subnets = u.Subnets
+		if len(lu.Subnets) == 0 {
+			lu.Subnets = nil
+		}
+	}
+	return a.saved()
+}
+
+// RemoveUser removes a user and revokes their tokens.
+func (a *Auth) RemoveUser(cfg Config, name string) (error, int) {
+	if name == cfg.Network.Username || cfg.User[name] != nil {
+		return errors.New("Defined in the config"), http.StatusConflict
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.users[name] == nil {
+		return errors.New("Not Found"), http.StatusNotFound
+	}
+	delete(a.users, name)
+	delete(a.verified, name)
+	for id, t := range a.tokens {
+		if t.User == name {
+			delete(a.tokens, id)
+		}
+	}
+	return a.saved()
+}
+
+// saved is the result of saving.  Assumes lock is held
+func (a *Auth) saved() (error, int) {
+	if err := a.save(); err != nil {
+		log.Println("Unable to save users and tokens: ", err)
+		return err, http.StatusInternalServerError
+	}
+	return nil, http.StatusOK
+}
+
+func (a *Auth) Tokens() []*ApiToken {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	tokens := make([]*ApiToken, 0)
+	for _, t := range a.tokens {
+		c := *t
+		c.Hash = ""
+		tokens = append(tokens, &c)
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].Expires.Before(tokens[j].Expires) })
+	return tokens
+}
+
+// AddToken issues a token for t.User, lasting t.ExpiresIn seconds.
+// t.Token is set to the secret, which is not kept.
+func (a *Auth) AddToken(cfg Config, t *ApiToken) (error, int) {
+	if _, ok := a.identity(cfg, t.User); !ok {
+		return errors.New("No such user: " + t.User), http.StatusBadRequest
+	}
+	if err := validScope(t.Subnets); err != nil {
+		return err, http.StatusBadRequest
+	}
+	if t.ExpiresIn < 0 {
+		return errors.New("expires_in can not be negative"), http.StatusBadRequest
+	}
+	lifetime := defaultTokenLifetime
+	if t.ExpiresIn > 0 {
+		lifetime = time.Duration(t.ExpiresIn) * time.Second
+	}
+	id := make([]byte, 8)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return err, http.StatusInternalServerError
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return err, http.StatusInternalServerError
+	}
+	s := base64.RawURLEncoding.EncodeToString(secret)
+	sum := sha256.Sum256([]byte(s))
+	t.Id = hex.EncodeToString(id)
+	t.Hash = hex.EncodeToString(sum[:])
+	t.Expires = time.Now().Add(lifetime).UTC()
+	t.ExpiresIn = 0
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	now := time.Now()
+	for id, lt := range a.tokens {
+		if now.After(lt.Expires) {
+			delete(a.tokens, id)
+		}
+	}
+	stored := *t
+	a.tokens[t.Id] = &stored
+	if err, code := a.saved(); err != nil {
+		return err, code
+	}
+	t.Hash = ""
+	t.Token = t.Id + "." + s
+	return nil, http.StatusOK
+}
+
+func (a *Auth) RemoveToken(id string) (error, int) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.tokens[id] == nil {
+		return errors.New("Not Found"), http.StatusNotFound
+	}
+	delete(a.tokens, id)
+	return a.saved()
+}
+
+/*
+ * Middleware and role checks
+ */
+
+func (fe *Frontend) authMiddleware(h rest.HandlerFunc) rest.HandlerFunc {
+	return func(w rest.ResponseWriter, r *rest.Request) {
+		cfg := fe.config()
+		var id *Identity
+		ok := false
+		if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+			if user, found := certUser(cfg, r.TLS.VerifiedChains[0][0]); found {
+				id, ok = fe.auth.identity(cfg, user)
+			}
+		}
+		if !ok {
+			id, ok = fe.auth.Authenticate(cfg, r.Header.Get("Authorization"))
+		}
+		if !ok {
+			if cfg.Network.DisableBasicAuth {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+			} else {
+				w.Header().Set("WWW-Authenticate", "Basic realm=test zone")
+			}
+			rest.Error(w, "Not Authorized", http.StatusUnauthorized)
+			return
+		}
+		r.Env["REMOTE_USER"] = id.User
+		r.Env["REMOTE_ROLE"] = id.Role
+		r.Env["REMOTE_SCOPE"] = id.Scope
+		h(w, r)
+	}
+}
+
+// allow wraps a route so only role and above may call it.
+func allow(role string, h rest.HandlerFunc) rest.HandlerFunc {
+	return func(w rest.ResponseWriter, r *rest.Request) {
+		have, _ := r.Env["REMOTE_ROLE"].(string)
+		if roleRank[have] < roleRank[role] {
+			rest.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
+
+/*
+ * Admin API
+ */
+
+func (fe *Frontend) GetUsers(w rest.ResponseWriter, r *rest.Request) {
+	w.WriteJson(fe.auth.Users(fe.config()))
+}
+
+func (fe *Frontend) CreateUser(w rest.ResponseWriter, r *rest.Request) {
+	u := &ApiUser{}
+	if err := r.DecodeJsonPayload(u); err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err, code := fe.auth.AddUser(fe.config(), u)
+	shown := &ApiUser{Name: u.Name, Role: u.Role, Source: "api"}
+	fe.audit.Record(r, AuditUserCreate, "", u.Name, nil, shown, err, code)
+	if err != nil {
+		rest.Error(w, err.Error(), code)
+		return
+	}
+	w.WriteJson(shown)
+}
+
+func (fe *Frontend) UpdateUser(w rest.ResponseWriter, r *rest.Request) {
+	name := r.PathParam("name")
+	u := &ApiUser{}
+	if err := r.DecodeJsonPayload(u); err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	before := fe.auditUser(name)
+	err, code := fe.auth.UpdateUser(fe.config(), name, u)
+	after := fe.auditUser(name)
+	if u.Password != "" && after != nil {
+		after.Password = "(changed)"
+	}
+	fe.audit.Record(r, AuditUserUpdate, "", name, before, after, err, code)
+	if err != nil {
+		rest.Error(w, err.Error(), code)
+		return
+	}
+	w.WriteJson(fe.auditUser(name))
+}
+
+func (fe *Frontend) DeleteUser(w rest.ResponseWriter, r *rest.Request) {
+	name := r.PathParam("name")
+	before := fe.auditUser(name)
+	err, code := fe.auth.RemoveUser(fe.config(), name)
+	fe.audit.Record(r, AuditUserDelete, "", name, before, nil, err, code)
+	if err != nil {
+		rest.Error(w, err.Error(), code)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (fe *Frontend) auditUser(name string) *ApiUser {
+	for _, u := range fe.auth.Users(fe.config()) {
+		if u.Name == name {
+			return u
+		}
+	}
+	return nil
+}
+
+func (fe *Frontend) GetTokens(w rest.ResponseWriter, r *rest.Request) {
+	w.WriteJson(fe.auth.Tokens())
+}
+
+func (fe *Frontend) CreateToken(w rest.ResponseWriter, r *rest.Request) {
+	t := &ApiToken{}
+	if err := r.DecodeJsonPayload(t); err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err, code := fe.auth.AddToken(fe.config(), t)
+	shown := *t
+	shown.Token = ""
+	fe.audit.Record(r, AuditTokenCreate, "", t.Id, nil, &shown, err, code)
+	if err != nil {
+		rest.Error(w, err.Error(), code)
+		return
+	}
+	w.WriteJson(t)
+}
+
+func (fe *Frontend) DeleteToken(w rest.ResponseWriter, r *rest.Request) {
+	id := r.PathParam("id")
+	var before *ApiToken
+	for _, t := range fe.auth.Tokens() {
+		if t.Id == id {
+			before = t
+		}
+	}
+	err, code := fe.auth.RemoveToken(id)
+	fe.audit.Record(r, AuditTokenDelete, "", id, before, nil, err, code)
+	if err != nil {
+		rest.Error(w, err.Error(), code)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
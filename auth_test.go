@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func bcryptHash(password string) string {
+	h, _ := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	return string(h)
+}
+
+func authFrontend(t *testing.T) (*Frontend, http.Handler) {
+	fe, handler, _ := auditFrontend(t)
+	cfg := fe.config()
+	cfg.User = map[string]*UserConfig{
+		"wilma":  {PasswordHash: bcryptHash("pebbles"), Role: RoleReadOnly},
+		"barney": {PasswordHash: bcryptHash("bambam"), Role: RoleOperator},
+	}
+	fe.cfg = cfg
+	apiCall(handler, "POST", "/subnets", `{"name": "fred", "subnet": "192.168.128.0/24",
+		"active_start": "192.168.128.10", "active_end": "192.168.128.20"}`)
+	return fe, handler
+}
+
+// authCall is apiCall with a given Authorization header.
+func authCall(handler http.Handler, auth, method, path, body string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, base_url(path), strings.NewReader(body))
+	req.Header.Set("Authorization", auth)
+	req.Header.Add("Content-Type", "application/json")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func basic(user, password string) string {
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.SetBasicAuth(user, password)
+	return req.Header.Get("Authorization")
+}
+
+func TestAuthRoles(t *testing.T) {
+	_, handler := authFrontend(t)
+	wilma := basic("wilma", "pebbles")
+	barney := basic("barney", "bambam")
+	binding := `{"mac": "52:54:00:00:00:01", "ip": "192.168.128.5"}`
+
+	assert.Equal(t, 401, authCall(handler, basic("wilma", "dino"), "GET", "/subnets", "").Code)
+	assert.Equal(t, 200, authCall(handler, wilma, "GET", "/subnets", "").Code)
+	assert.Equal(t, 403, authCall(handler, wilma, "POST", "/subnets/fred/bind", binding).Code)
+
+	assert.Equal(t, 200, authCall(handler, barney, "POST", "/subnets/fred/bind", binding).Code)
+	assert.Equal(t, 200, authCall(handler, barney, "DELETE", "/subnets/fred/bind/52:54:00:00:00:01", "").Code)
+	assert.Equal(t, 403, authCall(handler, barney, "DELETE", "/subnets/fred", "").Code)
+	assert.Equal(t, 403, authCall(handler, barney, "PUT", "/subnets/fred/next_server/192.168.128.5",
+		`{"next_server": "192.168.128.2"}`).Code)
+	assert.Equal(t, 403, authCall(handler, barney, "GET", "/admin/users", "").Code)
+
+	// Later requests are checked against the verified cache.
+	assert.Equal(t, 200, authCall(handler, barney, "GET", "/subnets", "").Code)
+}
+
+func TestAuthBcryptNetworkPassword(t *testing.T) {
+	fe, handler := authFrontend(t)
+	fe.cfg.Network.Password = bcryptHash("rules")
+	assert.Equal(t, 200, authCall(handler, basic("fred", "rules"), "GET", "/subnets", "").Code)
+	assert.Equal(t, 401, authCall(handler, basic("fred", fe.cfg.Network.Password), "GET", "/subnets", "").Code)
+}
+
+func TestAuthAdminUsers(t *testing.T) {
+	fe, handler := authFrontend(t)
+
+	assert.Equal(t, 200, apiCall(handler, "POST", "/admin/users",
+		`{"name": "betty", "password": "hoppy", "role": "read-only"}`).Code)
+	assert.Equal(t, 409, apiCall(handler, "POST", "/admin/users",
+		`{"name": "wilma", "password": "x", "role": "admin"}`).Code)
+	assert.Equal(t, 400, apiCall(handler, "POST", "/admin/users",
+		`{"name": "dino", "password": "x", "role": "pet"}`).Code)
+
+	betty := basic("betty", "hoppy")
+	assert.Equal(t, 403, authCall(handler, betty, "DELETE", "/subnets/fred", "").Code)
+	assert.Equal(t, 200, apiCall(handler, "PUT", "/admin/users/betty", `{"role": "admin"}`).Code)
+	assert.Equal(t, 200, authCall(handler, betty, "GET", "/admin/users", "").Code)
+	assert.Equal(t, 409, apiCall(handler, "PUT", "/admin/users/wilma", `{"role": "admin"}`).Code)
+
+	recorder := apiCall(handler, "GET", "/admin/users", "")
+	users := make([]*ApiUser, 0)
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &users))
+	assert.Equal(t, 4, len(users))
+	assert.Equal(t, &ApiUser{Name: "betty", Role: RoleAdmin, Source: "api"}, users[1])
+	assert.NotContains(t, recorder.Body.String(), "hoppy")
+	assert.NotContains(t, recorder.Body.String(), "$2a$")
+
+	assert.Equal(t, 200, apiCall(handler, "DELETE", "/admin/users/betty", "").Code)
+	assert.Equal(t, 401, authCall(handler, betty, "GET", "/subnets", "").Code)
+	assert.Equal(t, 409, apiCall(handler, "DELETE", "/admin/users/fred", "").Code)
+
+	assert.Equal(t, 2, len(fe.audit.Query(AuditQuery{User: "fred", Action: AuditUserUpdate})))
+}
+
+func TestAuthTokens(t *testing.T) {
+	fe, handler := authFrontend(t)
+
+	recorder := apiCall(handler, "POST", "/admin/tokens", `{"user": "barney", "description": "ci"}`)
+	assert.Equal(t, 200, recorder.Code)
+	token := &ApiToken{}
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), token))
+	assert.True(t, token.Expires.After(time.Now().Add(29*24*time.Hour)))
+	bearer := "Bearer " + token.Token
+
+	assert.Equal(t, 200, authCall(handler, bearer, "POST", "/subnets/fred/bind",
+		`{"mac": "52:54:00:00:00:01", "ip": "192.168.128.5"}`).Code)
+	assert.Equal(t, 403, authCall(handler, bearer, "DELETE", "/subnets/fred", "").Code)
+	assert.Equal(t, 401, authCall(handler, bearer+"x", "GET", "/subnets", "").Code)
+	assert.Equal(t, "barney", fe.audit.Query(AuditQuery{Action: AuditBind})[0].User)
+
+	// Secrets are never listed.
+	recorder = apiCall(handler, "GET", "/admin/tokens", "")
+	assert.Contains(t, recorder.Body.String(), token.Id)
+	assert.NotContains(t, recorder.Body.String(), token.Token)
+	assert.NotContains(t, recorder.Body.String(), "hash")
+
+	fe.auth.tokens[token.Id].Expires = time.Now().Add(-time.Second)
+	assert.Equal(t, 401, authCall(handler, bearer, "GET", "/subnets", "").Code)
+
+	assert.Equal(t, 400, apiCall(handler, "POST", "/admin/tokens", `{"user": "dino"}`).Code)
+	recorder = apiCall(handler, "POST", "/admin/tokens", `{"user": "barney", "expires_in": 60}`)
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), token))
+	assert.True(t, token.Expires.Before(time.Now().Add(time.Minute+time.Second)))
+	assert.Equal(t, 1, len(fe.auth.tokens), "expired tokens are dropped")
+	assert.Equal(t, 200, apiCall(handler, "DELETE", "/admin/tokens/"+token.Id, "").Code)
+	assert.Equal(t, 401, authCall(handler, "Bearer "+token.Token, "GET", "/subnets", "").Code)
+	assert.Equal(t, 404, apiCall(handler, "DELETE", "/admin/tokens/"+token.Id, "").Code)
+}
+
+func TestAuthSaved(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rebar-dhcp-auth")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "auth.json")
+	cfg := Config{}
+
+	a, err := NewAuth(path)
+	assert.Nil(t, err)
+	err, _ = a.AddUser(cfg, &ApiUser{Name: "betty", Password: "hoppy", Role: RoleOperator})
+	assert.Nil(t, err)
+	token := &ApiToken{User: "betty"}
+	err, _ = a.AddToken(cfg, token)
+	assert.Nil(t, err)
+
+	a, err = NewAuth(path)
+	assert.Nil(t, err)
+	id, ok := a.Authenticate(cfg, basic("betty", "hoppy"))
+	assert.True(t, ok)
+	assert.Equal(t, "betty", id.User)
+	assert.Equal(t, RoleOperator, id.Role)
+	_, ok = a.Authenticate(cfg, "Bearer "+token.Token)
+	assert.True(t, ok)
+
+	// Removing the user revokes the token.
+	err, _ = a.RemoveUser(cfg, "betty")
+	assert.Nil(t, err)
+	_, ok = a.Authenticate(cfg, "Bearer "+token.Token)
+	assert.False(t, ok)
+}
+
+func TestAuthConfig(t *testing.T) {
+	cfg := Config{}
+	cfg.Network.Port = 6755
+	cfg.Network.Username = "fred"
+	cfg.Storage.DataDir = "/tmp/dhcp"
+	cfg.User = map[string]*UserConfig{
+		"fred":  {PasswordHash: bcryptHash("x"), Role: RoleAdmin},
+		"wilma": {PasswordHash: "pebbles", Role: "boss"},
+	}
+	err := cfg.validate()
+	assert.NotNil(t, err)
+	ce := err.(ConfigError)
+	assert.Contains(t, ce, "network.username and network.password must be set together")
+	assert.Contains(t, ce, `user "fred" is also network.username`)
+	assert.Contains(t, ce, `user "wilma" password-hash is not a bcrypt hash`)
+	assert.Contains(t, ce, `user "wilma" role "boss" must be read-only, binding-operator or admin`)
+
+	// Users can replace the network pair.
+	cfg.Network.Username = ""
+	cfg.User = map[string]*UserConfig{"wilma": {PasswordHash: bcryptHash("x"), Role: RoleAdmin}}
+	assert.Nil(t, cfg.validate())
+}
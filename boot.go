@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/ant0ine/go-json-rest/rest"
+	dhcp "github.com/krolaw/dhcp4"
+)
+
+/*
+ * Boot scripts
+ *
+ * iPXE scripts and UEFI HTTP boot URLs are rendered from Go templates
+ * in the configured template directory.  The template is chosen by
+ * the binding, then the client's class, then the subnet, then the
+ * configured default.  A class matches the client's user class
+ * (option 77, e.g. "iPXE") or a prefix of its vendor class (option 60,
+ * e.g. "HTTPClient" or "PXEClient:Arch:00007").
+ */
+
+const httpBootClass = "HTTPClient"
+
+type BootTemplates struct {
+	dir      string
+	fallback string // Template when nothing else picks one
+	url      string // Base URL of the boot endpoint, for iPXE clients
+}
+
+// boot_templates is nil unless boot templates are configured.
+var boot_templates *BootTemplates
+
+func NewBootTemplates(dir, fallback, url string) *BootTemplates {
+	return &BootTemplates{
+		dir:      dir,
+		fallback: fallback,
+		url:      strings.TrimSuffix(url, "/"),
+	}
+}
+
+// BootData is what a template sees.
+type BootData struct {
+	Ip         net.IP
+	Mac        string
+	Hostname   string
+	Subnet     string
+	NextServer string
+	Lease      *Lease
+	Binding    *Binding
+	Options    map[int]string // Subnet options overlaid with binding options
+	BootUrl    string         // This client's script on the boot endpoint
+}
+
+// record_client_class keeps the class options the client sent.
+func (l *Lease) record_client_class(options dhcp.Options) {
+	if vc, ok := options[dhcp.OptionVendorClassIdentifier]; ok {
+		l.VendorClass = string(vc)
+	}
+	if uc, ok := options[dhcp.OptionUserClass]; ok {
+		l.UserClass = parseUserClass(uc)
+	}
+}
+
+// parseUserClass accepts both RFC 3004 length-prefixed data and the
+// bare string many clients (iPXE among them) send.
+func parseUserClass(b []byte) string {
+	if len(b) > 1 && int(b[0]) == len(b)-1 {
+		return string(b[1:])
+	}
+	return string(b)
+}
+
+func (l *Lease) in_class(class string) bool {
+	return class != "" && (l.UserClass == class || strings.HasPrefix(l.VendorClass, class))
+}
+
+// boot_template returns the template name for a client, or "".
+func (s *Subnet) boot_template(lease *Lease, binding *Binding) string {
+	if binding != nil && binding.BootTemplate != "" {
+		return binding.BootTemplate
+	}
+	if lease != nil {
+		// Longest class wins so "PXEClient:Arch:00007" beats "PXEClient".
+		best := ""
+		for class := range s.BootClassTemplates {
+			if lease.in_class(class) && len(class) > len(best) {
+				best = class
+			}
+		}
+		if best != "" {
+			return s.BootClassTemplates[best]
+		}
+	}
+	if s.BootTemplate != "" {
+		return s.BootTemplate
+	}
+	if boot_templates != nil {
+		return boot_templates.fallback
+	}
+	return ""
+}
+
+func (bt *BootTemplates) boot_url(mac string) string {
+	if bt.url == "" {
+		return ""
+	}
+	return bt.url + "/boot/" + url.PathEscape(mac)
+}
+
+// boot_data assumes the subnet's lock is held.
+func (bt *BootTemplates) boot_data(s *Subnet, lease *Lease, binding *Binding) *BootData {
+	d := &BootData{
+		Subnet:  s.Name,
+		Options: make(map[int]string),
+	}
+	// Copies, the template runs after the lock is released.
+	if lease != nil {
+		l := *lease
+		d.Lease = &l
+		d.Ip, d.Mac = lease.Ip, lease.Mac
+	}
+	if binding != nil {
+		b := *binding
+		d.Binding = &b
+		d.Ip, d.Mac = binding.Ip, binding.Mac
+	}
+	d.BootUrl = bt.boot_url(d.Mac)
+	d.Hostname, _ = s.hostname_for(lease, binding)
+	if s.NextServer != nil {
+		d.NextServer = s.NextServer.String()
+	}
+	for code, v := range s.Options {
+		d.Options[int(code)] = s.option_value(code, v)
+	}
+	if binding != nil {
+		if binding.NextServer != nil {
+			d.NextServer = *binding.NextServer
+		}
+		for _, o := range binding.Options {
+			d.Options[int(o.Code)] = o.Value
+		}
+	}
+	return d
+}
+
+func (bt *BootTemplates) render(name string, data *BootData) ([]byte, error) {
+	if name == "" {
+		return nil, errors.New("no boot template selected")
+	}
+	// Parsed on every use so templates can be edited in place.
+	t, err := template.New(name).Option("missingkey=zero").ParseGlob(filepath.Join(bt.dir, "*"))
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := t.ExecuteTemplate(&buf, name, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// boot_options points iPXE at its boot script and gives UEFI HTTP
+// boot clients their URL.  Option 67 set on the binding is left alone.
+func (s *Subnet) boot_options(opts dhcp.Options, lease *Lease, binding *Binding) {
+	bt := boot_templates
+	if bt == nil || lease == nil {
+		return
+	}
+	if binding != nil {
+		for _, o := range binding.Options {
+			if o.Code == dhcp.OptionBootFileName {
+				return
+			}
+		}
+	}
+	switch {
+	case lease.UserClass == "iPXE":
+		if u := bt.boot_url(lease.Mac); u != "" {
+			opts[dhcp.OptionBootFileName] = []byte(u)
+		}
+	case lease.in_class(httpBootClass):
+		out, err := bt.render(s.boot_template(lease, binding), bt.boot_data(s, lease, binding))
+		if err != nil {
+			log.Println("HTTP boot template for ", lease.Mac, " failed: ", err)
+			return
+		}
+		u := strings.TrimSpace(strings.SplitN(string(out), "\n", 2)[0])
+		if pu, err := url.Parse(u); err != nil || (pu.Scheme != "http" && pu.Scheme != "https") {
+			log.Printf("HTTP boot template for %s gave %q, not a URL", lease.Mac, u)
+			return
+		}
+		opts[dhcp.OptionBootFileName] = []byte(u)
+		opts[dhcp.OptionVendorClassIdentifier] = []byte(httpBootClass)
+	}
+}
+
+// find_boot_client looks a MAC up in every subnet, bindings first.
+func (dt *DataTracker) find_boot_client(mac string) (*Subnet, *Lease, *Binding) {
+	for _, s := range dt.Subnets {
+		s.lock.RLock()
+		b := s.Bindings[mac]
+		l := s.Leases[mac]
+		s.lock.RUnlock()
+		if b != nil {
+			return s, l, b
+		}
+	}
+	for _, s := range dt.Subnets {
+		s.lock.RLock()
+		l := s.Leases[mac]
+		s.lock.RUnlock()
+		if l != nil {
+			return s, l, nil
+		}
+	}
+	return nil, nil, nil
+}
+
+// GetBootScript renders the boot template for a MAC.
+func (fe *Frontend) GetBootScript(w rest.ResponseWriter, r *rest.Request) {
+	bt := boot_templates
+	if bt == nil {
+		rest.Error(w, "Boot templates not configured", http.StatusNotFound)
+		return
+	}
+	mac, err := net.ParseMAC(r.PathParam("mac"))
+	if err != nil {
+		rest.Error(w, "Invalid MAC address", http.StatusBadRequest)
+		return
+	}
+	subnet, lease, binding := fe.DhcpInfo.find_boot_client(mac.String())
+	if subnet == nil || !fe.inScope(scopeOf(r), subnet.Name, nil) {
+		rest.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	subnet.lock.RLock()
+	name := subnet.boot_template(lease, binding)
+	data := bt.boot_data(subnet, lease, binding)
+	subnet.lock.RUnlock()
+	out, err := bt.render(name, data)
+	if err != nil {
+		rest.Error(w, fmt.Sprintf("Rendering %q: %s", name, err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.(http.ResponseWriter).Write(out)
+}
+
+// BootHandler serves only the boot scripts, without authentication,
+// for the separate boot listener.
+func (fe *Frontend) BootHandler() http.Handler {
+	api := rest.NewApi()
+	api.Use(rest.DefaultDevStack...)
+	router, err := rest.MakeRouter(
+		rest.Get("/boot/#mac", fe.GetBootScript),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	api.SetApp(router)
+	return api.MakeHandler()
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	dhcp "github.com/krolaw/dhcp4"
+	"github.com/stretchr/testify/assert"
+)
+
+func bootSetup(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "rebar-dhcp-boot")
+	assert.Nil(t, err)
+	files := map[string]string{
+		"default.ipxe": "#!ipxe\nkernel http://{{.NextServer}}/vmlinuz hostname={{.Hostname}}\n",
+		"custom.ipxe":  "#!ipxe\necho {{.Mac}} {{.Ip}} {{index .Options 15}}\n",
+		"uefi.tmpl":    "http://{{.NextServer}}/uefi/{{.Mac}}/ipxe.efi\n",
+	}
+	for name, body := range files {
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(body), 0644))
+	}
+	boot_templates = NewBootTemplates(dir, "default.ipxe", "http://192.168.128.1:8080/")
+	return dir, func() {
+		boot_templates = nil
+		os.RemoveAll(dir)
+	}
+}
+
+func TestParseUserClass(t *testing.T) {
+	assert.Equal(t, "iPXE", parseUserClass([]byte("iPXE")))
+	assert.Equal(t, "iPXE", parseUserClass([]byte{4, 'i', 'P', 'X', 'E'}))
+}
+
+func TestBootTemplateSelection(t *testing.T) {
+	_, done := bootSetup(t)
+	defer done()
+
+	s := NewSubnet()
+	lease := &Lease{Mac: "aa", VendorClass: "PXEClient:Arch:00007:UNDI:003016"}
+	assert.Equal(t, "default.ipxe", s.boot_template(lease, nil))
+
+	s.BootTemplate = "subnet.ipxe"
+	assert.Equal(t, "subnet.ipxe", s.boot_template(lease, nil))
+
+	s.BootClassTemplates = map[string]string{
+		"PXEClient":            "bios.ipxe",
+		"PXEClient:Arch:00007": "efi.ipxe",
+		"iPXE":                 "ipxe.ipxe",
+	}
+	assert.Equal(t, "efi.ipxe", s.boot_template(lease, nil))
+	lease.UserClass = "iPXE"
+	lease.VendorClass = ""
+	assert.Equal(t, "ipxe.ipxe", s.boot_template(lease, nil))
+
+	assert.Equal(t, "custom.ipxe", s.boot_template(lease, &Binding{BootTemplate: "custom.ipxe"}))
+}
+
+func TestBootOptions(t *testing.T) {
+	_, done := bootSetup(t)
+	defer done()
+
+	s := NewSubnet()
+	ns := net.ParseIP("192.168.128.2").To4()
+	s.NextServer = &ns
+	lease := &Lease{Mac: "52:54:00:00:00:01"}
+
+	opts := dhcp.Options{}
+	s.boot_options(opts, lease, nil)
+	assert.Equal(t, 0, len(opts))
+
+	// iPXE is sent to its script
+	lease.UserClass = "iPXE"
+	s.boot_options(opts, lease, nil)
+	assert.Equal(t, "http://192.168.128.1:8080/boot/52:54:00:00:00:01", string(opts[dhcp.OptionBootFileName]))
+
+	// ... unless the binding says otherwise
+	opts = dhcp.Options{}
+	s.boot_options(opts, lease, &Binding{Options: []*Option{{Code: dhcp.OptionBootFileName, Value: "x"}}})
+	assert.Equal(t, 0, len(opts))
+
+	// HTTP boot gets a URL from its template
+	lease.UserClass = ""
+	lease.VendorClass = "HTTPClient:Arch:00016:UNDI:003001"
+	s.BootClassTemplates = map[string]string{"HTTPClient": "uefi.tmpl"}
+	s.boot_options(opts, lease, nil)
+	assert.Equal(t, "http://192.168.128.2/uefi/52:54:00:00:00:01/ipxe.efi", string(opts[dhcp.OptionBootFileName]))
+	assert.Equal(t, "HTTPClient", string(opts[dhcp.OptionVendorClassIdentifier]))
+
+	// A script is not a URL
+	opts = dhcp.Options{}
+	s.BootClassTemplates = nil
+	s.boot_options(opts, lease, nil)
+	assert.Equal(t, 0, len(opts))
+}
+
+func TestGetBootScript(t *testing.T) {
+	_, done := bootSetup(t)
+	defer done()
+
+	fe, handler := get_frontend()
+	dt, s := simpleSetup()
+	fe.DhcpInfo.Subnets = dt.Subnets
+	s.Options[dhcp.OptionDomainName] = []byte("lab.example.com")
+	s.Bindings["52:54:00:00:00:01"] = &Binding{
+		Mac:          "52:54:00:00:00:01",
+		Ip:           net.ParseIP("192.168.128.10").To4(),
+		BootTemplate: "custom.ipxe",
+	}
+	s.Leases["52:54:00:00:00:02"] = &Lease{Mac: "52:54:00:00:00:02", Ip: net.ParseIP("192.168.128.11").To4(), Hostname: "node11"}
+
+	get := func(h http.Handler, path string, auth bool) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", base_url(path), nil)
+		assert.Nil(t, err)
+		if auth {
+			req.SetBasicAuth("fred", "rules")
+		}
+		h.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	r := get(handler, "/boot/52:54:00:00:00:01", true)
+	assert.Equal(t, 200, r.Code)
+	assert.Equal(t, "#!ipxe\necho 52:54:00:00:00:01 192.168.128.10 lab.example.com\n", r.Body.String())
+
+	r = get(handler, "/boot/52-54-00-00-00-02", true)
+	assert.Equal(t, 200, r.Code)
+	assert.Equal(t, "#!ipxe\nkernel http:///vmlinuz hostname=node11\n", r.Body.String())
+
+	assert.Equal(t, 404, get(handler, "/boot/52:54:00:00:00:03", true).Code)
+	assert.Equal(t, 400, get(handler, "/boot/nope", true).Code)
+	assert.Equal(t, 401, get(handler, "/boot/52:54:00:00:00:01", false).Code)
+
+	// The boot listener needs no credentials
+	assert.Equal(t, 200, get(fe.BootHandler(), "/boot/52:54:00:00:00:01", false).Code)
+}
@@ -0,0 +1,555 @@
+package main
+
+import (
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/gcfg.v1"
+)
+
+type Config struct {
+	Network struct {
+		Port             int
+		Username         string
+		Password         string // Plain text or a bcrypt hash
+		DisableBasicAuth bool   `gcfg:"disable-basic-auth"` // Only client certs and tokens
+	}
+	Dhcp struct {
+		ServerIp       string `gcfg:"server-ip"`  // e.g. 10.10.10.1/24
+		ServerIp6      string `gcfg:"server-ip6"` // e.g. fd00:10::1/64, enables DHCPv6
+		IgnoreAnonymus bool   `gcfg:"ignore-anonymus"`
+	}
+	Storage struct {
+		DataDir   string `gcfg:"data-dir"`
+		KvUrl     string `gcfg:"kv-url"`    // Consul to keep subnets in instead of data-dir
+		KvPrefix  string `gcfg:"kv-prefix"` // Default rebar-dhcp/
+		KvToken   string `gcfg:"kv-token"`
+		SqlDriver string `gcfg:"sql-driver"` // sqlite3 or postgres
+		SqlDsn    string `gcfg:"sql-dsn"`
+	}
+	Tls struct {
+		Cert              string
+		Key               string
+		ClientCa          string `gcfg:"client-ca"` // CA for client certs, empty disables
+		RequireClientCert bool   `gcfg:"require-client-cert"`
+	}
+	Log struct {
+		File string // Empty means stderr
+	}
+	// Utilization alerts.  Subnets without alert_thresholds use these.
+	Alerts struct {
+		Threshold []int
+		Webhook   []string
+		Retries   int
+	}
+	// Dynamic DNS updates for bound leases
+	Ddns struct {
+		Server        string // host[:port], empty disables
+		TsigName      string `gcfg:"tsig-name"`
+		TsigSecret    string `gcfg:"tsig-secret"` // base64
+		TsigAlgorithm string `gcfg:"tsig-algorithm"`
+		Ttl           int
+	}
+	// [user "name"] sections for API users besides network.username
+	User map[string]*UserConfig
+	// [webhook "name"] sections for lease and binding events
+	Webhook map[string]*WebhookConfig
+	// Subnet files reconciled into the tracker at startup and reload.
+	Seed struct {
+		Dir   string
+		Prune bool // Remove subnets and bindings not in Dir
+	}
+	// Hosts and zone files rendered from bindings and leases
+	Files struct {
+		Hosts      string // /etc/hosts style file, empty disables
+		ZoneDir    string `gcfg:"zone-dir"` // <zone>.zone per subnet zone, empty disables
+		Nameserver string // SOA and NS name, default localhost
+		Ttl        int
+		Interval   int // Seconds between rewrites for expired leases
+	}
+	// Append-only log of lease events, queried by GET /history
+	History struct {
+		Dir        string // Empty disables
+		MaxSize    int    `gcfg:"max-size"`    // MB before rotating, default 10
+		RetainDays int    `gcfg:"retain-days"` // Keep rotated logs this long, default 90
+	}
+	// Management API changes, queried by GET /audit
+	Audit struct {
+		File string // Also append records here, empty keeps them in memory only
+	}
+	// Built-in TFTP server for PXE boot files
+	Tftp struct {
+		Root    string // Directory to serve, empty disables
+		Address string // Listen address, default :69
+	}
+	// iPXE scripts and HTTP boot URLs rendered from templates
+	Boot struct {
+		TemplateDir string `gcfg:"template-dir"` // Empty disables
+		Default     string // Template when nothing else picks one
+		Url         string // Base URL clients reach /boot on, for iPXE
+		Address     string // Extra unauthenticated listener, e.g. :8080
+	}
+	// ProxyDHCP: answer only PXE clients, with no address.
+	Proxy struct {
+		Enabled    bool
+		BootFile   string `gcfg:"boot-file"`
+		NextServer string `gcfg:"next-server"` // Default the serving interface
+	}
+	// [proxy-arch "7"] sections, by option 93 client architecture
+	ProxyArch map[string]*ProxyArchConfig `gcfg:"proxy-arch"`
+	// Relay mode: forward the [interface] segments to these servers
+	// instead of serving them.
+	Relay struct {
+		Server   []string // host[:port]
+		Option82 bool     // Add circuit and remote id
+	}
+	// Router advertisements on the DHCPv6 interfaces
+	Ra struct {
+		Enabled        bool
+		Interval       int // Seconds between advertisements, default 200
+		RouterLifetime int `gcfg:"router-lifetime"` // Seconds, 0 is not a default router
+	}
+	// Lease sync and load balancing with a partner server
+	Failover struct {
+		Role        string // primary or secondary, empty disables
+		Address     string // host[:port] the primary listens on
+		Secret      string
+		Split       int // Hash buckets of 256 the primary answers, default 128
+		PartnerDown int `gcfg:"partner-down"` // Seconds before taking over, default 60
+	}
+	// [interface "eth0"] sections.  When present, only the listed
+	// interfaces are served instead of the first match for server-ip.
+	Interface map[string]*InterfaceConfig
+}
+
+type WebhookConfig struct {
+	Url    string
+	Secret string
+	Event  []string // Event types to send, all if none
+	Subnet []string // Subnets to send for, all if none
+}
+
+type ProxyArchConfig struct {
+	BootFile   string `gcfg:"boot-file"`
+	NextServer string `gcfg:"next-server"`
+}
+
+type InterfaceConfig struct {
+	ServerIp  string `gcfg:"server-ip"`
+	ServerIp6 string `gcfg:"server-ip6"`
+	Disabled  bool
+}
+
+// ConfigError collects every validation problem so they can all be
+// reported at once.
+type ConfigError []string
+
+func (ce ConfigError) Error() string {
+	return strings.Join(ce, "; ")
+}
+
+// readConfig parses the gcfg file at path, overlays the command line
+// flags and validates the result.  A config that fails validation is
+// never returned.
+func readConfig(path string) (Config, error) {
+	var cfg Config
+	if err := gcfg.ReadFileInto(&cfg, path); err != nil {
+		return cfg, err
+	}
+	cfg.applyFlags(flag.CommandLine)
+	if err := cfg.validate(); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// applyFlags overlays the command line onto cfg.  Flags given on the
+// command line always win.  Flag defaults only fill in what the file
+// left empty.
+func (cfg *Config) applyFlags(fs *flag.FlagSet) {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	str := func(name string, dst *string) {
+		f := fs.Lookup(name)
+		if f == nil {
+			return
+		}
+		if set[name] || *dst == "" {
+			*dst = f.Value.String()
+		}
+	}
+	str("server_ip", &cfg.Dhcp.ServerIp)
+	str("server_ip6", &cfg.Dhcp.ServerIp6)
+	str("data_dir", &cfg.Storage.DataDir)
+	str("cert_pem", &cfg.Tls.Cert)
+	str("key_pem", &cfg.Tls.Key)
+
+	if f := fs.Lookup("ignore_anonymus"); f != nil && set[f.Name] {
+		cfg.Dhcp.IgnoreAnonymus = f.Value.String() == "true"
+	}
+}
+
+func (cfg *Config) validate() error {
+	errs := ConfigError{}
+
+	if cfg.Network.Port <= 0 || cfg.Network.Port > 65535 {
+		errs = append(errs, "network.port must be between 1 and 65535")
+	}
+	if len(cfg.User) == 0 && !cfg.Network.DisableBasicAuth {
+		if cfg.Network.Username == "" {
+			errs = append(errs, "network.username must be set")
+		}
+		if cfg.Network.Password == "" {
+			errs = append(errs, "network.password must be set")
+		}
+	} else if (cfg.Network.Username == "") != (cfg.Network.Password == "") {
+		errs = append(errs, "network.username and network.password must be set together")
+	}
+	for name, u := range cfg.User {
+		if name == cfg.Network.Username {
+			errs = append(errs, fmt.Sprintf("user %q is also network.username", name))
+		}
+		certs := len(u.CertSubject) > 0 || len(u.CertSan) > 0
+		if certs && cfg.Tls.ClientCa == "" {
+			errs = append(errs, fmt.Sprintf("user %q cert-subject and cert-san need tls.client-ca", name))
+		}
+		if (u.PasswordHash != "" || !certs) && !isBcrypt(u.PasswordHash) {
+			errs = append(errs, fmt.Sprintf("user %q password-hash is not a bcrypt hash", name))
+		}
+		if roleRank[u.Role] == 0 {
+			errs = append(errs, fmt.Sprintf("user %q role %q must be read-only, binding-operator or admin", name, u.Role))
+		}
+		if err := validScope(u.Subnet); err != nil {
+			errs = append(errs, fmt.Sprintf("user %q %s", name, err))
+		}
+	}
+
+	if cfg.Dhcp.ServerIp != "" {
+		if err := validateServerIp(cfg.Dhcp.ServerIp); err != nil {
+			errs = append(errs, "dhcp.server-ip "+err.Error())
+		}
+	}
+	if cfg.Dhcp.ServerIp6 != "" {
+		if err := validateServerIp6(cfg.Dhcp.ServerIp6); err != nil {
+			errs = append(errs, "dhcp.server-ip6 "+err.Error())
+		}
+	}
+
+	if cfg.Storage.DataDir == "" {
+		errs = append(errs, "storage.data-dir must be set")
+	}
+	if cfg.Storage.KvUrl != "" {
+		if pu, err := url.Parse(cfg.Storage.KvUrl); err != nil || (pu.Scheme != "http" && pu.Scheme != "https") {
+			errs = append(errs, fmt.Sprintf("storage.kv-url %q is not an http(s) URL", cfg.Storage.KvUrl))
+		}
+	}
+	if cfg.Storage.SqlDriver != "" {
+		if cfg.Storage.SqlDriver != "sqlite3" && cfg.Storage.SqlDriver != "postgres" {
+			errs = append(errs, fmt.Sprintf("storage.sql-driver %q must be sqlite3 or postgres", cfg.Storage.SqlDriver))
+		}
+		if cfg.Storage.SqlDsn == "" {
+			errs = append(errs, "storage.sql-dsn is required with sql-driver")
+		}
+		if cfg.Storage.KvUrl != "" {
+			errs = append(errs, "storage.kv-url and sql-driver can not be combined")
+		}
+	}
+
+	if (cfg.Tls.Cert == "") != (cfg.Tls.Key == "") {
+		errs = append(errs, "tls.cert and tls.key must be set together")
+	}
+	if cfg.Tls.ClientCa != "" && cfg.Tls.Cert == "" {
+		errs = append(errs, "tls.client-ca needs tls.cert and tls.key")
+	}
+	if cfg.Tls.RequireClientCert && cfg.Tls.ClientCa == "" {
+		errs = append(errs, "tls.require-client-cert needs tls.client-ca")
+	}
+	if cfg.Network.DisableBasicAuth && cfg.Tls.ClientCa == "" {
+		errs = append(errs, "network.disable-basic-auth needs tls.client-ca")
+	}
+
+	for _, t := range cfg.Alerts.Threshold {
+		if t <= 0 || t > 100 {
+			errs = append(errs, fmt.Sprintf("alerts.threshold %d must be between 1 and 100", t))
+		}
+	}
+	for _, u := range cfg.Alerts.Webhook {
+		if pu, err := url.Parse(u); err != nil || (pu.Scheme != "http" && pu.Scheme != "https") {
+			errs = append(errs, fmt.Sprintf("alerts.webhook %q is not an http(s) URL", u))
+		}
+	}
+	if cfg.Alerts.Retries < 0 {
+		errs = append(errs, "alerts.retries must not be negative")
+	}
+
+	if cfg.Ddns.Server != "" {
+		if (cfg.Ddns.TsigName == "") != (cfg.Ddns.TsigSecret == "") {
+			errs = append(errs, "ddns.tsig-name and ddns.tsig-secret must be set together")
+		}
+		if cfg.Ddns.TsigSecret != "" {
+			if _, err := base64.StdEncoding.DecodeString(cfg.Ddns.TsigSecret); err != nil {
+				errs = append(errs, "ddns.tsig-secret must be base64")
+			}
+		}
+		switch cfg.Ddns.TsigAlgorithm {
+		case "", "hmac-sha1", "hmac-sha256", "hmac-sha512":
+		default:
+			errs = append(errs, fmt.Sprintf("ddns.tsig-algorithm %q is not supported", cfg.Ddns.TsigAlgorithm))
+		}
+		if cfg.Ddns.Ttl < 0 {
+			errs = append(errs, "ddns.ttl must not be negative")
+		}
+	}
+
+	if cfg.History.MaxSize < 0 {
+		errs = append(errs, "history.max-size can not be negative")
+	}
+	if cfg.History.RetainDays < 0 {
+		errs = append(errs, "history.retain-days can not be negative")
+	}
+
+	if cfg.Files.Ttl < 0 {
+		errs = append(errs, "files.ttl must not be negative")
+	}
+	if cfg.Files.Interval < 0 {
+		errs = append(errs, "files.interval must not be negative")
+	}
+	if cfg.Files.ZoneDir != "" {
+		if fi, err := os.Stat(cfg.Files.ZoneDir); err != nil || !fi.IsDir() {
+			errs = append(errs, fmt.Sprintf("files.zone-dir %q is not a directory", cfg.Files.ZoneDir))
+		}
+	}
+
+	if cfg.Tftp.Root != "" {
+		if fi, err := os.Stat(cfg.Tftp.Root); err != nil || !fi.IsDir() {
+			errs = append(errs, fmt.Sprintf("tftp.root %q is not a directory", cfg.Tftp.Root))
+		}
+	}
+
+	if cfg.Boot.TemplateDir != "" {
+		if fi, err := os.Stat(cfg.Boot.TemplateDir); err != nil || !fi.IsDir() {
+			errs = append(errs, fmt.Sprintf("boot.template-dir %q is not a directory", cfg.Boot.TemplateDir))
+		}
+	}
+	if cfg.Boot.Url != "" {
+		if pu, err := url.Parse(cfg.Boot.Url); err != nil || (pu.Scheme != "http" && pu.Scheme != "https") {
+			errs = append(errs, fmt.Sprintf("boot.url %q is not an http(s) URL", cfg.Boot.Url))
+		}
+	}
+
+	if cfg.Proxy.NextServer != "" && net.ParseIP(cfg.Proxy.NextServer).To4() == nil {
+		errs = append(errs, fmt.Sprintf("proxy.next-server %q is not an IPv4 address", cfg.Proxy.NextServer))
+	}
+	for name, pa := range cfg.ProxyArch {
+		if _, err := strconv.ParseUint(name, 10, 16); err != nil {
+			errs = append(errs, fmt.Sprintf("proxy-arch %q is not an architecture number", name))
+		}
+		if pa.NextServer != "" && net.ParseIP(pa.NextServer).To4() == nil {
+			errs = append(errs, fmt.Sprintf("proxy-arch %q next-server %q is not an IPv4 address", name, pa.NextServer))
+		}
+	}
+
+	if len(cfg.Relay.Server) > 0 {
+		for _, s := range cfg.Relay.Server {
+			host := s
+			if h, _, err := net.SplitHostPort(s); err == nil {
+				host = h
+			}
+			if net.ParseIP(host).To4() == nil {
+				errs = append(errs, fmt.Sprintf("relay.server %q is not an IPv4 address", s))
+			}
+		}
+		if len(cfg.Interface) == 0 {
+			errs = append(errs, "relay mode needs [interface] sections")
+		}
+		if cfg.Proxy.Enabled {
+			errs = append(errs, "relay and proxy modes can not be combined")
+		}
+	}
+
+	if cfg.Ra.Enabled {
+		if cfg.Ra.Interval != 0 && (cfg.Ra.Interval < 4 || cfg.Ra.Interval > 1800) {
+			errs = append(errs, "ra.interval must be between 4 and 1800")
+		}
+		if cfg.Ra.RouterLifetime < 0 || cfg.Ra.RouterLifetime > 9000 {
+			errs = append(errs, "ra.router-lifetime must be between 0 and 9000")
+		}
+		v6 := cfg.Dhcp.ServerIp6 != ""
+		for _, intf := range cfg.Interface {
+			v6 = v6 || (!intf.Disabled && intf.ServerIp6 != "")
+		}
+		if !v6 {
+			errs = append(errs, "ra needs a server-ip6 to advertise on")
+		}
+	}
+
+	if cfg.Failover.Role != "" {
+		if cfg.Failover.Role != FailoverPrimary && cfg.Failover.Role != FailoverSecondary {
+			errs = append(errs, fmt.Sprintf("failover.role %q must be primary or secondary", cfg.Failover.Role))
+		}
+		if cfg.Failover.Address == "" {
+			errs = append(errs, "failover.address is required")
+		}
+		if cfg.Failover.Secret == "" {
+			errs = append(errs, "failover.secret is required")
+		}
+		if cfg.Failover.Split < 0 || cfg.Failover.Split > 256 {
+			errs = append(errs, "failover.split must be between 0 and 256")
+		}
+		if cfg.Failover.PartnerDown < 0 {
+			errs = append(errs, "failover.partner-down can not be negative")
+		}
+		if len(cfg.Relay.Server) > 0 || cfg.Proxy.Enabled {
+			errs = append(errs, "failover needs a server that hands out leases, not relay or proxy mode")
+		}
+	}
+
+	for name, wh := range cfg.Webhook {
+		if pu, err := url.Parse(wh.Url); err != nil || (pu.Scheme != "http" && pu.Scheme != "https") {
+			errs = append(errs, fmt.Sprintf("webhook %q url %q is not an http(s) URL", name, wh.Url))
+		}
+	}
+
+	for name, intf := range cfg.Interface {
+		if intf.Disabled {
+			continue
+		}
+		if intf.ServerIp == "" && intf.ServerIp6 == "" {
+			errs = append(errs, fmt.Sprintf("interface %q must set server-ip or server-ip6", name))
+		}
+		if intf.ServerIp != "" {
+			if err := validateServerIp(intf.ServerIp); err != nil {
+				errs = append(errs, fmt.Sprintf("interface %q server-ip %s", name, err.Error()))
+			}
+		}
+		if intf.ServerIp6 != "" {
+			if err := validateServerIp6(intf.ServerIp6); err != nil {
+				errs = append(errs, fmt.Sprintf("interface %q server-ip6 %s", name, err.Error()))
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// raSettings builds the router advertisement settings from a validated
+// config.
+func (cfg *Config) raSettings() *RASettings {
+	interval := cfg.Ra.Interval
+	if interval == 0 {
+		interval = 200
+	}
+	return &RASettings{
+		Interval:       time.Duration(interval) * time.Second,
+		RouterLifetime: time.Duration(cfg.Ra.RouterLifetime) * time.Second,
+	}
+}
+
+// store builds the backing store from a validated config.
+func (cfg *Config) store() (LoadSaver, error) {
+	if cfg.Storage.SqlDriver != "" {
+		return NewSQLStore(cfg.Storage.SqlDriver, cfg.Storage.SqlDsn)
+	}
+	if cfg.Storage.KvUrl == "" {
+		return NewFileStore(cfg.Storage.DataDir + "/database.json")
+	}
+	prefix := cfg.Storage.KvPrefix
+	if prefix == "" {
+		prefix = "rebar-dhcp/"
+	}
+	return NewKVStore(NewConsulKV(cfg.Storage.KvUrl, cfg.Storage.KvToken), prefix), nil
+}
+
+// leaseHistory opens the lease history log from a validated config.
+func (cfg *Config) leaseHistory() (*LeaseHistory, error) {
+	maxSize := cfg.History.MaxSize
+	if maxSize == 0 {
+		maxSize = 10
+	}
+	retain := cfg.History.RetainDays
+	if retain == 0 {
+		retain = 90
+	}
+	return NewLeaseHistory(cfg.History.Dir, int64(maxSize)<<20, time.Duration(retain)*24*time.Hour)
+}
+
+// failover builds the failover partner for dt from a validated config.
+func (cfg *Config) failover(dt *DataTracker) *Failover {
+	split := cfg.Failover.Split
+	if split == 0 {
+		split = 128
+	}
+	partnerDown := cfg.Failover.PartnerDown
+	if partnerDown == 0 {
+		partnerDown = 60
+	}
+	return NewFailover(dt, cfg.Failover.Role, cfg.Failover.Address, cfg.Failover.Secret,
+		split, time.Duration(partnerDown)*time.Second)
+}
+
+// proxyDHCP builds the ProxyDHCP settings from a validated config.
+func (cfg *Config) proxyDHCP() *ProxyDHCP {
+	def := ProxyBoot{BootFile: cfg.Proxy.BootFile}
+	if cfg.Proxy.NextServer != "" {
+		def.NextServer = net.ParseIP(cfg.Proxy.NextServer).To4()
+	}
+	arch := make(map[uint16]*ProxyBoot)
+	for name, pa := range cfg.ProxyArch {
+		a, _ := strconv.ParseUint(name, 10, 16)
+		pb := &ProxyBoot{BootFile: pa.BootFile}
+		if pa.NextServer != "" {
+			pb.NextServer = net.ParseIP(pa.NextServer).To4()
+		}
+		arch[uint16(a)] = pb
+	}
+	return NewProxyDHCP(def, arch)
+}
+
+func validateServerIp(s string) error {
+	ip, _, err := net.ParseCIDR(s)
+	if err != nil {
+		return fmt.Errorf("%q is not an address in CIDR form", s)
+	}
+	if ip.To4() == nil {
+		return fmt.Errorf("%q is not an IPv4 address", s)
+	}
+	return nil
+}
+
+func validateServerIp6(s string) error {
+	ip, _, err := net.ParseCIDR(s)
+	if err != nil {
+		return fmt.Errorf("%q is not an address in CIDR form", s)
+	}
+	if ip.To4() != nil {
+		return fmt.Errorf("%q is not an IPv6 address", s)
+	}
+	return nil
+}
+
+// setupLogging points the standard logger at the configured file.
+func setupLogging(cfg Config) error {
+	if cfg.Log.File == "" {
+		return nil
+	}
+	f, err := os.OpenFile(cfg.Log.File, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	log.SetOutput(f)
+	return nil
+}
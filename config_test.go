@@ -0,0 +1,103 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testFlagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("server_ip", "", "")
+	fs.String("data_dir", "/var/cache/rebar-dhcp", "")
+	fs.String("cert_pem", "/etc/dhcp-https-cert.pem", "")
+	fs.String("key_pem", "/etc/dhcp-https-key.pem", "")
+	fs.Bool("ignore_anonymus", false, "")
+	return fs
+}
+
+func TestReadConfigFull(t *testing.T) {
+	path := write_config(t, `[network]
+port = 6755
+username = admin
+password = admin
+
+[dhcp]
+server-ip = 10.10.10.1/24
+ignore-anonymus = true
+
+[storage]
+data-dir = /tmp/dhcp
+
+[tls]
+cert = /tmp/cert.pem
+key = /tmp/key.pem
+
+[log]
+file = /tmp/dhcp.log
+
+[interface "eth1"]
+server-ip = 10.10.20.1/24
+`)
+	defer os.Remove(path)
+
+	cfg, err := readConfig(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "10.10.10.1/24", cfg.Dhcp.ServerIp)
+	assert.True(t, cfg.Dhcp.IgnoreAnonymus)
+	assert.Equal(t, "/tmp/dhcp", cfg.Storage.DataDir)
+	assert.Equal(t, "/tmp/cert.pem", cfg.Tls.Cert)
+	assert.Equal(t, "/tmp/key.pem", cfg.Tls.Key)
+	assert.Equal(t, "/tmp/dhcp.log", cfg.Log.File)
+	assert.Equal(t, "10.10.20.1/24", cfg.Interface["eth1"].ServerIp)
+}
+
+func TestValidateReportsEveryProblem(t *testing.T) {
+	cfg := Config{}
+	cfg.Dhcp.ServerIp = "10.10.10.1"
+	cfg.Tls.Cert = "/tmp/cert.pem"
+	cfg.Interface = map[string]*InterfaceConfig{
+		"eth1": &InterfaceConfig{},
+	}
+
+	err := cfg.validate()
+	assert.NotNil(t, err)
+	ce := err.(ConfigError)
+	assert.Equal(t, ConfigError{
+		"network.port must be between 1 and 65535",
+		"network.username must be set",
+		"network.password must be set",
+		"dhcp.server-ip \"10.10.10.1\" is not an address in CIDR form",
+		"storage.data-dir must be set",
+		"tls.cert and tls.key must be set together",
+		"interface \"eth1\" must set server-ip or server-ip6",
+	}, ce)
+}
+
+func TestApplyFlagsDefaultsFillEmpty(t *testing.T) {
+	cfg := Config{}
+	cfg.Storage.DataDir = "/from/file"
+
+	cfg.applyFlags(testFlagSet())
+
+	assert.Equal(t, "/from/file", cfg.Storage.DataDir)
+	assert.Equal(t, "/etc/dhcp-https-cert.pem", cfg.Tls.Cert)
+	assert.Equal(t, "/etc/dhcp-https-key.pem", cfg.Tls.Key)
+	assert.False(t, cfg.Dhcp.IgnoreAnonymus)
+}
+
+func TestApplyFlagsOverrideFile(t *testing.T) {
+	cfg := Config{}
+	cfg.Storage.DataDir = "/from/file"
+	cfg.Dhcp.ServerIp = "10.10.10.1/24"
+
+	fs := testFlagSet()
+	fs.Parse([]string{"-data_dir", "/from/flag", "-ignore_anonymus", "-server_ip", "10.10.30.1/24"})
+	cfg.applyFlags(fs)
+
+	assert.Equal(t, "/from/flag", cfg.Storage.DataDir)
+	assert.Equal(t, "10.10.30.1/24", cfg.Dhcp.ServerIp)
+	assert.True(t, cfg.Dhcp.IgnoreAnonymus)
+}
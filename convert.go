@@ -4,9 +4,13 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/rfc1035label"
 	dhcp "github.com/krolaw/dhcp4"
 	"github.com/willf/bitset"
+	"math/big"
 	"net"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -259,20 +263,168 @@ func convertOptionValueToByte(code dhcp.OptionCode, value string) ([]byte, error
 // OptionRelayAgentInformation OptionCode = 82
 // OptionClasslessRouteFormat OptionCode = 121
 
+// DHCPv6 options (RFC 8415 and friends) kept in an IPv6 subnet's
+// Options.  Every code in common use fits the dhcp4 option code type.
+//
+// DNS and NTP servers may also be given under their DHCPv4 codes, 6 and
+// 42, and are stored under the DHCPv6 ones.  That makes 42 unusable for
+// the TZDB timezone, which has little use.
+var optionCodes6 = map[dhcp.OptionCode]dhcp.OptionCode{
+	dhcp.OptionDomainNameServer:           dhcp.OptionCode(dhcpv6.OptionDNSRecursiveNameServer),
+	dhcp.OptionNetworkTimeProtocolServers: dhcp.OptionCode(dhcpv6.OptionNTPServer),
+}
+
+func optionCode6(code dhcp.OptionCode) dhcp.OptionCode {
+	if c, ok := optionCodes6[code]; ok {
+		return c
+	}
+	return code
+}
+
+// NTP_SUBOPTION_SRV_ADDR in OPTION_NTP_SERVER (RFC 5908)
+const ntpSuboptionSrvAddr = 1
+
+func convertByteToOptionValue6(code dhcp.OptionCode, b []byte) string {
+	switch dhcpv6.OptionCode(code) {
+	// Address lists
+	case dhcpv6.OptionSIPServersIPv6AddressList,
+		dhcpv6.OptionDNSRecursiveNameServer,
+		dhcpv6.OptionNISServers,
+		dhcpv6.OptionNISPServers,
+		dhcpv6.OptionSNTPServerList:
+		addrs := make([]string, 0)
+		for len(b) >= net.IPv6len {
+			addrs = append(addrs, net.IP(b[:net.IPv6len]).String())
+			b = b[net.IPv6len:]
+		}
+		return strings.Join(addrs, ",")
+
+	case dhcpv6.OptionNTPServer:
+		addrs := make([]string, 0)
+		for len(b) >= 4 {
+			t, l := binary.BigEndian.Uint16(b), int(binary.BigEndian.Uint16(b[2:]))
+			if len(b) < 4+l {
+				break
+			}
+			if t == ntpSuboptionSrvAddr && l == net.IPv6len {
+				addrs = append(addrs, net.IP(b[4:4+l]).String())
+			}
+			b = b[4+l:]
+		}
+		return strings.Join(addrs, ",")
+
+	// Domain name lists
+	case dhcpv6.OptionSIPServersDomainNameList,
+		dhcpv6.OptionDomainSearchList,
+		dhcpv6.OptionNISDomainName,
+		dhcpv6.OptionNISPDomainName:
+		labels, err := rfc1035label.FromBytes(b)
+		if err != nil {
+			return ""
+		}
+		return strings.Join(labels.Labels, ",")
+
+	// Strings
+	case dhcpv6.OptionNewPOSIXTimezone,
+		dhcpv6.OptionBootfileURL:
+		return string(b)
+
+	// 4 byte integer value
+	case dhcpv6.OptionInformationRefreshTime:
+		if len(b) != 4 {
+			return ""
+		}
+		return fmt.Sprint(binary.BigEndian.Uint32(b))
+	}
+	return ""
+}
+
+func convertOptionValueToByte6(code dhcp.OptionCode, value string) ([]byte, error) {
+	switch dhcpv6.OptionCode(code) {
+	case dhcpv6.OptionSIPServersIPv6AddressList,
+		dhcpv6.OptionDNSRecursiveNameServer,
+		dhcpv6.OptionNISServers,
+		dhcpv6.OptionNISPServers,
+		dhcpv6.OptionSNTPServerList:
+		answer := make([]byte, 0)
+		for _, a := range strings.Split(value, ",") {
+			ip := net.ParseIP(strings.TrimSpace(a))
+			if ip == nil || ip.To4() != nil {
+				return nil, errors.New("Invalid IPv6 address: " + a)
+			}
+			answer = append(answer, ip.To16()...)
+		}
+		return answer, nil
+
+	case dhcpv6.OptionNTPServer:
+		answer := make([]byte, 0)
+		for _, a := range strings.Split(value, ",") {
+			ip := net.ParseIP(strings.TrimSpace(a))
+			if ip == nil || ip.To4() != nil {
+				return nil, errors.New("Invalid IPv6 address: " + a)
+			}
+			answer = append(answer, 0, ntpSuboptionSrvAddr, 0, net.IPv6len)
+			answer = append(answer, ip.To16()...)
+		}
+		return answer, nil
+
+	case dhcpv6.OptionSIPServersDomainNameList,
+		dhcpv6.OptionDomainSearchList,
+		dhcpv6.OptionNISDomainName,
+		dhcpv6.OptionNISPDomainName:
+		labels := rfc1035label.NewLabels()
+		for _, d := range strings.Split(value, ",") {
+			labels.Labels = append(labels.Labels, strings.TrimSpace(d))
+		}
+		return labels.ToBytes(), nil
+
+	case dhcpv6.OptionNewPOSIXTimezone,
+		dhcpv6.OptionBootfileURL:
+		return []byte(value), nil
+
+	case dhcpv6.OptionInformationRefreshTime:
+		answer := make([]byte, 4)
+		ival, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, err
+		}
+		binary.BigEndian.PutUint32(answer, uint32(ival))
+		return answer, nil
+	}
+
+	return nil, fmt.Errorf("Invalid DHCPv6 Option: %d %s", code, value)
+}
+
 func convertSubnetToApiSubnet(s *Subnet) *ApiSubnet {
 	apiSubnet := NewApiSubnet()
 	apiSubnet.Name = s.Name
 	apiSubnet.Subnet = s.Subnet.String()
-	apiSubnet.ActiveStart = s.ActiveStart.String()
-	apiSubnet.ActiveEnd = s.ActiveEnd.String()
+	// Stateless IPv6 subnets have no active range
+	if s.ActiveStart != nil {
+		apiSubnet.ActiveStart = s.ActiveStart.String()
+		apiSubnet.ActiveEnd = s.ActiveEnd.String()
+	}
 	apiSubnet.ActiveLeaseTime = int(s.ActiveLeaseTime.Seconds())
 	apiSubnet.ReservedLeaseTime = int(s.ReservedLeaseTime.Seconds())
+	apiSubnet.AlertThresholds = s.AlertThresholds
+	apiSubnet.ForwardZone = s.ForwardZone
+	apiSubnet.ReverseZone = s.ReverseZone
+	apiSubnet.HostnameTemplate = s.HostnameTemplate
+	apiSubnet.TftpRoot = s.TftpRoot
+	apiSubnet.BootTemplate = s.BootTemplate
+	apiSubnet.BootClassTemplates = s.BootClassTemplates
+	apiSubnet.Revision = s.Revision
 
 	if s.NextServer != nil {
 		ns := s.NextServer.String()
 		apiSubnet.NextServer = &ns
 	}
 
+	if s.DelegatedPrefix != nil {
+		apiSubnet.DelegatedPrefix = s.DelegatedPrefix.String()
+		apiSubnet.DelegatedLength = s.DelegatedLength
+	}
+
 	for _, v := range s.Leases {
 		apiSubnet.Leases = append(apiSubnet.Leases, v)
 	}
@@ -281,10 +433,14 @@ func convertSubnetToApiSubnet(s *Subnet) *ApiSubnet {
 		apiSubnet.Bindings = append(apiSubnet.Bindings, v)
 	}
 
+	for _, v := range s.Delegations {
+		apiSubnet.Delegations = append(apiSubnet.Delegations, v)
+	}
+
 	for i, v := range s.Options {
 		o := &Option{
 			Code:  i,
-			Value: convertByteToOptionValue(i, v),
+			Value: s.option_value(i, v),
 		}
 		apiSubnet.Options = append(apiSubnet.Options, o)
 	}
@@ -292,6 +448,14 @@ func convertSubnetToApiSubnet(s *Subnet) *ApiSubnet {
 	return apiSubnet
 }
 
+// option_value converts an option in the subnet's DHCP version.
+func (s *Subnet) option_value(code dhcp.OptionCode, b []byte) string {
+	if s.v6() {
+		return convertByteToOptionValue6(code, b)
+	}
+	return convertByteToOptionValue(code, b)
+}
+
 func convertApiSubnetToSubnet(as *ApiSubnet, subnet *Subnet) (*Subnet, error) {
 	if subnet == nil {
 		subnet = NewSubnet()
@@ -302,15 +466,27 @@ func convertApiSubnetToSubnet(as *ApiSubnet, subnet *Subnet) (*Subnet, error) {
 	if err != nil {
 		return nil, err
 	}
+	v6 := netdata.IP.To4() == nil
 
 	subnet.Subnet = &MyIPNet{netdata}
-	subnet.ActiveStart = net.ParseIP(as.ActiveStart).To4()
-	subnet.ActiveEnd = net.ParseIP(as.ActiveEnd).To4()
+	subnet.ActiveStart = parseFamilyIP(as.ActiveStart, v6)
+	subnet.ActiveEnd = parseFamilyIP(as.ActiveEnd, v6)
 	subnet.ActiveLeaseTime = time.Duration(as.ActiveLeaseTime) * time.Second
 	subnet.ReservedLeaseTime = time.Duration(as.ReservedLeaseTime) * time.Second
-	subnet.ActiveBits = bitset.New(uint(dhcp.IPRange(subnet.ActiveStart, subnet.ActiveEnd)))
+	subnet.AlertThresholds = as.AlertThresholds
+	subnet.ForwardZone = as.ForwardZone
+	subnet.ReverseZone = as.ReverseZone
+	subnet.HostnameTemplate = as.HostnameTemplate
+	subnet.TftpRoot = as.TftpRoot
+	subnet.BootTemplate = as.BootTemplate
+	subnet.BootClassTemplates = as.BootClassTemplates
+	subnet.Revision = as.Revision
+	subnet.ActiveBits = bitset.New(subnet.active_size())
 
 	if as.NextServer != nil {
+		if v6 {
+			return nil, errors.New("next_server is not used in IPv6 subnets")
+		}
 		ip := net.ParseIP(*as.NextServer).To4()
 		subnet.NextServer = &ip
 	}
@@ -323,45 +499,99 @@ func convertApiSubnetToSubnet(as *ApiSubnet, subnet *Subnet) (*Subnet, error) {
 	}
 
 	for _, v := range as.Leases {
-		subnet.Leases[v.Mac] = v
-		if dhcp.IPInRange(subnet.ActiveStart, subnet.ActiveEnd, v.Ip) {
-			subnet.ActiveBits.Set(uint(dhcp.IPRange(subnet.ActiveStart, v.Ip) - 1))
+		subnet.Leases[v.key()] = v
+		if bit, ok := subnet.active_bit(v.Ip); ok {
+			subnet.ActiveBits.Set(bit)
 		}
 	}
 
 	for _, v := range as.Bindings {
-		subnet.Bindings[v.Mac] = v
-		if dhcp.IPInRange(subnet.ActiveStart, subnet.ActiveEnd, v.Ip) {
-			subnet.ActiveBits.Set(uint(dhcp.IPRange(subnet.ActiveStart, v.Ip) - 1))
+		if err := subnet.check_binding(v); err != nil {
+			return nil, err
+		}
+		subnet.Bindings[v.key()] = v
+		if bit, ok := subnet.active_bit(v.Ip); ok {
+			subnet.ActiveBits.Set(bit)
+		}
+	}
+
+	if as.DelegatedPrefix != "" {
+		if err := subnet.set_delegation_pool(as.DelegatedPrefix, as.DelegatedLength); err != nil {
+			return nil, err
+		}
+		for _, v := range as.Delegations {
+			subnet.Delegations[v.key()] = v
+			if bit, ok := subnet.delegation_bit(v.Ip); ok {
+				subnet.DelegatedBits.Set(bit)
+			}
 		}
 	}
 
 	// Seed initial options
-	subnet.Options[dhcp.OptionSubnetMask] = []byte(net.IP(netdata.Mask).To4())
-	m := binary.BigEndian.Uint32(subnet.Options[dhcp.OptionSubnetMask])
-	n := binary.BigEndian.Uint32(netdata.IP)
-	b := n | ^m
-	result := make([]byte, 4)
-	binary.BigEndian.PutUint32(result, b)
-	subnet.Options[dhcp.OptionBroadcastAddress] = result
+	if !v6 {
+		subnet.Options[dhcp.OptionSubnetMask] = []byte(net.IP(netdata.Mask).To4())
+		m := binary.BigEndian.Uint32(subnet.Options[dhcp.OptionSubnetMask])
+		n := binary.BigEndian.Uint32(netdata.IP)
+		b := n | ^m
+		result := make([]byte, 4)
+		binary.BigEndian.PutUint32(result, b)
+		subnet.Options[dhcp.OptionBroadcastAddress] = result
+	}
 
 	for _, o := range as.Options {
-		subnet.Options[o.Code], err = convertOptionValueToByte(o.Code, o.Value)
+		if v6 {
+			code := optionCode6(o.Code)
+			subnet.Options[code], err = convertOptionValueToByte6(code, o.Value)
+		} else {
+			subnet.Options[o.Code], err = convertOptionValueToByte(o.Code, o.Value)
+		}
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	if !netdata.Contains(subnet.ActiveStart) {
-		return nil, errors.New("ActiveStart not in Subnet")
+	if !(v6 && as.ActiveStart == "" && as.ActiveEnd == "") {
+		if !netdata.Contains(subnet.ActiveStart) {
+			return nil, errors.New("ActiveStart not in Subnet")
+		}
+		if !netdata.Contains(subnet.ActiveEnd) {
+			return nil, errors.New("ActiveEnd not in Subnet")
+		}
+
+		if new(big.Int).Sub(ipInt(subnet.ActiveEnd), ipInt(subnet.ActiveStart)).Sign() < 0 {
+			return nil, errors.New("ActiveEnd less than ActiveStart")
+		}
+		if subnet.active_size() == 0 {
+			return nil, fmt.Errorf("Active range is larger than %d addresses", maxActiveRange)
+		}
 	}
-	if !netdata.Contains(subnet.ActiveEnd) {
-		return nil, errors.New("ActiveEnd not in Subnet")
+
+	if subnet.TftpRoot != "" && !filepath.IsAbs(subnet.TftpRoot) {
+		return nil, errors.New("TFTP root must be an absolute path")
+	}
+	if subnet.TftpRoot != "" && !tftp_enabled {
+		// Nothing would serve it.
+		return nil, errors.New("TFTP root needs the tftp root to be configured")
 	}
 
-	if dhcp.IPLess(subnet.ActiveEnd, subnet.ActiveStart) {
-		return nil, errors.New("ActiveEnd less than ActiveStart")
+	for _, t := range subnet.AlertThresholds {
+		if t <= 0 || t > 100 {
+			return nil, errors.New("Alert thresholds must be between 1 and 100")
+		}
 	}
 
 	return subnet, nil
 }
+
+// parseFamilyIP parses s as an address of the subnet's family, so an
+// IPv4 address in an IPv6 subnet fails the subnet checks.
+func parseFamilyIP(s string, v6 bool) net.IP {
+	ip := net.ParseIP(s)
+	if ip == nil || (ip.To4() == nil) != v6 {
+		return nil
+	}
+	if v6 {
+		return ip.To16()
+	}
+	return ip.To4()
+}
@@ -6,25 +6,36 @@ import (
 	"net"
 	"net/http"
 	"sync"
-
-	dhcp "github.com/krolaw/dhcp4"
+	"time"
 )
 
 type DataTracker struct {
 	sync.Mutex `json:"-"`
 	store      LoadSaver          `json:"-"`
+	alerter    *Alerter           `json:"-"` // nil disables utilization alerts
+	events     *Publisher         `json:"-"`
+	webhooks   *Webhooks          `json:"-"` // nil disables webhooks
+	ddns       *DDNSUpdater       `json:"-"` // nil disables dynamic DNS
+	failover   *Failover          `json:"-"` // nil without a failover partner
+	history    *LeaseHistory      `json:"-"` // nil disables lease history
 	Subnets    map[string]*Subnet // subnet -> SubnetData
+	Revision   uint64             // Last subnet revision handed out
 }
 
 func NewDataTracker(store LoadSaver) *DataTracker {
 	return &DataTracker{
 		Subnets: make(map[string]*Subnet),
 		store:   store,
+		events:  NewPublisher(),
 	}
 }
 
+// FindBoundIP finds the IPv4 subnet with a binding for mac.
 func (dt *DataTracker) FindBoundIP(mac net.HardwareAddr) *Subnet {
 	for _, s := range dt.Subnets {
+		if s.v6() {
+			continue
+		}
 		for _, b := range s.Bindings {
 			if b.Mac == mac.String() {
 				return s
@@ -54,8 +65,10 @@ func (dt *DataTracker) AddSubnet(s *Subnet) (error, int) {
 		return errors.New("Subnet overlaps with existing subnet"), http.StatusBadRequest
 	}
 
+	s.Revision = dt.next_revision()
 	dt.Subnets[s.Name] = s
-	dt.save_data()
+	dt.save_subnet(s.Name)
+	dt.publish(EventSubnetCreated, s.Name, nil, nil)
 	return nil, http.StatusOK
 }
 
@@ -65,7 +78,9 @@ func (dt *DataTracker) RemoveSubnet(subnetName string) (error, int) {
 		return errors.New("Not Found"), http.StatusNotFound
 	}
 	delete(dt.Subnets, subnetName)
-	dt.save_data()
+	dt.alerter.Forget(subnetName)
+	dt.save_subnet(subnetName)
+	dt.publish(EventSubnetDeleted, subnetName, nil, nil)
 	return nil, http.StatusOK
 }
 
@@ -78,9 +93,12 @@ func (dt *DataTracker) ReplaceSubnet(subnetName string, subnet *Subnet) (error,
 	// Take Leases and Bindings from old to new if nets match
 	subnet.Leases = lsubnet.Leases
 	subnet.Bindings = lsubnet.Bindings
+	subnet.Delegations = lsubnet.Delegations
 
 	// XXX: One day we should handle if active/reserved change.
 	subnet.ActiveBits = lsubnet.ActiveBits
+	subnet.DelegatedBits = lsubnet.DelegatedBits
+	subnet.Revision = dt.next_revision()
 
 	delete(dt.Subnets, lsubnet.Name)
 
@@ -92,7 +110,8 @@ func (dt *DataTracker) ReplaceSubnet(subnetName string, subnet *Subnet) (error,
 	}
 
 	dt.Subnets[subnet.Name] = subnet
-	dt.save_data()
+	dt.save_subnet(lsubnet.Name, subnet.Name)
+	dt.publish(EventSubnetUpdated, subnet.Name, nil, nil)
 	return nil, http.StatusOK
 }
 
@@ -125,6 +144,22 @@ func (ipnet *MyIPNet) UnmarshalText(text []byte) error {
 /*
  * Data storage/retrieval functions
  */
+// next_revision hands out subnet revisions from one counter for every
+// subnet, so a subnet deleted and created again never repeats a tag
+// seen before.  The counter is saved with the subnets; data saved
+// before it was starts past the highest subnet revision.
+func (dt *DataTracker) next_revision() uint64 {
+	dt.Lock()
+	defer dt.Unlock()
+	for _, s := range dt.Subnets {
+		if s.Revision > dt.Revision {
+			dt.Revision = s.Revision
+		}
+	}
+	dt.Revision++
+	return dt.Revision
+}
+
 func (dt *DataTracker) load_data() {
 	if err := dt.store.Load(dt); err != nil {
 		log.Panicf("Unable to load data from backing store: %s", err)
@@ -132,17 +167,30 @@ func (dt *DataTracker) load_data() {
 }
 
 func (dt *DataTracker) save_data() {
+	start := time.Now()
 	if err := dt.store.Save(dt); err != nil {
 		log.Panicf("Unable to save data to backing store: %s", err)
 	}
+	storeSaveDuration.Observe(time.Since(start).Seconds())
+}
+
+// save_subnet saves after a change to only the named subnets.
+func (dt *DataTracker) save_subnet(names ...string) {
+	ss, ok := dt.store.(SubnetSaver)
+	if !ok {
+		dt.save_data()
+		return
+	}
+	start := time.Now()
+	if err := ss.SaveSubnet(dt, names...); err != nil {
+		log.Panicf("Unable to save data to backing store: %s", err)
+	}
+	storeSaveDuration.Observe(time.Since(start).Seconds())
 }
 
 func (dt *DataTracker) subnetsOverlap(subnet *Subnet) bool {
 	for _, es := range dt.Subnets {
-		if es.Subnet.Contains(subnet.Subnet.IP) {
-			return true
-		}
-		if subnet.Subnet.Contains(es.Subnet.IP) {
+		if es.overlaps(subnet) {
 			return true
 		}
 	}
@@ -154,22 +202,31 @@ func (dt *DataTracker) AddBinding(subnetName string, binding Binding) (error, in
 	if lsubnet == nil {
 		return errors.New("Not Found"), http.StatusNotFound
 	}
+	if err := lsubnet.check_binding(&binding); err != nil {
+		return err, http.StatusBadRequest
+	}
 
 	// If existing, clear the reservation for IP
-	b := lsubnet.Bindings[binding.Mac]
+	b := lsubnet.Bindings[binding.key()]
 	if b != nil {
-		if dhcp.IPInRange(lsubnet.ActiveStart, lsubnet.ActiveEnd, b.Ip) {
-			lsubnet.ActiveBits.Clear(uint(dhcp.IPRange(lsubnet.ActiveStart, b.Ip) - 1))
+		if bit, ok := lsubnet.active_bit(b.Ip); ok {
+			lsubnet.ActiveBits.Clear(bit)
 		}
 	}
 
 	// Reserve the IP if in Active range
-	if dhcp.IPInRange(lsubnet.ActiveStart, lsubnet.ActiveEnd, binding.Ip) {
-		lsubnet.ActiveBits.Set(uint(dhcp.IPRange(lsubnet.ActiveStart, binding.Ip) - 1))
+	if bit, ok := lsubnet.active_bit(binding.Ip); ok {
+		lsubnet.ActiveBits.Set(bit)
 	}
 
-	lsubnet.Bindings[binding.Mac] = &binding
-	dt.save_data()
+	lsubnet.Bindings[binding.key()] = &binding
+	lsubnet.Revision = dt.next_revision()
+	dt.save_subnet(subnetName)
+	if b != nil {
+		dt.publish(EventBindingUpdated, subnetName, nil, &binding)
+	} else {
+		dt.publish(EventBindingAdded, subnetName, nil, &binding)
+	}
 	return nil, http.StatusOK
 }
 
@@ -178,18 +235,25 @@ func (dt *DataTracker) DeleteBinding(subnetName, mac string) (error, int) {
 	if lsubnet == nil {
 		return errors.New("Subnet Not Found"), http.StatusNotFound
 	}
+	if lsubnet.v6() {
+		if duid, err := parseDuid(mac); err == nil {
+			mac = duid
+		}
+	}
 
 	b := lsubnet.Bindings[mac]
 	if b == nil {
 		return errors.New("Binding Not Found"), http.StatusNotFound
 	}
 
-	if dhcp.IPInRange(lsubnet.ActiveStart, lsubnet.ActiveEnd, b.Ip) {
-		lsubnet.ActiveBits.Clear(uint(dhcp.IPRange(lsubnet.ActiveStart, b.Ip) - 1))
+	if bit, ok := lsubnet.active_bit(b.Ip); ok {
+		lsubnet.ActiveBits.Clear(bit)
 	}
 
 	delete(lsubnet.Bindings, mac)
-	dt.save_data()
+	lsubnet.Revision = dt.next_revision()
+	dt.save_subnet(subnetName)
+	dt.publish(EventBindingRemoved, subnetName, nil, b)
 	return nil, http.StatusOK
 }
 
@@ -199,16 +263,20 @@ func (dt *DataTracker) SetNextServer(subnetName string, ip net.IP, nextServer Ne
 		return errors.New("Not Found"), http.StatusNotFound
 	}
 
-	save_me := false
+	updated := make([]*Binding, 0)
 	for _, v := range lsubnet.Bindings {
 		if v.Ip.Equal(ip) && (v.NextServer == nil || *v.NextServer != nextServer.Server) {
-			save_me = true
+			updated = append(updated, v)
 			v.NextServer = &nextServer.Server
 		}
 	}
 
-	if save_me {
-		dt.save_data()
+	if len(updated) > 0 {
+		lsubnet.Revision = dt.next_revision()
+		dt.save_subnet(subnetName)
+	}
+	for _, v := range updated {
+		dt.publish(EventBindingUpdated, subnetName, nil, v)
 	}
 
 	return nil, http.StatusOK
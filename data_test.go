@@ -1,9 +1,11 @@
 package main
 
 import (
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
+	"path/filepath"
 	"testing"
 
 	dhcp "github.com/krolaw/dhcp4"
@@ -37,6 +39,20 @@ func simpleSetup() (dt *DataTracker, s *Subnet) {
 	return
 }
 
+// tempSetup is simpleSetup saving to a copy of the fixture, for tests
+// that leave leases or bindings behind.
+func tempSetup(t *testing.T) (dt *DataTracker, s *Subnet) {
+	data, err := ioutil.ReadFile("./database.test.json")
+	assert.Nil(t, err)
+	path := filepath.Join(t.TempDir(), "database.json")
+	assert.Nil(t, ioutil.WriteFile(path, data, 0600))
+	store, err := NewFileStore(path)
+	assert.Nil(t, err)
+	dt = NewDataTracker(store)
+	s, _, _ = addNewSubnet(dt, "fred", "192.168.128.0/24")
+	return
+}
+
 func TestAddSubnet(t *testing.T) {
 	dt, s := simpleSetup()
 
@@ -382,3 +398,23 @@ func TestSetNextServer(t *testing.T) {
 	assert.Nil(t, err, "Error should be nil")
 	assert.Equal(t, *b.NextServer, "1.1.1.1", "Next server should be 1.1.1.1, but is %s", b.NextServer)
 }
+
+func TestSubnetRevision(t *testing.T) {
+	dt, s := simpleSetup()
+	assert.Equal(t, uint64(1), s.Revision)
+
+	b := NewBinding()
+	b.Mac = "macit"
+	b.Ip = net.ParseIP("192.168.128.10")
+	dt.AddBinding("fred", *b)
+	dt.SetNextServer("fred", b.Ip, NextServer{Server: "1.1.1.1"})
+	dt.SetNextServer("fred", b.Ip, NextServer{Server: "1.1.1.1"})
+	assert.Equal(t, uint64(3), s.Revision, "an unchanged next server is not a change")
+
+	ns := newSubnet(dt, "fred", "192.168.128.0/24")
+	ns.Revision = 99
+	dt.ReplaceSubnet("fred", ns)
+	assert.Equal(t, uint64(4), ns.Revision)
+	dt.DeleteBinding("fred", "macit")
+	assert.Equal(t, uint64(5), ns.Revision)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+/*
+ * Dynamic DNS (RFC 2136)
+ *
+ * When a lease becomes bound an A (or, for DHCPv6, AAAA) record is
+ * added in the subnet's forward zone and a PTR in its reverse zone.
+ * Released, declined and expired leases have theirs removed.  Updates
+ * run on their own goroutine so a slow DNS server never holds up DHCP.
+ */
+
+type DDNSUpdater struct {
+	dt       *DataTracker
+	server   string // host:port
+	tsigName string // Empty disables TSIG
+	tsigAlgo string
+	ttl      uint32
+	client   *dns.Client
+	queue    chan *Event
+}
+
+func NewDDNSUpdater(dt *DataTracker, server, tsigName, tsigSecret, tsigAlgo string, ttl int) *DDNSUpdater {
+	u := &DDNSUpdater{
+		dt:     dt,
+		server: server,
+		ttl:    uint32(ttl),
+		client: &dns.Client{Timeout: 5 * time.Second},
+		queue:  make(chan *Event, 256),
+	}
+	if tsigName != "" {
+		u.tsigName = dns.Fqdn(tsigName)
+		u.tsigAlgo = dns.Fqdn(tsigAlgo)
+		u.client.TsigSecret = map[string]string{u.tsigName: tsigSecret}
+	}
+	return u
+}
+
+// Handle queues the DNS work for a lease event.  It never blocks.
+func (u *DDNSUpdater) Handle(e *Event) {
+	if u == nil || e.Lease == nil {
+		return
+	}
+	switch e.Type {
+	case EventLeaseBound, EventLeaseReleased, EventLeaseDeclined, EventLeaseExpired:
+	default:
+		return
+	}
+	select {
+	case u.queue <- e:
+	default:
+		log.Println("DDNS queue full, dropping update for ", e.Mac)
+	}
+}
+
+func (u *DDNSUpdater) Run() {
+	for e := range u.queue {
+		if err := u.process(e); err != nil {
+			log.Println("DDNS update for ", e.Mac, " failed: ", err)
+		}
+	}
+}
+
+func (u *DDNSUpdater) process(e *Event) error {
+	subnet := u.dt.Subnets[e.Subnet]
+	if subnet == nil {
+		return nil
+	}
+	ip := e.Lease.Ip
+	if ip == nil {
+		return nil
+	}
+
+	subnet.lock.RLock()
+	binding := subnet.Bindings[e.Lease.key()]
+	subnet.lock.RUnlock()
+	_, assigned := subnet.hostname_for(e.Lease, binding)
+	forward, reverse, _ := ddns_policy(e.Lease, assigned)
+
+	if forward && subnet.ForwardZone != "" {
+		if fqdn := u.fqdn(subnet, e.Lease); fqdn != "" {
+			a := u.address_rr(fqdn, ip)
+			var err error
+			if e.Type == EventLeaseBound {
+				err = u.update(subnet.ForwardZone, []dns.RR{a}, nil)
+			} else {
+				err = u.update(subnet.ForwardZone, nil, []dns.RR{a})
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if reverse && subnet.ReverseZone != "" {
+		rev, err := dns.ReverseAddr(ip.String())
+		if err != nil {
+			return err
+		}
+		if e.Type == EventLeaseBound {
+			fqdn := u.fqdn(subnet, e.Lease)
+			if fqdn == "" {
+				return nil
+			}
+			ptr := &dns.PTR{
+				Hdr: dns.RR_Header{Name: rev, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: u.ttl},
+				Ptr: fqdn,
+			}
+			return u.update(subnet.ReverseZone, []dns.RR{ptr}, nil)
+		}
+		// Whatever the name was, the address is no longer in use.
+		m := u.message(subnet.ReverseZone)
+		m.RemoveRRset([]dns.RR{&dns.PTR{Hdr: dns.RR_Header{Name: rev, Rrtype: dns.TypePTR, Class: dns.ClassINET}}})
+		return u.send(m)
+	}
+	return nil
+}
+
+func (u *DDNSUpdater) address_rr(fqdn string, ip net.IP) dns.RR {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &dns.A{
+			Hdr: dns.RR_Header{Name: fqdn, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: u.ttl},
+			A:   ip4,
+		}
+	}
+	return &dns.AAAA{
+		Hdr:  dns.RR_Header{Name: fqdn, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: u.ttl},
+		AAAA: ip,
+	}
+}
+
+// fqdn is the lease's name (see hostname_for) in the forward zone.
+func (u *DDNSUpdater) fqdn(subnet *Subnet, lease *Lease) string {
+	subnet.lock.RLock()
+	binding := subnet.Bindings[lease.key()]
+	subnet.lock.RUnlock()
+	name, _ := subnet.hostname_for(lease, binding)
+	if name == "" || subnet.ForwardZone == "" {
+		return ""
+	}
+	return dns.Fqdn(subnet.qualify(name))
+}
+
+func (u *DDNSUpdater) message(zone string) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetUpdate(dns.Fqdn(zone))
+	return m
+}
+
+// update replaces the RRsets of insert and deletes the RRs in remove.
+func (u *DDNSUpdater) update(zone string, insert, remove []dns.RR) error {
+	m := u.message(zone)
+	if len(insert) > 0 {
+		m.RemoveRRset(insert)
+		m.Insert(insert)
+	}
+	if len(remove) > 0 {
+		m.Remove(remove)
+	}
+	return u.send(m)
+}
+
+func (u *DDNSUpdater) send(m *dns.Msg) error {
+	if u.tsigName != "" {
+		m.SetTsig(u.tsigName, u.tsigAlgo, 300, time.Now().Unix())
+	}
+	r, _, err := u.client.Exchange(m, u.server)
+	if err != nil {
+		return err
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("%s rejected update for %s: %s", u.server, m.Question[0].Name, dns.RcodeToString[r.Rcode])
+	}
+	return nil
+}
+
+// ddnsServer adds the default port to a configured server address.
+func ddnsServer(server string) string {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		return net.JoinHostPort(server, "53")
+	}
+	return server
+}
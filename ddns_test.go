@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	dhcp "github.com/krolaw/dhcp4"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+const testTsigSecret = "c2Vrcml0c2Vrcml0c2Vrcml0"
+
+// dnsUpdateServer runs an in-process DNS server that accepts TSIG
+// signed updates and passes each update section on.
+func dnsUpdateServer(t *testing.T) (string, chan []dns.RR, func()) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	updates := make(chan []dns.RR, 10)
+	started := make(chan struct{})
+	server := &dns.Server{
+		PacketConn:        pc,
+		TsigSecret:        map[string]string{"dhcp.": testTsigSecret},
+		NotifyStartedFunc: func() { close(started) },
+		MsgAcceptFunc: func(dh dns.Header) dns.MsgAcceptAction {
+			return dns.MsgAccept
+		},
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(r)
+			if r.IsTsig() == nil || w.TsigStatus() != nil {
+				m.Rcode = dns.RcodeRefused
+			} else {
+				updates <- r.Ns
+				m.SetTsig("dhcp.", dns.HmacSHA256, 300, time.Now().Unix())
+			}
+			w.WriteMsg(m)
+		}),
+	}
+	go server.ActivateAndServe()
+	<-started
+	return pc.LocalAddr().String(), updates, func() { server.Shutdown() }
+}
+
+func waitUpdate(t *testing.T, updates chan []dns.RR) []dns.RR {
+	select {
+	case rrs := <-updates:
+		return rrs
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for DNS update")
+	}
+	return nil
+}
+
+func ddnsSetup(t *testing.T, secret string) (*DataTracker, *Subnet, chan []dns.RR, func()) {
+	addr, updates, stop := dnsUpdateServer(t)
+	dt, s := simpleSetup()
+	s.ForwardZone = "lab.example.com"
+	s.ReverseZone = "128.168.192.in-addr.arpa"
+	dt.ddns = NewDDNSUpdater(dt, addr, "dhcp", secret, "hmac-sha256", 60)
+	go dt.ddns.Run()
+	return dt, s, updates, stop
+}
+
+func TestDDNSBindAndRelease(t *testing.T) {
+	dt, s, updates, stop := ddnsSetup(t, testTsigSecret)
+	defer stop()
+
+	lease := &Lease{Ip: net.ParseIP("192.168.128.7").To4(), Mac: "aa", Hostname: "node1"}
+	s.Leases["aa"] = lease
+	s.update_lease_time(dt, lease, time.Hour)
+
+	rrs := waitUpdate(t, updates)
+	assert.Equal(t, 2, len(rrs))
+	assert.Equal(t, uint16(dns.ClassANY), rrs[0].Header().Class, "Old A RRset is removed")
+	a := rrs[1].(*dns.A)
+	assert.Equal(t, "node1.lab.example.com.", a.Hdr.Name)
+	assert.Equal(t, "192.168.128.7", a.A.String())
+	assert.Equal(t, uint32(60), a.Hdr.Ttl)
+
+	rrs = waitUpdate(t, updates)
+	ptr := rrs[1].(*dns.PTR)
+	assert.Equal(t, "7.128.168.192.in-addr.arpa.", ptr.Hdr.Name)
+	assert.Equal(t, "node1.lab.example.com.", ptr.Ptr)
+
+	s.free_lease(dt, "aa", EventLeaseReleased)
+
+	rrs = waitUpdate(t, updates)
+	assert.Equal(t, 1, len(rrs))
+	assert.Equal(t, uint16(dns.ClassNONE), rrs[0].Header().Class, "Only this A record is removed")
+	rrs = waitUpdate(t, updates)
+	assert.Equal(t, uint16(dns.ClassANY), rrs[0].Header().Class)
+	assert.Equal(t, "7.128.168.192.in-addr.arpa.", rrs[0].Header().Name)
+}
+
+func TestDDNSBindingNameWins(t *testing.T) {
+	dt, s, _, stop := ddnsSetup(t, testTsigSecret)
+	defer stop()
+
+	s.Bindings["aa"] = &Binding{Mac: "aa", Options: []*Option{{Code: dhcp.OptionHostName, Value: "Server7"}}}
+	lease := &Lease{Mac: "aa", Hostname: "client-chosen"}
+	assert.Equal(t, "server7.lab.example.com.", dt.ddns.fqdn(s, lease))
+
+	delete(s.Bindings, "aa")
+	assert.Equal(t, "client-chosen.lab.example.com.", dt.ddns.fqdn(s, lease))
+
+	lease.Hostname = "db.lab.example.com."
+	assert.Equal(t, "db.lab.example.com.", dt.ddns.fqdn(s, lease))
+
+	lease.Hostname = "db.elsewhere.org"
+	assert.Equal(t, "db.lab.example.com.", dt.ddns.fqdn(s, lease))
+
+	lease.Hostname = ""
+	assert.Equal(t, "", dt.ddns.fqdn(s, lease))
+}
+
+func TestDDNSBadTsigRejected(t *testing.T) {
+	dt, s, _, stop := ddnsSetup(t, "d3Jvbmd3cm9uZw==")
+	defer stop()
+
+	lease := &Lease{Ip: net.ParseIP("192.168.128.7").To4(), Mac: "aa", Hostname: "node1"}
+	s.Leases["aa"] = lease
+	err := dt.ddns.process(&Event{Type: EventLeaseBound, Subnet: s.Name, Lease: lease})
+	assert.NotNil(t, err)
+}
+
+func TestDDNSServer(t *testing.T) {
+	assert.Equal(t, "10.0.0.1:53", ddnsServer("10.0.0.1"))
+	assert.Equal(t, "10.0.0.1:5353", ddnsServer("10.0.0.1:5353"))
+	assert.Equal(t, "[fd00::1]:53", ddnsServer("fd00::1"))
+}
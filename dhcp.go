@@ -2,6 +2,7 @@
 package main
 
 import (
+	"bytes"
 	"log"
 	"net"
 	"strings"
@@ -9,6 +10,11 @@ import (
 	dhcp "github.com/krolaw/dhcp4"
 )
 
+// Options the dhcp4 library has no name for
+const (
+	OptionClientFQDN dhcp.OptionCode = 81 // RFC 4702
+)
+
 func RunDhcpHandler(dhcpInfo *DataTracker, intf net.Interface, myIp string) {
 	log.Println("Starting on interface: ", intf.Name, " with server ip: ", myIp)
 
@@ -16,18 +22,51 @@ func RunDhcpHandler(dhcpInfo *DataTracker, intf net.Interface, myIp string) {
 	serverIP = serverIP.To4()
 	handler := &DHCPHandler{
 		ip:   serverIP,
+		port: dhcpServerPort,
 		intf: intf,
 		info: dhcpInfo,
 	}
+	if proxy_dhcp != nil {
+		go runProxyPort(intf, handler)
+	}
 	log.Fatal(dhcp.ListenAndServeIf(intf.Name, handler))
 }
 
-func StartDhcpHandlers(dhcpInfo *DataTracker, serverIp string) error {
+func StartDhcpHandlers(dhcpInfo *DataTracker, serverIp, serverIp6 string, intfCfgs map[string]*InterfaceConfig) error {
 	intfs, err := net.Interfaces()
 	if err != nil {
 		return err
 	}
+
+	// Explicitly configured interfaces replace the first-match search.
+	if len(intfCfgs) > 0 {
+		found := make(map[string]bool)
+		for _, intf := range intfs {
+			ic := intfCfgs[intf.Name]
+			if ic == nil || ic.Disabled {
+				continue
+			}
+			found[intf.Name] = true
+			if ic.ServerIp != "" {
+				go RunDhcpHandler(dhcpInfo, intf, ic.ServerIp)
+			}
+			if ic.ServerIp6 != "" {
+				go RunDhcp6Handler(dhcpInfo, intf, ic.ServerIp6)
+			}
+		}
+		for name, ic := range intfCfgs {
+			if !ic.Disabled && !found[name] {
+				log.Println("Configured interface ", name, " not found, skipping")
+			}
+		}
+		return nil
+	}
+
+	started4, started6 := serverIp == "", serverIp6 == ""
 	for _, intf := range intfs {
+		if started4 && started6 {
+			break
+		}
 		if (intf.Flags & net.FlagLoopback) == net.FlagLoopback {
 			continue
 		}
@@ -37,7 +76,6 @@ func StartDhcpHandlers(dhcpInfo *DataTracker, serverIp string) error {
 		if strings.HasPrefix(intf.Name, "veth") {
 			continue
 		}
-		var sip string
 		addrs, err := intf.Addrs()
 		if err != nil {
 			return err
@@ -49,23 +87,17 @@ func StartDhcpHandlers(dhcpInfo *DataTracker, serverIp string) error {
 			if !thisIP.IsGlobalUnicast() {
 				continue
 			}
-			// Only deal with IPv4 for now.
-			if thisIP.To4() == nil {
-				continue
-			}
 
-			if serverIp != "" && serverIp == addr.String() {
-				sip = addr.String()
-				break
+			// Only run the first one that matches, for each family
+			if !started4 && serverIp == addr.String() {
+				started4 = true
+				go RunDhcpHandler(dhcpInfo, intf, serverIp)
+			}
+			if !started6 && serverIp6 == addr.String() {
+				started6 = true
+				go RunDhcp6Handler(dhcpInfo, intf, serverIp6)
 			}
 		}
-
-		if sip == "" {
-			continue
-		}
-		// Only run the first one that matches
-		go RunDhcpHandler(dhcpInfo, intf, sip)
-		break
 	}
 	return nil
 }
@@ -73,10 +105,21 @@ func StartDhcpHandlers(dhcpInfo *DataTracker, serverIp string) error {
 type DHCPHandler struct {
 	intf net.Interface // Interface processing on.
 	ip   net.IP        // Server IP to use
+	port int           // Port listened on
 	info *DataTracker  // Subnet data
 }
 
 func (h *DHCPHandler) ServeDHCP(p dhcp.Packet, msgType dhcp.MessageType, options dhcp.Options) (d dhcp.Packet) {
+	subnetName := ""
+	dropReason := dropNoReply
+	defer func() {
+		recordPacket(h.intf.Name, subnetName, msgType, d, dropReason)
+	}()
+
+	if proxy_dhcp != nil {
+		d, subnetName, dropReason = h.serveProxy(h.port, p, msgType, options)
+		return d
+	}
 
 	// First find the subnet to use. giaddr field to lookup subnet if not all zeros.
 	// If all zeros, use the interfaces Addrs to find a subnet, first wins.
@@ -123,16 +166,24 @@ func (h *DHCPHandler) ServeDHCP(p dhcp.Packet, msgType dhcp.MessageType, options
 
 	if subnet == nil {
 		log.Println("Can not find subnet for packet, ignoring")
+		dropReason = dropNoSubnet
 		return
 	}
+	subnetName = subnet.Name
 
 	nic := p.CHAddr().String()
+	prl := options[dhcp.OptionParameterRequestList]
 	switch msgType {
 
 	case dhcp.Discover:
+		if !h.info.failover.serves(client_id(p, options)) {
+			dropReason = dropBalanced
+			return nil
+		}
 		lease, binding := subnet.find_or_get_info(h.info, nic, p.CIAddr())
 		if lease == nil {
 			log.Println("Out of IPs for ", subnet.Name, ", ignoring")
+			dropReason = dropOutOfIPs
 			return nil
 		}
 		// Ignore unknown MAC address
@@ -140,22 +191,35 @@ func (h *DHCPHandler) ServeDHCP(p dhcp.Packet, msgType dhcp.MessageType, options
 			log.Println("Ignoring request from unknown MAC address")
 			return dhcp.ReplyPacket(p, dhcp.NAK, h.ip, nil, 0, nil)
 		}
+		subnet.record_client(lease, options, relayInfo4(p, options))
 
-		options, lease_time := subnet.build_options(lease, binding)
+		opts, lease_time := subnet.build_options(lease, binding)
 
 		reply := dhcp.ReplyPacket(p, dhcp.Offer,
 			h.ip,
 			lease.Ip,
 			lease_time,
-			subnet.Options.SelectOrderOrAll(options[dhcp.OptionParameterRequestList]))
+			select_options(opts, prl))
+		if ns := h.next_server(subnet, binding); ns != nil {
+			reply.SetSIAddr(ns)
+		}
+		h.info.publish(EventLeaseOffered, subnet.Name, lease, nil)
 		log.Println("Discover: Handing out: ", reply.YIAddr(), " to ", reply.CHAddr())
 		return reply
 
 	case dhcp.Request:
 		server, ok := options[dhcp.OptionServerIdentifier]
 		if ok && !net.IP(server).Equal(h.ip) {
+			dropReason = dropNotForUs
 			return nil // Message not for this dhcp server
 		}
+		// A rebooting client (no server id or ciaddr) is answered by
+		// the failover server that would have made its offer.
+		if !ok && net.IP(p.CIAddr()).Equal(net.IPv4zero) &&
+			!h.info.failover.serves(client_id(p, options)) {
+			dropReason = dropBalanced
+			return nil
+		}
 		reqIP := net.IP(options[dhcp.OptionRequestedIPAddress])
 		if reqIP == nil {
 			reqIP = net.IP(p.CIAddr())
@@ -175,7 +239,9 @@ func (h *DHCPHandler) ServeDHCP(p dhcp.Packet, msgType dhcp.MessageType, options
 			return dhcp.ReplyPacket(p, dhcp.NAK, h.ip, nil, 0, nil)
 		}
 
-		options, lease_time := subnet.build_options(lease, binding)
+		subnet.record_client(lease, options, relayInfo4(p, options))
+
+		opts, lease_time := subnet.build_options(lease, binding)
 
 		subnet.update_lease_time(h.info, lease, lease_time)
 
@@ -183,18 +249,65 @@ func (h *DHCPHandler) ServeDHCP(p dhcp.Packet, msgType dhcp.MessageType, options
 			h.ip,
 			lease.Ip,
 			lease_time,
-			subnet.Options.SelectOrderOrAll(options[dhcp.OptionParameterRequestList]))
-		if binding != nil && binding.NextServer != nil {
-			reply.SetSIAddr(net.ParseIP(*binding.NextServer))
-		} else if subnet.NextServer != nil {
-			reply.SetSIAddr(*subnet.NextServer)
+			select_options(opts, prl))
+		if ns := h.next_server(subnet, binding); ns != nil {
+			reply.SetSIAddr(ns)
 		}
 		log.Println("Request: Handing out: ", reply.YIAddr(), " to ", reply.CHAddr())
 		return reply
 
 	case dhcp.Release, dhcp.Decline:
 		nic := p.CHAddr().String()
-		subnet.free_lease(h.info, nic)
+		if msgType == dhcp.Release {
+			subnet.free_lease(h.info, nic, EventLeaseReleased)
+		} else {
+			subnet.free_lease(h.info, nic, EventLeaseDeclined)
+		}
+
+	default:
+		dropReason = dropUnhandled
 	}
 	return nil
 }
+
+// next_server is the binding's next server, then the subnet's.  With
+// the built-in TFTP server running it defaults to this interface.
+func (h *DHCPHandler) next_server(subnet *Subnet, binding *Binding) net.IP {
+	if binding != nil && binding.NextServer != nil {
+		return net.ParseIP(*binding.NextServer)
+	}
+	if subnet.NextServer != nil {
+		return *subnet.NextServer
+	}
+	if tftp_enabled {
+		return h.ip
+	}
+	return nil
+}
+
+// client_id is what failover load balancing hashes: the client
+// identifier if the client sent one, else its hardware address.
+func client_id(p dhcp.Packet, options dhcp.Options) []byte {
+	if id, ok := options[dhcp.OptionClientIdentifier]; ok {
+		return id
+	}
+	return p.CHAddr()
+}
+
+// select_options orders opts by the client's parameter request list.
+// The Client FQDN option is an answer to the client's own option 81,
+// so it is sent whether requested or not.
+func select_options(opts dhcp.Options, prl []byte) []dhcp.Option {
+	selected := opts.SelectOrderOrAll(prl)
+	if prl == nil {
+		return selected
+	}
+	for _, code := range []dhcp.OptionCode{dhcp.OptionHostName, OptionClientFQDN} {
+		v, ok := opts[code]
+		if !ok || bytes.IndexByte(prl, byte(code)) >= 0 {
+			continue
+		}
+		selected = append(selected, dhcp.Option{Code: code, Value: v})
+	}
+	return selected
+}
@@ -0,0 +1,525 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"log"
+	"math/big"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/dhcpv6/server6"
+	"github.com/insomniacslk/dhcp/iana"
+	"github.com/willf/bitset"
+)
+
+/*
+ * DHCPv6 server (RFC 8415)
+ *
+ * IPv6 subnets hand out addresses (IA_NA) from the active range and
+ * prefixes (IA_PD) from the subnet's delegated_prefix.  Clients are
+ * known by DUID: leases, delegations and bindings are filed under it.
+ * A relayed message picks its subnet by the link address of the relay
+ * next to the client, as giaddr does for DHCPv4.
+ *
+ * Information-Request gets the subnet's options in any subnet.  In a
+ * stateless one, without an active range, that is all its SLAAC hosts
+ * need.
+ */
+
+// maxDelegationBits bounds the prefixes a delegation pool tracks.
+const maxDelegationBits = 24
+
+// parseDuid accepts a DUID as hex, with or without separators, and
+// returns it in the form leases and bindings are filed under.
+func parseDuid(s string) (string, error) {
+	h := strings.NewReplacer(":", "", "-", "").Replace(s)
+	b, err := hex.DecodeString(h)
+	// Two bytes of type and at most 128 of identifier
+	if err != nil || len(b) < 3 || len(b) > 130 {
+		return "", errors.New("Invalid DUID: " + s)
+	}
+	return duidString(b), nil
+}
+
+func duidString(b []byte) string {
+	return net.HardwareAddr(b).String()
+}
+
+// duidMac is the link layer address in a DUID-LLT or DUID-LL.
+func duidMac(d dhcpv6.DUID) string {
+	switch d := d.(type) {
+	case *dhcpv6.DUIDLLT:
+		return d.LinkLayerAddr.String()
+	case *dhcpv6.DUIDLL:
+		return d.LinkLayerAddr.String()
+	}
+	return ""
+}
+
+func RunDhcp6Handler(dhcpInfo *DataTracker, intf net.Interface, myIp string) {
+	log.Println("Starting DHCPv6 on interface: ", intf.Name, " with server ip: ", myIp)
+
+	serverIP, _, _ := net.ParseCIDR(myIp)
+	handler := NewDHCPv6Handler(dhcpInfo, intf, serverIP)
+	if ra_settings != nil {
+		go func() {
+			ra := NewRouterAdvertiser(dhcpInfo, intf, serverIP, *ra_settings)
+			log.Println("RA: ", intf.Name, ": ", ra.Run())
+		}()
+	}
+	server, err := server6.NewServer(intf.Name, nil, handler.handle)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Fatal(server.Serve())
+}
+
+type DHCPv6Handler struct {
+	intf net.Interface // Interface processing on.
+	ip   net.IP        // Server IP, finds the subnet of local clients
+	duid dhcpv6.DUID   // Server identifier
+	info *DataTracker  // Subnet data
+}
+
+// NewDHCPv6Handler identifies the server by the interface's MAC, so the
+// DUID stays the same across restarts without being stored.
+func NewDHCPv6Handler(dhcpInfo *DataTracker, intf net.Interface, ip net.IP) *DHCPv6Handler {
+	return &DHCPv6Handler{
+		intf: intf,
+		ip:   ip,
+		duid: &dhcpv6.DUIDLL{HWType: iana.HWTypeEthernet, LinkLayerAddr: intf.HardwareAddr},
+		info: dhcpInfo,
+	}
+}
+
+func (h *DHCPv6Handler) handle(conn net.PacketConn, peer net.Addr, req dhcpv6.DHCPv6) {
+	reply := h.ServeDHCPv6(req)
+	if reply == nil {
+		return
+	}
+	if _, err := conn.WriteTo(reply.ToBytes(), peer); err != nil {
+		log.Println("DHCPv6: reply to ", peer, " failed: ", err)
+	}
+}
+
+func (h *DHCPv6Handler) ServeDHCPv6(req dhcpv6.DHCPv6) (d dhcpv6.DHCPv6) {
+	subnetName := ""
+	dropReason := dropNoReply
+	msgType := dhcpv6.MessageTypeNone
+	defer func() {
+		recordPacket6(h.intf.Name, subnetName, msgType, d, dropReason)
+	}()
+
+	msg, err := req.GetInnerMessage()
+	if err != nil {
+		log.Println("DHCPv6: ignoring malformed message: ", err)
+		return nil
+	}
+	msgType = msg.MessageType
+
+	link := h.ip
+	if req.IsRelay() {
+		inner, err := dhcpv6.DecapsulateRelayIndex(req, -1)
+		if err != nil {
+			return nil
+		}
+		if r, ok := inner.(*dhcpv6.RelayMessage); ok && !r.LinkAddr.IsUnspecified() {
+			link = r.LinkAddr
+		}
+	}
+	subnet := h.info.FindSubnet(link)
+	if subnet == nil || !subnet.v6() {
+		log.Println("Can not find IPv6 subnet for ", link, ", ignoring")
+		dropReason = dropNoSubnet
+		return nil
+	}
+	subnetName = subnet.Name
+
+	reply, reason := h.serve_message(subnet, msg, relayInfo6(req))
+	if reply == nil {
+		dropReason = reason
+		return nil
+	}
+	if !req.IsRelay() {
+		return reply
+	}
+	d, err = dhcpv6.NewRelayReplFromRelayForw(req.(*dhcpv6.RelayMessage), reply)
+	if err != nil {
+		log.Println("DHCPv6: can not relay reply: ", err)
+		return nil
+	}
+	return d
+}
+
+// serve_message answers a client message, or returns why it didn't.
+func (h *DHCPv6Handler) serve_message(subnet *Subnet, msg *dhcpv6.Message, ri relayInfo) (*dhcpv6.Message, string) {
+	// Only Information-Request may leave out the client id.
+	cid := msg.Options.ClientID()
+	duid := ""
+	if cid != nil {
+		duid = duidString(cid.ToBytes())
+	} else if msg.MessageType != dhcpv6.MessageTypeInformationRequest {
+		return nil, dropNoReply
+	}
+
+	sid := msg.Options.ServerID()
+	switch msg.MessageType {
+	case dhcpv6.MessageTypeRequest, dhcpv6.MessageTypeRenew,
+		dhcpv6.MessageTypeRelease, dhcpv6.MessageTypeDecline:
+		if sid == nil {
+			return nil, dropNotForUs
+		}
+	}
+	if sid != nil && !bytes.Equal(sid.ToBytes(), h.duid.ToBytes()) {
+		return nil, dropNotForUs // Message not for this dhcp server
+	}
+
+	subnet.lock.RLock()
+	binding := subnet.Bindings[duid]
+	subnet.lock.RUnlock()
+	// Ignore unknown DUIDs
+	if ignore_anonymus && binding == nil {
+		log.Println("Ignoring request from unknown DUID ", duid)
+		return nil, dropNoReply
+	}
+
+	reply := &dhcpv6.Message{
+		MessageType:   dhcpv6.MessageTypeReply,
+		TransactionID: msg.TransactionID,
+	}
+	if cid != nil {
+		reply.AddOption(dhcpv6.OptClientID(cid))
+	}
+	reply.AddOption(dhcpv6.OptServerID(h.duid))
+
+	switch msg.MessageType {
+	case dhcpv6.MessageTypeSolicit:
+		if !h.info.failover.serves(cid.ToBytes()) {
+			return nil, dropBalanced
+		}
+		commit := msg.GetOneOption(dhcpv6.OptionRapidCommit) != nil
+		if commit {
+			dhcpv6.WithRapidCommit(reply)
+		} else {
+			reply.MessageType = dhcpv6.MessageTypeAdvertise
+		}
+		h.assign(subnet, msg, reply, duidMac(cid), ri, true, commit)
+
+	case dhcpv6.MessageTypeRequest:
+		h.assign(subnet, msg, reply, duidMac(cid), ri, true, true)
+
+	case dhcpv6.MessageTypeRenew, dhcpv6.MessageTypeRebind:
+		if !h.assign(subnet, msg, reply, duidMac(cid), ri, false, true) &&
+			msg.MessageType == dhcpv6.MessageTypeRebind {
+			// Another server may know the client.
+			return nil, dropNoReply
+		}
+
+	case dhcpv6.MessageTypeConfirm:
+		addrs := make([]net.IP, 0)
+		for _, ia := range msg.Options.IANA() {
+			for _, a := range ia.Options.Addresses() {
+				addrs = append(addrs, a.IPv6Addr)
+			}
+		}
+		if len(addrs) == 0 {
+			return nil, dropNoReply
+		}
+		status := iana.StatusSuccess
+		for _, a := range addrs {
+			if !subnet.Subnet.Contains(a) {
+				status = iana.StatusNotOnLink
+			}
+		}
+		reply.AddOption(&dhcpv6.OptStatusCode{StatusCode: status, StatusMessage: status.String()})
+		return reply, ""
+
+	case dhcpv6.MessageTypeInformationRequest:
+		// Options only, added below.
+
+	case dhcpv6.MessageTypeRelease, dhcpv6.MessageTypeDecline:
+		eventType := EventLeaseReleased
+		if msg.MessageType == dhcpv6.MessageTypeDecline {
+			eventType = EventLeaseDeclined
+		}
+		subnet.free_lease(h.info, duid, eventType)
+		if msg.MessageType == dhcpv6.MessageTypeRelease {
+			subnet.free_prefix(h.info, duid, EventPrefixReleased)
+		}
+		reply.AddOption(&dhcpv6.OptStatusCode{StatusCode: iana.StatusSuccess, StatusMessage: "Released"})
+		return reply, ""
+
+	default:
+		return nil, dropUnhandled
+	}
+
+	for _, o := range subnet.options6(msg.Options.RequestedOptions(), binding) {
+		reply.AddOption(o)
+	}
+	return reply, ""
+}
+
+// assign answers the client's IA_NA and IA_PD options.  Only the first
+// of each gets an address or prefix, which is all clients ask for in
+// practice.  With allocate false only existing leases are renewed, and
+// commit extends them.  It reports whether anything was found.
+func (h *DHCPv6Handler) assign(subnet *Subnet, msg, reply *dhcpv6.Message, mac string, ri relayInfo, allocate, commit bool) bool {
+	cid := msg.Options.ClientID()
+	duid := duidString(cid.ToBytes())
+	found := false
+
+	for i, ia := range msg.Options.IANA() {
+		out := &dhcpv6.OptIANA{IaId: ia.IaId}
+		var lease *Lease
+		var binding *Binding
+		if i == 0 {
+			if allocate {
+				lease, binding = subnet.find_or_get_info(h.info, duid, nil)
+			} else {
+				lease, binding = subnet.find_info(h.info, duid)
+			}
+		}
+		if lease == nil {
+			status := iana.StatusNoAddrsAvail
+			if !allocate {
+				status = iana.StatusNoBinding
+			}
+			out.Options.Add(&dhcpv6.OptStatusCode{StatusCode: status, StatusMessage: status.String()})
+			reply.AddOption(out)
+			continue
+		}
+		found = true
+		subnet.lock.Lock()
+		lease.Mac = mac
+		lease.Iaid = binary.BigEndian.Uint32(ia.IaId[:])
+		lease.record_relay(ri)
+		subnet.lock.Unlock()
+		lt := subnet.lease_time(binding)
+		out.T1, out.T2 = lt/2, lt*4/5
+		out.Options.Add(&dhcpv6.OptIAAddress{IPv6Addr: lease.Ip, PreferredLifetime: lt, ValidLifetime: lt})
+		// Anything else the client holds is no longer valid.
+		for _, a := range ia.Options.Addresses() {
+			if !a.IPv6Addr.Equal(lease.Ip) {
+				out.Options.Add(&dhcpv6.OptIAAddress{IPv6Addr: a.IPv6Addr})
+			}
+		}
+		reply.AddOption(out)
+
+		if commit {
+			subnet.update_lease_time(h.info, lease, lt)
+			log.Println(msg.MessageType, ": Handing out: ", lease.Ip, " to ", duid)
+		} else {
+			h.info.publish(EventLeaseOffered, subnet.Name, lease, nil)
+		}
+	}
+
+	for i, ia := range msg.Options.IAPD() {
+		out := &dhcpv6.OptIAPD{IaId: ia.IaId}
+		var pd *Lease
+		if i == 0 && subnet.DelegatedPrefix != nil {
+			if allocate {
+				pd = subnet.find_or_get_prefix(h.info, duid)
+			} else {
+				pd = subnet.find_prefix(duid)
+			}
+		}
+		if pd == nil {
+			status := iana.StatusNoPrefixAvail
+			if !allocate {
+				status = iana.StatusNoBinding
+			}
+			out.Options.Add(&dhcpv6.OptStatusCode{StatusCode: status, StatusMessage: status.String()})
+			reply.AddOption(out)
+			continue
+		}
+		found = true
+		subnet.lock.Lock()
+		pd.Mac = mac
+		pd.Iaid = binary.BigEndian.Uint32(ia.IaId[:])
+		pd.record_relay(ri)
+		subnet.lock.Unlock()
+		lt := subnet.ActiveLeaseTime
+		out.T1, out.T2 = lt/2, lt*4/5
+		out.Options.Add(&dhcpv6.OptIAPrefix{
+			PreferredLifetime: lt,
+			ValidLifetime:     lt,
+			Prefix:            &net.IPNet{IP: pd.Ip, Mask: net.CIDRMask(pd.PrefixLen, 8*net.IPv6len)},
+		})
+		reply.AddOption(out)
+
+		if commit {
+			subnet.update_prefix_time(h.info, pd, lt)
+			log.Println(msg.MessageType, ": Delegating: ", pd.Ip, "/", pd.PrefixLen, " to ", duid)
+		}
+	}
+	return found
+}
+
+// options6 returns the subnet's options overlaid with the binding's,
+// only those in oro if the client sent one.
+func (s *Subnet) options6(oro dhcpv6.OptionCodes, binding *Binding) []dhcpv6.Option {
+	s.lock.RLock()
+	values := make(map[dhcpv6.OptionCode][]byte)
+	for c, v := range s.Options {
+		values[dhcpv6.OptionCode(c)] = v
+	}
+	s.lock.RUnlock()
+	if binding != nil {
+		for _, o := range binding.Options {
+			b, err := convertOptionValueToByte6(o.Code, o.Value)
+			if err != nil {
+				log.Println("Failed to parse option: ", o.Code, " ", o.Value)
+				continue
+			}
+			values[dhcpv6.OptionCode(o.Code)] = b
+		}
+	}
+
+	codes := oro
+	if len(codes) == 0 {
+		for c := range values {
+			codes = append(codes, c)
+		}
+		sort.Slice(codes, func(i, j int) bool { return codes[i] < codes[j] })
+	}
+	opts := make([]dhcpv6.Option, 0)
+	for _, c := range codes {
+		if v, ok := values[c]; ok {
+			opts = append(opts, &dhcpv6.OptionGeneric{OptionCode: c, OptionData: v})
+		}
+	}
+	return opts
+}
+
+/*
+ * Prefix delegation
+ */
+
+// set_delegation_pool splits prefix into prefixes of length bits.
+func (s *Subnet) set_delegation_pool(prefix string, length int) error {
+	if !s.v6() {
+		return errors.New("Prefix delegation needs an IPv6 subnet")
+	}
+	_, pool, err := net.ParseCIDR(prefix)
+	if err != nil || pool.IP.To4() != nil {
+		return errors.New("delegated_prefix must be an IPv6 prefix")
+	}
+	ones, _ := pool.Mask.Size()
+	if length < ones || length > 128 || length-ones > maxDelegationBits {
+		return errors.New("delegated_length must be at least the delegated_prefix length and split it into at most 2^24 prefixes")
+	}
+	s.DelegatedPrefix = &MyIPNet{pool}
+	s.DelegatedLength = length
+	s.DelegatedBits = bitset.New(1 << uint(length-ones))
+	return nil
+}
+
+func (s *Subnet) delegation_bit(prefix net.IP) (uint, bool) {
+	if s.DelegatedPrefix == nil || !s.DelegatedPrefix.Contains(prefix) {
+		return 0, false
+	}
+	n := new(big.Int).Sub(ipInt(prefix), ipInt(s.DelegatedPrefix.IP))
+	return uint(n.Rsh(n, uint(128-s.DelegatedLength)).Uint64()), true
+}
+
+func (s *Subnet) delegation_prefix(bit uint) net.IP {
+	n := new(big.Int).Lsh(new(big.Int).SetUint64(uint64(bit)), uint(128-s.DelegatedLength))
+	return intIP(n.Add(n, ipInt(s.DelegatedPrefix.IP)), true)
+}
+
+func (s *Subnet) find_prefix(duid string) *Lease {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.Delegations[duid]
+}
+
+// expire_delegations frees the delegations that expired before now
+// and reports whether there were any.  Assumes s.lock is held.
+func (s *Subnet) expire_delegations(dt *DataTracker, now time.Time) bool {
+	expired := false
+	for k, pd := range s.Delegations {
+		if now.After(pd.ExpireTime) {
+			if b, ok := s.delegation_bit(pd.Ip); ok {
+				s.DelegatedBits.Clear(b)
+			}
+			delete(s.Delegations, k)
+			dt.publish(EventPrefixExpired, s.Name, pd, nil)
+			expired = true
+		}
+	}
+	return expired
+}
+
+// find_or_get_prefix returns the client's delegation, making one if
+// there is a free prefix.  Expired delegations the reaper hasn't got
+// to yet are reclaimed when the pool runs out.
+func (s *Subnet) find_or_get_prefix(dt *DataTracker, duid string) *Lease {
+	s.lock.Lock()
+	if pd := s.Delegations[duid]; pd != nil {
+		s.lock.Unlock()
+		return pd
+	}
+
+	save_me := false
+	bit, ok := dt.failover.firstFreeBit(s.DelegatedBits)
+	if !ok {
+		save_me = s.expire_delegations(dt, time.Now())
+		bit, ok = dt.failover.firstFreeBit(s.DelegatedBits)
+	}
+	if !ok {
+		s.lock.Unlock()
+		if save_me {
+			dt.save_subnet(s.Name)
+		}
+		return nil
+	}
+
+	s.DelegatedBits.Set(bit)
+	pd := &Lease{
+		Ip:        s.delegation_prefix(bit),
+		Duid:      duid,
+		PrefixLen: s.DelegatedLength,
+		Valid:     true,
+	}
+	s.Delegations[duid] = pd
+	s.lock.Unlock()
+	dt.save_subnet(s.Name)
+	return pd
+}
+
+func (s *Subnet) update_prefix_time(dt *DataTracker, pd *Lease, d time.Duration) {
+	now := time.Now()
+	s.lock.Lock()
+	renewal := now.Before(pd.ExpireTime)
+	pd.ExpireTime = now.Add(d)
+	s.lock.Unlock()
+	dt.save_subnet(s.Name)
+	if renewal {
+		dt.publish(EventPrefixRenewed, s.Name, pd, nil)
+	} else {
+		dt.publish(EventPrefixBound, s.Name, pd, nil)
+	}
+}
+
+func (s *Subnet) free_prefix(dt *DataTracker, duid, eventType string) *Lease {
+	s.lock.Lock()
+	pd := s.Delegations[duid]
+	if pd == nil {
+		s.lock.Unlock()
+		return nil
+	}
+	if bit, ok := s.delegation_bit(pd.Ip); ok {
+		s.DelegatedBits.Clear(bit)
+	}
+	delete(s.Delegations, duid)
+	s.lock.Unlock()
+	dt.save_subnet(s.Name)
+	dt.publish(eventType, s.Name, pd, nil)
+	return pd
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+	"github.com/stretchr/testify/assert"
+)
+
+func v6Setup() (*DHCPv6Handler, *Subnet) {
+	store, err := NewFileStore("./database.test.json")
+	if err != nil {
+		log.Panic(err)
+	}
+	dt := NewDataTracker(store)
+	s := NewSubnet()
+	err = json.Unmarshal([]byte(`{
+		"name": "wilma",
+		"subnet": "fd00:10::/64",
+		"active_start": "fd00:10::100",
+		"active_end": "fd00:10::1ff",
+		"active_lease_time": 3600,
+		"reserved_lease_time": 7200,
+		"delegated_prefix": "fd00:20::/48",
+		"delegated_length": 56,
+		"options": [{"id": 23, "value": "fd00:10::1"}, {"id": 24, "value": "example.com"}]
+	}`), s)
+	if err != nil {
+		log.Panic(err)
+	}
+	dt.AddSubnet(s)
+	intf := net.Interface{Name: "eth0", HardwareAddr: net.HardwareAddr{0x52, 0x54, 0, 0, 0, 0xfe}}
+	return NewDHCPv6Handler(dt, intf, net.ParseIP("fd00:10::1")), s
+}
+
+func clientDuid(mac string) dhcpv6.DUID {
+	hw, _ := net.ParseMAC(mac)
+	return &dhcpv6.DUIDLL{HWType: iana.HWTypeEthernet, LinkLayerAddr: hw}
+}
+
+func v6Message(mt dhcpv6.MessageType, mac string, opts ...dhcpv6.Option) *dhcpv6.Message {
+	m := &dhcpv6.Message{MessageType: mt, TransactionID: dhcpv6.TransactionID{1, 2, 3}}
+	m.AddOption(dhcpv6.OptClientID(clientDuid(mac)))
+	for _, o := range opts {
+		m.AddOption(o)
+	}
+	return m
+}
+
+func iana1() *dhcpv6.OptIANA {
+	return &dhcpv6.OptIANA{IaId: [4]byte{0, 0, 0, 1}}
+}
+
+func serve6(t *testing.T, h *DHCPv6Handler, req dhcpv6.DHCPv6) *dhcpv6.Message {
+	d := h.ServeDHCPv6(req)
+	if d == nil {
+		return nil
+	}
+	// Parsed back from the wire so options have their proper types.
+	d, err := dhcpv6.FromBytes(d.ToBytes())
+	assert.Nil(t, err)
+	m, err := d.GetInnerMessage()
+	assert.Nil(t, err)
+	return m
+}
+
+func TestParseDuid(t *testing.T) {
+	d, err := parseDuid("00030001525400000001")
+	assert.Nil(t, err)
+	assert.Equal(t, "00:03:00:01:52:54:00:00:00:01", d)
+	d, err = parseDuid("00-03-00-01-52-54-00-00-00-01")
+	assert.Nil(t, err)
+	assert.Equal(t, "00:03:00:01:52:54:00:00:00:01", d)
+
+	_, err = parseDuid("0003")
+	assert.NotNil(t, err)
+	_, err = parseDuid("not a duid")
+	assert.NotNil(t, err)
+}
+
+func TestDhcp6SolicitRequest(t *testing.T) {
+	h, s := v6Setup()
+	mac := "52:54:00:00:00:01"
+	duid := duidString(clientDuid(mac).ToBytes())
+
+	adv := serve6(t, h, v6Message(dhcpv6.MessageTypeSolicit, mac, iana1()))
+	assert.NotNil(t, adv)
+	assert.Equal(t, dhcpv6.MessageTypeAdvertise, adv.MessageType)
+	ia := adv.Options.OneIANA()
+	assert.NotNil(t, ia)
+	addr := ia.Options.OneAddress()
+	assert.Equal(t, "fd00:10::100", addr.IPv6Addr.String())
+	assert.Equal(t, time.Hour, addr.ValidLifetime)
+	assert.Equal(t, 30*time.Minute, ia.T1)
+	assert.Equal(t, []net.IP{net.ParseIP("fd00:10::1")}, adv.Options.DNS())
+	assert.Equal(t, []string{"example.com"}, adv.Options.DomainSearchList().Labels)
+	// Offered, not yet bound
+	assert.True(t, s.Leases[duid].ExpireTime.IsZero())
+
+	// A request without our server id is not for us
+	assert.Nil(t, serve6(t, h, v6Message(dhcpv6.MessageTypeRequest, mac, iana1())))
+	assert.Nil(t, serve6(t, h, v6Message(dhcpv6.MessageTypeRequest, mac, iana1(),
+		dhcpv6.OptServerID(clientDuid("52:54:00:00:00:99")))))
+
+	rep := serve6(t, h, v6Message(dhcpv6.MessageTypeRequest, mac, iana1(), adv.Options.GetOne(dhcpv6.OptionServerID)))
+	assert.NotNil(t, rep)
+	assert.Equal(t, dhcpv6.MessageTypeReply, rep.MessageType)
+	assert.Equal(t, "fd00:10::100", rep.Options.OneIANA().Options.OneAddress().IPv6Addr.String())
+	lease := s.Leases[duid]
+	assert.False(t, lease.ExpireTime.IsZero())
+	assert.Equal(t, mac, lease.Mac)
+	assert.Equal(t, uint32(1), lease.Iaid)
+
+	// Only requested options when there is an ORO
+	oro := dhcpv6.OptRequestedOption(dhcpv6.OptionDNSRecursiveNameServer)
+	rep = serve6(t, h, v6Message(dhcpv6.MessageTypeRenew, mac, iana1(), oro, adv.Options.GetOne(dhcpv6.OptionServerID)))
+	assert.Equal(t, "fd00:10::100", rep.Options.OneIANA().Options.OneAddress().IPv6Addr.String())
+	assert.NotNil(t, rep.Options.DNS())
+	assert.Nil(t, rep.Options.DomainSearchList())
+
+	// Released addresses go back in the pool
+	rep = serve6(t, h, v6Message(dhcpv6.MessageTypeRelease, mac, iana1(), adv.Options.GetOne(dhcpv6.OptionServerID)))
+	assert.Equal(t, iana.StatusSuccess, rep.Options.Status().StatusCode)
+	assert.Nil(t, s.Leases[duid])
+	used, _ := s.utilization()
+	assert.Equal(t, uint(0), used)
+}
+
+func TestDhcp6RapidCommitAndRenew(t *testing.T) {
+	h, s := v6Setup()
+	mac := "52:54:00:00:00:02"
+
+	req := v6Message(dhcpv6.MessageTypeSolicit, mac, iana1())
+	dhcpv6.WithRapidCommit(req)
+	rep := serve6(t, h, req)
+	assert.Equal(t, dhcpv6.MessageTypeReply, rep.MessageType)
+	assert.NotNil(t, rep.GetOneOption(dhcpv6.OptionRapidCommit))
+	assert.False(t, s.Leases[duidString(clientDuid(mac).ToBytes())].ExpireTime.IsZero())
+
+	// Unknown clients renewing get NoBinding, rebinding gets silence
+	other := "52:54:00:00:00:03"
+	rep = serve6(t, h, v6Message(dhcpv6.MessageTypeRenew, other, iana1(), dhcpv6.OptServerID(h.duid)))
+	assert.Equal(t, iana.StatusNoBinding, rep.Options.OneIANA().Options.Status().StatusCode)
+	assert.Nil(t, serve6(t, h, v6Message(dhcpv6.MessageTypeRebind, other, iana1())))
+
+	// Confirm checks the link
+	a := iana1()
+	a.Options.Add(&dhcpv6.OptIAAddress{IPv6Addr: net.ParseIP("fd00:99::5")})
+	rep = serve6(t, h, v6Message(dhcpv6.MessageTypeConfirm, mac, a))
+	assert.Equal(t, iana.StatusNotOnLink, rep.Options.Status().StatusCode)
+}
+
+func TestDhcp6Binding(t *testing.T) {
+	h, s := v6Setup()
+	mac := "52:54:00:00:00:04"
+	b := Binding{
+		Duid:    "0003000152540000000" + "4",
+		Ip:      net.ParseIP("fd00:10::42"),
+		Options: []*Option{{Code: 59, Value: "http://boot/ipxe.efi"}},
+	}
+	err, code := h.info.AddBinding(s.Name, b)
+	assert.Nil(t, err)
+	assert.Equal(t, 200, code)
+	assert.NotNil(t, s.Bindings["00:03:00:01:52:54:00:00:00:04"])
+
+	rep := serve6(t, h, v6Message(dhcpv6.MessageTypeSolicit, mac, iana1()))
+	addr := rep.Options.OneIANA().Options.OneAddress()
+	assert.Equal(t, "fd00:10::42", addr.IPv6Addr.String())
+	assert.Equal(t, 2*time.Hour, addr.ValidLifetime)
+	assert.Equal(t, "http://boot/ipxe.efi", rep.Options.BootFileURL())
+
+	// Address family must match
+	err, code = h.info.AddBinding(s.Name, Binding{Duid: b.Duid, Ip: net.ParseIP("192.168.1.1")})
+	assert.NotNil(t, err)
+	assert.Equal(t, 400, code)
+	err, _ = h.info.AddBinding(s.Name, Binding{Duid: "zz"})
+	assert.NotNil(t, err)
+}
+
+func TestDhcp6PrefixDelegation(t *testing.T) {
+	h, s := v6Setup()
+	mac := "52:54:00:00:00:05"
+	duid := duidString(clientDuid(mac).ToBytes())
+	pd := &dhcpv6.OptIAPD{IaId: [4]byte{0, 0, 0, 7}}
+
+	rep := serve6(t, h, v6Message(dhcpv6.MessageTypeRequest, mac, pd, dhcpv6.OptServerID(h.duid)))
+	prefixes := rep.Options.OneIAPD().Options.Prefixes()
+	assert.Equal(t, 1, len(prefixes))
+	assert.Equal(t, "fd00:20::/56", prefixes[0].Prefix.String())
+	assert.Equal(t, 56, s.Delegations[duid].PrefixLen)
+	assert.Equal(t, uint32(7), s.Delegations[duid].Iaid)
+
+	// The next client gets the next prefix
+	rep = serve6(t, h, v6Message(dhcpv6.MessageTypeRequest, "52:54:00:00:00:06", pd, dhcpv6.OptServerID(h.duid)))
+	assert.Equal(t, "fd00:20:0:100::/56", rep.Options.OneIAPD().Options.Prefixes()[0].Prefix.String())
+
+	// Delegations survive a round trip through the API form
+	s2 := NewSubnet()
+	data, _ := json.Marshal(s)
+	assert.Nil(t, json.Unmarshal(data, s2))
+	assert.Equal(t, 2, len(s2.Delegations))
+	assert.Equal(t, uint(2), s2.DelegatedBits.Count())
+
+	serve6(t, h, v6Message(dhcpv6.MessageTypeRelease, mac, pd, dhcpv6.OptServerID(h.duid)))
+	assert.Nil(t, s.Delegations[duid])
+	assert.Equal(t, uint(1), s.DelegatedBits.Count())
+
+	assert.NotNil(t, s.set_delegation_pool("fd00:20::/48", 40))
+	assert.NotNil(t, s.set_delegation_pool("fd00:20::/48", 80))
+}
+
+func TestDhcp6Relayed(t *testing.T) {
+	h, s := v6Setup()
+	h.ip = net.ParseIP("fd00:99::1")
+	mac := "52:54:00:00:00:07"
+
+	// Not a local subnet
+	assert.Nil(t, h.ServeDHCPv6(v6Message(dhcpv6.MessageTypeSolicit, mac, iana1())))
+
+	fwd, _ := dhcpv6.EncapsulateRelay(v6Message(dhcpv6.MessageTypeSolicit, mac, iana1()),
+		dhcpv6.MessageTypeRelayForward, net.ParseIP("fd00:10::2"), net.ParseIP("fe80::1"))
+	d := h.ServeDHCPv6(fwd)
+	assert.NotNil(t, d)
+	assert.True(t, d.IsRelay())
+	assert.Equal(t, dhcpv6.MessageTypeRelayReply, d.Type())
+	m, _ := d.GetInnerMessage()
+	assert.Equal(t, dhcpv6.MessageTypeAdvertise, m.MessageType)
+	assert.True(t, s.Subnet.Contains(m.Options.OneIANA().Options.OneAddress().IPv6Addr))
+}
+
+func TestV6SubnetValidation(t *testing.T) {
+	s := NewSubnet()
+	// IPv4 range in an IPv6 subnet
+	err := json.Unmarshal([]byte(`{"name": "x", "subnet": "fd00:10::/64",
+		"active_start": "10.0.0.1", "active_end": "10.0.0.9"}`), s)
+	assert.NotNil(t, err)
+
+	// Too large to track
+	err = json.Unmarshal([]byte(`{"name": "x", "subnet": "fd00:10::/64",
+		"active_start": "fd00:10::1", "active_end": "fd00:10::ffff:ffff"}`), s)
+	assert.NotNil(t, err)
+
+	// DHCPv4 only options
+	err = json.Unmarshal([]byte(`{"name": "x", "subnet": "fd00:10::/64",
+		"active_start": "fd00:10::1", "active_end": "fd00:10::ff",
+		"options": [{"id": 3, "value": "10.0.0.1"}]}`), s)
+	assert.NotNil(t, err)
+}
+
+func TestDhcp6InformationRequest(t *testing.T) {
+	h, _ := v6Setup()
+	s := NewSubnet()
+	err := json.Unmarshal([]byte(`{
+		"name": "betty",
+		"subnet": "fd00:30::/64",
+		"options": [{"id": 6, "value": "fd00:30::53"}, {"id": 42, "value": "fd00:30::123,fd00:30::124"}]
+	}`), s)
+	assert.Nil(t, err)
+	assert.True(t, s.stateless())
+	h.info.AddSubnet(s)
+	h.ip = net.ParseIP("fd00:30::1")
+
+	// Stored and listed under the DHCPv6 codes
+	as := convertSubnetToApiSubnet(s)
+	assert.Equal(t, "", as.ActiveStart)
+	values := make(map[int]string)
+	for _, o := range as.Options {
+		values[int(o.Code)] = o.Value
+	}
+	assert.Equal(t, map[int]string{23: "fd00:30::53", 56: "fd00:30::123,fd00:30::124"}, values)
+
+	// No client id needed
+	req := &dhcpv6.Message{MessageType: dhcpv6.MessageTypeInformationRequest, TransactionID: dhcpv6.TransactionID{4, 5, 6}}
+	rep := serve6(t, h, req)
+	assert.NotNil(t, rep)
+	assert.Equal(t, dhcpv6.MessageTypeReply, rep.MessageType)
+	assert.Nil(t, rep.Options.ClientID())
+	assert.Equal(t, []net.IP{net.ParseIP("fd00:30::53")}, rep.Options.DNS())
+	assert.Equal(t, []net.IP{net.ParseIP("fd00:30::123"), net.ParseIP("fd00:30::124")}, rep.Options.NTPServers())
+
+	// Stateless subnets have no addresses to give
+	rep = serve6(t, h, v6Message(dhcpv6.MessageTypeSolicit, "52:54:00:00:00:08", iana1()))
+	assert.Equal(t, iana.StatusNoAddrsAvail, rep.Options.OneIANA().Options.Status().StatusCode)
+	assert.Equal(t, 0, len(s.Leases))
+}
+
+func TestUpdatePrefixTimeLocked(t *testing.T) {
+	h, s := v6Setup()
+	ss, err := NewSQLStore("sqlite3", ":memory:")
+	assert.Nil(t, err)
+	defer ss.Close()
+	h.info.store = ss
+	pd := s.find_or_get_prefix(h.info, "00:03:00:01:52:54:00:00:00:01")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			s.update_prefix_time(h.info, pd, time.Hour)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		s.MarshalJSON()
+	}
+	<-done
+	assert.True(t, pd.ExpireTime.After(time.Now()))
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	dhcp "github.com/krolaw/dhcp4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSelectOptions(t *testing.T) {
+	opts := dhcp.Options{
+		dhcp.OptionRouter:     []byte{192, 168, 1, 1},
+		dhcp.OptionSubnetMask: []byte{255, 255, 255, 0},
+		dhcp.OptionHostName:   []byte("node1"),
+		OptionClientFQDN:      []byte{0x01, 255, 255},
+	}
+
+	// No request list, everything goes
+	assert.Equal(t, 4, len(select_options(opts, nil)))
+
+	// Requested options in order, then the names
+	sel := select_options(opts, []byte{byte(dhcp.OptionSubnetMask), byte(dhcp.OptionRouter)})
+	codes := make([]dhcp.OptionCode, 0)
+	for _, o := range sel {
+		codes = append(codes, o.Code)
+	}
+	assert.Equal(t, []dhcp.OptionCode{dhcp.OptionSubnetMask, dhcp.OptionRouter, dhcp.OptionHostName, OptionClientFQDN}, codes)
+
+	// Not sent twice when requested
+	sel = select_options(opts, []byte{byte(dhcp.OptionHostName)})
+	assert.Equal(t, 2, len(sel))
+}
+
+func TestNextServer(t *testing.T) {
+	h := &DHCPHandler{ip: net.ParseIP("192.168.128.1").To4()}
+	s := NewSubnet()
+	assert.Nil(t, h.next_server(s, nil))
+
+	tftp_enabled = true
+	defer func() { tftp_enabled = false }()
+	assert.Equal(t, h.ip, h.next_server(s, nil))
+
+	ns := net.ParseIP("192.168.128.2").To4()
+	s.NextServer = &ns
+	assert.Equal(t, ns, h.next_server(s, nil))
+
+	bns := "192.168.128.3"
+	assert.Equal(t, "192.168.128.3", h.next_server(s, &Binding{NextServer: &bns}).String())
+}
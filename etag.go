@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ant0ine/go-json-rest/rest"
+)
+
+/*
+ * ETags
+ *
+ * Each subnet has a revision, renewed whenever the API (or a seed)
+ * changes its configuration, bindings or next servers.  Revisions come
+ * from one counter for all subnets, so a subnet created again under an
+ * old name doesn't match tags from before.  Leases don't
+ * count, so a tag only goes stale when another client changed what a
+ * PUT would overwrite.  Changes sent with If-Match are refused with
+ * 412 when the subnet has moved on since it was read.
+ */
+
+func subnetETag(revision uint64) string {
+	return `"` + strconv.FormatUint(revision, 10) + `"`
+}
+
+// subnetsETag tags a list of subnets.  It changes when any of them is
+// changed, added or removed.
+func subnetsETag(subnets []*Subnet) string {
+	keys := make([]string, 0, len(subnets))
+	for _, s := range subnets {
+		keys = append(keys, fmt.Sprintf("%s:%d", s.Name, s.Revision))
+	}
+	sort.Strings(keys)
+	h := fnv.New64a()
+	for _, k := range keys {
+		h.Write([]byte(k + "\n"))
+	}
+	return fmt.Sprintf(`"%x"`, h.Sum64())
+}
+
+// etagMatches checks an If-Match header.  Weak tags compare as
+// strong ones, since revisions are only ever handed out once.
+func etagMatches(header, etag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		if t == "*" || t == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// ifMatch checks the request's If-Match against the subnet, answering
+// 412 with the current tag when it is stale.  A missing subnet is left
+// to the handler's 404.  Callers hold writeLock until their change is
+// made, so two clients can't both pass with the same tag.
+func (fe *Frontend) ifMatch(w rest.ResponseWriter, r *rest.Request, name string) bool {
+	header := r.Header.Get("If-Match")
+	s := fe.DhcpInfo.Subnets[name]
+	if header == "" || s == nil {
+		return true
+	}
+	etag := subnetETag(s.Revision)
+	if etagMatches(header, etag) {
+		return true
+	}
+	w.Header().Set("ETag", etag)
+	rest.Error(w, "Precondition Failed", http.StatusPreconditionFailed)
+	return false
+}
+
+// setETag tags a response with the subnet's current revision.
+func (fe *Frontend) setETag(w rest.ResponseWriter, name string) {
+	if s := fe.DhcpInfo.Subnets[name]; s != nil {
+		w.Header().Set("ETag", subnetETag(s.Revision))
+	}
+}
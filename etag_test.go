@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// ifMatchCall is apiCall with an If-Match header.
+func ifMatchCall(handler http.Handler, etag, method, path, body string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, base_url(path), strings.NewReader(body))
+	req.SetBasicAuth("fred", "rules")
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Set("If-Match", etag)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestSubnetETags(t *testing.T) {
+	fe, handler, _ := auditFrontend(t)
+	subnet := `{"name": "fred", "subnet": "192.168.128.0/24", "active_start": "192.168.128.10",
+		"active_end": "192.168.128.20", "active_lease_time": 3600}`
+	recorder := apiCall(handler, "POST", "/subnets", subnet)
+	assert.Equal(t, `"1"`, recorder.Header().Get("ETag"))
+
+	recorder = apiCall(handler, "GET", "/subnets/fred", "")
+	etag := recorder.Header().Get("ETag")
+	assert.Equal(t, `"1"`, etag)
+	as := &ApiSubnet{}
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), as))
+	assert.Equal(t, uint64(1), as.Revision)
+
+	// Two jobs read the same revision; the second to write loses.
+	first := ifMatchCall(handler, etag, "PUT", "/subnets/fred", strings.Replace(subnet, "3600", "600", 1))
+	assert.Equal(t, 200, first.Code)
+	assert.Equal(t, `"2"`, first.Header().Get("ETag"))
+	second := ifMatchCall(handler, etag, "PUT", "/subnets/fred", strings.Replace(subnet, "3600", "60", 1))
+	assert.Equal(t, 412, second.Code)
+	assert.Equal(t, `"2"`, second.Header().Get("ETag"))
+	assert.Equal(t, 600, int(fe.DhcpInfo.Subnets["fred"].ActiveLeaseTime.Seconds()))
+
+	// Bindings are part of the subnet.
+	binding := `{"mac": "52:54:00:00:00:01", "ip": "192.168.128.5"}`
+	assert.Equal(t, 412, ifMatchCall(handler, etag, "POST", "/subnets/fred/bind", binding).Code)
+	recorder = ifMatchCall(handler, `W/"2"`, "POST", "/subnets/fred/bind", binding)
+	assert.Equal(t, 200, recorder.Code)
+	assert.Equal(t, `"3"`, recorder.Header().Get("ETag"))
+	assert.Equal(t, 412, ifMatchCall(handler, `"2"`, "DELETE", "/subnets/fred/bind/52:54:00:00:00:01", "").Code)
+	assert.Equal(t, 200, ifMatchCall(handler, `"1", "3"`, "DELETE", "/subnets/fred/bind/52:54:00:00:00:01", "").Code)
+
+	// Leases don't change the tag.
+	s := fe.DhcpInfo.Subnets["fred"]
+	lease, _ := s.find_or_get_info(fe.DhcpInfo, "52:54:00:00:00:02", nil)
+	s.update_lease_time(fe.DhcpInfo, lease, time.Hour)
+	assert.Equal(t, `"4"`, apiCall(handler, "GET", "/subnets/fred", "").Header().Get("ETag"))
+
+	// Without If-Match, or with *, changes go through as before.
+	assert.Equal(t, 412, ifMatchCall(handler, `"3"`, "DELETE", "/subnets/fred", "").Code)
+	assert.Equal(t, 404, ifMatchCall(handler, `"3"`, "DELETE", "/subnets/barney", "").Code)
+	assert.Equal(t, 200, ifMatchCall(handler, "*", "DELETE", "/subnets/fred", "").Code)
+}
+
+func TestSubnetsETag(t *testing.T) {
+	_, handler, _ := auditFrontend(t)
+	empty := apiCall(handler, "GET", "/subnets", "").Header().Get("ETag")
+	apiCall(handler, "POST", "/subnets", `{"name": "fred", "subnet": "192.168.128.0/24",
+		"active_start": "192.168.128.10", "active_end": "192.168.128.20"}`)
+	one := apiCall(handler, "GET", "/subnets", "").Header().Get("ETag")
+	assert.NotEqual(t, empty, one)
+	assert.Equal(t, one, apiCall(handler, "GET", "/subnets", "").Header().Get("ETag"))
+
+	apiCall(handler, "POST", "/subnets/fred/bind", `{"mac": "52:54:00:00:00:01", "ip": "192.168.128.5"}`)
+	assert.NotEqual(t, one, apiCall(handler, "GET", "/subnets", "").Header().Get("ETag"))
+}
+
+func TestSubnetETagRecreate(t *testing.T) {
+	fe, handler, _ := auditFrontend(t)
+	subnet := `{"name": "fred", "subnet": "192.168.128.0/24", "active_start": "192.168.128.10",
+		"active_end": "192.168.128.20", "active_lease_time": 3600}`
+	etag := apiCall(handler, "POST", "/subnets", subnet).Header().Get("ETag")
+	assert.Equal(t, 200, apiCall(handler, "DELETE", "/subnets/fred", "").Code)
+
+	// A job still holding the old tag can't change the new subnet.
+	recorder := apiCall(handler, "POST", "/subnets", subnet)
+	assert.NotEqual(t, etag, recorder.Header().Get("ETag"))
+	assert.Equal(t, 412, ifMatchCall(handler, etag, "PUT", "/subnets/fred", strings.Replace(subnet, "3600", "600", 1)).Code)
+	assert.Equal(t, 412, ifMatchCall(handler, etag, "DELETE", "/subnets/fred", "").Code)
+
+	// Nor after a restart that lost the first subnet's revision.
+	etag = recorder.Header().Get("ETag")
+	assert.Equal(t, 200, apiCall(handler, "DELETE", "/subnets/fred", "").Code)
+	dt := NewDataTracker(fe.DhcpInfo.store)
+	dt.load_data()
+	s, err := convertApiSubnetToSubnet(&ApiSubnet{Name: "fred", Subnet: "192.168.128.0/24",
+		ActiveStart: "192.168.128.10", ActiveEnd: "192.168.128.20"}, nil)
+	assert.Nil(t, err)
+	dt.AddSubnet(s)
+	assert.NotEqual(t, etag, subnetETag(s.Revision))
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ant0ine/go-json-rest/rest"
+)
+
+/*
+ * Lease and config events
+ *
+ * The DataTracker publishes an Event for every lease transition and
+ * every subnet or binding change.  Each event gets the next sequence
+ * number, and the last eventBacklog events are kept so a client can
+ * reconnect and resume where it left off.
+ */
+
+// Event types
+const (
+	EventLeaseOffered    = "lease.offered"
+	EventLeaseBound      = "lease.bound"
+	EventLeaseRenewed    = "lease.renewed"
+	EventLeaseReleased   = "lease.released"
+	EventLeaseExpired    = "lease.expired" // Freed by the reaper, see reaper.go
+	EventLeaseDeclined   = "lease.declined"
+	EventPrefixBound     = "prefix.bound" // DHCPv6 prefix delegation
+	EventPrefixRenewed   = "prefix.renewed"
+	EventPrefixReleased  = "prefix.released"
+	EventPrefixExpired   = "prefix.expired" // Delegations freed by the reaper
+	EventMacUnknown      = "mac.unknown"    // First lease for a MAC with no binding
+	EventBindingBound    = "binding.bound"  // A bound MAC's lease became bound
+	EventBindingAdded    = "binding.added"
+	EventBindingUpdated  = "binding.updated"
+	EventBindingRemoved  = "binding.removed"
+	EventSubnetCreated   = "subnet.created"
+	EventSubnetUpdated   = "subnet.updated"
+	EventSubnetDeleted   = "subnet.deleted"
+	EventPoolUtilization = "pool.utilization" // A subnet crossed an alert threshold
+	EventStreamGap       = "stream.gap"       // Resume point no longer available
+)
+
+const eventBacklog = 1024
+
+type Event struct {
+	Seq     uint64    `json:"seq"`
+	Type    string    `json:"type"`
+	Time    time.Time `json:"time"`
+	Subnet  string    `json:"subnet,omitempty"`
+	Mac     string    `json:"mac,omitempty"`
+	Ip      net.IP    `json:"ip,omitempty"`
+	Lease   *Lease    `json:"lease,omitempty"`
+	Binding *Binding  `json:"binding,omitempty"`
+
+	Utilization *PoolUtilization `json:"utilization,omitempty"`
+}
+
+// EventFilter limits a subscription to a subnet and/or MAC.  Empty
+// fields match everything.
+type EventFilter struct {
+	Subnet string
+	Mac    string
+}
+
+func (f EventFilter) match(e *Event) bool {
+	if f.Subnet != "" && f.Subnet != e.Subnet {
+		return false
+	}
+	if f.Mac != "" && f.Mac != e.Mac {
+		return false
+	}
+	return true
+}
+
+type Subscription struct {
+	C      chan *Event // Closed if the subscriber falls too far behind
+	filter EventFilter
+}
+
+type Publisher struct {
+	lock    sync.Mutex
+	seq     uint64
+	backlog []*Event
+	subs    map[*Subscription]bool
+}
+
+func NewPublisher() *Publisher {
+	return &Publisher{
+		backlog: make([]*Event, 0, eventBacklog),
+		subs:    make(map[*Subscription]bool),
+	}
+}
+
+// Publish stamps the event and fans it out.  It never blocks, a
+// subscriber whose channel is full is dropped and must resume.
+func (p *Publisher) Publish(e *Event) {
+	if p == nil {
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.seq++
+	e.Seq = p.seq
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	if len(p.backlog) == eventBacklog {
+		copy(p.backlog, p.backlog[1:])
+		p.backlog = p.backlog[:eventBacklog-1]
+	}
+	p.backlog = append(p.backlog, e)
+
+	for s := range p.subs {
+		if !s.filter.match(e) {
+			continue
+		}
+		select {
+		case s.C <- e:
+		default:
+			delete(p.subs, s)
+			close(s.C)
+		}
+	}
+}
+
+// Subscribe returns a subscription and the backlogged events after
+// since.  If events after since have already been discarded, the
+// backlog starts with a stream.gap event.
+func (p *Publisher) Subscribe(since uint64, filter EventFilter) (*Subscription, []*Event) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	missed := make([]*Event, 0)
+	if since > 0 {
+		oldest := p.seq + 1
+		if len(p.backlog) > 0 {
+			oldest = p.backlog[0].Seq
+		}
+		if since+1 < oldest || since > p.seq {
+			missed = append(missed, &Event{Seq: p.seq, Type: EventStreamGap, Time: time.Now()})
+		}
+		for _, e := range p.backlog {
+			if e.Seq > since && filter.match(e) {
+				missed = append(missed, e)
+			}
+		}
+	}
+
+	s := &Subscription{
+		C:      make(chan *Event, 64),
+		filter: filter,
+	}
+	p.subs[s] = true
+	return s, missed
+}
+
+func (p *Publisher) Unsubscribe(s *Subscription) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.subs[s] {
+		delete(p.subs, s)
+		close(s.C)
+	}
+}
+
+func (dt *DataTracker) publish(eventType, subnet string, lease *Lease, binding *Binding) {
+	e := &Event{
+		Type:   eventType,
+		Subnet: subnet,
+	}
+	// Copy so later mutation doesn't race the stream.
+	if lease != nil {
+		l := *lease
+		e.Lease = &l
+		e.Mac = l.Mac
+		e.Ip = l.Ip
+	}
+	if binding != nil {
+		b := *binding
+		e.Binding = &b
+		e.Mac = b.Mac
+		e.Ip = b.Ip
+	}
+	dt.emit(e)
+}
+
+// emit hands a built event to everything that follows them.
+func (dt *DataTracker) emit(e *Event) {
+	dt.events.Publish(e)
+	dt.history.Record(e)
+	dt.webhooks.Enqueue(e)
+	dt.ddns.Handle(e)
+	dt.failover.Handle(e)
+}
+
+// StreamEvents serves events as Server-Sent Events.  Query parameters
+// subnet and mac filter the stream.  A client resumes with the
+// Last-Event-ID header or the since parameter.
+func (fe *Frontend) StreamEvents(w rest.ResponseWriter, r *rest.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		rest.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	q := r.URL.Query()
+	filter := EventFilter{
+		Subnet: q.Get("subnet"),
+		Mac:    q.Get("mac"),
+	}
+	sinceStr := r.Header.Get("Last-Event-ID")
+	if sinceStr == "" {
+		sinceStr = q.Get("since")
+	}
+	var since uint64
+	if sinceStr != "" {
+		var err error
+		since, err = strconv.ParseUint(sinceStr, 10, 64)
+		if err != nil {
+			rest.Error(w, "Invalid event id: "+sinceStr, http.StatusBadRequest)
+			return
+		}
+	}
+
+	sub, missed := fe.DhcpInfo.events.Subscribe(since, filter)
+	defer fe.DhcpInfo.events.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	hw := w.(http.ResponseWriter)
+	sc := scopeOf(r)
+	for _, e := range missed {
+		if fe.inScope(sc, e.Subnet, e.Ip) {
+			writeEvent(hw, e)
+		}
+	}
+	flusher.Flush()
+
+	ping := time.NewTicker(30 * time.Second)
+	defer ping.Stop()
+	done := r.Context().Done()
+	for {
+		select {
+		case e, ok := <-sub.C:
+			if !ok {
+				// Too slow, the client will resume from its last id.
+				return
+			}
+			if !fe.inScope(sc, e.Subnet, e.Ip) {
+				continue
+			}
+			writeEvent(hw, e)
+		case <-ping.C:
+			fmt.Fprint(hw, ": ping\n\n")
+		case <-done:
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func writeEvent(w http.ResponseWriter, e *Event) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.Seq, e.Type, data)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublisherFilter(t *testing.T) {
+	p := NewPublisher()
+	sub, missed := p.Subscribe(0, EventFilter{Subnet: "fred", Mac: "aa"})
+	assert.Equal(t, 0, len(missed))
+
+	p.Publish(&Event{Type: EventLeaseBound, Subnet: "barney", Mac: "aa"})
+	p.Publish(&Event{Type: EventLeaseBound, Subnet: "fred", Mac: "bb"})
+	p.Publish(&Event{Type: EventLeaseBound, Subnet: "fred", Mac: "aa"})
+
+	e := <-sub.C
+	assert.Equal(t, uint64(3), e.Seq)
+	assert.Equal(t, 0, len(sub.C))
+
+	p.Unsubscribe(sub)
+	_, ok := <-sub.C
+	assert.False(t, ok, "Channel should be closed")
+}
+
+func TestPublisherResume(t *testing.T) {
+	p := NewPublisher()
+	for i := 0; i < 5; i++ {
+		p.Publish(&Event{Type: EventSubnetUpdated, Subnet: "fred"})
+	}
+
+	_, missed := p.Subscribe(3, EventFilter{})
+	assert.Equal(t, 2, len(missed))
+	assert.Equal(t, uint64(4), missed[0].Seq)
+	assert.Equal(t, uint64(5), missed[1].Seq)
+
+	// Resuming from a future id (e.g. after a restart) reports a gap.
+	_, missed = p.Subscribe(100, EventFilter{})
+	assert.Equal(t, 1, len(missed))
+	assert.Equal(t, EventStreamGap, missed[0].Type)
+}
+
+func TestPublisherBacklogOverflow(t *testing.T) {
+	p := NewPublisher()
+	for i := 0; i < eventBacklog+10; i++ {
+		p.Publish(&Event{Type: EventSubnetUpdated})
+	}
+	assert.Equal(t, eventBacklog, len(p.backlog))
+	assert.Equal(t, uint64(11), p.backlog[0].Seq)
+
+	_, missed := p.Subscribe(5, EventFilter{})
+	assert.Equal(t, EventStreamGap, missed[0].Type)
+	assert.Equal(t, eventBacklog+1, len(missed))
+}
+
+func TestPublisherDropsSlowSubscriber(t *testing.T) {
+	p := NewPublisher()
+	sub, _ := p.Subscribe(0, EventFilter{})
+	for i := 0; i < cap(sub.C)+1; i++ {
+		p.Publish(&Event{Type: EventSubnetUpdated})
+	}
+	for range sub.C {
+	}
+	assert.Equal(t, 0, len(p.subs))
+}
+
+func TestLeaseEvents(t *testing.T) {
+	dt, s := simpleSetup()
+	sub, _ := dt.events.Subscribe(0, EventFilter{})
+
+	lease := &Lease{Ip: net.ParseIP("192.168.128.5"), Mac: "aa"}
+	s.Leases["aa"] = lease
+	s.update_lease_time(dt, lease, time.Hour)
+	s.update_lease_time(dt, lease, time.Hour)
+	s.free_lease(dt, "aa", EventLeaseReleased)
+
+	assert.Equal(t, EventLeaseBound, (<-sub.C).Type)
+	assert.Equal(t, EventLeaseRenewed, (<-sub.C).Type)
+}
+
+func TestStreamEvents(t *testing.T) {
+	fe, handler := get_frontend()
+	for k := range fe.DhcpInfo.Subnets {
+		delete(fe.DhcpInfo.Subnets, k)
+	}
+	addNewSubnet(fe.DhcpInfo, "fred", "192.168.128.0/24")
+
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	req, err := http.NewRequest("GET", ts.URL+"/events?subnet=fred&since=1", nil)
+	assert.Nil(t, err)
+	req.SetBasicAuth("fred", "rules")
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	fe.DhcpInfo.AddBinding("fred", Binding{Ip: net.ParseIP("192.168.128.50"), Mac: "aa:bb:cc:dd:ee:ff"})
+
+	reader := bufio.NewReader(resp.Body)
+	lines := make([]string, 0)
+	for len(lines) < 3 {
+		line, err := reader.ReadString('\n')
+		assert.Nil(t, err)
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	assert.Equal(t, "event: binding.added", lines[1])
+
+	e := &Event{}
+	assert.Nil(t, json.Unmarshal([]byte(strings.TrimPrefix(lines[2], "data: ")), e))
+	assert.Equal(t, "fred", e.Subnet)
+	assert.Equal(t, "aa:bb:cc:dd:ee:ff", e.Mac)
+	assert.Equal(t, fmt.Sprintf("id: %d", e.Seq), lines[0])
+}
@@ -0,0 +1,617 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/willf/bitset"
+)
+
+/*
+ * Failover between two servers
+ *
+ * Two instances serve the same subnets (configured on both, e.g. from
+ * the same seed files) and keep their leases in step.  The primary
+ * listens and the secondary connects.  Each proves it knows the shared
+ * secret, and every frame after that carries an HMAC.  On connect each
+ * side sends its bound leases (catch-up), then every lease change as
+ * the DataTracker publishes it.  Newer expiry times win.
+ *
+ * Clients are split by the RFC 3074 hash of their client id: the
+ * primary answers buckets below split, the secondary the rest.  Free
+ * addresses are split too, even offsets to the primary and odd to the
+ * secondary, so both can allocate without asking.  A server that has
+ * not heard from its partner for the partner-down time answers every
+ * client from the whole pool.
+ */
+
+const (
+	FailoverPrimary   = "primary"
+	FailoverSecondary = "secondary"
+
+	failoverPort = "647"
+)
+
+// Failover states
+const (
+	failoverNormal      = "normal"
+	failoverInterrupted = "interrupted" // Own clients and addresses only
+	failoverPartnerDown = "partner-down"
+)
+
+// Frame types
+const (
+	fmHello   = "hello"
+	fmWelcome = "welcome"
+	fmUpdate  = "update"
+	fmRemove  = "remove"
+	fmSynced  = "synced" // End of catch-up
+	fmPing    = "ping"
+)
+
+// RFC 3074 section 6 mixing table
+var loadbMxTbl = [256]byte{
+	251, 175, 119, 215, 81, 14, 79, 191, 103, 49, 181, 143, 186, 157, 0,
+	232, 31, 32, 55, 60, 152, 58, 17, 237, 174, 70, 160, 144, 220, 90, 57,
+	223, 59, 3, 18, 140, 111, 166, 203, 196, 134, 243, 124, 95, 222, 179,
+	197, 65, 180, 48, 36, 15, 107, 46, 233, 130, 165, 30, 123, 161, 209, 23,
+	97, 16, 40, 91, 219, 61, 100, 10, 210, 109, 250, 127, 22, 138, 29, 108,
+	244, 67, 207, 9, 178, 204, 74, 98, 126, 249, 167, 116, 34, 77, 193,
+	200, 121, 5, 20, 113, 71, 35, 128, 13, 182, 94, 25, 226, 227, 199, 75,
+	27, 41, 245, 230, 224, 43, 225, 177, 26, 155, 150, 212, 142, 218, 115,
+	241, 73, 88, 105, 39, 114, 62, 255, 192, 201, 145, 214, 168, 158, 221,
+	148, 154, 122, 12, 84, 82, 163, 44, 139, 228, 236, 205, 242, 217, 11,
+	187, 146, 159, 64, 86, 239, 195, 42, 106, 198, 118, 112, 184, 172, 87,
+	2, 173, 117, 176, 229, 247, 253, 137, 185, 99, 164, 102, 147, 45, 66,
+	231, 52, 141, 211, 194, 206, 246, 238, 56, 110, 78, 248, 63, 240, 189,
+	93, 92, 51, 53, 183, 19, 171, 72, 50, 33, 104, 101, 69, 8, 252, 83, 120,
+	76, 135, 85, 54, 202, 125, 188, 213, 96, 235, 136, 208, 162, 129, 190,
+	132, 156, 38, 47, 1, 7, 254, 24, 4, 216, 131, 89, 21, 28, 133, 37, 153,
+	149, 80, 170, 68, 6, 169, 234, 151,
+}
+
+// loadBalanceHash is the RFC 3074 bucket of a client id.
+func loadBalanceHash(key []byte) byte {
+	hash := byte(len(key))
+	for i := len(key); i > 0; {
+		i--
+		hash = loadbMxTbl[hash^key[i]]
+	}
+	return hash
+}
+
+type failoverMsg struct {
+	Type   string `json:"type"`
+	Role   string `json:"role,omitempty"`
+	Nonce  string `json:"nonce,omitempty"`
+	Proof  string `json:"proof,omitempty"`
+	Split  int    `json:"split,omitempty"`
+	Subnet string `json:"subnet,omitempty"`
+	Prefix bool   `json:"prefix,omitempty"` // Lease is a delegated prefix
+	Lease  *Lease `json:"lease,omitempty"`
+}
+
+type Failover struct {
+	dt          *DataTracker
+	role        string
+	address     string // Where the primary listens
+	secret      []byte
+	split       int // Buckets the primary answers, of 256
+	partnerDown time.Duration
+	heartbeat   time.Duration
+
+	lock     sync.Mutex
+	state    string
+	since    time.Time // Of the last state change
+	session  *failoverSession
+	listener net.Listener
+	closed   bool
+}
+
+func NewFailover(dt *DataTracker, role, address, secret string, split int, partnerDown time.Duration) *Failover {
+	return &Failover{
+		dt:          dt,
+		role:        role,
+		address:     failoverAddr(address),
+		secret:      []byte(secret),
+		split:       split,
+		partnerDown: partnerDown,
+		heartbeat:   time.Second,
+		state:       failoverInterrupted,
+		since:       time.Now(),
+	}
+}
+
+// failoverAddr adds the failover port if it is missing.
+func failoverAddr(s string) string {
+	if _, _, err := net.SplitHostPort(s); err != nil {
+		return net.JoinHostPort(s, failoverPort)
+	}
+	return s
+}
+
+// Start listens on the primary and starts connecting on the secondary.
+func (f *Failover) Start() error {
+	if f.role == FailoverSecondary {
+		go f.Run()
+		return nil
+	}
+	l, err := net.Listen("tcp", f.address)
+	if err != nil {
+		return err
+	}
+	go f.Serve(l)
+	return nil
+}
+
+// Serve takes partner connections on the primary until l is closed.
+func (f *Failover) Serve(l net.Listener) error {
+	f.lock.Lock()
+	f.listener = l
+	f.lock.Unlock()
+	log.Println("Failover: waiting for the secondary on ", l.Addr())
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			err := f.run_session(conn)
+			log.Println("Failover: lost secondary: ", err)
+		}()
+	}
+}
+
+// Run keeps the secondary connected to the primary until Close.
+func (f *Failover) Run() {
+	for !f.is_closed() {
+		conn, err := net.DialTimeout("tcp", f.address, 5*time.Second)
+		if err == nil {
+			err = f.run_session(conn)
+		}
+		log.Println("Failover: no primary at ", f.address, ": ", err)
+		time.Sleep(f.heartbeat)
+	}
+}
+
+func (f *Failover) Close() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.closed = true
+	if f.listener != nil {
+		f.listener.Close()
+	}
+	if f.session != nil {
+		f.session.conn.Close()
+	}
+}
+
+func (f *Failover) is_closed() bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.closed
+}
+
+// current_state moves on to partner-down once the partner has been
+// gone long enough.
+func (f *Failover) current_state() string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.state == failoverInterrupted && time.Since(f.since) >= f.partnerDown {
+		f.set_state(failoverPartnerDown)
+	}
+	return f.state
+}
+
+// set_state assumes the lock is held.
+func (f *Failover) set_state(state string) {
+	if f.state != state {
+		log.Println("Failover: ", f.state, " -> ", state)
+		f.state = state
+		f.since = time.Now()
+	}
+}
+
+// serves reports whether this server answers the client with id.
+func (f *Failover) serves(id []byte) bool {
+	if f == nil || f.current_state() == failoverPartnerDown {
+		return true
+	}
+	primary := int(loadBalanceHash(id)) < f.split
+	return primary == (f.role == FailoverPrimary)
+}
+
+// firstFreeBit is firstClearBit over the addresses this server may
+// hand out.
+func (f *Failover) firstFreeBit(bs *bitset.BitSet) (uint, bool) {
+	if f == nil || f.current_state() == failoverPartnerDown {
+		return firstClearBit(bs)
+	}
+	start := uint(0)
+	if f.role == FailoverSecondary {
+		start = 1
+	}
+	for i := start; i < bs.Len(); i += 2 {
+		if !bs.Test(i) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// Handle sends lease changes to the partner.  If the partner can't
+// keep up the session is dropped, and catch-up brings it back in step.
+func (f *Failover) Handle(e *Event) {
+	if f == nil || e.Lease == nil {
+		return
+	}
+	m := &failoverMsg{Subnet: e.Subnet, Lease: e.Lease}
+	switch e.Type {
+	case EventLeaseBound, EventLeaseRenewed:
+		m.Type = fmUpdate
+	case EventLeaseReleased, EventLeaseDeclined, EventLeaseExpired:
+		m.Type = fmRemove
+	case EventPrefixBound, EventPrefixRenewed:
+		m.Type, m.Prefix = fmUpdate, true
+	case EventPrefixReleased, EventPrefixExpired:
+		m.Type, m.Prefix = fmRemove, true
+	default:
+		return
+	}
+	f.lock.Lock()
+	s := f.session
+	f.lock.Unlock()
+	if s == nil {
+		return
+	}
+	select {
+	case s.out <- m:
+	default:
+		log.Println("Failover: partner too slow, resyncing")
+		s.conn.Close()
+	}
+}
+
+/*
+ * Sessions
+ */
+
+type failoverSession struct {
+	conn    net.Conn
+	r       *bufio.Reader
+	sendKey []byte
+	recvKey []byte
+	sendSeq uint64
+	recvSeq uint64
+	out     chan *failoverMsg
+	dead    chan struct{} // Closed when write_loop stops draining out
+}
+
+func (f *Failover) mac(key []byte, parts ...string) []byte {
+	h := hmac.New(sha256.New, key)
+	for _, p := range parts {
+		h.Write([]byte(p))
+	}
+	return h.Sum(nil)
+}
+
+// write sends m, with an HMAC over the sequence number and message
+// once the session has keys.
+func (s *failoverSession) write(m *failoverMsg) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	line := string(data)
+	if s.sendKey != nil {
+		s.sendSeq++
+		line = hex.EncodeToString(frameMac(s.sendKey, s.sendSeq, data)) + " " + line
+	}
+	_, err = s.conn.Write([]byte(line + "\n"))
+	return err
+}
+
+func (s *failoverSession) read(timeout time.Duration) (*failoverMsg, error) {
+	s.conn.SetReadDeadline(time.Now().Add(timeout))
+	line, err := s.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	data := []byte(strings.TrimSpace(line))
+	if s.recvKey != nil {
+		parts := strings.SplitN(string(data), " ", 2)
+		if len(parts) != 2 {
+			return nil, errors.New("unauthenticated frame")
+		}
+		sum, err := hex.DecodeString(parts[0])
+		s.recvSeq++
+		if err != nil || !hmac.Equal(sum, frameMac(s.recvKey, s.recvSeq, []byte(parts[1]))) {
+			return nil, errors.New("bad frame authentication")
+		}
+		data = []byte(parts[1])
+	}
+	m := &failoverMsg{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func frameMac(key []byte, seq uint64, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	binary.Write(h, binary.BigEndian, seq)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func newNonce() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// handshake proves both sides know the secret and derives the frame
+// keys from both nonces.
+func (f *Failover) handshake(s *failoverSession) error {
+	timeout := 10 * time.Second
+	partner := FailoverSecondary
+	if f.role == FailoverSecondary {
+		partner = FailoverPrimary
+	}
+	var np, ns string
+	if f.role == FailoverPrimary {
+		np = newNonce()
+		if err := s.write(&failoverMsg{Type: fmHello, Role: f.role, Nonce: np, Split: f.split}); err != nil {
+			return err
+		}
+		m, err := s.read(timeout)
+		if err != nil {
+			return err
+		}
+		ns = m.Nonce
+		if err := f.check_hello(m, partner, np, ns); err != nil {
+			return err
+		}
+		proof := hex.EncodeToString(f.mac(f.secret, f.role, np, ns))
+		if err := s.write(&failoverMsg{Type: fmWelcome, Proof: proof}); err != nil {
+			return err
+		}
+	} else {
+		m, err := s.read(timeout)
+		if err != nil {
+			return err
+		}
+		np, ns = m.Nonce, newNonce()
+		if m.Type != fmHello || m.Role != partner || np == "" {
+			return errors.New("unexpected hello")
+		}
+		if m.Split != f.split {
+			return fmt.Errorf("partner split is %d, ours is %d", m.Split, f.split)
+		}
+		proof := hex.EncodeToString(f.mac(f.secret, f.role, np, ns))
+		if err := s.write(&failoverMsg{Type: fmHello, Role: f.role, Nonce: ns, Split: f.split, Proof: proof}); err != nil {
+			return err
+		}
+		m, err = s.read(timeout)
+		if err != nil {
+			return err
+		}
+		if m.Type != fmWelcome || !f.check_proof(m.Proof, partner, np, ns) {
+			return errors.New("primary failed authentication")
+		}
+	}
+	s.sendKey = f.mac(f.secret, f.role+" session", np, ns)
+	s.recvKey = f.mac(f.secret, partner+" session", np, ns)
+	return nil
+}
+
+func (f *Failover) check_hello(m *failoverMsg, partner, np, ns string) error {
+	if m.Type != fmHello || m.Role != partner || ns == "" {
+		return errors.New("unexpected hello")
+	}
+	if !f.check_proof(m.Proof, partner, np, ns) {
+		return errors.New("secondary failed authentication")
+	}
+	if m.Split != f.split {
+		return fmt.Errorf("partner split is %d, ours is %d", m.Split, f.split)
+	}
+	return nil
+}
+
+func (f *Failover) check_proof(proof, role, np, ns string) bool {
+	sum, err := hex.DecodeString(proof)
+	return err == nil && hmac.Equal(sum, f.mac(f.secret, role, np, ns))
+}
+
+// run_session authenticates the partner, catches both sides up and
+// then exchanges lease changes until the connection fails.
+func (f *Failover) run_session(conn net.Conn) error {
+	defer conn.Close()
+	s := &failoverSession{
+		conn: conn,
+		r:    bufio.NewReader(conn),
+		out:  make(chan *failoverMsg, 1024),
+		dead: make(chan struct{}),
+	}
+	if err := f.handshake(s); err != nil {
+		return err
+	}
+
+	f.lock.Lock()
+	if f.closed {
+		f.lock.Unlock()
+		return errors.New("closed")
+	}
+	if f.session != nil {
+		f.session.conn.Close()
+	}
+	f.session = s
+	f.lock.Unlock()
+	log.Println("Failover: connected to ", f.partner_role(), " at ", conn.RemoteAddr())
+
+	defer func() {
+		f.lock.Lock()
+		if f.session == s {
+			f.session = nil
+			f.set_state(failoverInterrupted)
+		}
+		f.lock.Unlock()
+	}()
+
+	done := make(chan struct{})
+	defer close(done)
+	go f.write_loop(s, done)
+
+	// Catch-up.  Changes made meanwhile are queued behind it.  If the
+	// writer gives up nothing drains out, so stop with it.
+	for _, m := range append(f.snapshot(), &failoverMsg{Type: fmSynced}) {
+		select {
+		case s.out <- m:
+		case <-s.dead:
+			return errors.New("connection lost during catch-up")
+		}
+	}
+
+	for {
+		m, err := s.read(3 * f.heartbeat)
+		if err != nil {
+			return err
+		}
+		switch m.Type {
+		case fmUpdate, fmRemove:
+			f.apply(m)
+		case fmSynced:
+			f.lock.Lock()
+			f.set_state(failoverNormal)
+			f.lock.Unlock()
+		}
+	}
+}
+
+func (f *Failover) partner_role() string {
+	if f.role == FailoverPrimary {
+		return FailoverSecondary
+	}
+	return FailoverPrimary
+}
+
+func (f *Failover) write_loop(s *failoverSession, done chan struct{}) {
+	defer close(s.dead)
+	ticker := time.NewTicker(f.heartbeat)
+	defer ticker.Stop()
+	for {
+		var err error
+		select {
+		case m := <-s.out:
+			err = s.write(m)
+		case <-ticker.C:
+			err = s.write(&failoverMsg{Type: fmPing})
+		case <-done:
+			return
+		}
+		if err != nil {
+			s.conn.Close()
+			return
+		}
+	}
+}
+
+// snapshot copies every unexpired bound lease and delegation.
+func (f *Failover) snapshot() []*failoverMsg {
+	now := time.Now()
+	msgs := make([]*failoverMsg, 0)
+	add := func(subnet string, l *Lease, prefix bool) {
+		if l.ExpireTime.After(now) {
+			c := *l
+			msgs = append(msgs, &failoverMsg{Type: fmUpdate, Subnet: subnet, Lease: &c, Prefix: prefix})
+		}
+	}
+	for _, s := range f.dt.Subnets {
+		s.lock.RLock()
+		for _, l := range s.Leases {
+			add(s.Name, l, false)
+		}
+		for _, l := range s.Delegations {
+			add(s.Name, l, true)
+		}
+		s.lock.RUnlock()
+	}
+	return msgs
+}
+
+// apply merges a lease change from the partner.  It is not published:
+// the partner already sent its webhooks and DNS updates.
+func (f *Failover) apply(m *failoverMsg) {
+	s := f.dt.Subnets[m.Subnet]
+	if s == nil || m.Lease == nil {
+		return
+	}
+	remove := m.Type == fmRemove
+	s.lock.Lock()
+	var changed bool
+	if m.Prefix {
+		if s.DelegatedPrefix == nil {
+			s.lock.Unlock()
+			return
+		}
+		changed = mergeLease(s.Delegations, s.DelegatedBits, s.delegation_bit, m.Lease, remove)
+	} else {
+		changed = mergeLease(s.Leases, s.ActiveBits, s.active_bit, m.Lease, remove)
+	}
+	s.lock.Unlock()
+	if changed {
+		f.dt.save_subnet(s.Name)
+	}
+}
+
+// mergeLease applies a partner's lease to leases and their bits, the
+// later expiry winning.  It reports whether anything changed.
+func mergeLease(leases map[string]*Lease, bits *bitset.BitSet, bit func(net.IP) (uint, bool), l *Lease, remove bool) bool {
+	key := l.key()
+	ours := leases[key]
+	if remove {
+		if ours == nil || !ours.Ip.Equal(l.Ip) || ours.ExpireTime.After(l.ExpireTime) {
+			return false
+		}
+		if b, ok := bit(ours.Ip); ok {
+			bits.Clear(b)
+		}
+		delete(leases, key)
+		return true
+	}
+
+	if ours != nil && !l.ExpireTime.After(ours.ExpireTime) {
+		return false
+	}
+	// Another client holding the address loses to the newer lease.
+	for k, o := range leases {
+		if k != key && o.Ip.Equal(l.Ip) {
+			if o.ExpireTime.After(l.ExpireTime) {
+				return false
+			}
+			delete(leases, k)
+		}
+	}
+	if ours != nil && !ours.Ip.Equal(l.Ip) {
+		if b, ok := bit(ours.Ip); ok {
+			bits.Clear(b)
+		}
+	}
+	if b, ok := bit(l.Ip); ok {
+		bits.Set(b)
+	}
+	leases[key] = l
+	return true
+}
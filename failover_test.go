@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/willf/bitset"
+)
+
+func failoverTracker(t *testing.T) *DataTracker {
+	f, err := ioutil.TempFile("", "rebar-dhcp-failover")
+	assert.Nil(t, err)
+	f.Close()
+	t.Cleanup(func() { os.Remove(f.Name()) })
+	store, err := NewFileStore(f.Name())
+	assert.Nil(t, err)
+	dt := NewDataTracker(store)
+	s, _, _ := addNewSubnet(dt, "fred", "192.168.128.0/24")
+	s.ActiveBits = bitset.New(s.active_size())
+	return dt
+}
+
+// failoverPair connects a primary and a secondary on loopback.
+func failoverPair(t *testing.T, dt1, dt2 *DataTracker, secret2 string) (*Failover, *Failover) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	p := NewFailover(dt1, FailoverPrimary, "", "sekrit", 128, 300*time.Millisecond)
+	s := NewFailover(dt2, FailoverSecondary, l.Addr().String(), secret2, 128, 300*time.Millisecond)
+	p.heartbeat = 20 * time.Millisecond
+	s.heartbeat = 20 * time.Millisecond
+	dt1.failover, dt2.failover = p, s
+	go p.Serve(l)
+	go s.Run()
+	t.Cleanup(func() {
+		p.Close()
+		s.Close()
+	})
+	return p, s
+}
+
+func waitFor(cond func() bool) bool {
+	for i := 0; i < 200; i++ {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func leaseFor(dt *DataTracker, mac string) *Lease {
+	s := dt.Subnets["fred"]
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if l := s.Leases[mac]; l != nil {
+		c := *l
+		return &c
+	}
+	return nil
+}
+
+func TestFailoverSync(t *testing.T) {
+	dt1, dt2 := failoverTracker(t), failoverTracker(t)
+
+	// Bound before the partners meet: sent in the catch-up.
+	s1 := dt1.Subnets["fred"]
+	early, _ := s1.find_or_get_info(dt1, "52:54:00:00:00:01", nil)
+	s1.update_lease_time(dt1, early, time.Hour)
+
+	p, s := failoverPair(t, dt1, dt2, "sekrit")
+	assert.True(t, waitFor(func() bool {
+		return p.current_state() == failoverNormal && s.current_state() == failoverNormal
+	}))
+	assert.True(t, waitFor(func() bool { return leaseFor(dt2, "52:54:00:00:00:01") != nil }))
+	l := leaseFor(dt2, "52:54:00:00:00:01")
+	assert.Equal(t, "192.168.128.5", l.Ip.String())
+	bit, _ := dt2.Subnets["fred"].active_bit(l.Ip)
+	assert.True(t, dt2.Subnets["fred"].ActiveBits.Test(bit))
+
+	// The secondary hands out odd offsets, and the primary hears of it.
+	s2 := dt2.Subnets["fred"]
+	live, _ := s2.find_or_get_info(dt2, "52:54:00:00:00:02", nil)
+	assert.Equal(t, "192.168.128.6", live.Ip.String())
+	s2.update_lease_time(dt2, live, time.Hour)
+	assert.True(t, waitFor(func() bool { return leaseFor(dt1, "52:54:00:00:00:02") != nil }))
+
+	// Releases are removed on the partner.
+	s1.free_lease(dt1, "52:54:00:00:00:01", EventLeaseReleased)
+	assert.True(t, waitFor(func() bool { return leaseFor(dt2, "52:54:00:00:00:01") == nil }))
+	assert.False(t, s2.ActiveBits.Test(bit))
+}
+
+func TestFailoverCatchUpCut(t *testing.T) {
+	dt1, dt2 := failoverTracker(t), failoverTracker(t)
+	// More than the session queue holds.
+	s1 := dt1.Subnets["fred"]
+	for i := 0; i < 2000; i++ {
+		mac := fmt.Sprintf("52:54:00:00:%02x:%02x", i>>8, i&0xff)
+		s1.Leases[mac] = &Lease{Ip: net.ParseIP("192.168.128.5"), Mac: mac, ExpireTime: time.Now().Add(time.Hour)}
+	}
+	p := NewFailover(dt1, FailoverPrimary, "", "sekrit", 128, time.Minute)
+	sec := NewFailover(dt2, FailoverSecondary, "", "sekrit", 128, time.Minute)
+
+	c1, c2 := net.Pipe()
+	errs := make(chan error, 1)
+	go func() { errs <- p.run_session(c1) }()
+
+	// The partner authenticates, then goes away before the catch-up.
+	assert.Nil(t, sec.handshake(&failoverSession{conn: c2, r: bufio.NewReader(c2)}))
+	c2.Close()
+	select {
+	case err := <-errs:
+		assert.NotNil(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("catch-up hung on a dead connection")
+	}
+	p.lock.Lock()
+	assert.Nil(t, p.session)
+	p.lock.Unlock()
+}
+
+func TestFailoverBadSecret(t *testing.T) {
+	dt1, dt2 := failoverTracker(t), failoverTracker(t)
+	p, s := failoverPair(t, dt1, dt2, "guess")
+	time.Sleep(100 * time.Millisecond)
+	assert.NotEqual(t, failoverNormal, p.current_state())
+	assert.NotEqual(t, failoverNormal, s.current_state())
+}
+
+func TestFailoverPartnerDown(t *testing.T) {
+	dt1, dt2 := failoverTracker(t), failoverTracker(t)
+	p, s := failoverPair(t, dt1, dt2, "sekrit")
+	assert.True(t, waitFor(func() bool { return p.current_state() == failoverNormal }))
+
+	// Find clients in each server's half.
+	var mine, theirs []byte
+	for i := byte(0); mine == nil || theirs == nil; i++ {
+		id := []byte{1, 0x52, 0x54, 0, 0, 0, i}
+		if loadBalanceHash(id) < 128 {
+			mine = id
+		} else {
+			theirs = id
+		}
+	}
+	assert.True(t, p.serves(mine))
+	assert.False(t, p.serves(theirs))
+	assert.True(t, s.serves(theirs))
+
+	s.Close()
+	assert.True(t, waitFor(func() bool { return p.current_state() == failoverInterrupted }))
+	assert.False(t, p.serves(theirs))
+	bit, _ := p.firstFreeBit(dt1.Subnets["fred"].ActiveBits)
+	assert.Equal(t, uint(0), bit)
+	dt1.Subnets["fred"].ActiveBits.Set(0)
+	bit, _ = p.firstFreeBit(dt1.Subnets["fred"].ActiveBits)
+	assert.Equal(t, uint(2), bit)
+
+	assert.True(t, waitFor(func() bool { return p.current_state() == failoverPartnerDown }))
+	assert.True(t, p.serves(theirs))
+	bit, _ = p.firstFreeBit(dt1.Subnets["fred"].ActiveBits)
+	assert.Equal(t, uint(1), bit)
+}
+
+func TestLoadBalanceHash(t *testing.T) {
+	seen := make(map[byte]bool)
+	for _, b := range loadbMxTbl {
+		seen[b] = true
+	}
+	assert.Equal(t, 256, len(seen))
+
+	assert.Equal(t, byte(0), loadBalanceHash(nil))
+	assert.Equal(t, loadbMxTbl[1^0xaa], loadBalanceHash([]byte{0xaa}))
+	assert.Equal(t, loadbMxTbl[loadbMxTbl[2^0x02]^0x01], loadBalanceHash([]byte{0x01, 0x02}))
+}
+
+func TestFailoverMerge(t *testing.T) {
+	_, s := simpleSetup()
+	s.ActiveBits = bitset.New(s.active_size())
+	now := time.Now()
+	old := &Lease{Ip: net.ParseIP("192.168.128.5").To4(), Mac: "a", ExpireTime: now.Add(time.Minute)}
+	newer := &Lease{Ip: net.ParseIP("192.168.128.5").To4(), Mac: "b", ExpireTime: now.Add(time.Hour)}
+
+	assert.True(t, mergeLease(s.Leases, s.ActiveBits, s.active_bit, old, false))
+	assert.True(t, s.ActiveBits.Test(0))
+	// An older copy doesn't win.
+	stale := *old
+	stale.ExpireTime = now
+	assert.False(t, mergeLease(s.Leases, s.ActiveBits, s.active_bit, &stale, false))
+	// A newer lease on the same address takes it over.
+	assert.True(t, mergeLease(s.Leases, s.ActiveBits, s.active_bit, newer, false))
+	assert.Nil(t, s.Leases["a"])
+	// A client moving address frees the old one.
+	moved := *newer
+	moved.Ip = net.ParseIP("192.168.128.7").To4()
+	moved.ExpireTime = now.Add(2 * time.Hour)
+	assert.True(t, mergeLease(s.Leases, s.ActiveBits, s.active_bit, &moved, false))
+	assert.False(t, s.ActiveBits.Test(0))
+	assert.True(t, s.ActiveBits.Test(2))
+	// A remove for an address the client no longer has is ignored.
+	assert.False(t, mergeLease(s.Leases, s.ActiveBits, s.active_bit, newer, true))
+	assert.True(t, mergeLease(s.Leases, s.ActiveBits, s.active_bit, &moved, true))
+	assert.False(t, s.ActiveBits.Test(2))
+}
+
+func TestFailoverConfig(t *testing.T) {
+	path := write_config(t, `[network]
+port = 6755
+username = admin
+password = admin
+
+[storage]
+data-dir = /tmp/dhcp
+
+[failover]
+role = secondary
+address = 10.0.0.1
+secret = sekrit
+`)
+	defer os.Remove(path)
+
+	cfg, err := readConfig(path)
+	assert.Nil(t, err)
+	f := cfg.failover(nil)
+	assert.Equal(t, "10.0.0.1:647", f.address)
+	assert.Equal(t, 128, f.split)
+	assert.Equal(t, time.Minute, f.partnerDown)
+
+	cfg.Failover.Role = "tertiary"
+	cfg.Failover.Secret = ""
+	cfg.Failover.Split = 300
+	assert.Equal(t, ConfigError{
+		`failover.role "tertiary" must be primary or secondary`,
+		"failover.secret is required",
+		"failover.split must be between 0 and 256",
+	}, cfg.validate())
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ant0ine/go-json-rest/rest"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	dhcp "github.com/krolaw/dhcp4"
+)
+
+/*
+ * Lease history
+ *
+ * Lease events are appended to <dir>/history.log as JSON lines, so
+ * the holders of an address can be found after their lease is gone.
+ * When the log passes max-size it is renamed to history-<time>.log and
+ * a new one started.  Rotated logs older than the retention time are
+ * removed.
+ */
+
+const (
+	historyFile   = "history.log"
+	historyPrefix = "history-"
+)
+
+type HistoryRecord struct {
+	Time       time.Time `json:"time"`
+	Event      string    `json:"event"`
+	Subnet     string    `json:"subnet"`
+	Ip         net.IP    `json:"ip"`
+	Mac        string    `json:"mac,omitempty"`
+	ClientId   string    `json:"client_id,omitempty"` // Option 61 in hex, or the DUID
+	Hostname   string    `json:"hostname,omitempty"`
+	ExpireTime time.Time `json:"expire_time"`
+	RelayAddr  net.IP    `json:"relay_addr,omitempty"`
+	CircuitId  string    `json:"circuit_id,omitempty"`
+	RemoteId   string    `json:"remote_id,omitempty"`
+}
+
+// holds reports whether the record's client held its address at some
+// point between from and to.  Bound and renewed leases are held until
+// they expire, anything else only at the moment it happened.
+func (r *HistoryRecord) holds(from, to time.Time) bool {
+	end := r.Time
+	switch r.Event {
+	case EventLeaseBound, EventLeaseRenewed, EventPrefixBound, EventPrefixRenewed:
+		if r.ExpireTime.After(end) {
+			end = r.ExpireTime
+		}
+	}
+	return (from.IsZero() || !end.Before(from)) && (to.IsZero() || !r.Time.After(to))
+}
+
+type LeaseHistory struct {
+	dir     string
+	maxSize int64
+	retain  time.Duration
+
+	lock sync.Mutex
+	file *os.File
+	size int64
+}
+
+func NewLeaseHistory(dir string, maxSize int64, retain time.Duration) (*LeaseHistory, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	h := &LeaseHistory{dir: dir, maxSize: maxSize, retain: retain}
+	if err := h.open(); err != nil {
+		return nil, err
+	}
+	h.prune()
+	return h, nil
+}
+
+func (h *LeaseHistory) open() error {
+	f, err := os.OpenFile(filepath.Join(h.dir, historyFile), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	h.file, h.size = f, fi.Size()
+	return nil
+}
+
+// Record appends lease events.  Failures are logged, the DHCP answer
+// has already gone.
+func (h *LeaseHistory) Record(e *Event) {
+	if h == nil || e.Lease == nil {
+		return
+	}
+	switch e.Type {
+	case EventLeaseOffered, EventLeaseBound, EventLeaseRenewed, EventLeaseReleased,
+		EventLeaseDeclined, EventLeaseExpired, EventPrefixBound, EventPrefixRenewed,
+		EventPrefixReleased, EventPrefixExpired:
+	default:
+		return
+	}
+	l := e.Lease
+	r := &HistoryRecord{
+		Time:       e.Time,
+		Event:      e.Type,
+		Subnet:     e.Subnet,
+		Ip:         l.Ip,
+		Mac:        l.Mac,
+		ClientId:   l.ClientId,
+		Hostname:   l.ClientName(),
+		ExpireTime: l.ExpireTime,
+		RelayAddr:  l.RelayAddr,
+		CircuitId:  l.CircuitId,
+		RemoteId:   l.RemoteId,
+	}
+	if l.Duid != "" {
+		r.ClientId = l.Duid
+	}
+	if r.Time.IsZero() {
+		r.Time = time.Now()
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		log.Println("History: ", err)
+		return
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.file == nil {
+		if err := h.open(); err != nil {
+			log.Println("History: ", err)
+			return
+		}
+	}
+	n, err := h.file.Write(append(data, '\n'))
+	h.size += int64(n)
+	if err != nil {
+		log.Println("History: ", err)
+	}
+	if h.size >= h.maxSize {
+		h.rotate()
+	}
+}
+
+// rotate assumes the lock is held.
+func (h *LeaseHistory) rotate() {
+	h.file.Close()
+	h.file = nil
+	name := historyPrefix + time.Now().UTC().Format("20060102T150405.000000000") + ".log"
+	if err := os.Rename(filepath.Join(h.dir, historyFile), filepath.Join(h.dir, name)); err != nil {
+		log.Println("History: rotating failed: ", err)
+	}
+	if err := h.open(); err != nil {
+		log.Println("History: ", err)
+	}
+	h.prune()
+}
+
+// rotated lists the rotated logs, oldest first.
+func (h *LeaseHistory) rotated() []string {
+	files, _ := filepath.Glob(filepath.Join(h.dir, historyPrefix+"*.log"))
+	sort.Strings(files)
+	return files
+}
+
+// prune removes rotated logs last written before the retention time.
+func (h *LeaseHistory) prune() {
+	if h.retain <= 0 {
+		return
+	}
+	cutoff := time.Now().Add(-h.retain)
+	for _, f := range h.rotated() {
+		if fi, err := os.Stat(f); err == nil && fi.ModTime().Before(cutoff) {
+			os.Remove(f)
+		}
+	}
+}
+
+type HistoryQuery struct {
+	Mac  string
+	Ip   net.IP
+	From time.Time // Zero for no limit
+	To   time.Time
+}
+
+// Query returns the matching records, oldest first.  The logs are
+// opened under the lock, so a rotation can't move one away, and read
+// after it is released so Record isn't held up by the scan.
+func (h *LeaseHistory) Query(q HistoryQuery) ([]*HistoryRecord, error) {
+	files, err := h.openLogs()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	records := make([]*HistoryRecord, 0)
+	for _, f := range files {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			r := &HistoryRecord{}
+			if json.Unmarshal(scanner.Bytes(), r) != nil {
+				continue // Torn write
+			}
+			if q.Mac != "" && !strings.EqualFold(r.Mac, q.Mac) {
+				continue
+			}
+			if q.Ip != nil && !r.Ip.Equal(q.Ip) {
+				continue
+			}
+			if r.holds(q.From, q.To) {
+				records = append(records, r)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return records, nil
+}
+
+// openLogs opens the rotated logs and the current one, oldest first.
+func (h *LeaseHistory) openLogs() ([]*os.File, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	files := make([]*os.File, 0)
+	for _, name := range append(h.rotated(), filepath.Join(h.dir, historyFile)) {
+		f, err := os.Open(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+func (h *LeaseHistory) Close() error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.file == nil {
+		return nil
+	}
+	err := h.file.Close()
+	h.file = nil
+	return err
+}
+
+/*
+ * Client and relay details kept on leases for the history
+ */
+
+// relayInfo is where a relayed request came from.
+type relayInfo struct {
+	addr    net.IP // giaddr, or the DHCPv6 relay's link address
+	circuit string // Option 82 circuit id, or DHCPv6 interface-id
+	remote  string // Option 82 remote id, or DHCPv6 remote-id
+}
+
+// idString shows printable ids as text and others as hex.
+func idString(b []byte) string {
+	for _, c := range b {
+		if c < 0x20 || c > 0x7e {
+			return net.HardwareAddr(b).String()
+		}
+	}
+	return string(b)
+}
+
+func relayInfo4(p dhcp.Packet, options dhcp.Options) relayInfo {
+	ri := relayInfo{}
+	if giaddr := p.GIAddr(); !giaddr.Equal(net.IPv4zero) {
+		ri.addr = append(net.IP{}, giaddr...)
+	}
+	sub := options[OptionRelayAgentInfo]
+	for len(sub) >= 2 && len(sub) >= 2+int(sub[1]) {
+		v := sub[2 : 2+int(sub[1])]
+		switch sub[0] {
+		case relayCircuitId:
+			ri.circuit = idString(v)
+		case relayRemoteId:
+			ri.remote = idString(v)
+		}
+		sub = sub[2+int(sub[1]):]
+	}
+	return ri
+}
+
+// relayInfo6 is the relay nearest the client.
+func relayInfo6(req dhcpv6.DHCPv6) relayInfo {
+	ri := relayInfo{}
+	if !req.IsRelay() {
+		return ri
+	}
+	inner, err := dhcpv6.DecapsulateRelayIndex(req, -1)
+	if err != nil {
+		return ri
+	}
+	r, ok := inner.(*dhcpv6.RelayMessage)
+	if !ok {
+		return ri
+	}
+	ri.addr = r.LinkAddr
+	if id := r.Options.InterfaceID(); id != nil {
+		ri.circuit = idString(id)
+	}
+	if rid := r.Options.RemoteID(); rid != nil {
+		ri.remote = idString(rid.RemoteID)
+	}
+	return ri
+}
+
+func (l *Lease) record_relay(ri relayInfo) {
+	l.RelayAddr = ri.addr
+	l.CircuitId = ri.circuit
+	l.RemoteId = ri.remote
+}
+
+func (l *Lease) record_client_id(options dhcp.Options) {
+	if id, ok := options[dhcp.OptionClientIdentifier]; ok {
+		l.ClientId = hex.EncodeToString(id)
+	}
+}
+
+/*
+ * API
+ */
+
+func (fe *Frontend) GetHistory(w rest.ResponseWriter, r *rest.Request) {
+	if fe.DhcpInfo.history == nil {
+		rest.Error(w, "Lease history is not enabled", http.StatusNotFound)
+		return
+	}
+	v := r.URL.Query()
+	q := HistoryQuery{Mac: v.Get("mac")}
+	if q.Mac != "" {
+		if mac, err := net.ParseMAC(q.Mac); err == nil {
+			q.Mac = mac.String()
+		}
+	}
+	if s := v.Get("ip"); s != "" {
+		if q.Ip = net.ParseIP(s); q.Ip == nil {
+			rest.Error(w, "Invalid ip: "+s, http.StatusBadRequest)
+			return
+		}
+	}
+	for _, t := range []struct {
+		name string
+		dest *time.Time
+	}{{"from", &q.From}, {"to", &q.To}} {
+		s := v.Get(t.name)
+		if s == "" {
+			continue
+		}
+		var err error
+		if *t.dest, err = time.Parse(time.RFC3339, s); err != nil {
+			rest.Error(w, "Invalid "+t.name+" time, use RFC 3339: "+s, http.StatusBadRequest)
+			return
+		}
+	}
+	records, err := fe.DhcpInfo.history.Query(q)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sc := scopeOf(r)
+	visible := make([]*HistoryRecord, 0, len(records))
+	for _, rec := range records {
+		if fe.inScope(sc, rec.Subnet, rec.Ip) {
+			visible = append(visible, rec)
+		}
+	}
+	w.WriteJson(visible)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	dhcp "github.com/krolaw/dhcp4"
+	"github.com/stretchr/testify/assert"
+)
+
+func historySetup(t *testing.T, maxSize int64) (*DataTracker, *Subnet, *LeaseHistory) {
+	dir, err := ioutil.TempDir("", "rebar-dhcp-history")
+	assert.Nil(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	h, err := NewLeaseHistory(dir, maxSize, 24*time.Hour)
+	assert.Nil(t, err)
+	t.Cleanup(func() { h.Close() })
+	dt, s := simpleSetup()
+	dt.history = h
+	return dt, s, h
+}
+
+func TestLeaseHistory(t *testing.T) {
+	dt, s, h := historySetup(t, 1<<20)
+
+	lease := &Lease{Ip: net.ParseIP("192.168.128.5"), Mac: "52:54:00:00:00:01",
+		Hostname: "barney", RelayAddr: net.ParseIP("10.0.0.1"), CircuitId: "eth0"}
+	s.Leases[lease.Mac] = lease
+	s.update_lease_time(dt, lease, time.Hour)
+	s.free_lease(dt, lease.Mac, EventLeaseReleased)
+	other := &Lease{Ip: net.ParseIP("192.168.128.6"), Mac: "52:54:00:00:00:02"}
+	s.Leases[other.Mac] = other
+	s.update_lease_time(dt, other, time.Hour)
+
+	records, err := h.Query(HistoryQuery{Mac: "52:54:00:00:00:01"})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(records))
+	assert.Equal(t, EventLeaseBound, records[0].Event)
+	assert.Equal(t, EventLeaseReleased, records[1].Event)
+	assert.Equal(t, "barney", records[0].Hostname)
+	assert.Equal(t, "10.0.0.1", records[0].RelayAddr.String())
+	assert.Equal(t, "eth0", records[0].CircuitId)
+
+	records, _ = h.Query(HistoryQuery{Ip: net.ParseIP("192.168.128.6")})
+	assert.Equal(t, 1, len(records))
+	assert.Equal(t, "52:54:00:00:00:02", records[0].Mac)
+
+	// A bound lease is held until it expires.
+	from := time.Now().Add(30 * time.Minute)
+	records, _ = h.Query(HistoryQuery{Ip: net.ParseIP("192.168.128.6"), From: from})
+	assert.Equal(t, 1, len(records))
+	records, _ = h.Query(HistoryQuery{From: from.Add(time.Hour)})
+	assert.Equal(t, 0, len(records))
+	records, _ = h.Query(HistoryQuery{To: time.Now().Add(-time.Minute)})
+	assert.Equal(t, 0, len(records))
+}
+
+func TestLeaseHistoryRotation(t *testing.T) {
+	dt, s, h := historySetup(t, 200)
+
+	// Left behind by an earlier run, past retention.
+	stale := filepath.Join(h.dir, historyPrefix+"20000101T000000.000000000.log")
+	assert.Nil(t, ioutil.WriteFile(stale, []byte("{}\n"), 0600))
+	old := time.Now().Add(-48 * time.Hour)
+	assert.Nil(t, os.Chtimes(stale, old, old))
+
+	lease := &Lease{Ip: net.ParseIP("192.168.128.5"), Mac: "52:54:00:00:00:01"}
+	s.Leases[lease.Mac] = lease
+	for i := 0; i < 5; i++ {
+		s.update_lease_time(dt, lease, time.Hour)
+	}
+
+	_, err := os.Stat(stale)
+	assert.True(t, os.IsNotExist(err))
+	assert.True(t, len(h.rotated()) > 0)
+
+	// Queries read the rotated logs too.
+	records, err := h.Query(HistoryQuery{Mac: lease.Mac})
+	assert.Nil(t, err)
+	assert.Equal(t, 5, len(records))
+	assert.Equal(t, EventLeaseBound, records[0].Event)
+	assert.Equal(t, EventLeaseRenewed, records[4].Event)
+}
+
+func TestLeaseHistoryQueryDuringRotation(t *testing.T) {
+	dt, s, h := historySetup(t, 200)
+	lease := &Lease{Ip: net.ParseIP("192.168.128.5"), Mac: "52:54:00:00:00:01"}
+	s.Leases[lease.Mac] = lease
+	s.update_lease_time(dt, lease, time.Hour)
+
+	// A query's logs stay readable when a rotation moves them away.
+	files, err := h.openLogs()
+	assert.Nil(t, err)
+	for i := 0; i < 4; i++ {
+		s.update_lease_time(dt, lease, time.Hour)
+	}
+	assert.True(t, len(h.rotated()) > 0)
+	data, err := ioutil.ReadAll(files[len(files)-1])
+	assert.Nil(t, err)
+	assert.Contains(t, string(data), EventLeaseBound)
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+func TestRelayInfo4(t *testing.T) {
+	mac, _ := net.ParseMAC("52:54:00:00:00:01")
+	p := dhcp.RequestPacket(dhcp.Discover, mac, nil, []byte{1, 2, 3, 4}, false, []dhcp.Option{
+		{Code: dhcp.OptionClientIdentifier, Value: []byte{1, 0x52, 0x54, 0, 0, 0, 1}},
+		{Code: OptionRelayAgentInfo, Value: []byte{1, 4, 'e', 't', 'h', '0', 2, 2, 0xbe, 0xef}},
+	})
+	p.SetGIAddr(net.ParseIP("10.0.0.1").To4())
+	options := p.ParseOptions()
+
+	ri := relayInfo4(p, options)
+	assert.Equal(t, "10.0.0.1", ri.addr.String())
+	assert.Equal(t, "eth0", ri.circuit)
+	assert.Equal(t, "be:ef", ri.remote)
+
+	lease := &Lease{}
+	lease.record_client_id(options)
+	assert.Equal(t, "01525400000001", lease.ClientId)
+
+	// Not relayed.
+	p.SetGIAddr(net.IPv4zero)
+	assert.Nil(t, relayInfo4(p, dhcp.Options{}).addr)
+}
+
+func TestHistoryConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rebar-dhcp-history")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := write_config(t, `[network]
+port = 6755
+username = admin
+password = admin
+
+[storage]
+data-dir = /tmp/dhcp
+
+[history]
+dir = `+dir+`
+`)
+	defer os.Remove(path)
+	cfg, err := readConfig(path)
+	assert.Nil(t, err)
+	h, err := cfg.leaseHistory()
+	assert.Nil(t, err)
+	defer h.Close()
+	assert.Equal(t, int64(10<<20), h.maxSize)
+	assert.Equal(t, 90*24*time.Hour, h.retain)
+
+	cfg.History.MaxSize = -1
+	cfg.History.RetainDays = -1
+	assert.Equal(t, ConfigError{
+		"history.max-size can not be negative",
+		"history.retain-days can not be negative",
+	}, cfg.validate())
+}
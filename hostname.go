@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	dhcp "github.com/krolaw/dhcp4"
+)
+
+/*
+ * Host names and the Client FQDN option (RFC 4702)
+ *
+ * A lease's name comes from, in order: the binding's hostname, option
+ * 12 set on the binding, the subnet's hostname template, and finally
+ * whatever the client sent.  The first three are assigned by us and
+ * returned to the client in option 12 (and 81 if it sent one).
+ */
+
+// Client FQDN option flags
+const (
+	fqdnFlagS byte = 0x01 // Server should do the A update
+	fqdnFlagO byte = 0x02 // Server overrode the client's S
+	fqdnFlagE byte = 0x04 // Name is in DNS wire format
+	fqdnFlagN byte = 0x08 // Server should do no updates
+)
+
+// parseClientFQDN splits option 81 into its flags and name.
+func parseClientFQDN(b []byte) (byte, string) {
+	if len(b) < 3 {
+		return 0, ""
+	}
+	flags, name := b[0], b[3:]
+	if flags&fqdnFlagE == 0 {
+		return flags, string(name)
+	}
+	labels := make([]string, 0)
+	for len(name) > 0 && name[0] != 0 && int(name[0]) < len(name) {
+		labels = append(labels, string(name[1:1+name[0]]))
+		name = name[1+name[0]:]
+	}
+	fqdn := strings.Join(labels, ".")
+	// A trailing root label means fully qualified.
+	if len(name) > 0 && name[0] == 0 {
+		fqdn += "."
+	}
+	return flags, fqdn
+}
+
+// encodeClientFQDN builds option 81 using the client's encoding.
+func encodeClientFQDN(flags byte, name string) []byte {
+	b := []byte{flags, 255, 255}
+	if flags&fqdnFlagE == 0 {
+		return append(b, []byte(name)...)
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" {
+			continue
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, []byte(label)...)
+	}
+	if strings.HasSuffix(name, ".") {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// record_client_names keeps the names the client sent on the lease.
+func (l *Lease) record_client_names(options dhcp.Options) {
+	if hn := options[dhcp.OptionHostName]; len(hn) > 0 {
+		l.Hostname = string(hn)
+	}
+	if fqdn, ok := options[OptionClientFQDN]; ok {
+		l.ClientFQDNFlags, l.ClientFQDN = parseClientFQDN(fqdn)
+		l.ClientFQDNSent = true
+	}
+}
+
+// ClientName is the name the client asked for, FQDN first.
+func (l *Lease) ClientName() string {
+	if l.ClientFQDN != "" {
+		return l.ClientFQDN
+	}
+	return l.Hostname
+}
+
+// expandHostnameTemplate fills in {ip-dashed}, {ip-hex}, {mac-dashed}
+// and {mac-plain}.
+func expandHostnameTemplate(tmpl string, ip net.IP, mac string) string {
+	ip4 := ip.To4()
+	ipDashed, ipHex := "", ""
+	if ip4 != nil {
+		ipDashed = strings.Replace(ip4.String(), ".", "-", -1)
+		ipHex = fmt.Sprintf("%02x%02x%02x%02x", ip4[0], ip4[1], ip4[2], ip4[3])
+	}
+	r := strings.NewReplacer(
+		"{ip-dashed}", ipDashed,
+		"{ip-hex}", ipHex,
+		"{mac-dashed}", strings.Replace(mac, ":", "-", -1),
+		"{mac-plain}", strings.Replace(mac, ":", "", -1),
+	)
+	return r.Replace(tmpl)
+}
+
+// hostname_for returns the lease's name and whether we assigned it.
+func (s *Subnet) hostname_for(lease *Lease, binding *Binding) (string, bool) {
+	if binding != nil {
+		if binding.Hostname != "" {
+			return binding.Hostname, true
+		}
+		for _, o := range binding.Options {
+			if o.Code == dhcp.OptionHostName && o.Value != "" {
+				return o.Value, true
+			}
+		}
+	}
+	if s.HostnameTemplate != "" && lease != nil {
+		return expandHostnameTemplate(s.HostnameTemplate, lease.Ip, lease.Mac), true
+	}
+	if lease != nil {
+		return lease.ClientName(), false
+	}
+	return "", false
+}
+
+// qualify places a name in the subnet's forward zone.  Names already
+// in the zone are kept and names outside it keep only their host part.
+func (s *Subnet) qualify(name string) string {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if name == "" || s.ForwardZone == "" {
+		return name
+	}
+	zone := strings.ToLower(strings.TrimSuffix(s.ForwardZone, "."))
+	if name == zone || strings.HasSuffix(name, "."+zone) {
+		return name
+	}
+	return strings.SplitN(name, ".", 2)[0] + "." + zone
+}
+
+// ddns_policy decides who updates DNS for a lease, following the
+// client's option 81 flags.  A name we assigned is always ours to
+// publish, overriding a client that wanted to do it itself.
+func ddns_policy(lease *Lease, assigned bool) (forward, reverse bool, flags byte) {
+	if !lease.ClientFQDNSent {
+		return true, true, 0
+	}
+	flags = lease.ClientFQDNFlags & fqdnFlagE
+	switch {
+	case lease.ClientFQDNFlags&fqdnFlagN != 0 && !assigned:
+		return false, false, flags | fqdnFlagN
+	case lease.ClientFQDNFlags&fqdnFlagS != 0:
+		return true, true, flags | fqdnFlagS
+	case assigned:
+		return true, true, flags | fqdnFlagS | fqdnFlagO
+	}
+	// The client does its own A record, we do the PTR.
+	return false, true, flags
+}
+
+// hostname_options adds option 12 and 81 to a reply.
+func (s *Subnet) hostname_options(opts dhcp.Options, lease *Lease, binding *Binding) {
+	name, assigned := s.hostname_for(lease, binding)
+	if name == "" {
+		return
+	}
+	if assigned {
+		opts[dhcp.OptionHostName] = []byte(strings.SplitN(name, ".", 2)[0])
+	}
+	if lease.ClientFQDNSent {
+		_, _, flags := ddns_policy(lease, assigned)
+		fqdn := s.qualify(name)
+		if s.ForwardZone != "" && flags&fqdnFlagE != 0 {
+			fqdn += "."
+		}
+		opts[OptionClientFQDN] = encodeClientFQDN(flags, fqdn)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	dhcp "github.com/krolaw/dhcp4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseClientFQDN(t *testing.T) {
+	flags, name := parseClientFQDN(nil)
+	assert.Equal(t, byte(0), flags)
+	assert.Equal(t, "", name)
+
+	// ASCII encoded
+	flags, name = parseClientFQDN(append([]byte{0x01, 0, 0}, []byte("node2.lab.")...))
+	assert.Equal(t, fqdnFlagS, flags)
+	assert.Equal(t, "node2.lab.", name)
+
+	// Wire encoded, fully qualified and not
+	flags, name = parseClientFQDN([]byte{0x05, 0, 0, 5, 'n', 'o', 'd', 'e', '3', 3, 'l', 'a', 'b', 0})
+	assert.Equal(t, fqdnFlagS|fqdnFlagE, flags)
+	assert.Equal(t, "node3.lab.", name)
+	_, name = parseClientFQDN([]byte{0x04, 0, 0, 5, 'n', 'o', 'd', 'e', '3'})
+	assert.Equal(t, "node3", name)
+
+	// Round trip
+	for _, f := range []byte{0, fqdnFlagE} {
+		for _, n := range []string{"node4", "node4.lab.example.com."} {
+			flags, name = parseClientFQDN(encodeClientFQDN(f|fqdnFlagS, n))
+			assert.Equal(t, f|fqdnFlagS, flags)
+			assert.Equal(t, n, name)
+		}
+	}
+}
+
+func TestRecordClientNames(t *testing.T) {
+	l := &Lease{}
+	l.record_client_names(dhcp.Options{dhcp.OptionHostName: []byte("node1")})
+	assert.Equal(t, "node1", l.Hostname)
+	assert.False(t, l.ClientFQDNSent)
+	assert.Equal(t, "node1", l.ClientName())
+
+	l.record_client_names(dhcp.Options{
+		dhcp.OptionHostName: []byte("node1"),
+		OptionClientFQDN:    append([]byte{0x00, 0, 0}, []byte("node1.lab.")...),
+	})
+	assert.True(t, l.ClientFQDNSent)
+	assert.Equal(t, byte(0), l.ClientFQDNFlags)
+	assert.Equal(t, "node1.lab.", l.ClientName())
+}
+
+func TestExpandHostnameTemplate(t *testing.T) {
+	ip := net.ParseIP("192.168.1.10")
+	assert.Equal(t, "node-192-168-1-10", expandHostnameTemplate("node-{ip-dashed}", ip, "00:11:22:33:44:55"))
+	assert.Equal(t, "c0a8010a", expandHostnameTemplate("{ip-hex}", ip, "00:11:22:33:44:55"))
+	assert.Equal(t, "n-00-11-22-33-44-55", expandHostnameTemplate("n-{mac-dashed}", ip, "00:11:22:33:44:55"))
+	assert.Equal(t, "n001122334455", expandHostnameTemplate("n{mac-plain}", ip, "00:11:22:33:44:55"))
+}
+
+func TestHostnameFor(t *testing.T) {
+	s := NewSubnet()
+	lease := &Lease{Ip: net.ParseIP("192.168.1.10").To4(), Mac: "aa", Hostname: "client"}
+
+	name, assigned := s.hostname_for(lease, nil)
+	assert.Equal(t, "client", name)
+	assert.False(t, assigned)
+
+	s.HostnameTemplate = "node-{ip-dashed}"
+	name, assigned = s.hostname_for(lease, nil)
+	assert.Equal(t, "node-192-168-1-10", name)
+	assert.True(t, assigned)
+
+	b := &Binding{Mac: "aa", Options: []*Option{{Code: dhcp.OptionHostName, Value: "opt12"}}}
+	name, _ = s.hostname_for(lease, b)
+	assert.Equal(t, "opt12", name)
+
+	b.Hostname = "bound"
+	name, assigned = s.hostname_for(lease, b)
+	assert.Equal(t, "bound", name)
+	assert.True(t, assigned)
+}
+
+func TestDDNSPolicy(t *testing.T) {
+	l := &Lease{}
+	fwd, rev, _ := ddns_policy(l, false)
+	assert.True(t, fwd)
+	assert.True(t, rev)
+
+	// Client does its own A record
+	l.ClientFQDNSent = true
+	fwd, rev, flags := ddns_policy(l, false)
+	assert.False(t, fwd)
+	assert.True(t, rev)
+	assert.Equal(t, byte(0), flags)
+
+	// ... unless we assigned the name
+	fwd, rev, flags = ddns_policy(l, true)
+	assert.True(t, fwd)
+	assert.True(t, rev)
+	assert.Equal(t, fqdnFlagS|fqdnFlagO, flags)
+
+	l.ClientFQDNFlags = fqdnFlagS | fqdnFlagE
+	fwd, _, flags = ddns_policy(l, false)
+	assert.True(t, fwd)
+	assert.Equal(t, fqdnFlagS|fqdnFlagE, flags)
+
+	l.ClientFQDNFlags = fqdnFlagN
+	fwd, rev, flags = ddns_policy(l, false)
+	assert.False(t, fwd)
+	assert.False(t, rev)
+	assert.Equal(t, fqdnFlagN, flags)
+}
+
+func TestHostnameOptions(t *testing.T) {
+	s := NewSubnet()
+	s.ForwardZone = "lab.example.com"
+	lease := &Lease{Ip: net.ParseIP("192.168.1.10").To4(), Mac: "aa", Hostname: "client"}
+
+	// A client chosen name is not echoed back
+	opts := dhcp.Options{}
+	s.hostname_options(opts, lease, nil)
+	assert.Equal(t, 0, len(opts))
+
+	// An assigned one is, in option 81 too if the client sent one
+	lease.ClientFQDNSent = true
+	lease.ClientFQDNFlags = fqdnFlagE
+	b := &Binding{Mac: "aa", Hostname: "server7"}
+	s.hostname_options(opts, lease, b)
+	assert.Equal(t, []byte("server7"), opts[dhcp.OptionHostName])
+	flags, name := parseClientFQDN(opts[OptionClientFQDN])
+	assert.Equal(t, fqdnFlagE|fqdnFlagS|fqdnFlagO, flags)
+	assert.Equal(t, "server7.lab.example.com.", name)
+}
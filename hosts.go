@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ant0ine/go-json-rest/rest"
+	"github.com/miekg/dns"
+)
+
+/*
+ * Hosts and zone files
+ *
+ * For networks with no DNS server of their own, the names of bound
+ * machines are rendered as an /etc/hosts style file and as BIND zone
+ * files for each subnet's forward_zone and reverse_zone.  They are
+ * served by the API and can be written to disk on every change.
+ */
+
+type hostRecord struct {
+	Name string // Qualified in the forward zone when there is one
+	Ip   net.IP
+	Zone string // Forward zone, may be empty
+}
+
+// host_records returns a record for every binding and every active
+// lease without a binding, IPv4 then IPv6, ordered by address.  keep
+// limits the subnets looked at, nil is all of them.
+func (dt *DataTracker) host_records(keep func(*Subnet) bool) []*hostRecord {
+	now := time.Now()
+	records := make([]*hostRecord, 0)
+	for _, s := range dt.Subnets {
+		if keep != nil && !keep(s) {
+			continue
+		}
+		s.lock.RLock()
+		add := func(lease *Lease, binding *Binding) {
+			name, _ := s.hostname_for(lease, binding)
+			name = s.qualify(name)
+			if name == "" || lease.Ip == nil {
+				return
+			}
+			ip := lease.Ip.To4()
+			if ip == nil {
+				ip = lease.Ip.To16()
+			}
+			records = append(records, &hostRecord{
+				Name: name,
+				Ip:   ip,
+				Zone: strings.ToLower(strings.TrimSuffix(s.ForwardZone, ".")),
+			})
+		}
+		for _, b := range s.Bindings {
+			lease := s.Leases[b.key()]
+			if lease == nil || !lease.Ip.Equal(b.Ip) {
+				lease = &Lease{Ip: b.Ip, Mac: b.Mac, Duid: b.Duid}
+			}
+			add(lease, b)
+		}
+		for _, l := range s.Leases {
+			if s.Bindings[l.key()] != nil || now.After(l.ExpireTime) {
+				continue
+			}
+			add(l, nil)
+		}
+		s.lock.RUnlock()
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if len(records[i].Ip) != len(records[j].Ip) {
+			return len(records[i].Ip) < len(records[j].Ip)
+		}
+		if c := bytes.Compare(records[i].Ip, records[j].Ip); c != 0 {
+			return c < 0
+		}
+		return records[i].Name < records[j].Name
+	})
+	return records
+}
+
+// zone_names lists every forward and reverse zone set on a subnet
+// that keep allows.
+func (dt *DataTracker) zone_names(keep func(*Subnet) bool) []string {
+	seen := make(map[string]bool)
+	for _, s := range dt.Subnets {
+		if keep != nil && !keep(s) {
+			continue
+		}
+		for _, z := range []string{s.ForwardZone, s.ReverseZone} {
+			if z != "" {
+				seen[strings.ToLower(strings.TrimSuffix(z, "."))] = true
+			}
+		}
+	}
+	zones := make([]string, 0, len(seen))
+	for z := range seen {
+		zones = append(zones, z)
+	}
+	sort.Strings(zones)
+	return zones
+}
+
+func renderHosts(records []*hostRecord) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("# Generated by rebar-dhcp\n")
+	for _, r := range records {
+		names := r.Name
+		if short := strings.SplitN(r.Name, ".", 2)[0]; short != r.Name {
+			names += " " + short
+		}
+		fmt.Fprintf(&buf, "%s\t%s\n", r.Ip, names)
+	}
+	return buf.Bytes()
+}
+
+// renderZone builds a BIND zone file.  A zone ending in in-addr.arpa
+// or ip6.arpa gets PTR records, any other gets A and AAAA records.
+func renderZone(zone string, records []*hostRecord, nameserver string, ttl int, serial uint32) []byte {
+	origin := dns.Fqdn(zone)
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "; Generated by rebar-dhcp\n")
+	fmt.Fprintf(&buf, "$ORIGIN %s\n$TTL %d\n", origin, ttl)
+	fmt.Fprintf(&buf, "@\tIN\tSOA\t%s hostmaster.%s %d 3600 600 86400 %d\n", dns.Fqdn(nameserver), origin, serial, ttl)
+	fmt.Fprintf(&buf, "@\tIN\tNS\t%s\n", dns.Fqdn(nameserver))
+
+	reverse := dns.IsSubDomain("in-addr.arpa.", origin) || dns.IsSubDomain("ip6.arpa.", origin)
+	seen := make(map[string]bool)
+	for _, r := range records {
+		var line string
+		if reverse {
+			rev, err := dns.ReverseAddr(r.Ip.String())
+			if err != nil || !dns.IsSubDomain(origin, rev) || !strings.Contains(r.Name, ".") {
+				continue
+			}
+			line = fmt.Sprintf("%s\tIN\tPTR\t%s\n", relativeName(rev, origin), dns.Fqdn(r.Name))
+		} else {
+			if r.Zone != strings.TrimSuffix(origin, ".") {
+				continue
+			}
+			rr := "A"
+			if r.Ip.To4() == nil {
+				rr = "AAAA"
+			}
+			line = fmt.Sprintf("%s\tIN\t%s\t%s\n", relativeName(dns.Fqdn(r.Name), origin), rr, r.Ip)
+		}
+		// A binding and a stale copy of it must not give two PTRs.
+		if !seen[line] {
+			seen[line] = true
+			buf.WriteString(line)
+		}
+	}
+	return buf.Bytes()
+}
+
+func relativeName(name, origin string) string {
+	if name == origin {
+		return "@"
+	}
+	return strings.TrimSuffix(name, "."+origin)
+}
+
+func zoneFileDefaults(cfg Config) (string, int) {
+	ns, ttl := cfg.Files.Nameserver, cfg.Files.Ttl
+	if ns == "" {
+		ns = "localhost"
+	}
+	if ttl == 0 {
+		ttl = 300
+	}
+	return ns, ttl
+}
+
+/*
+ * API
+ */
+
+func (fe *Frontend) GetHosts(w rest.ResponseWriter, r *rest.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.(http.ResponseWriter).Write(renderHosts(fe.DhcpInfo.host_records(fe.keeps(r))))
+}
+
+func (fe *Frontend) GetZones(w rest.ResponseWriter, r *rest.Request) {
+	w.WriteJson(fe.DhcpInfo.zone_names(fe.keeps(r)))
+}
+
+func (fe *Frontend) GetZone(w rest.ResponseWriter, r *rest.Request) {
+	zone := strings.ToLower(strings.TrimSuffix(r.PathParam("zone"), "."))
+	keep := fe.keeps(r)
+	found := false
+	for _, z := range fe.DhcpInfo.zone_names(keep) {
+		if z == zone {
+			found = true
+		}
+	}
+	if !found {
+		rest.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	ns, ttl := zoneFileDefaults(fe.config())
+	w.Header().Set("Content-Type", "text/dns; charset=utf-8")
+	w.(http.ResponseWriter).Write(renderZone(zone, fe.DhcpInfo.host_records(keep), ns, ttl, uint32(time.Now().Unix())))
+}
+
+/*
+ * File writer
+ */
+
+type ZoneFileWriter struct {
+	dt         *DataTracker
+	hostsFile  string // Empty skips the hosts file
+	zoneDir    string // Empty skips zone files
+	nameserver string
+	ttl        int
+	interval   time.Duration // Rewrite period, so expired leases drop out
+	delay      time.Duration // Collects a burst of events into one write
+	last       map[string][]byte
+}
+
+func NewZoneFileWriter(dt *DataTracker, cfg Config) *ZoneFileWriter {
+	ns, ttl := zoneFileDefaults(cfg)
+	interval := time.Duration(cfg.Files.Interval) * time.Second
+	if interval == 0 {
+		interval = time.Minute
+	}
+	return &ZoneFileWriter{
+		dt:         dt,
+		hostsFile:  cfg.Files.Hosts,
+		zoneDir:    cfg.Files.ZoneDir,
+		nameserver: ns,
+		ttl:        ttl,
+		interval:   interval,
+		delay:      time.Second,
+		last:       make(map[string][]byte),
+	}
+}
+
+// Run writes the files now and again after every event until stop
+// is closed.
+func (zw *ZoneFileWriter) Run(stop <-chan struct{}) {
+	sub, _ := zw.dt.events.Subscribe(0, EventFilter{})
+	defer func() { zw.dt.events.Unsubscribe(sub) }()
+	ticker := time.NewTicker(zw.interval)
+	defer ticker.Stop()
+
+	zw.write()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		case _, ok := <-sub.C:
+			if !ok {
+				sub, _ = zw.dt.events.Subscribe(0, EventFilter{})
+			}
+			zw.settle(sub, stop)
+		}
+		zw.write()
+	}
+}
+
+// settle waits until no events have arrived for zw.delay.
+func (zw *ZoneFileWriter) settle(sub *Subscription, stop <-chan struct{}) {
+	timer := time.NewTimer(zw.delay)
+	defer timer.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-timer.C:
+			return
+		case _, ok := <-sub.C:
+			if !ok {
+				return
+			}
+		}
+	}
+}
+
+func (zw *ZoneFileWriter) write() {
+	records := zw.dt.host_records(nil)
+	if zw.hostsFile != "" {
+		zw.writeFile(zw.hostsFile, renderHosts(records), nil)
+	}
+	if zw.zoneDir != "" {
+		serial := uint32(time.Now().Unix())
+		for _, zone := range zw.dt.zone_names(nil) {
+			path := filepath.Join(zw.zoneDir, zone+".zone")
+			// Compare without the serial so only real changes bump it.
+			compare := renderZone(zone, records, zw.nameserver, zw.ttl, 0)
+			zw.writeFile(path, renderZone(zone, records, zw.nameserver, zw.ttl, serial), compare)
+		}
+	}
+}
+
+// writeFile replaces path atomically if its content changed.
+func (zw *ZoneFileWriter) writeFile(path string, data, compare []byte) {
+	if compare == nil {
+		compare = data
+	}
+	if bytes.Equal(zw.last[path], compare) {
+		return
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		log.Println("Unable to write ", path, ": ", err)
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		log.Println("Unable to write ", path, ": ", err)
+		return
+	}
+	zw.last[path] = compare
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func hostsSetup() (*DataTracker, *Subnet) {
+	dt, s := simpleSetup()
+	s.ForwardZone = "lab.example.com"
+	s.ReverseZone = "128.168.192.in-addr.arpa"
+	s.Bindings["aa"] = &Binding{Mac: "aa", Ip: net.ParseIP("192.168.128.20").To4(), Hostname: "server20"}
+	s.Leases["bb"] = &Lease{Mac: "bb", Ip: net.ParseIP("192.168.128.7").To4(), Hostname: "laptop", ExpireTime: time.Now().Add(time.Hour)}
+	s.Leases["cc"] = &Lease{Mac: "cc", Ip: net.ParseIP("192.168.128.8").To4(), Hostname: "gone", ExpireTime: time.Now().Add(-time.Hour)}
+	s.Leases["dd"] = &Lease{Mac: "dd", Ip: net.ParseIP("192.168.128.9").To4(), ExpireTime: time.Now().Add(time.Hour)}
+	return dt, s
+}
+
+func TestHostRecords(t *testing.T) {
+	dt, _ := hostsSetup()
+	records := dt.host_records(nil)
+
+	// Expired and unnamed leases are left out
+	assert.Equal(t, 2, len(records))
+	assert.Equal(t, "laptop.lab.example.com", records[0].Name)
+	assert.Equal(t, "192.168.128.7", records[0].Ip.String())
+	assert.Equal(t, "server20.lab.example.com", records[1].Name)
+	assert.Equal(t, "lab.example.com", records[1].Zone)
+
+	assert.Equal(t, "# Generated by rebar-dhcp\n"+
+		"192.168.128.7\tlaptop.lab.example.com laptop\n"+
+		"192.168.128.20\tserver20.lab.example.com server20\n", string(renderHosts(records)))
+}
+
+func TestRenderZone(t *testing.T) {
+	dt, _ := hostsSetup()
+	records := dt.host_records(nil)
+	assert.Equal(t, []string{"128.168.192.in-addr.arpa", "lab.example.com"}, dt.zone_names(nil))
+
+	fwd := string(renderZone("lab.example.com", records, "ns1.lab.example.com", 60, 42))
+	assert.Contains(t, fwd, "$ORIGIN lab.example.com.\n$TTL 60\n")
+	assert.Contains(t, fwd, "@\tIN\tSOA\tns1.lab.example.com. hostmaster.lab.example.com. 42 ")
+	assert.Contains(t, fwd, "laptop\tIN\tA\t192.168.128.7\n")
+	assert.Contains(t, fwd, "server20\tIN\tA\t192.168.128.20\n")
+
+	rev := string(renderZone("128.168.192.in-addr.arpa", records, "ns1.lab.example.com", 60, 42))
+	assert.Contains(t, rev, "7\tIN\tPTR\tlaptop.lab.example.com.\n")
+	assert.Contains(t, rev, "20\tIN\tPTR\tserver20.lab.example.com.\n")
+}
+
+func TestRenderZoneIPv6(t *testing.T) {
+	h, s := v6Setup()
+	dt := h.info
+	s.ForwardZone = "lab.example.com"
+	s.ReverseZone = "0.0.0.0.0.0.0.0.0.1.0.0.0.0.d.f.ip6.arpa"
+	duid := "00:03:00:01:52:54:00:00:00:01"
+	s.Bindings[duid] = &Binding{Duid: duid, Ip: net.ParseIP("fd00:10::150"), Hostname: "server150"}
+	s.Leases["bb"] = &Lease{Mac: "bb", Ip: net.ParseIP("fd00:10::107"), Hostname: "laptop", ExpireTime: time.Now().Add(time.Hour)}
+
+	records := dt.host_records(nil)
+	assert.Equal(t, 2, len(records))
+	assert.Equal(t, "fd00:10::107", records[0].Ip.String())
+	assert.Contains(t, string(renderHosts(records)), "fd00:10::150\tserver150.lab.example.com server150\n")
+
+	fwd := string(renderZone("lab.example.com", records, "ns1.lab.example.com", 60, 42))
+	assert.Contains(t, fwd, "laptop\tIN\tAAAA\tfd00:10::107\n")
+	assert.Contains(t, fwd, "server150\tIN\tAAAA\tfd00:10::150\n")
+
+	rev := string(renderZone(s.ReverseZone, records, "ns1.lab.example.com", 60, 42))
+	assert.Contains(t, rev, "7.0.1.0.0.0.0.0.0.0.0.0.0.0.0.0\tIN\tPTR\tlaptop.lab.example.com.\n")
+	assert.Contains(t, rev, "0.5.1.0.0.0.0.0.0.0.0.0.0.0.0.0\tIN\tPTR\tserver150.lab.example.com.\n")
+}
+
+func TestGetHostsAndZones(t *testing.T) {
+	fe, handler := get_frontend()
+	dt, _ := hostsSetup()
+	fe.DhcpInfo.Subnets = dt.Subnets
+
+	for _, c := range []struct {
+		path string
+		code int
+		body string
+	}{
+		{"/hosts", 200, "192.168.128.20\tserver20.lab.example.com server20\n"},
+		{"/zones", 200, `"lab.example.com"`},
+		{"/zones/lab.example.com", 200, "server20\tIN\tA\t192.168.128.20\n"},
+		{"/zones/128.168.192.in-addr.arpa", 200, "20\tIN\tPTR\tserver20.lab.example.com.\n"},
+		{"/zones/example.org", 404, ""},
+	} {
+		recorder := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", base_url(c.path), nil)
+		assert.Nil(t, err)
+		req.SetBasicAuth("fred", "rules")
+		handler.ServeHTTP(recorder, req)
+		assert.Equal(t, c.code, recorder.Code, c.path)
+		assert.Contains(t, recorder.Body.String(), c.body, c.path)
+	}
+}
+
+func TestZoneFileWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rebar-dhcp-zones")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	dt, s := hostsSetup()
+	cfg := Config{}
+	cfg.Files.Hosts = filepath.Join(dir, "hosts")
+	cfg.Files.ZoneDir = dir
+	zw := NewZoneFileWriter(dt, cfg)
+	zw.delay = 10 * time.Millisecond
+	stop := make(chan struct{})
+	defer close(stop)
+	go zw.Run(stop)
+
+	waitFor := func(path, text string) {
+		deadline := time.Now().Add(2 * time.Second)
+		for time.Now().Before(deadline) {
+			data, _ := ioutil.ReadFile(path)
+			if strings.Contains(string(data), text) {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("%s never contained %q", path, text)
+	}
+	waitFor(cfg.Files.Hosts, "server20.lab.example.com")
+	waitFor(filepath.Join(dir, "lab.example.com.zone"), "laptop\tIN\tA\t192.168.128.7")
+
+	// A new binding is written out
+	b := &Binding{Mac: "ee", Ip: net.ParseIP("192.168.128.30").To4(), Hostname: "server30"}
+	err, _ = dt.AddBinding(s.Name, *b)
+	assert.Nil(t, err)
+	waitFor(cfg.Files.Hosts, "192.168.128.30\tserver30.lab.example.com server30")
+	waitFor(filepath.Join(dir, "128.168.192.in-addr.arpa.zone"), "30\tIN\tPTR\tserver30.lab.example.com.")
+}
@@ -0,0 +1,514 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * Key/value store backend
+ *
+ * Each subnet is one key, <prefix>subnets/<name>, holding the same
+ * JSON the file store writes for it.  Writes are compare-and-swap on
+ * the revision last read, so two servers sharing the keys don't
+ * overwrite each other: on a conflict the other writer's leases are
+ * merged in (later expiry wins) and the write is retried.  Changes
+ * made elsewhere arrive through Watch and are copied into the live
+ * subnet under its lock, so handlers holding it see the change.
+ * <prefix>revision holds the last subnet revision handed out, raised
+ * to the higher value when writers race.
+ */
+
+var ErrKVConflict = errors.New("key was changed by another writer")
+
+type KVPair struct {
+	Key      string
+	Value    []byte
+	Revision uint64
+}
+
+// KVEvent is a change under a watched prefix.
+type KVEvent struct {
+	KVPair
+	Deleted bool
+}
+
+// KVClient is what the store needs from a key/value service.
+type KVClient interface {
+	// List returns the pairs under prefix and the index to watch from.
+	List(prefix string) ([]KVPair, uint64, error)
+	// Get returns nil if key doesn't exist.
+	Get(key string) (*KVPair, error)
+	// Put writes key if its revision is still rev (0: it must not
+	// exist) and returns the new revision, or ErrKVConflict.
+	Put(key string, value []byte, rev uint64) (uint64, error)
+	// Delete removes key if its revision is still rev.
+	Delete(key string, rev uint64) error
+	// Watch sends changes under prefix made after index until stop is
+	// closed, then closes the channel.  known is the listing at index,
+	// so keys deleted since are reported.
+	Watch(prefix string, index uint64, known []KVPair, stop <-chan struct{}) <-chan KVEvent
+}
+
+type KVStore struct {
+	client KVClient
+	prefix string
+
+	lock   sync.Mutex
+	revs   map[string]uint64 // Subnet -> revision last read or written
+	saved  map[string][]byte // Subnet -> value at that revision
+	index  uint64            // Where Watch starts
+	listed []KVPair          // What Load read at index
+
+	revision    uint64 // DataTracker.Revision last read or written
+	revisionRev uint64 // KV revision of the revision key
+}
+
+func NewKVStore(client KVClient, prefix string) *KVStore {
+	return &KVStore{
+		client: client,
+		prefix: prefix,
+		revs:   make(map[string]uint64),
+		saved:  make(map[string][]byte),
+	}
+}
+
+func (ks *KVStore) key(name string) string {
+	return ks.prefix + "subnets/" + name
+}
+
+// name is the subnet a key holds, or "" for other keys.
+func (ks *KVStore) name(key string) string {
+	name := strings.TrimPrefix(key, ks.prefix+"subnets/")
+	if name == key || strings.Contains(name, "/") {
+		return ""
+	}
+	return name
+}
+
+func (ks *KVStore) Load(dt *DataTracker) error {
+	pairs, index, err := ks.client.List(ks.prefix + "subnets/")
+	if err != nil {
+		return err
+	}
+	dt.Lock()
+	defer dt.Unlock()
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+	for _, p := range pairs {
+		name := ks.name(p.Key)
+		if name == "" {
+			continue
+		}
+		s := NewSubnet()
+		if err := json.Unmarshal(p.Value, s); err != nil {
+			return fmt.Errorf("%s: %s", p.Key, err)
+		}
+		if cur := dt.Subnets[name]; cur != nil {
+			cur.assign(s)
+		} else {
+			dt.Subnets[name] = s
+		}
+		ks.revs[name] = p.Revision
+		ks.saved[name], _ = json.Marshal(s)
+	}
+	ks.index = index
+	ks.listed = pairs
+
+	p, err := ks.client.Get(ks.prefix + "revision")
+	if err != nil {
+		return err
+	}
+	if p != nil {
+		if dt.Revision, err = strconv.ParseUint(string(p.Value), 10, 64); err != nil {
+			return fmt.Errorf("%s: %s", p.Key, err)
+		}
+		ks.revision, ks.revisionRev = dt.Revision, p.Revision
+	}
+	return nil
+}
+
+// Save writes the subnets that changed since they were last read or
+// written and deletes removed ones.  A failed write is logged and
+// tried again on the next Save rather than taking the server down
+// with the service.
+func (ks *KVStore) Save(dt *DataTracker) error {
+	dt.Lock()
+	defer dt.Unlock()
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+	for name, s := range dt.Subnets {
+		data, err := json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(data, ks.saved[name]) {
+			continue
+		}
+		if err := ks.put(s, data); err != nil {
+			log.Println("KV store: saving subnet ", name, " failed: ", err)
+		}
+	}
+	for name, rev := range ks.revs {
+		if dt.Subnets[name] != nil {
+			continue
+		}
+		err := ks.client.Delete(ks.key(name), rev)
+		if err != nil && err != ErrKVConflict {
+			log.Println("KV store: deleting subnet ", name, " failed: ", err)
+			continue
+		}
+		// Changed elsewhere after our delete: the watch brings it back.
+		delete(ks.revs, name)
+		delete(ks.saved, name)
+	}
+	if err := ks.put_revision(dt); err != nil {
+		log.Println("KV store: saving revision failed: ", err)
+	}
+	return nil
+}
+
+// put_revision writes dt.Revision if it went up, or takes another
+// writer's if that is higher.  Assumes dt and ks.lock are held.
+func (ks *KVStore) put_revision(dt *DataTracker) error {
+	key := ks.prefix + "revision"
+	for try := 0; try < 3; try++ {
+		if dt.Revision <= ks.revision {
+			return nil
+		}
+		value := []byte(strconv.FormatUint(dt.Revision, 10))
+		rev, err := ks.client.Put(key, value, ks.revisionRev)
+		if err == nil {
+			ks.revision, ks.revisionRev = dt.Revision, rev
+			return nil
+		}
+		if err != ErrKVConflict {
+			return err
+		}
+		p, err := ks.client.Get(key)
+		if err != nil {
+			return err
+		}
+		if p == nil {
+			ks.revision, ks.revisionRev = 0, 0
+			continue
+		}
+		other, err := strconv.ParseUint(string(p.Value), 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s: %s", key, err)
+		}
+		ks.revision, ks.revisionRev = other, p.Revision
+		if other > dt.Revision {
+			dt.Revision = other
+		}
+	}
+	return ErrKVConflict
+}
+
+// put writes s, merging in another writer's leases on conflicts.
+// Assumes ks.lock is held.
+func (ks *KVStore) put(s *Subnet, data []byte) error {
+	key := ks.key(s.Name)
+	for try := 0; try < 3; try++ {
+		rev, err := ks.client.Put(key, data, ks.revs[s.Name])
+		if err == nil {
+			ks.revs[s.Name] = rev
+			ks.saved[s.Name] = data
+			return nil
+		}
+		if err != ErrKVConflict {
+			return err
+		}
+		p, err := ks.client.Get(key)
+		if err != nil {
+			return err
+		}
+		if p == nil {
+			ks.revs[s.Name] = 0
+			continue
+		}
+		if err := mergeSubnet(s, p.Value); err != nil {
+			return err
+		}
+		ks.revs[s.Name] = p.Revision
+		if data, err = json.Marshal(s); err != nil {
+			return err
+		}
+	}
+	return ErrKVConflict
+}
+
+// mergeSubnet adds the leases and delegations in another writer's copy
+// of s.  Ours win for everything else.  Leases the other writer freed
+// stay until they expire.
+func mergeSubnet(s *Subnet, data []byte) error {
+	other := NewSubnet()
+	if err := json.Unmarshal(data, other); err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, l := range other.Leases {
+		mergeLease(s.Leases, s.ActiveBits, s.active_bit, l, false)
+	}
+	if s.DelegatedPrefix != nil {
+		for _, l := range other.Delegations {
+			mergeLease(s.Delegations, s.DelegatedBits, s.delegation_bit, l, false)
+		}
+	}
+	return nil
+}
+
+// Watch applies changes made by other writers until stop is closed.
+func (ks *KVStore) Watch(dt *DataTracker, stop <-chan struct{}) {
+	ks.lock.Lock()
+	index, listed := ks.index, ks.listed
+	ks.lock.Unlock()
+	for e := range ks.client.Watch(ks.prefix+"subnets/", index, listed, stop) {
+		ks.apply(dt, e)
+	}
+}
+
+// apply updates, adds or removes the subnet in e.  Our own writes
+// come back with revisions we already have and are skipped.  A
+// subnet we already have is updated in place, so handlers and
+// readers holding it never see it swapped underneath them.
+func (ks *KVStore) apply(dt *DataTracker, e KVEvent) {
+	name := ks.name(e.Key)
+	if name == "" {
+		return
+	}
+	dt.Lock()
+	ks.lock.Lock()
+	eventType := ""
+	if e.Deleted {
+		if dt.Subnets[name] != nil {
+			delete(dt.Subnets, name)
+			dt.alerter.Forget(name)
+			eventType = EventSubnetDeleted
+		}
+		delete(ks.revs, name)
+		delete(ks.saved, name)
+	} else if e.Revision > ks.revs[name] {
+		s := NewSubnet()
+		if err := json.Unmarshal(e.Value, s); err != nil {
+			log.Println("KV store: ignoring bad subnet ", e.Key, ": ", err)
+		} else {
+			if cur := dt.Subnets[name]; cur != nil {
+				eventType = EventSubnetUpdated
+				cur.assign(s)
+			} else {
+				eventType = EventSubnetCreated
+				dt.Subnets[name] = s
+			}
+			ks.revs[name] = e.Revision
+			ks.saved[name], _ = json.Marshal(s)
+		}
+	}
+	ks.lock.Unlock()
+	dt.Unlock()
+	if eventType != "" {
+		log.Println("KV store: subnet ", name, " changed elsewhere")
+		dt.publish(eventType, name, nil, nil)
+	}
+}
+
+/*
+ * Consul client
+ *
+ * The KV HTTP API: recursive GETs to list, transactions for
+ * compare-and-swap, and blocking queries to watch.
+ */
+
+type ConsulKV struct {
+	url    string
+	token  string
+	client *http.Client
+	wait   time.Duration // Blocking query timeout
+}
+
+func NewConsulKV(url, token string) *ConsulKV {
+	return &ConsulKV{
+		url:    strings.TrimSuffix(url, "/"),
+		token:  token,
+		client: &http.Client{Timeout: 10 * time.Second},
+		wait:   5 * time.Minute,
+	}
+}
+
+type consulPair struct {
+	Key         string
+	Value       []byte // base64 in JSON, as Consul sends it
+	ModifyIndex uint64
+}
+
+func (c *ConsulKV) do(ctx context.Context, client *http.Client, method, path string, body []byte) (*http.Response, []byte, error) {
+	req, err := http.NewRequest(method, c.url+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	req = req.WithContext(ctx)
+	if c.token != "" {
+		req.Header.Set("X-Consul-Token", c.token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	return resp, data, err
+}
+
+// get lists key (recursively, for a prefix), blocking until index
+// passes if it is non-zero.
+func (c *ConsulKV) get(ctx context.Context, key string, recurse bool, index uint64) ([]KVPair, uint64, error) {
+	q := url.Values{}
+	client := c.client
+	if recurse {
+		q.Set("recurse", "true")
+	}
+	if index > 0 {
+		q.Set("index", strconv.FormatUint(index, 10))
+		q.Set("wait", fmt.Sprintf("%ds", int(c.wait/time.Second)))
+		client = &http.Client{Timeout: c.wait + c.wait/16 + 10*time.Second}
+	}
+	resp, data, err := c.do(ctx, client, "GET", "/v1/kv/"+key+"?"+q.Encode(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	newIndex, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, newIndex, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("consul: %s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	cps := make([]consulPair, 0)
+	if err := json.Unmarshal(data, &cps); err != nil {
+		return nil, 0, err
+	}
+	pairs := make([]KVPair, 0, len(cps))
+	for _, cp := range cps {
+		pairs = append(pairs, KVPair{Key: cp.Key, Value: cp.Value, Revision: cp.ModifyIndex})
+	}
+	return pairs, newIndex, nil
+}
+
+func (c *ConsulKV) List(prefix string) ([]KVPair, uint64, error) {
+	return c.get(context.Background(), prefix, true, 0)
+}
+
+func (c *ConsulKV) Get(key string) (*KVPair, error) {
+	pairs, _, err := c.get(context.Background(), key, false, 0)
+	if err != nil || len(pairs) == 0 {
+		return nil, err
+	}
+	return &pairs[0], nil
+}
+
+// txn runs one compare-and-swap operation.
+func (c *ConsulKV) txn(verb, key string, value []byte, rev uint64) (uint64, error) {
+	ops := []map[string]interface{}{{
+		"KV": map[string]interface{}{"Verb": verb, "Key": key, "Value": value, "Index": rev},
+	}}
+	body, err := json.Marshal(ops)
+	if err != nil {
+		return 0, err
+	}
+	resp, data, err := c.do(context.Background(), c.client, "PUT", "/v1/txn", body)
+	if err != nil {
+		return 0, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusConflict:
+		return 0, ErrKVConflict
+	default:
+		return 0, fmt.Errorf("consul: %s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	result := struct {
+		Results []struct{ KV *consulPair }
+	}{}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return 0, err
+	}
+	if len(result.Results) > 0 && result.Results[0].KV != nil {
+		return result.Results[0].KV.ModifyIndex, nil
+	}
+	return 0, nil
+}
+
+func (c *ConsulKV) Put(key string, value []byte, rev uint64) (uint64, error) {
+	return c.txn("cas", key, value, rev)
+}
+
+func (c *ConsulKV) Delete(key string, rev uint64) error {
+	_, err := c.txn("delete-cas", key, nil, rev)
+	return err
+}
+
+// Watch turns blocking queries on prefix into events by comparing
+// each listing with the last, starting from known.
+func (c *ConsulKV) Watch(prefix string, index uint64, known []KVPair, stop <-chan struct{}) <-chan KVEvent {
+	events := make(chan KVEvent)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stop
+		cancel()
+	}()
+	go func() {
+		defer close(events)
+		last := make(map[string]KVPair)
+		for _, p := range known {
+			last[p.Key] = p
+		}
+		for ctx.Err() == nil {
+			pairs, newIndex, err := c.get(ctx, prefix, true, index)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Println("Consul watch on ", prefix, " failed: ", err)
+					time.Sleep(time.Second)
+				}
+				continue
+			}
+			// The index can go backwards, e.g. after a restore.
+			if newIndex < index {
+				newIndex = 0
+			}
+			current := make(map[string]KVPair)
+			for _, p := range pairs {
+				current[p.Key] = p
+				if p.Revision > index {
+					select {
+					case events <- KVEvent{KVPair: p}:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+			for key, p := range last {
+				if _, ok := current[key]; !ok {
+					select {
+					case events <- KVEvent{KVPair: p, Deleted: true}:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+			last, index = current, newIndex
+		}
+	}()
+	return events
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/willf/bitset"
+)
+
+// memKV is an in-memory KVClient.
+type memKV struct {
+	lock     sync.Mutex
+	rev      uint64
+	pairs    map[string]KVPair
+	watchers map[chan KVEvent]string
+}
+
+func newMemKV() *memKV {
+	return &memKV{pairs: make(map[string]KVPair), watchers: make(map[chan KVEvent]string)}
+}
+
+func (m *memKV) List(prefix string) ([]KVPair, uint64, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	pairs := make([]KVPair, 0)
+	for k, p := range m.pairs {
+		if strings.HasPrefix(k, prefix) {
+			pairs = append(pairs, p)
+		}
+	}
+	return pairs, m.rev, nil
+}
+
+func (m *memKV) Get(key string) (*KVPair, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if p, ok := m.pairs[key]; ok {
+		return &p, nil
+	}
+	return nil, nil
+}
+
+func (m *memKV) Put(key string, value []byte, rev uint64) (uint64, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.pairs[key].Revision != rev {
+		return 0, ErrKVConflict
+	}
+	m.rev++
+	p := KVPair{Key: key, Value: value, Revision: m.rev}
+	m.pairs[key] = p
+	m.notify(KVEvent{KVPair: p})
+	return m.rev, nil
+}
+
+func (m *memKV) Delete(key string, rev uint64) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	p, ok := m.pairs[key]
+	if !ok || p.Revision != rev {
+		return ErrKVConflict
+	}
+	delete(m.pairs, key)
+	m.rev++
+	m.notify(KVEvent{KVPair: p, Deleted: true})
+	return nil
+}
+
+// notify assumes the lock is held.
+func (m *memKV) notify(e KVEvent) {
+	for c, prefix := range m.watchers {
+		if strings.HasPrefix(e.Key, prefix) {
+			c <- e
+		}
+	}
+}
+
+func (m *memKV) Watch(prefix string, index uint64, known []KVPair, stop <-chan struct{}) <-chan KVEvent {
+	c := make(chan KVEvent, 100)
+	m.lock.Lock()
+	m.watchers[c] = prefix
+	for k, p := range m.pairs {
+		if strings.HasPrefix(k, prefix) && p.Revision > index {
+			c <- KVEvent{KVPair: p}
+		}
+	}
+	for _, p := range known {
+		if _, ok := m.pairs[p.Key]; !ok {
+			c <- KVEvent{KVPair: p, Deleted: true}
+		}
+	}
+	m.lock.Unlock()
+	go func() {
+		<-stop
+		m.lock.Lock()
+		delete(m.watchers, c)
+		close(c)
+		m.lock.Unlock()
+	}()
+	return c
+}
+
+func kvTracker(kv KVClient) *DataTracker {
+	dt := NewDataTracker(NewKVStore(kv, "test/"))
+	dt.load_data()
+	return dt
+}
+
+func kvLease(dt *DataTracker, mac string) *Lease {
+	s := dt.Subnets["fred"]
+	lease, _ := s.find_or_get_info(dt, mac, nil)
+	s.update_lease_time(dt, lease, time.Hour)
+	return lease
+}
+
+func TestKVStoreSaveLoad(t *testing.T) {
+	kv := newMemKV()
+	dt := kvTracker(kv)
+	s := newSubnet(dt, "fred", "192.168.128.0/24")
+	s.ActiveBits = bitset.New(s.active_size())
+	dt.AddSubnet(s)
+	lease := kvLease(dt, "52:54:00:00:00:01")
+
+	rev := kv.pairs["test/subnets/fred"].Revision
+	dt.save_data()
+	assert.Equal(t, rev, kv.pairs["test/subnets/fred"].Revision, "unchanged subnets aren't rewritten")
+
+	dt2 := kvTracker(kv)
+	assert.NotNil(t, dt2.Subnets["fred"])
+	l := dt2.Subnets["fred"].Leases["52:54:00:00:00:01"]
+	assert.Equal(t, lease.Ip.String(), l.Ip.String())
+	assert.Equal(t, dt.Revision, dt2.Revision)
+
+	dt.RemoveSubnet("fred")
+	_, ok := kv.pairs["test/subnets/fred"]
+	assert.False(t, ok)
+	assert.Equal(t, "1", string(kv.pairs["test/revision"].Value), "the revision counter outlives the subnet")
+}
+
+func TestKVStoreConflict(t *testing.T) {
+	kv := newMemKV()
+	dt := kvTracker(kv)
+	s := newSubnet(dt, "fred", "192.168.128.0/24")
+	s.ActiveBits = bitset.New(s.active_size())
+	dt.AddSubnet(s)
+
+	// Both load the same revision, then both hand out a lease.
+	dt2 := kvTracker(kv)
+	dt2.Subnets["fred"].ActiveBits = bitset.New(s.active_size())
+	kvLease(dt, "52:54:00:00:00:01")
+	s2 := dt2.Subnets["fred"]
+	s2.ActiveBits.Set(0) // Don't collide with the first server's lease
+	kvLease(dt2, "52:54:00:00:00:02")
+
+	dt3 := kvTracker(kv)
+	assert.Equal(t, 2, len(dt3.Subnets["fred"].Leases))
+	assert.Equal(t, 2, len(s2.Leases), "the conflict merged the other lease in")
+}
+
+func TestKVStoreWatch(t *testing.T) {
+	kv := newMemKV()
+	dt := kvTracker(kv)
+	dt2 := kvTracker(kv)
+	stop := make(chan struct{})
+	defer close(stop)
+	sub, _ := dt2.events.Subscribe(0, EventFilter{})
+	go dt2.store.(*KVStore).Watch(dt2, stop)
+
+	s := newSubnet(dt, "fred", "192.168.128.0/24")
+	s.ActiveBits = bitset.New(s.active_size())
+	dt.AddSubnet(s)
+	e := <-sub.C
+	assert.Equal(t, EventSubnetCreated, e.Type)
+	assert.Equal(t, "fred", e.Subnet)
+
+	// Later changes land in the subnet readers already hold.
+	s2 := dt2.Subnets["fred"]
+	kvLease(dt, "52:54:00:00:00:01")
+	assert.True(t, waitFor(func() bool {
+		s2.lock.RLock()
+		defer s2.lock.RUnlock()
+		return len(s2.Leases) == 1
+	}))
+	assert.True(t, s2 == dt2.Subnets["fred"])
+
+	dt.RemoveSubnet("fred")
+	assert.True(t, waitFor(func() bool {
+		dt2.Lock()
+		defer dt2.Unlock()
+		return dt2.Subnets["fred"] == nil
+	}))
+}
+
+func TestKVStoreRemoteDeleteForgetsAlerts(t *testing.T) {
+	kv := newMemKV()
+	dt := kvTracker(kv)
+	s := newSubnet(dt, "fred", "192.168.128.0/24")
+	s.ActiveBits = bitset.New(s.active_size())
+	dt.AddSubnet(s)
+	dt.alerter = NewAlerter([]int{1})
+	dt.alerter.levels["fred"] = 1
+
+	ks := dt.store.(*KVStore)
+	ks.apply(dt, KVEvent{KVPair: KVPair{Key: "test/subnets/fred"}, Deleted: true})
+	assert.Nil(t, dt.Subnets["fred"])
+	_, ok := dt.alerter.levels["fred"]
+	assert.False(t, ok)
+}
+
+func TestKVStoreWatchMissedDelete(t *testing.T) {
+	kv := newMemKV()
+	dt := kvTracker(kv)
+	s := newSubnet(dt, "fred", "192.168.128.0/24")
+	s.ActiveBits = bitset.New(s.active_size())
+	dt.AddSubnet(s)
+
+	// Deleted between dt2's Load and its Watch.
+	dt2 := kvTracker(kv)
+	dt.RemoveSubnet("fred")
+	stop := make(chan struct{})
+	defer close(stop)
+	go dt2.store.(*KVStore).Watch(dt2, stop)
+	assert.True(t, waitFor(func() bool {
+		dt2.Lock()
+		defer dt2.Unlock()
+		return dt2.Subnets["fred"] == nil
+	}))
+}
+
+func TestConsulKV(t *testing.T) {
+	var txn []map[string]map[string]interface{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "sekrit", r.Header.Get("X-Consul-Token"))
+		switch r.URL.Path {
+		case "/v1/kv/test/subnets/":
+			w.Header().Set("X-Consul-Index", "7")
+			w.Write([]byte(`[{"Key": "test/subnets/fred", "Value": "e30=", "ModifyIndex": 5}]`))
+		case "/v1/txn":
+			body, _ := ioutil.ReadAll(r.Body)
+			json.Unmarshal(body, &txn)
+			if txn[0]["KV"]["Index"].(float64) != 5 {
+				w.WriteHeader(http.StatusConflict)
+				return
+			}
+			w.Write([]byte(`{"Results": [{"KV": {"Key": "test/subnets/fred", "ModifyIndex": 8}}]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	c := NewConsulKV(ts.URL+"/", "sekrit")
+	pairs, index, err := c.List("test/subnets/")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(7), index)
+	assert.Equal(t, []KVPair{{Key: "test/subnets/fred", Value: []byte("{}"), Revision: 5}}, pairs)
+
+	p, err := c.Get("test/subnets/barney")
+	assert.Nil(t, err)
+	assert.Nil(t, p)
+
+	rev, err := c.Put("test/subnets/fred", []byte("{}"), 5)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(8), rev)
+	assert.Equal(t, "cas", txn[0]["KV"]["Verb"])
+	assert.Equal(t, "e30=", txn[0]["KV"]["Value"])
+
+	_, err = c.Put("test/subnets/fred", []byte("{}"), 4)
+	assert.Equal(t, ErrKVConflict, err)
+	assert.Equal(t, ErrKVConflict, c.Delete("test/subnets/fred", 4))
+	assert.Equal(t, "delete-cas", txn[0]["KV"]["Verb"])
+}
+
+func TestConsulKVWatchKnown(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Consul-Index", "9")
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer ts.Close()
+
+	c := NewConsulKV(ts.URL, "")
+	stop := make(chan struct{})
+	defer close(stop)
+	known := []KVPair{{Key: "test/subnets/fred", Value: []byte("{}"), Revision: 5}}
+	e := <-c.Watch("test/subnets/", 7, known, stop)
+	assert.True(t, e.Deleted)
+	assert.Equal(t, "test/subnets/fred", e.Key)
+}
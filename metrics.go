@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ant0ine/go-json-rest/rest"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	dhcp "github.com/krolaw/dhcp4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+/*
+ * Prometheus metrics
+ *
+ * Packet and API counters are process wide.  Lease and pool gauges
+ * are computed from the DataTracker at scrape time.
+ */
+var (
+	dhcpPacketsReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rebar_dhcp_packets_received_total",
+		Help: "DHCP packets received by message type.",
+	}, []string{"interface", "subnet", "type"})
+
+	dhcpPacketsSent = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rebar_dhcp_packets_sent_total",
+		Help: "DHCP replies sent by message type.",
+	}, []string{"interface", "subnet", "type"})
+
+	dhcpPacketsDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rebar_dhcp_packets_dropped_total",
+		Help: "DHCP packets that got no reply, by reason.",
+	}, []string{"interface", "subnet", "reason"})
+
+	dhcpPacketsRelayed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rebar_dhcp_packets_relayed_total",
+		Help: "Packets forwarded in relay mode, by client interface and direction.",
+	}, []string{"interface", "direction"})
+
+	storeSaveDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "rebar_dhcp_store_save_duration_seconds",
+		Help:    "Time spent saving the DataTracker to its store.",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+	})
+
+	apiRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rebar_dhcp_api_requests_total",
+		Help: "Management API requests by method and status code.",
+	}, []string{"method", "code"})
+)
+
+// Reasons a packet is dropped
+const (
+	dropNoSubnet  = "no_subnet"
+	dropOutOfIPs  = "out_of_ips"
+	dropNotForUs  = "other_server"
+	dropNoReply   = "no_reply"
+	dropUnhandled = "unhandled_type"
+	dropNotPXE    = "not_pxe"       // ProxyDHCP ignores other clients
+	dropBalanced  = "load_balanced" // The failover partner's client
+)
+
+// recordPacket counts a received packet and what became of it.
+func recordPacket(intf, subnet string, msgType dhcp.MessageType, reply dhcp.Packet, reason string) {
+	dhcpPacketsReceived.WithLabelValues(intf, subnet, msgType.String()).Inc()
+	if reply == nil {
+		dhcpPacketsDropped.WithLabelValues(intf, subnet, reason).Inc()
+		return
+	}
+	sent := reply.ParseOptions()[dhcp.OptionDHCPMessageType]
+	if len(sent) == 1 {
+		dhcpPacketsSent.WithLabelValues(intf, subnet, dhcp.MessageType(sent[0]).String()).Inc()
+	}
+}
+
+// recordPacket6 is recordPacket for DHCPv6.  Relay wrapping is not
+// counted, only the client message inside.
+func recordPacket6(intf, subnet string, msgType dhcpv6.MessageType, reply dhcpv6.DHCPv6, reason string) {
+	dhcpPacketsReceived.WithLabelValues(intf, subnet, msgType.String()).Inc()
+	if reply == nil {
+		dhcpPacketsDropped.WithLabelValues(intf, subnet, reason).Inc()
+		return
+	}
+	if m, err := reply.GetInnerMessage(); err == nil {
+		dhcpPacketsSent.WithLabelValues(intf, subnet, m.MessageType.String()).Inc()
+	}
+}
+
+// TrackerCollector exports lease and pool state for every subnet.
+type TrackerCollector struct {
+	dt *DataTracker
+
+	leases   *prometheus.Desc
+	bindings *prometheus.Desc
+	poolSize *prometheus.Desc
+	poolFree *prometheus.Desc
+}
+
+func NewTrackerCollector(dt *DataTracker) *TrackerCollector {
+	return &TrackerCollector{
+		dt: dt,
+		leases: prometheus.NewDesc("rebar_dhcp_leases",
+			"Leases by state.", []string{"subnet", "state"}, nil),
+		bindings: prometheus.NewDesc("rebar_dhcp_bindings",
+			"Configured MAC to IP bindings.", []string{"subnet"}, nil),
+		poolSize: prometheus.NewDesc("rebar_dhcp_pool_addresses",
+			"Addresses in the active range.", []string{"subnet"}, nil),
+		poolFree: prometheus.NewDesc("rebar_dhcp_pool_free_addresses",
+			"Addresses in the active range not leased or bound.", []string{"subnet"}, nil),
+	}
+}
+
+func (tc *TrackerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- tc.leases
+	ch <- tc.bindings
+	ch <- tc.poolSize
+	ch <- tc.poolFree
+}
+
+func (tc *TrackerCollector) Collect(ch chan<- prometheus.Metric) {
+	now := time.Now()
+	for _, s := range tc.dt.Subnets {
+		s.lock.RLock()
+		active, expired := 0, 0
+		for _, l := range s.Leases {
+			if now.After(l.ExpireTime) {
+				expired++
+			} else {
+				active++
+			}
+		}
+		used, size := s.utilization()
+		free := size - used
+		bindings := len(s.Bindings)
+		s.lock.RUnlock()
+
+		ch <- prometheus.MustNewConstMetric(tc.leases, prometheus.GaugeValue, float64(active), s.Name, "active")
+		ch <- prometheus.MustNewConstMetric(tc.leases, prometheus.GaugeValue, float64(expired), s.Name, "expired")
+		ch <- prometheus.MustNewConstMetric(tc.bindings, prometheus.GaugeValue, float64(bindings), s.Name)
+		ch <- prometheus.MustNewConstMetric(tc.poolSize, prometheus.GaugeValue, float64(size), s.Name)
+		ch <- prometheus.MustNewConstMetric(tc.poolFree, prometheus.GaugeValue, float64(free), s.Name)
+	}
+}
+
+// metricsHandler builds the /metrics handler for a frontend.
+func (fe *Frontend) metricsHandler() rest.HandlerFunc {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		dhcpPacketsReceived,
+		dhcpPacketsSent,
+		dhcpPacketsDropped,
+		dhcpPacketsRelayed,
+		storeSaveDuration,
+		apiRequests,
+		NewTrackerCollector(fe.DhcpInfo),
+	)
+	h := promhttp.HandlerFor(reg, promhttp.HandlerOpts{})
+	return func(w rest.ResponseWriter, r *rest.Request) {
+		sc := scopeOf(r)
+		if !sc.limited() {
+			h.ServeHTTP(w.(http.ResponseWriter), r.Request)
+			return
+		}
+		g := scopedGatherer{reg, func(subnet string) bool { return fe.inScope(sc, subnet, nil) }}
+		promhttp.HandlerFor(g, promhttp.HandlerOpts{}).ServeHTTP(w.(http.ResponseWriter), r.Request)
+	}
+}
+
+// scopedGatherer leaves out series labelled with a subnet the request
+// can't see.  Series without a subnet label are kept.
+type scopedGatherer struct {
+	prometheus.Gatherer
+	allows func(subnet string) bool
+}
+
+func (sg scopedGatherer) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := sg.Gatherer.Gather()
+	kept := make([]*dto.MetricFamily, 0, len(mfs))
+	for _, mf := range mfs {
+		metrics := make([]*dto.Metric, 0, len(mf.Metric))
+		for _, m := range mf.Metric {
+			if sg.keeps(m) {
+				metrics = append(metrics, m)
+			}
+		}
+		if len(metrics) > 0 {
+			mf.Metric = metrics
+			kept = append(kept, mf)
+		}
+	}
+	return kept, err
+}
+
+func (sg scopedGatherer) keeps(m *dto.Metric) bool {
+	for _, l := range m.Label {
+		if l.GetName() == "subnet" {
+			return sg.allows(l.GetValue())
+		}
+	}
+	return true
+}
+
+// apiMetricsMiddleware counts requests.  The status code is left in
+// the env by the RecorderMiddleware.
+func apiMetricsMiddleware(h rest.HandlerFunc) rest.HandlerFunc {
+	return func(w rest.ResponseWriter, r *rest.Request) {
+		h(w, r)
+		code, ok := r.Env["STATUS_CODE"].(int)
+		if !ok {
+			code = http.StatusOK
+		}
+		apiRequests.WithLabelValues(r.Method, fmt.Sprint(code)).Inc()
+	}
+}
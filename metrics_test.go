@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	dhcp "github.com/krolaw/dhcp4"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordPacket(t *testing.T) {
+	req := dhcp.RequestPacket(dhcp.Discover, net.HardwareAddr{1, 2, 3, 4, 5, 6}, nil, nil, false, nil)
+	reply := dhcp.ReplyPacket(req, dhcp.Offer, net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 2}, time.Minute, nil)
+
+	sent := dhcpPacketsSent.WithLabelValues("eth9", "fred", "Offer")
+	dropped := dhcpPacketsDropped.WithLabelValues("eth9", "fred", dropOutOfIPs)
+	received := dhcpPacketsReceived.WithLabelValues("eth9", "fred", "Discover")
+	sentBefore := testutil.ToFloat64(sent)
+	droppedBefore := testutil.ToFloat64(dropped)
+	receivedBefore := testutil.ToFloat64(received)
+
+	recordPacket("eth9", "fred", dhcp.Discover, reply, dropNoReply)
+	recordPacket("eth9", "fred", dhcp.Discover, nil, dropOutOfIPs)
+
+	assert.Equal(t, receivedBefore+2, testutil.ToFloat64(received))
+	assert.Equal(t, sentBefore+1, testutil.ToFloat64(sent))
+	assert.Equal(t, droppedBefore+1, testutil.ToFloat64(dropped))
+}
+
+func TestGetMetrics(t *testing.T) {
+	fe, handler := get_frontend()
+	for k := range fe.DhcpInfo.Subnets {
+		delete(fe.DhcpInfo.Subnets, k)
+	}
+	s, _, _ := addNewSubnet(fe.DhcpInfo, "fred", "192.168.128.0/24")
+	s.ActiveBits.Set(0)
+	s.Leases["one"] = &Lease{Ip: s.ActiveStart, Mac: "one", ExpireTime: time.Now().Add(time.Hour)}
+	s.Leases["two"] = &Lease{Mac: "two"}
+
+	recorder := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", base_url("/metrics"), nil)
+	assert.Nil(t, err)
+	req.SetBasicAuth("fred", "rules")
+
+	handler.ServeHTTP(recorder, req)
+
+	assert.Equal(t, 200, recorder.Code)
+	body := recorder.Body.String()
+	assert.Contains(t, body, "rebar_dhcp_leases{state=\"active\",subnet=\"fred\"} 1")
+	assert.Contains(t, body, "rebar_dhcp_leases{state=\"expired\",subnet=\"fred\"} 1")
+	assert.Contains(t, body, "rebar_dhcp_pool_addresses{subnet=\"fred\"} 21")
+	assert.Contains(t, body, "rebar_dhcp_pool_free_addresses{subnet=\"fred\"} 20")
+	assert.Contains(t, body, "rebar_dhcp_store_save_duration_seconds_count")
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/binary"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+
+	dhcp "github.com/krolaw/dhcp4"
+	"github.com/krolaw/dhcp4/conn"
+)
+
+/*
+ * ProxyDHCP (PXE specification 2.1)
+ *
+ * Where another server hands out addresses, PXE clients can still be
+ * booted.  Their DHCPDISCOVER on port 67 is answered with an offer
+ * carrying no address, only the boot server and file, and their
+ * follow-up request on port 4011 is acked the same way.  Requests on
+ * port 67 are the real server's unless they name us.  Clients that are
+ * not PXEClient are ignored.
+ */
+
+const OptionClientUUID dhcp.OptionCode = 97 // RFC 4578
+
+const pxeClass = "PXEClient"
+
+// Ports the proxy listens on
+const (
+	dhcpServerPort = 67
+	pxeBootPort    = 4011 // PXE boot server
+)
+
+// PXE vendor option 6, PXE_DISCOVERY_CONTROL, set to 8: boot the file
+// in this packet rather than discovering boot servers.
+var pxeVendorOptions = []byte{6, 1, 8, 255}
+
+type ProxyBoot struct {
+	BootFile   string
+	NextServer net.IP
+}
+
+type ProxyDHCP struct {
+	ProxyBoot
+	arch map[uint16]*ProxyBoot // By client architecture, option 93
+}
+
+// proxy_dhcp is nil unless proxyDHCP mode is configured.
+var proxy_dhcp *ProxyDHCP
+
+func NewProxyDHCP(def ProxyBoot, arch map[uint16]*ProxyBoot) *ProxyDHCP {
+	if arch == nil {
+		arch = make(map[uint16]*ProxyBoot)
+	}
+	return &ProxyDHCP{ProxyBoot: def, arch: arch}
+}
+
+// runProxyPort serves the PXE boot server port on an interface.
+func runProxyPort(intf net.Interface, handler *DHCPHandler) {
+	l, err := conn.NewUDP4FilterListener(intf.Name, ":"+strconv.Itoa(pxeBootPort))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer l.Close()
+	h := *handler
+	h.port = pxeBootPort
+	log.Fatal(dhcp.Serve(l, &h))
+}
+
+func isPXEClient(options dhcp.Options) bool {
+	return strings.HasPrefix(string(options[dhcp.OptionVendorClassIdentifier]), pxeClass)
+}
+
+func clientArch(options dhcp.Options) (uint16, bool) {
+	a := options[dhcp.OptionClientArchitecture]
+	if len(a) < 2 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint16(a), true
+}
+
+// boot picks the next server and boot file for a client.  The binding
+// wins, then the client's architecture, then the proxy default, then
+// the subnet.
+func (px *ProxyDHCP) boot(subnet *Subnet, binding *Binding, lease *Lease, options dhcp.Options) (net.IP, string) {
+	var ns net.IP
+	file := ""
+	if binding != nil {
+		if binding.NextServer != nil {
+			ns = net.ParseIP(*binding.NextServer)
+		}
+		for _, o := range binding.Options {
+			if o.Code == dhcp.OptionBootFileName {
+				file = o.Value
+			}
+		}
+	}
+	if file == "" && boot_templates != nil && lease.UserClass == "iPXE" {
+		file = boot_templates.boot_url(lease.Mac)
+	}
+	choices := make([]*ProxyBoot, 0, 2)
+	if a, ok := clientArch(options); ok && px.arch[a] != nil {
+		choices = append(choices, px.arch[a])
+	}
+	choices = append(choices, &px.ProxyBoot)
+	for _, c := range choices {
+		if ns == nil && c.NextServer != nil {
+			ns = c.NextServer
+		}
+		if file == "" {
+			file = c.BootFile
+		}
+	}
+	if subnet != nil {
+		if ns == nil && subnet.NextServer != nil {
+			ns = *subnet.NextServer
+		}
+		if file == "" {
+			file = string(subnet.Options[dhcp.OptionBootFileName])
+		}
+	}
+	return ns, file
+}
+
+// serveProxy answers a PXE client without giving it an address.  port
+// is the one the packet came in on: discovers are offered on port 67,
+// requests are acked on the PXE boot server port.
+func (h *DHCPHandler) serveProxy(port int, p dhcp.Packet, msgType dhcp.MessageType, options dhcp.Options) (dhcp.Packet, string, string) {
+	if !isPXEClient(options) {
+		return nil, "", dropNotPXE
+	}
+	var reply dhcp.MessageType
+	switch {
+	case msgType == dhcp.Discover && port == dhcpServerPort:
+		reply = dhcp.Offer
+	case msgType == dhcp.Request || msgType == dhcp.Inform:
+		// Requests to the real DHCP server pass by on port 67.
+		server, ok := options[dhcp.OptionServerIdentifier]
+		if ok && !net.IP(server).Equal(h.ip) || !ok && port != pxeBootPort {
+			return nil, "", dropNotForUs
+		}
+		reply = dhcp.ACK
+	default:
+		return nil, "", dropUnhandled
+	}
+
+	nic := p.CHAddr().String()
+	var binding *Binding
+	subnet := h.info.FindBoundIP(p.CHAddr())
+	if subnet != nil {
+		subnet.lock.RLock()
+		binding = subnet.Bindings[nic]
+		subnet.lock.RUnlock()
+	} else {
+		subnet = h.info.FindSubnet(h.ip)
+	}
+	subnetName := ""
+	if subnet != nil {
+		subnetName = subnet.Name
+	}
+
+	lease := &Lease{Mac: nic, Ip: p.CIAddr()}
+	lease.record_client_class(options)
+	ns, file := proxy_dhcp.boot(subnet, binding, lease, options)
+	if file == "" {
+		log.Println("ProxyDHCP: no boot file for ", nic)
+		return nil, subnetName, dropNoReply
+	}
+	if ns == nil {
+		ns = h.ip
+	}
+
+	opts := []dhcp.Option{
+		{Code: dhcp.OptionVendorClassIdentifier, Value: []byte(pxeClass)},
+		{Code: dhcp.OptionVendorSpecificInformation, Value: pxeVendorOptions},
+	}
+	if uuid, ok := options[OptionClientUUID]; ok {
+		opts = append(opts, dhcp.Option{Code: OptionClientUUID, Value: uuid})
+	}
+	d := dhcp.ReplyPacket(p, reply, h.ip, nil, 0, opts)
+	d.SetCIAddr(p.CIAddr())
+	d.SetSIAddr(ns)
+	d.SetFile([]byte(file))
+	log.Println("ProxyDHCP: ", nic, " boots ", file, " from ", ns, " (arch ", archName(options), ")")
+	return d, subnetName, dropNoReply
+}
+
+func archName(options dhcp.Options) string {
+	if a, ok := clientArch(options); ok {
+		return strconv.Itoa(int(a))
+	}
+	return "unknown"
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"net"
+	"os"
+	"testing"
+
+	dhcp "github.com/krolaw/dhcp4"
+	"github.com/stretchr/testify/assert"
+)
+
+func pxeRequest(mt dhcp.MessageType, mac string, arch uint16, extra ...dhcp.Option) (dhcp.Packet, dhcp.Options) {
+	hw, _ := net.ParseMAC(mac)
+	opts := []dhcp.Option{
+		{Code: dhcp.OptionVendorClassIdentifier, Value: []byte("PXEClient:Arch:00000:UNDI:002001")},
+		{Code: dhcp.OptionClientArchitecture, Value: []byte{byte(arch >> 8), byte(arch)}},
+	}
+	opts = append(opts, extra...)
+	p := dhcp.RequestPacket(mt, hw, nil, []byte{1, 2, 3, 4}, true, opts)
+	return p, p.ParseOptions()
+}
+
+func proxySetup() (*DHCPHandler, *Subnet, func()) {
+	dt, s := simpleSetup()
+	h := &DHCPHandler{ip: net.ParseIP("192.168.128.1").To4(), port: dhcpServerPort, info: dt}
+	proxy_dhcp = NewProxyDHCP(ProxyBoot{BootFile: "pxelinux.0"}, map[uint16]*ProxyBoot{
+		7: {BootFile: "ipxe.efi", NextServer: net.ParseIP("192.168.128.5").To4()},
+	})
+	return h, s, func() { proxy_dhcp = nil }
+}
+
+func TestProxyOffer(t *testing.T) {
+	h, _, done := proxySetup()
+	defer done()
+
+	p, opts := pxeRequest(dhcp.Discover, "52:54:00:00:00:01", 0, dhcp.Option{Code: OptionClientUUID, Value: []byte{0, 1, 2}})
+	d := h.ServeDHCP(p, dhcp.Discover, opts)
+	assert.NotNil(t, d)
+	ropts := d.ParseOptions()
+	assert.Equal(t, []byte{byte(dhcp.Offer)}, ropts[dhcp.OptionDHCPMessageType])
+	assert.True(t, d.YIAddr().Equal(net.IPv4zero), "No address is offered")
+	assert.Equal(t, "192.168.128.1", d.SIAddr().String())
+	assert.Equal(t, "pxelinux.0", string(d.File()[:len("pxelinux.0")]))
+	assert.Equal(t, "PXEClient", string(ropts[dhcp.OptionVendorClassIdentifier]))
+	assert.Equal(t, pxeVendorOptions, ropts[dhcp.OptionVendorSpecificInformation])
+	assert.Equal(t, []byte{0, 1, 2}, ropts[OptionClientUUID])
+	_, ok := ropts[dhcp.OptionIPAddressLeaseTime]
+	assert.False(t, ok)
+
+	// Non-PXE clients are left to the real DHCP server
+	hw, _ := net.ParseMAC("52:54:00:00:00:02")
+	p = dhcp.RequestPacket(dhcp.Discover, hw, nil, []byte{1, 2, 3, 4}, true, nil)
+	assert.Nil(t, h.ServeDHCP(p, dhcp.Discover, p.ParseOptions()))
+}
+
+func TestProxyArchAndBinding(t *testing.T) {
+	h, s, done := proxySetup()
+	defer done()
+	h.port = pxeBootPort
+
+	p, opts := pxeRequest(dhcp.Request, "52:54:00:00:00:01", 7)
+	d := h.ServeDHCP(p, dhcp.Request, opts)
+	assert.NotNil(t, d)
+	assert.Equal(t, []byte{byte(dhcp.ACK)}, d.ParseOptions()[dhcp.OptionDHCPMessageType])
+	assert.Equal(t, "192.168.128.5", d.SIAddr().String())
+	assert.Equal(t, "ipxe.efi", string(d.File()[:len("ipxe.efi")]))
+
+	// The binding beats the architecture
+	ns := "192.168.128.9"
+	s.Bindings["52:54:00:00:00:01"] = &Binding{
+		Mac:        "52:54:00:00:00:01",
+		Ip:         net.ParseIP("192.168.128.10").To4(),
+		NextServer: &ns,
+		Options:    []*Option{{Code: dhcp.OptionBootFileName, Value: "special.efi"}},
+	}
+	d = h.ServeDHCP(p, dhcp.Request, opts)
+	assert.Equal(t, "192.168.128.9", d.SIAddr().String())
+	assert.Equal(t, "special.efi", string(d.File()[:len("special.efi")]))
+
+	// Requests for another server are not ours
+	p, opts = pxeRequest(dhcp.Request, "52:54:00:00:00:01", 7,
+		dhcp.Option{Code: dhcp.OptionServerIdentifier, Value: []byte{192, 168, 128, 254}})
+	assert.Nil(t, h.ServeDHCP(p, dhcp.Request, opts))
+}
+
+func TestProxyPorts(t *testing.T) {
+	h, _, done := proxySetup()
+	defer done()
+	boot := *h
+	boot.port = pxeBootPort
+	ours := dhcp.Option{Code: dhcp.OptionServerIdentifier, Value: []byte{192, 168, 128, 1}}
+
+	// Port 67 offers to discovers, and leaves requests to the real server.
+	p, opts := pxeRequest(dhcp.Discover, "52:54:00:00:00:01", 0)
+	assert.NotNil(t, h.ServeDHCP(p, dhcp.Discover, opts))
+	for _, mt := range []dhcp.MessageType{dhcp.Request, dhcp.Inform} {
+		p, opts = pxeRequest(mt, "52:54:00:00:00:01", 0)
+		assert.Nil(t, h.ServeDHCP(p, mt, opts))
+		p, opts = pxeRequest(mt, "52:54:00:00:00:01", 0, ours)
+		d := h.ServeDHCP(p, mt, opts)
+		assert.NotNil(t, d, "requests naming us are ours")
+		assert.Equal(t, []byte{byte(dhcp.ACK)}, d.ParseOptions()[dhcp.OptionDHCPMessageType])
+	}
+
+	// Port 4011 acks requests and ignores discovers.
+	p, opts = pxeRequest(dhcp.Discover, "52:54:00:00:00:01", 0)
+	assert.Nil(t, boot.ServeDHCP(p, dhcp.Discover, opts))
+	for _, mt := range []dhcp.MessageType{dhcp.Request, dhcp.Inform} {
+		p, opts = pxeRequest(mt, "52:54:00:00:00:01", 0)
+		d := boot.ServeDHCP(p, mt, opts)
+		assert.NotNil(t, d)
+		assert.Equal(t, []byte{byte(dhcp.ACK)}, d.ParseOptions()[dhcp.OptionDHCPMessageType])
+		assert.Equal(t, "pxelinux.0", string(d.File()[:len("pxelinux.0")]))
+	}
+}
+
+func TestProxyConfig(t *testing.T) {
+	path := write_config(t, `[network]
+port = 6755
+username = admin
+password = admin
+
+[storage]
+data-dir = /tmp/dhcp
+
+[proxy]
+enabled = true
+boot-file = pxelinux.0
+
+[proxy-arch "7"]
+boot-file = ipxe.efi
+next-server = 10.10.10.5
+`)
+	defer os.Remove(path)
+
+	cfg, err := readConfig(path)
+	assert.Nil(t, err)
+	assert.True(t, cfg.Proxy.Enabled)
+	px := cfg.proxyDHCP()
+	assert.Equal(t, "pxelinux.0", px.BootFile)
+	assert.Nil(t, px.NextServer)
+	assert.Equal(t, "ipxe.efi", px.arch[7].BootFile)
+	assert.Equal(t, "10.10.10.5", px.arch[7].NextServer.String())
+
+	cfg.ProxyArch["efi"] = &ProxyArchConfig{NextServer: "nope"}
+	err = cfg.validate()
+	assert.NotNil(t, err)
+	assert.Equal(t, 2, len(err.(ConfigError)))
+}
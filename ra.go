@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/binary"
+	"log"
+	"net"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv6"
+)
+
+/*
+ * Router advertisements (RFC 4861)
+ *
+ * A minimal sender for links where nothing else advertises, so hosts
+ * use DHCPv6 and SLAAC the way the subnet expects.  The subnet holding
+ * the interface's server-ip6 picks the flags: a stateful one (with an
+ * active range) sets Managed and Other and keeps its prefix out of
+ * SLAAC, a stateless one sets only Other and lets hosts autoconfigure
+ * from its /64.  Router lifetime is 0 unless configured, so hosts
+ * don't pick this server as their default router.
+ */
+
+const (
+	raManaged    byte = 0x80
+	raOther      byte = 0x40
+	prefixOnLink byte = 0x80
+	prefixAuto   byte = 0x40
+
+	raHopLimit        = 64
+	raValidLifetime   = 30 * 24 * time.Hour // RFC 4861 defaults
+	raPreferLifetime  = 7 * 24 * time.Hour
+	raMinDelayBetween = 3 * time.Second // MIN_DELAY_BETWEEN_RAS
+)
+
+var (
+	allNodes   = net.ParseIP("ff02::1")
+	allRouters = net.ParseIP("ff02::2")
+)
+
+type RASettings struct {
+	Interval       time.Duration // Between unsolicited advertisements
+	RouterLifetime time.Duration
+}
+
+// ra_settings is nil unless router advertisements are configured.
+var ra_settings *RASettings
+
+type RouterAdvertiser struct {
+	RASettings
+	dt   *DataTracker
+	intf net.Interface
+	ip   net.IP // server-ip6, finds the subnet
+}
+
+func NewRouterAdvertiser(dt *DataTracker, intf net.Interface, ip net.IP, settings RASettings) *RouterAdvertiser {
+	return &RouterAdvertiser{RASettings: settings, dt: dt, intf: intf, ip: ip}
+}
+
+// routerAdvertisement builds the ICMPv6 message for a subnet.  The
+// kernel fills in the checksum.
+func routerAdvertisement(s *Subnet, mac net.HardwareAddr, lifetime time.Duration) []byte {
+	s.lock.RLock()
+	stateless := s.stateless()
+	prefix := s.Subnet.IPNet
+	s.lock.RUnlock()
+
+	ones, _ := prefix.Mask.Size()
+	flags := raManaged | raOther
+	pflags := prefixOnLink
+	if stateless && ones == 64 {
+		flags = raOther
+		pflags |= prefixAuto
+	}
+
+	b := make([]byte, 16)
+	b[0] = byte(ipv6.ICMPTypeRouterAdvertisement)
+	b[4] = raHopLimit
+	b[5] = flags
+	binary.BigEndian.PutUint16(b[6:], uint16(lifetime/time.Second))
+
+	if len(mac) == 6 {
+		b = append(b, 1, 1) // Source link-layer address
+		b = append(b, mac...)
+	}
+
+	pi := make([]byte, 32)
+	pi[0], pi[1] = 3, 4 // Prefix information, 4 * 8 bytes
+	pi[2] = byte(ones)
+	pi[3] = pflags
+	binary.BigEndian.PutUint32(pi[4:], uint32(raValidLifetime/time.Second))
+	binary.BigEndian.PutUint32(pi[8:], uint32(raPreferLifetime/time.Second))
+	copy(pi[16:], prefix.IP.To16())
+	return append(b, pi...)
+}
+
+// Run advertises every Interval and answers router solicitations until
+// the socket fails.
+func (ra *RouterAdvertiser) Run() error {
+	c, err := icmp.ListenPacket("ip6:ipv6-icmp", "::")
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	p := c.IPv6PacketConn()
+	if err := p.SetMulticastHopLimit(255); err != nil {
+		return err
+	}
+	if err := p.SetMulticastInterface(&ra.intf); err != nil {
+		return err
+	}
+	if err := p.JoinGroup(&ra.intf, &net.IPAddr{IP: allRouters}); err != nil {
+		return err
+	}
+	if err := p.SetControlMessage(ipv6.FlagInterface, true); err != nil {
+		return err
+	}
+	var f ipv6.ICMPFilter
+	f.SetAll(true)
+	f.Accept(ipv6.ICMPTypeRouterSolicitation)
+	if err := p.SetICMPFilter(&f); err != nil {
+		return err
+	}
+
+	solicited := make(chan struct{}, 1)
+	failed := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, cm, _, err := p.ReadFrom(buf)
+			if err != nil {
+				failed <- err
+				return
+			}
+			if n == 0 || buf[0] != byte(ipv6.ICMPTypeRouterSolicitation) ||
+				(cm != nil && cm.IfIndex != ra.intf.Index) {
+				continue
+			}
+			select {
+			case solicited <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	log.Println("Sending router advertisements on interface: ", ra.intf.Name)
+	ticker := time.NewTicker(ra.Interval)
+	defer ticker.Stop()
+	var last time.Time
+	send := func() {
+		s := ra.dt.FindSubnet(ra.ip)
+		if s == nil || !s.v6() {
+			return
+		}
+		msg := routerAdvertisement(s, ra.intf.HardwareAddr, ra.RouterLifetime)
+		if _, err := p.WriteTo(msg, nil, &net.IPAddr{IP: allNodes, Zone: ra.intf.Name}); err != nil {
+			log.Println("RA: sending on ", ra.intf.Name, " failed: ", err)
+			return
+		}
+		last = time.Now()
+	}
+	send()
+	for {
+		select {
+		case <-ticker.C:
+			send()
+		case <-solicited:
+			if time.Since(last) >= raMinDelayBetween {
+				send()
+			}
+		case err := <-failed:
+			return err
+		}
+	}
+}
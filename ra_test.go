@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRouterAdvertisement(t *testing.T) {
+	mac := net.HardwareAddr{0x52, 0x54, 0, 0, 0, 0xfe}
+
+	// Stateful: addresses from DHCPv6, no SLAAC
+	_, s := v6Setup()
+	b := routerAdvertisement(s, mac, 0)
+	assert.Equal(t, 16+8+32, len(b))
+	assert.Equal(t, byte(134), b[0])
+	assert.Equal(t, raManaged|raOther, b[5])
+	assert.Equal(t, []byte{0, 0}, b[6:8])
+	assert.Equal(t, []byte{1, 1, 0x52, 0x54, 0, 0, 0, 0xfe}, b[16:24])
+	pi := b[24:]
+	assert.Equal(t, []byte{3, 4, 64, prefixOnLink}, pi[:4])
+	assert.Equal(t, "fd00:10::", net.IP(pi[16:]).String())
+
+	// Stateless: SLAAC, options from DHCPv6
+	s = NewSubnet()
+	assert.Nil(t, json.Unmarshal([]byte(`{"name": "betty", "subnet": "fd00:30::/64"}`), s))
+	b = routerAdvertisement(s, mac, 30*time.Minute)
+	assert.Equal(t, raOther, b[5])
+	assert.Equal(t, []byte{0x07, 0x08}, b[6:8])
+	assert.Equal(t, prefixOnLink|prefixAuto, b[24+3])
+}
+
+func TestRaConfig(t *testing.T) {
+	path := write_config(t, `[network]
+port = 6755
+username = admin
+password = admin
+
+[storage]
+data-dir = /tmp/dhcp
+
+[ra]
+enabled = true
+router-lifetime = 1800
+
+[interface "eth1"]
+server-ip6 = fd00:10::1/64
+`)
+	defer os.Remove(path)
+
+	cfg, err := readConfig(path)
+	assert.Nil(t, err)
+	ra := cfg.raSettings()
+	assert.Equal(t, 200*time.Second, ra.Interval)
+	assert.Equal(t, 30*time.Minute, ra.RouterLifetime)
+
+	cfg.Ra.Interval = 2
+	cfg.Interface = nil
+	assert.Equal(t, ConfigError{
+		"ra.interval must be between 4 and 1800",
+		"ra needs a server-ip6 to advertise on",
+	}, cfg.validate())
+}
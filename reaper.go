@@ -0,0 +1,55 @@
+package main
+
+import (
+	"time"
+)
+
+/*
+ * Lease expiry
+ *
+ * Leases and delegated prefixes that run out without a release are
+ * freed by a scan of every subnet each reapInterval, publishing
+ * lease.expired and prefix.expired.  Allocation still frees expired
+ * leases itself when a pool runs out between scans.
+ */
+
+const reapInterval = time.Minute
+
+// RunReaper scans for expired leases every interval until stop is
+// closed.
+func (dt *DataTracker) RunReaper(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			dt.reap(time.Now())
+		}
+	}
+}
+
+// reap frees the leases and delegations that expired before now and
+// saves the subnets that had any.
+func (dt *DataTracker) reap(now time.Time) {
+	dt.Lock()
+	subnets := make([]*Subnet, 0, len(dt.Subnets))
+	for _, s := range dt.Subnets {
+		subnets = append(subnets, s)
+	}
+	dt.Unlock()
+
+	for _, s := range subnets {
+		s.lock.Lock()
+		expired := s.expire_leases(dt, now)
+		if s.DelegatedPrefix != nil && s.expire_delegations(dt, now) {
+			expired = true
+		}
+		s.lock.Unlock()
+		if expired {
+			dt.alerter.Check(dt, s)
+			dt.save_subnet(s.Name)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/willf/bitset"
+)
+
+func TestReapLeases(t *testing.T) {
+	dt, s := tempSetup(t)
+	s.ActiveBits = bitset.New(21)
+	old, _ := s.find_or_get_info(dt, "52:54:00:00:00:01", nil)
+	s.update_lease_time(dt, old, time.Hour)
+	live, _ := s.find_or_get_info(dt, "52:54:00:00:00:02", nil)
+	s.update_lease_time(dt, live, time.Hour)
+	bit, _ := s.active_bit(old.Ip)
+
+	sub, _ := dt.events.Subscribe(0, EventFilter{})
+	defer dt.events.Unsubscribe(sub)
+
+	// Nothing has expired yet; the pool isn't short either.
+	dt.reap(time.Now())
+	assert.Equal(t, 2, len(s.Leases))
+
+	s.lock.Lock()
+	old.ExpireTime = time.Now().Add(-time.Second)
+	s.lock.Unlock()
+	dt.reap(time.Now())
+	assert.Nil(t, s.Leases["52:54:00:00:00:01"])
+	assert.NotNil(t, s.Leases["52:54:00:00:00:02"])
+	assert.False(t, s.ActiveBits.Test(bit))
+	e := <-sub.C
+	assert.Equal(t, EventLeaseExpired, e.Type)
+	assert.Equal(t, "52:54:00:00:00:01", e.Mac)
+
+	dt2 := NewDataTracker(dt.store)
+	dt2.load_data()
+	assert.Nil(t, dt2.Subnets["fred"].Leases["52:54:00:00:00:01"], "the freed lease is saved")
+}
+
+func TestReapDelegations(t *testing.T) {
+	h, s := v6Setup()
+	ss, err := NewSQLStore("sqlite3", ":memory:")
+	assert.Nil(t, err)
+	defer ss.Close()
+	h.info.store = ss
+	pd := s.find_or_get_prefix(h.info, "00:03:00:01:52:54:00:00:00:01")
+	s.update_prefix_time(h.info, pd, time.Hour)
+	bit, _ := s.delegation_bit(pd.Ip)
+
+	sub, _ := h.info.events.Subscribe(0, EventFilter{})
+	defer h.info.events.Unsubscribe(sub)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go h.info.RunReaper(10*time.Millisecond, stop)
+	s.lock.Lock()
+	pd.ExpireTime = time.Now().Add(-time.Second)
+	s.lock.Unlock()
+
+	select {
+	case e := <-sub.C:
+		assert.Equal(t, EventPrefixExpired, e.Type)
+	case <-time.After(2 * time.Second):
+		t.Fatal("the reaper never expired the delegation")
+	}
+	s.lock.RLock()
+	assert.Equal(t, 0, len(s.Delegations))
+	assert.False(t, s.DelegatedBits.Test(bit))
+	s.lock.RUnlock()
+}
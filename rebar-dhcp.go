@@ -3,21 +3,17 @@ package main
 import (
 	"flag"
 	"log"
-
-	"gopkg.in/gcfg.v1"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
-type Config struct {
-	Network struct {
-		Port     int
-		Username string
-		Password string
-	}
-}
-
 var ignore_anonymus bool
+var tftp_enabled bool // next-server defaults to the serving interface, subnets may set tftp_root
 var config_path, key_pem, cert_pem, data_dir string
 var server_ip string
+var server_ip6 string
 
 func init() {
 	flag.StringVar(&config_path, "config_path", "/etc/rebar-dhcp.conf", "Path to config file")
@@ -25,26 +21,164 @@ func init() {
 	flag.StringVar(&cert_pem, "cert_pem", "/etc/dhcp-https-cert.pem", "Path to cert file")
 	flag.StringVar(&data_dir, "data_dir", "/var/cache/rebar-dhcp", "Path to store data")
 	flag.StringVar(&server_ip, "server_ip", "", "Server IP to return in packets (e.g. 10.10.10.1/24)")
+	flag.StringVar(&server_ip6, "server_ip6", "", "Server IPv6 address to serve DHCPv6 on (e.g. fd00:10::1/64)")
 	flag.BoolVar(&ignore_anonymus, "ignore_anonymus", false, "Ignore unknown MAC addresses")
 }
 
 func main() {
 	flag.Parse()
 
-	var cfg Config
-	cerr := gcfg.ReadFileInto(&cfg, config_path)
+	cfg, cerr := readConfig(config_path)
 	if cerr != nil {
 		log.Fatal(cerr)
 	}
-	fs, err := NewFileStore(data_dir + "/database.json")
+	if err := setupLogging(cfg); err != nil {
+		log.Fatal(err)
+	}
+
+	// The merged config is authoritative from here on.
+	data_dir = cfg.Storage.DataDir
+	tftp_enabled = cfg.Tftp.Root != "" // Before any subnet is checked
+	server_ip = cfg.Dhcp.ServerIp
+	server_ip6 = cfg.Dhcp.ServerIp6
+	ignore_anonymus = cfg.Dhcp.IgnoreAnonymus
+	cert_pem = cfg.Tls.Cert
+	key_pem = cfg.Tls.Key
+
+	store, err := cfg.store()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fe := NewFrontend(cert_pem, key_pem, cfg, store)
+	if ks, ok := store.(*KVStore); ok {
+		go ks.Watch(fe.DhcpInfo, nil)
+	}
+	if fe.auth, err = NewAuth(data_dir + "/auth.json"); err != nil {
+		log.Fatal(err)
+	}
+	if cfg.Audit.File != "" {
+		if fe.audit, err = NewAuditLog(cfg.Audit.File); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	endpoints := alertEndpoints(cfg.Alerts.Webhook, cfg.Alerts.Retries)
+	for name, wc := range cfg.Webhook {
+		endpoints = append(endpoints, &WebhookEndpoint{
+			Name:    name,
+			Url:     wc.Url,
+			Secret:  wc.Secret,
+			Events:  wc.Event,
+			Subnets: wc.Subnet,
+		})
+	}
+	if len(endpoints) > 0 {
+		wh, err := NewWebhooks(data_dir+"/webhooks.json", endpoints)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fe.DhcpInfo.webhooks = wh
+		go wh.Run(nil)
+	}
+
+	if len(cfg.Alerts.Webhook) > 0 {
+		thresholds := cfg.Alerts.Threshold
+		if len(thresholds) == 0 {
+			thresholds = defaultAlertThresholds
+		}
+		fe.DhcpInfo.alerter = NewAlerter(thresholds)
+		fe.DhcpInfo.alerter.Seed(fe.DhcpInfo)
+	}
+
+	if cfg.History.Dir != "" {
+		h, err := cfg.leaseHistory()
+		if err != nil {
+			log.Fatal(err)
+		}
+		fe.DhcpInfo.history = h
+	}
+
+	if cfg.Ddns.Server != "" {
+		algo := cfg.Ddns.TsigAlgorithm
+		if algo == "" {
+			algo = "hmac-sha256"
+		}
+		ttl := cfg.Ddns.Ttl
+		if ttl == 0 {
+			ttl = 300
+		}
+		fe.DhcpInfo.ddns = NewDDNSUpdater(fe.DhcpInfo, ddnsServer(cfg.Ddns.Server),
+			cfg.Ddns.TsigName, cfg.Ddns.TsigSecret, algo, ttl)
+		go fe.DhcpInfo.ddns.Run()
+	}
+
+	seeds, err := readSeedDir(cfg.Seed.Dir)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if err := fe.DhcpInfo.ReconcileSeeds(seeds, cfg.Seed.Prune); err != nil {
+		log.Fatal(err)
+	}
+
+	go fe.DhcpInfo.RunReaper(reapInterval, nil)
+
+	if cfg.Files.Hosts != "" || cfg.Files.ZoneDir != "" {
+		go NewZoneFileWriter(fe.DhcpInfo, cfg).Run(nil)
+	}
+
+	if cfg.Tftp.Root != "" {
+		addr := cfg.Tftp.Address
+		if addr == "" {
+			addr = ":69"
+		}
+		ts := NewTftpServer(fe.DhcpInfo, cfg.Tftp.Root)
+		go func() {
+			log.Fatal(ts.ListenAndServe(addr))
+		}()
+	}
+
+	if cfg.Boot.TemplateDir != "" {
+		boot_templates = NewBootTemplates(cfg.Boot.TemplateDir, cfg.Boot.Default, cfg.Boot.Url)
+		if cfg.Boot.Address != "" {
+			go func() {
+				log.Fatal(http.ListenAndServe(cfg.Boot.Address, fe.BootHandler()))
+			}()
+		}
+	}
 
-	fe := NewFrontend(cert_pem, key_pem, cfg, fs)
+	if cfg.Proxy.Enabled {
+		proxy_dhcp = cfg.proxyDHCP()
+	}
+	if cfg.Ra.Enabled {
+		ra_settings = cfg.raSettings()
+	}
 
-	if err := StartDhcpHandlers(fe.DhcpInfo, server_ip); err != nil {
+	if cfg.Failover.Role != "" {
+		fe.DhcpInfo.failover = cfg.failover(fe.DhcpInfo)
+		if err := fe.DhcpInfo.failover.Start(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if len(cfg.Relay.Server) > 0 {
+		if err := StartRelay(cfg.Relay.Server, cfg.Relay.Option82, cfg.Interface); err != nil {
+			log.Fatal(err)
+		}
+	} else if err := StartDhcpHandlers(fe.DhcpInfo, server_ip, server_ip6, cfg.Interface); err != nil {
 		log.Fatal(err)
 	}
+	// SIGHUP re-reads the config file.  Failures leave the running config alone.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.Println("Received SIGHUP, reloading", config_path)
+			if err := fe.ReloadConfig(); err != nil {
+				log.Println("Config reload failed, keeping current config: ", err)
+			}
+		}
+	}()
+
 	fe.RunServer(true)
 }
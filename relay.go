@@ -0,0 +1,278 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+
+	dhcp "github.com/krolaw/dhcp4"
+	"golang.org/x/net/ipv4"
+)
+
+/*
+ * DHCP relay agent (RFC 1542, RFC 3046)
+ *
+ * Client broadcasts on the relay interfaces get giaddr set to the
+ * interface address, and optionally option 82, and are forwarded to
+ * every upstream server.  Server replies come back to giaddr and are
+ * sent to the client out the interface that address belongs to.
+ */
+
+const (
+	OptionRelayAgentInfo dhcp.OptionCode = 82
+	relayCircuitId       byte            = 1
+	relayRemoteId        byte            = 2
+	relayMaxHops         byte            = 16
+)
+
+// relayConn is a ServeConn that knows which interface a packet came in
+// on and can send out a chosen one.
+type relayConn interface {
+	dhcp.ServeConn
+	LastIf() int
+	WriteToIf(b []byte, addr net.Addr, ifIndex int) (int, error)
+}
+
+type ipv4RelayConn struct {
+	p      *ipv4.PacketConn
+	lastIf int
+}
+
+func newIpv4RelayConn(pc net.PacketConn) (*ipv4RelayConn, error) {
+	p := ipv4.NewPacketConn(pc)
+	if err := p.SetControlMessage(ipv4.FlagInterface, true); err != nil {
+		return nil, err
+	}
+	return &ipv4RelayConn{p: p}, nil
+}
+
+// ReadFrom is only called from the single Serve loop, so lastIf needs
+// no lock.
+func (c *ipv4RelayConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, cm, addr, err := c.p.ReadFrom(b)
+	c.lastIf = 0
+	if cm != nil {
+		c.lastIf = cm.IfIndex
+	}
+	return n, addr, err
+}
+
+func (c *ipv4RelayConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return c.p.WriteTo(b, nil, addr)
+}
+
+func (c *ipv4RelayConn) WriteToIf(b []byte, addr net.Addr, ifIndex int) (int, error) {
+	return c.p.WriteTo(b, &ipv4.ControlMessage{IfIndex: ifIndex}, addr)
+}
+
+func (c *ipv4RelayConn) LastIf() int {
+	return c.lastIf
+}
+
+type relayIntf struct {
+	intf net.Interface
+	ip   net.IP // giaddr for this segment
+}
+
+type RelayAgent struct {
+	conn     relayConn
+	servers  []*net.UDPAddr
+	byIndex  map[int]*relayIntf
+	byAddr   map[string]*relayIntf
+	option82 bool
+}
+
+func NewRelayAgent(servers []string, option82 bool) (*RelayAgent, error) {
+	ra := &RelayAgent{
+		byIndex:  make(map[int]*relayIntf),
+		byAddr:   make(map[string]*relayIntf),
+		option82: option82,
+	}
+	for _, s := range servers {
+		addr, err := net.ResolveUDPAddr("udp4", relayServerAddr(s))
+		if err != nil {
+			return nil, err
+		}
+		ra.servers = append(ra.servers, addr)
+	}
+	return ra, nil
+}
+
+// AddInterface relays for the segment on intf, using ip as giaddr.
+func (ra *RelayAgent) AddInterface(intf net.Interface, ip net.IP) {
+	ri := &relayIntf{intf: intf, ip: ip.To4()}
+	ra.byIndex[intf.Index] = ri
+	ra.byAddr[ri.ip.String()] = ri
+	log.Println("Relaying on interface: ", intf.Name, " with giaddr: ", ri.ip)
+}
+
+// ListenAndServe relays until the socket fails.
+func (ra *RelayAgent) ListenAndServe() error {
+	if len(ra.byIndex) == 0 {
+		return errors.New("no relay interfaces")
+	}
+	pc, err := net.ListenPacket("udp4", ":67")
+	if err != nil {
+		return err
+	}
+	defer pc.Close()
+	conn, err := newIpv4RelayConn(pc)
+	if err != nil {
+		return err
+	}
+	ra.conn = conn
+	return dhcp.Serve(conn, ra)
+}
+
+// ServeDHCP forwards the packet and never answers it directly.
+func (ra *RelayAgent) ServeDHCP(p dhcp.Packet, msgType dhcp.MessageType, options dhcp.Options) dhcp.Packet {
+	// Serve reuses its buffer.
+	pkt := make(dhcp.Packet, len(p))
+	copy(pkt, p)
+
+	switch pkt.OpCode() {
+	case dhcp.BootRequest:
+		ra.relayRequest(pkt, options)
+	case dhcp.BootReply:
+		ra.relayReply(pkt, options)
+	}
+	return nil
+}
+
+func (ra *RelayAgent) relayRequest(p dhcp.Packet, options dhcp.Options) {
+	ri := ra.byIndex[ra.conn.LastIf()]
+	if ri == nil {
+		// Upstream side, or an interface we don't relay for.
+		return
+	}
+	if p.Hops() >= relayMaxHops {
+		log.Println("Relay: dropping request from ", p.CHAddr(), " after ", p.Hops(), " hops")
+		return
+	}
+	p.SetHops(p.Hops() + 1)
+	if p.GIAddr().Equal(net.IPv4zero) {
+		p.SetGIAddr(ri.ip)
+		if _, ok := options[OptionRelayAgentInfo]; ra.option82 && !ok {
+			p = rewriteOptions(p, OptionRelayAgentInfo, relayAgentInfo(ri.intf))
+		}
+	}
+	for _, s := range ra.servers {
+		if _, err := ra.conn.WriteTo(p, s); err != nil {
+			log.Println("Relay: forwarding to ", s, " failed: ", err)
+			continue
+		}
+		dhcpPacketsRelayed.WithLabelValues(ri.intf.Name, "upstream").Inc()
+	}
+}
+
+func (ra *RelayAgent) relayReply(p dhcp.Packet, options dhcp.Options) {
+	ri := ra.byAddr[p.GIAddr().String()]
+	if ri == nil {
+		return
+	}
+	if _, ok := options[OptionRelayAgentInfo]; ok {
+		p = rewriteOptions(p, OptionRelayAgentInfo, nil)
+	}
+	// Without ARP we can't unicast to yiaddr, so broadcast unless the
+	// client already has its address configured.
+	dst := &net.UDPAddr{IP: net.IPv4bcast, Port: 68}
+	if !p.CIAddr().Equal(net.IPv4zero) && !p.Broadcast() {
+		dst.IP = append(net.IP{}, p.CIAddr()...)
+	}
+	if _, err := ra.conn.WriteToIf(p, dst, ri.intf.Index); err != nil {
+		log.Println("Relay: reply to ", p.CHAddr(), " on ", ri.intf.Name, " failed: ", err)
+		return
+	}
+	dhcpPacketsRelayed.WithLabelValues(ri.intf.Name, "client").Inc()
+}
+
+// relayAgentInfo builds option 82 with the interface name as circuit
+// id and its MAC as remote id.
+func relayAgentInfo(intf net.Interface) []byte {
+	b := []byte{relayCircuitId, byte(len(intf.Name))}
+	b = append(b, intf.Name...)
+	if len(intf.HardwareAddr) > 0 {
+		b = append(b, relayRemoteId, byte(len(intf.HardwareAddr)))
+		b = append(b, intf.HardwareAddr...)
+	}
+	return b
+}
+
+// rewriteOptions drops option code from p and, if value is not nil,
+// adds it back with value.  Option order is otherwise kept.
+func rewriteOptions(p dhcp.Packet, code dhcp.OptionCode, value []byte) dhcp.Packet {
+	out := append(dhcp.Packet{}, p[:240]...)
+	opts := p.Options()
+	for len(opts) > 0 {
+		c := dhcp.OptionCode(opts[0])
+		if c == dhcp.End {
+			break
+		}
+		if c == dhcp.Pad {
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || len(opts) < 2+int(opts[1]) {
+			break
+		}
+		size := int(opts[1])
+		if c != code {
+			out = append(out, opts[:2+size]...)
+		}
+		opts = opts[2+size:]
+	}
+	if value != nil {
+		out = append(out, byte(code), byte(len(value)))
+		out = append(out, value...)
+	}
+	out = append(out, byte(dhcp.End))
+	out.PadToMinSize()
+	return out
+}
+
+// relayServerAddr adds the server port if it is missing.
+func relayServerAddr(s string) string {
+	if _, _, err := net.SplitHostPort(s); err != nil {
+		return net.JoinHostPort(s, "67")
+	}
+	return s
+}
+
+// StartRelay relays for every enabled configured interface.
+func StartRelay(servers []string, option82 bool, intfCfgs map[string]*InterfaceConfig) error {
+	ra, err := NewRelayAgent(servers, option82)
+	if err != nil {
+		return err
+	}
+	intfs, err := net.Interfaces()
+	if err != nil {
+		return err
+	}
+	for _, intf := range intfs {
+		ic := intfCfgs[intf.Name]
+		// DHCPv6 is not relayed.
+		if ic == nil || ic.Disabled || ic.ServerIp == "" {
+			continue
+		}
+		ip, _, _ := net.ParseCIDR(ic.ServerIp)
+		ra.AddInterface(intf, ip)
+	}
+	for name, ic := range intfCfgs {
+		if !ic.Disabled && ic.ServerIp != "" && ra.find(name) == nil {
+			log.Println("Configured interface ", name, " not found, skipping")
+		}
+	}
+	go func() {
+		log.Fatal(ra.ListenAndServe())
+	}()
+	return nil
+}
+
+func (ra *RelayAgent) find(name string) *relayIntf {
+	for _, ri := range ra.byIndex {
+		if ri.intf.Name == name {
+			return ri
+		}
+	}
+	return nil
+}
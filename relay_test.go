@@ -0,0 +1,153 @@
+package main
+
+import (
+	"net"
+	"os"
+	"testing"
+
+	dhcp "github.com/krolaw/dhcp4"
+	"github.com/stretchr/testify/assert"
+)
+
+type sentPacket struct {
+	p       dhcp.Packet
+	addr    string
+	ifIndex int
+}
+
+type fakeRelayConn struct {
+	lastIf int
+	sent   []sentPacket
+}
+
+func (c *fakeRelayConn) ReadFrom(b []byte) (int, net.Addr, error) { return 0, nil, nil }
+func (c *fakeRelayConn) LastIf() int                              { return c.lastIf }
+
+func (c *fakeRelayConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.sent = append(c.sent, sentPacket{append(dhcp.Packet{}, b...), addr.String(), 0})
+	return len(b), nil
+}
+
+func (c *fakeRelayConn) WriteToIf(b []byte, addr net.Addr, ifIndex int) (int, error) {
+	c.sent = append(c.sent, sentPacket{append(dhcp.Packet{}, b...), addr.String(), ifIndex})
+	return len(b), nil
+}
+
+func relaySetup(t *testing.T, option82 bool) (*RelayAgent, *fakeRelayConn) {
+	ra, err := NewRelayAgent([]string{"10.0.0.1", "10.0.0.2:1067"}, option82)
+	assert.Nil(t, err)
+	conn := &fakeRelayConn{}
+	ra.conn = conn
+	hw, _ := net.ParseMAC("02:00:00:00:00:01")
+	ra.AddInterface(net.Interface{Index: 3, Name: "eth1", HardwareAddr: hw}, net.ParseIP("192.168.50.1"))
+	return ra, conn
+}
+
+func TestRelayRequest(t *testing.T) {
+	ra, conn := relaySetup(t, true)
+
+	hw, _ := net.ParseMAC("52:54:00:00:00:01")
+	p := dhcp.RequestPacket(dhcp.Discover, hw, nil, []byte{1, 2, 3, 4}, true,
+		[]dhcp.Option{{Code: dhcp.OptionHostName, Value: []byte("node1")}})
+
+	// Not from a relay interface
+	conn.lastIf = 2
+	assert.Nil(t, ra.ServeDHCP(p, dhcp.Discover, p.ParseOptions()))
+	assert.Equal(t, 0, len(conn.sent))
+
+	conn.lastIf = 3
+	assert.Nil(t, ra.ServeDHCP(p, dhcp.Discover, p.ParseOptions()))
+	assert.Equal(t, 2, len(conn.sent))
+	assert.Equal(t, "10.0.0.1:67", conn.sent[0].addr)
+	assert.Equal(t, "10.0.0.2:1067", conn.sent[1].addr)
+
+	out := conn.sent[0].p
+	assert.Equal(t, "192.168.50.1", out.GIAddr().String())
+	assert.Equal(t, byte(1), out.Hops())
+	opts := out.ParseOptions()
+	assert.Equal(t, []byte("node1"), opts[dhcp.OptionHostName])
+	assert.Equal(t, []byte{1, 4, 'e', 't', 'h', '1', 2, 6, 2, 0, 0, 0, 0, 1}, opts[OptionRelayAgentInfo])
+	assert.True(t, p.GIAddr().Equal(net.IPv4zero), "The received packet is untouched")
+
+	// A request already relayed keeps its giaddr and gets no option 82
+	conn.sent = nil
+	p.SetGIAddr(net.ParseIP("172.16.0.1"))
+	ra.ServeDHCP(p, dhcp.Discover, p.ParseOptions())
+	out = conn.sent[0].p
+	assert.Equal(t, "172.16.0.1", out.GIAddr().String())
+	_, ok := out.ParseOptions()[OptionRelayAgentInfo]
+	assert.False(t, ok)
+
+	// Loops are cut off
+	conn.sent = nil
+	p.SetHops(relayMaxHops)
+	ra.ServeDHCP(p, dhcp.Discover, p.ParseOptions())
+	assert.Equal(t, 0, len(conn.sent))
+}
+
+func TestRelayReply(t *testing.T) {
+	ra, conn := relaySetup(t, true)
+
+	hw, _ := net.ParseMAC("52:54:00:00:00:01")
+	req := dhcp.RequestPacket(dhcp.Discover, hw, nil, []byte{1, 2, 3, 4}, false, nil)
+	req.SetGIAddr(net.ParseIP("192.168.50.1"))
+	reply := dhcp.ReplyPacket(req, dhcp.Offer, net.ParseIP("10.0.0.1").To4(), net.ParseIP("192.168.50.20"), 0,
+		[]dhcp.Option{{Code: OptionRelayAgentInfo, Value: []byte{1, 1, 'x'}}})
+
+	assert.Nil(t, ra.ServeDHCP(reply, dhcp.Offer, reply.ParseOptions()))
+	assert.Equal(t, 1, len(conn.sent))
+	assert.Equal(t, "255.255.255.255:68", conn.sent[0].addr)
+	assert.Equal(t, 3, conn.sent[0].ifIndex)
+	opts := conn.sent[0].p.ParseOptions()
+	_, ok := opts[OptionRelayAgentInfo]
+	assert.False(t, ok, "Option 82 is removed")
+	assert.Equal(t, []byte{byte(dhcp.Offer)}, opts[dhcp.OptionDHCPMessageType])
+
+	// Renewing clients are unicast
+	conn.sent = nil
+	reply.SetCIAddr(net.ParseIP("192.168.50.20"))
+	ra.ServeDHCP(reply, dhcp.ACK, reply.ParseOptions())
+	assert.Equal(t, "192.168.50.20:68", conn.sent[0].addr)
+
+	// Replies for other relays are dropped
+	conn.sent = nil
+	reply.SetGIAddr(net.ParseIP("192.168.60.1"))
+	ra.ServeDHCP(reply, dhcp.ACK, reply.ParseOptions())
+	assert.Equal(t, 0, len(conn.sent))
+}
+
+func TestRelayConfig(t *testing.T) {
+	path := write_config(t, `[network]
+port = 6755
+username = admin
+password = admin
+
+[storage]
+data-dir = /tmp/dhcp
+
+[relay]
+server = 10.0.0.1
+server = 10.0.0.2:1067
+option82 = true
+
+[interface "eth1"]
+server-ip = 192.168.50.1/24
+`)
+	defer os.Remove(path)
+
+	cfg, err := readConfig(path)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2:1067"}, cfg.Relay.Server)
+	assert.True(t, cfg.Relay.Option82)
+
+	cfg.Relay.Server = append(cfg.Relay.Server, "dhcp.example.com")
+	cfg.Proxy.Enabled = true
+	cfg.Interface = nil
+	err = cfg.validate()
+	assert.NotNil(t, err)
+	assert.Equal(t, ConfigError{
+		"relay.server \"dhcp.example.com\" is not an IPv4 address",
+		"relay mode needs [interface] sections",
+		"relay and proxy modes can not be combined",
+	}, err.(ConfigError))
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/ant0ine/go-json-rest/rest"
+)
+
+/*
+ * Subnet scopes
+ *
+ * A user, and a token on top of its user, may be limited to a list of
+ * subnet names and CIDR ranges.  Subnets outside the scope are hidden:
+ * they are left out of lists, the hosts and zone files and metrics,
+ * and answered as not found.  Users, tokens and the audit log need an
+ * unlimited user.
+ */
+
+// subnetScope holds the lists a subnet must be allowed by.  An empty
+// list allows every subnet.
+type subnetScope [][]string
+
+func validScope(list []string) error {
+	for _, e := range list {
+		if e == "" {
+			return errors.New("subnet entry can not be empty")
+		}
+		if strings.Contains(e, "/") {
+			if _, _, err := net.ParseCIDR(e); err != nil {
+				return errors.New("subnet entry " + e + " is not a CIDR range")
+			}
+		}
+	}
+	return nil
+}
+
+func scopeListAllows(list []string, name string, n *net.IPNet) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, e := range list {
+		if e == name {
+			return true
+		}
+		if _, r, err := net.ParseCIDR(e); err == nil && n != nil {
+			ones, _ := n.Mask.Size()
+			rones, _ := r.Mask.Size()
+			if r.Contains(n.IP) && rones <= ones {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// allows checks a subnet by name and network.  n may be nil when only
+// the name is known.
+func (sc subnetScope) allows(name string, n *net.IPNet) bool {
+	for _, list := range sc {
+		if !scopeListAllows(list, name, n) {
+			return false
+		}
+	}
+	return true
+}
+
+func (sc subnetScope) limited() bool {
+	for _, list := range sc {
+		if len(list) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func scopeOf(r *rest.Request) subnetScope {
+	sc, _ := r.Env["REMOTE_SCOPE"].(subnetScope)
+	return sc
+}
+
+// inScope checks a subnet, or an address in one that may be gone.
+func (fe *Frontend) inScope(sc subnetScope, name string, ip net.IP) bool {
+	if !sc.limited() {
+		return true
+	}
+	if s := fe.DhcpInfo.Subnets[name]; s != nil {
+		return sc.allows(name, s.Subnet.IPNet)
+	}
+	if ip != nil {
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+		return sc.allows(name, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	return sc.allows(name, nil)
+}
+
+// hidden reports whether a subnet exists but is out of the request's
+// scope.  Handlers answer it as they do a missing subnet.
+func (fe *Frontend) hidden(r *rest.Request, name string) bool {
+	return fe.DhcpInfo.Subnets[name] != nil && !fe.inScope(scopeOf(r), name, nil)
+}
+
+// keeps filters the subnets behind a view of all of them, nil when the
+// request's scope allows everything.
+func (fe *Frontend) keeps(r *rest.Request) func(*Subnet) bool {
+	sc := scopeOf(r)
+	if !sc.limited() {
+		return nil
+	}
+	return func(s *Subnet) bool {
+		return sc.allows(s.Name, s.Subnet.IPNet)
+	}
+}
+
+// unscoped wraps a route that isn't about subnets.
+func unscoped(h rest.HandlerFunc) rest.HandlerFunc {
+	return func(w rest.ResponseWriter, r *rest.Request) {
+		if scopeOf(r).limited() {
+			rest.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func scopeFrontend(t *testing.T) (*Frontend, http.Handler, func(method, path, body string) int) {
+	fe, handler := authFrontend(t)
+	apiCall(handler, "POST", "/subnets", `{"name": "wilma", "subnet": "10.1.2.0/24",
+		"active_start": "10.1.2.10", "active_end": "10.1.2.20"}`)
+	fe.cfg.User["pebbles"] = &UserConfig{PasswordHash: bcryptHash("bambam"), Role: RoleAdmin,
+		Subnet: []string{"fred", "10.0.0.0/8"}}
+	return fe, handler, func(method, path, body string) int {
+		return authCall(handler, basic("pebbles", "bambam"), method, path, body).Code
+	}
+}
+
+func TestSubnetScopes(t *testing.T) {
+	fe, handler, call := scopeFrontend(t)
+	apiCall(handler, "POST", "/subnets", `{"name": "betty", "subnet": "192.168.129.0/24",
+		"active_start": "192.168.129.10", "active_end": "192.168.129.20"}`)
+
+	recorder := authCall(handler, basic("pebbles", "bambam"), "GET", "/subnets", "")
+	subnets := make([]*ApiSubnet, 0)
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &subnets))
+	names := []string{}
+	for _, s := range subnets {
+		names = append(names, s.Name)
+	}
+	assert.ElementsMatch(t, []string{"fred", "wilma"}, names)
+
+	// Out of scope looks like missing.
+	assert.Equal(t, 404, call("GET", "/subnets/betty", ""))
+	assert.Equal(t, 404, call("DELETE", "/subnets/betty", ""))
+	assert.Equal(t, 404, call("POST", "/subnets/betty/bind", `{"mac": "52:54:00:00:00:01", "ip": "192.168.129.5"}`))
+	assert.Equal(t, 404, call("DELETE", "/subnets/betty/bind/52:54:00:00:00:01", ""))
+	assert.NotNil(t, fe.DhcpInfo.Subnets["betty"])
+
+	assert.Equal(t, 200, call("GET", "/subnets/wilma", ""))
+	assert.Equal(t, 200, call("POST", "/subnets/fred/bind", `{"mac": "52:54:00:00:00:01", "ip": "192.168.128.5"}`))
+
+	// New subnets must land in scope, by name or range.
+	assert.Equal(t, 403, call("POST", "/subnets", `{"name": "dino", "subnet": "172.16.0.0/24",
+		"active_start": "172.16.0.10", "active_end": "172.16.0.20"}`))
+	assert.Equal(t, 200, call("POST", "/subnets", `{"name": "dino", "subnet": "10.9.0.0/24",
+		"active_start": "10.9.0.10", "active_end": "10.9.0.20"}`))
+	assert.Equal(t, 403, call("PUT", "/subnets/dino", `{"name": "dino", "subnet": "172.16.0.0/24",
+		"active_start": "172.16.0.10", "active_end": "172.16.0.20"}`))
+
+	// Users and the audit log need an unlimited user.
+	assert.Equal(t, 403, call("GET", "/audit", ""))
+	assert.Equal(t, 403, call("GET", "/admin/users", ""))
+}
+
+func TestSubnetScopeViews(t *testing.T) {
+	fe, handler, call := scopeFrontend(t)
+	apiCall(handler, "POST", "/subnets", `{"name": "betty", "subnet": "192.168.129.0/24",
+		"active_start": "192.168.129.10", "active_end": "192.168.129.20", "forward_zone": "betty.example.com"}`)
+	apiCall(handler, "POST", "/subnets/fred/bind", `{"mac": "52:54:00:00:00:01", "ip": "192.168.128.5", "hostname": "dino"}`)
+	apiCall(handler, "POST", "/subnets/betty/bind", `{"mac": "52:54:00:00:00:02", "ip": "192.168.129.5", "hostname": "hoppy"}`)
+
+	get := func(path string) (int, string) {
+		recorder := authCall(handler, basic("pebbles", "bambam"), "GET", path, "")
+		return recorder.Code, recorder.Body.String()
+	}
+	code, body := get("/hosts")
+	assert.Equal(t, 200, code)
+	assert.Contains(t, body, "dino")
+	assert.NotContains(t, body, "hoppy")
+	assert.Contains(t, apiCall(handler, "GET", "/hosts", "").Body.String(), "hoppy")
+
+	code, body = get("/zones")
+	assert.Equal(t, 200, code)
+	assert.NotContains(t, body, "betty.example.com")
+	assert.Equal(t, 404, call("GET", "/zones/betty.example.com", ""))
+	assert.Equal(t, 200, apiCall(handler, "GET", "/zones/betty.example.com", "").Code)
+
+	code, body = get("/metrics")
+	assert.Equal(t, 200, code)
+	assert.Contains(t, body, `subnet="fred"`)
+	assert.NotContains(t, body, `subnet="betty"`)
+
+	_, done := bootSetup(t)
+	defer done()
+	assert.Equal(t, 404, call("GET", "/boot/52:54:00:00:00:02", ""))
+	assert.Equal(t, 200, call("GET", "/boot/52:54:00:00:00:01", ""))
+	assert.NotNil(t, fe.DhcpInfo.Subnets["betty"])
+}
+
+func TestSubnetScopeTokens(t *testing.T) {
+	fe, handler := authFrontend(t)
+	apiCall(handler, "POST", "/subnets", `{"name": "wilma", "subnet": "10.1.2.0/24",
+		"active_start": "10.1.2.10", "active_end": "10.1.2.20"}`)
+
+	assert.Equal(t, 400, apiCall(handler, "POST", "/admin/tokens",
+		`{"user": "barney", "subnets": ["10.0.0.0/33"]}`).Code)
+	recorder := apiCall(handler, "POST", "/admin/tokens", `{"user": "barney", "subnets": ["wilma"]}`)
+	assert.Equal(t, 200, recorder.Code)
+	token := &ApiToken{}
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), token))
+	bearer := "Bearer " + token.Token
+
+	assert.Equal(t, 404, authCall(handler, bearer, "GET", "/subnets/fred", "").Code)
+	assert.Equal(t, 200, authCall(handler, bearer, "GET", "/subnets/wilma", "").Code)
+
+	// A token can't widen its user.
+	fe.cfg.User["barney"].Subnet = []string{"fred"}
+	assert.Equal(t, 404, authCall(handler, bearer, "GET", "/subnets/wilma", "").Code)
+	assert.Equal(t, 200, authCall(handler, basic("barney", "bambam"), "GET", "/subnets/fred", "").Code)
+}
+
+func TestInScope(t *testing.T) {
+	fe, _ := authFrontend(t)
+	sc := subnetScope{{"10.0.0.0/8"}, {"10.1.0.0/16", "fred"}}
+
+	assert.True(t, fe.inScope(nil, "anything", nil))
+	assert.True(t, fe.inScope(sc, "gone", net.ParseIP("10.1.2.3")))
+	assert.False(t, fe.inScope(sc, "gone", net.ParseIP("10.2.0.1")))
+	assert.False(t, fe.inScope(sc, "gone", nil))
+	// fred is named by one list but outside the other's range.
+	assert.False(t, fe.inScope(sc, "fred", nil))
+	assert.True(t, fe.inScope(subnetScope{{"fred"}}, "fred", nil))
+	// A range must hold the whole subnet.
+	assert.False(t, fe.inScope(subnetScope{{"192.168.128.0/25"}}, "fred", nil))
+	assert.True(t, fe.inScope(subnetScope{{"192.168.0.0/16"}}, "fred", nil))
+}
+
+func TestScopeConfig(t *testing.T) {
+	cfg := Config{}
+	cfg.Network.Port = 6755
+	cfg.Storage.DataDir = "/tmp/dhcp"
+	cfg.User = map[string]*UserConfig{
+		"wilma": {PasswordHash: bcryptHash("x"), Role: RoleAdmin, Subnet: []string{"fred", "10.0.0.0/33"}},
+	}
+	assert.Equal(t, ConfigError{`user "wilma" subnet entry 10.0.0.0/33 is not a CIDR range`}, cfg.validate())
+
+	cfg.User["wilma"].Subnet = []string{"fred", "10.0.0.0/8"}
+	assert.Nil(t, cfg.validate())
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ghodss/yaml"
+)
+
+/*
+ * Declarative seeding
+ *
+ * A seed directory holds subnet files in the same shape as the
+ * management API (see test/subnet.json), as json or yaml.  The files
+ * are reconciled into the DataTracker at startup and on reload.
+ */
+
+// readSeedDir parses every seed file in dir.  Nothing is returned
+// unless all of them parse, so a bad file never half-applies.
+func readSeedDir(dir string) ([]*ApiSubnet, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	errs := ConfigError{}
+	seeds := make([]*ApiSubnet, 0)
+	names := make(map[string]string)
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		path := filepath.Join(dir, f.Name())
+		ext := strings.ToLower(filepath.Ext(path))
+		if ext != ".json" && ext != ".yaml" && ext != ".yml" {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		as := NewApiSubnet()
+		if ext == ".json" {
+			err = json.Unmarshal(data, as)
+		} else {
+			err = yaml.Unmarshal(data, as)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", path, err.Error()))
+			continue
+		}
+
+		// Leases are runtime state, never seeded.
+		as.Leases = nil
+		if _, err := convertApiSubnetToSubnet(seedSubnetOnly(as), nil); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", path, err.Error()))
+			continue
+		}
+		if other, ok := names[as.Name]; ok {
+			errs = append(errs, fmt.Sprintf("%s: subnet %s already defined in %s", path, as.Name, other))
+			continue
+		}
+		names[as.Name] = path
+		seeds = append(seeds, as)
+	}
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return seeds, nil
+}
+
+// seedSubnetOnly copies the subnet level fields, leaving bindings to
+// be applied one at a time.
+func seedSubnetOnly(as *ApiSubnet) *ApiSubnet {
+	ns := *as
+	ns.Leases = nil
+	ns.Bindings = nil
+	return &ns
+}
+
+// seedConfig is the subnet level configuration as the API shows it,
+// with options sorted so equal subnets give equal bytes.
+func seedConfig(s *Subnet) []byte {
+	s.lock.RLock()
+	as := convertSubnetToApiSubnet(s)
+	s.lock.RUnlock()
+	as.Leases, as.Bindings, as.Delegations, as.Revision = nil, nil, nil, 0
+	sort.Slice(as.Options, func(i, j int) bool { return as.Options[i].Code < as.Options[j].Code })
+	data, _ := json.Marshal(as)
+	return data
+}
+
+func sameBinding(a, b *Binding) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	ja, _ := json.Marshal(a)
+	jb, _ := json.Marshal(b)
+	return bytes.Equal(ja, jb)
+}
+
+// CheckSeeds reports what would stop ReconcileSeeds applying seeds,
+// without changing anything: bindings that don't fit their subnet and
+// subnets that would overlap once the seeds, and with prune the
+// removals, are in place.
+func (dt *DataTracker) CheckSeeds(seeds []*ApiSubnet, prune bool) error {
+	errs := ConfigError{}
+	after := make(map[string]*Subnet)
+	if !prune {
+		for name, s := range dt.Subnets {
+			after[name] = s
+		}
+	}
+	for _, as := range seeds {
+		subnet, err := convertApiSubnetToSubnet(seedSubnetOnly(as), nil)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", as.Name, err.Error()))
+			continue
+		}
+		after[as.Name] = subnet
+		for _, b := range as.Bindings {
+			nb := *b
+			if err := subnet.check_binding(&nb); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: binding %s: %s", as.Name, b.key(), err.Error()))
+			}
+		}
+	}
+
+	names := make([]string, 0, len(after))
+	for name := range after {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, a := range names {
+		for _, b := range names[i+1:] {
+			if after[a].overlaps(after[b]) {
+				errs = append(errs, fmt.Sprintf("%s: overlaps with subnet %s", a, b))
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// ReconcileSeeds makes the tracker match seeds.  Existing subnets go
+// through ReplaceSubnet so their leases survive.  Subnets and bindings
+// that already match are left alone, so a reload doesn't save, publish
+// events or bump revisions for them.  With prune, subnets and bindings
+// missing from the seeds are removed.
+func (dt *DataTracker) ReconcileSeeds(seeds []*ApiSubnet, prune bool) error {
+	errs := ConfigError{}
+	seen := make(map[string]bool)
+
+	for _, as := range seeds {
+		seen[as.Name] = true
+
+		subnet, err := convertApiSubnetToSubnet(seedSubnetOnly(as), nil)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", as.Name, err.Error()))
+			continue
+		}
+
+		var code int
+		if cur := dt.Subnets[as.Name]; cur == nil {
+			err, code = dt.AddSubnet(subnet)
+		} else if !bytes.Equal(seedConfig(cur), seedConfig(subnet)) {
+			err, code = dt.ReplaceSubnet(as.Name, subnet)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s (%d)", as.Name, err.Error(), code))
+			continue
+		}
+
+		// Bindings are filed by key(), the DUID in IPv6 subnets, as
+		// check_binding normalizes it.
+		ls := dt.Subnets[as.Name]
+		bound := make(map[string]bool)
+		for _, b := range as.Bindings {
+			nb := *b
+			if err := ls.check_binding(&nb); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: binding %s: %s", as.Name, b.key(), err.Error()))
+				continue
+			}
+			bound[nb.key()] = true
+			if sameBinding(ls.Bindings[nb.key()], &nb) {
+				continue
+			}
+			if err, _ := dt.AddBinding(as.Name, nb); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: binding %s: %s", as.Name, b.key(), err.Error()))
+			}
+		}
+		if prune {
+			for key := range ls.Bindings {
+				if !bound[key] {
+					dt.DeleteBinding(as.Name, key)
+				}
+			}
+		}
+	}
+
+	if prune {
+		stale := make([]string, 0)
+		for name := range dt.Subnets {
+			if !seen[name] {
+				stale = append(stale, name)
+			}
+		}
+		sort.Strings(stale)
+		for _, name := range stale {
+			log.Println("Pruning subnet not in seed directory: ", name)
+			dt.RemoveSubnet(name)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func seed_dir(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "rebar-dhcp-seed")
+	assert.Nil(t, err)
+	for name, contents := range files {
+		err = ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644)
+		assert.Nil(t, err)
+	}
+	return dir
+}
+
+const seedJson = `{
+  "name": "fred",
+  "subnet": "192.168.128.0/24",
+  "active_start": "192.168.128.5",
+  "active_end": "192.168.128.25",
+  "active_lease_time": 60,
+  "bindings": [ { "ip": "192.168.128.50", "mac": "aa:bb:cc:dd:ee:ff" } ]
+}`
+
+const seedYaml = `name: barney
+subnet: 192.168.129.0/24
+active_start: 192.168.129.10
+active_end: 192.168.129.20
+options:
+  - id: 3
+    value: 192.168.129.1
+`
+
+func TestReadSeedDir(t *testing.T) {
+	dir := seed_dir(t, map[string]string{
+		"fred.json":   seedJson,
+		"barney.yaml": seedYaml,
+		"README":      "ignored",
+	})
+	defer os.RemoveAll(dir)
+
+	seeds, err := readSeedDir(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(seeds))
+	assert.Equal(t, "barney", seeds[0].Name)
+	assert.Equal(t, "192.168.129.1", seeds[0].Options[0].Value)
+	assert.Equal(t, "fred", seeds[1].Name)
+	assert.Equal(t, 1, len(seeds[1].Bindings))
+}
+
+func TestReadSeedDirBadFile(t *testing.T) {
+	dir := seed_dir(t, map[string]string{
+		"fred.json": seedJson,
+		"bad.json":  `{ "name": "bad", "subnet": "192k.168.1.0/24" }`,
+	})
+	defer os.RemoveAll(dir)
+
+	seeds, err := readSeedDir(dir)
+	assert.Nil(t, seeds)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "invalid CIDR address: 192k.168.1.0/24")
+}
+
+func TestReconcileSeedsPreservesLeases(t *testing.T) {
+	dt, s := tempSetup(t)
+	s.Leases["11:22:33:44:55:66"] = &Lease{Ip: net.ParseIP("192.168.128.6").To4(), Mac: "11:22:33:44:55:66"}
+
+	dir := seed_dir(t, map[string]string{"fred.json": seedJson, "barney.yml": seedYaml})
+	defer os.RemoveAll(dir)
+	seeds, err := readSeedDir(dir)
+	assert.Nil(t, err)
+
+	err = dt.ReconcileSeeds(seeds, false)
+	assert.Nil(t, err)
+
+	fred := dt.Subnets["fred"]
+	assert.NotEqual(t, s, fred, "fred should have been replaced")
+	assert.Equal(t, 60, int(fred.ActiveLeaseTime.Seconds()))
+	assert.NotNil(t, fred.Leases["11:22:33:44:55:66"], "Lease should survive reconcile")
+	assert.NotNil(t, fred.Bindings["aa:bb:cc:dd:ee:ff"], "Binding should be added")
+	assert.NotNil(t, dt.Subnets["barney"], "barney should be created")
+}
+
+func TestReconcileSeedsPrune(t *testing.T) {
+	dt, _ := tempSetup(t)
+	dt.AddBinding("fred", Binding{Ip: net.ParseIP("192.168.128.60"), Mac: "00:00:00:00:00:01"})
+
+	dir := seed_dir(t, map[string]string{"barney.yml": seedYaml, "fred.json": seedJson})
+	defer os.RemoveAll(dir)
+	seeds, _ := readSeedDir(dir)
+
+	// Without fred in the seeds, prune removes it.
+	err := dt.ReconcileSeeds(seeds[:1], true)
+	assert.Nil(t, err)
+	assert.Nil(t, dt.Subnets["fred"])
+	assert.NotNil(t, dt.Subnets["barney"])
+
+	// Bindings not in the seed are pruned too.
+	dt.ReconcileSeeds(seeds, true)
+	dt.AddBinding("fred", Binding{Ip: net.ParseIP("192.168.128.60"), Mac: "00:00:00:00:00:01"})
+	err = dt.ReconcileSeeds(seeds, true)
+	assert.Nil(t, err)
+	assert.Nil(t, dt.Subnets["fred"].Bindings["00:00:00:00:00:01"])
+	assert.NotNil(t, dt.Subnets["fred"].Bindings["aa:bb:cc:dd:ee:ff"])
+}
+
+func TestReconcileSeedsUnchanged(t *testing.T) {
+	dt, _ := tempSetup(t)
+	dir := seed_dir(t, map[string]string{"fred.json": seedJson, "barney.yml": seedYaml})
+	defer os.RemoveAll(dir)
+	seeds, _ := readSeedDir(dir)
+
+	assert.Nil(t, dt.ReconcileSeeds(seeds, true))
+	fred, barney := dt.Subnets["fred"], dt.Subnets["barney"]
+	revisions := []uint64{fred.Revision, barney.Revision}
+
+	// Reading the same files again changes nothing.
+	seeds, _ = readSeedDir(dir)
+	sub, _ := dt.events.Subscribe(0, EventFilter{})
+	defer dt.events.Unsubscribe(sub)
+	assert.Nil(t, dt.ReconcileSeeds(seeds, true))
+	assert.True(t, fred == dt.Subnets["fred"], "fred should not have been replaced")
+	assert.Equal(t, revisions, []uint64{dt.Subnets["fred"].Revision, dt.Subnets["barney"].Revision})
+	assert.Equal(t, 0, len(sub.C))
+}
+
+const seedJson6 = `{
+  "name": "wilma",
+  "subnet": "2001:db8::/64",
+  "active_start": "2001:db8::100",
+  "active_end": "2001:db8::1ff",
+  "bindings": [ { "ip": "2001:db8::50", "duid": "00-03-00-01-52-54-00-00-00-01" } ]
+}`
+
+func TestReconcileSeedsPruneV6(t *testing.T) {
+	dt, _ := tempSetup(t)
+	dir := seed_dir(t, map[string]string{"fred.json": seedJson, "wilma.json": seedJson6})
+	defer os.RemoveAll(dir)
+	seeds, err := readSeedDir(dir)
+	assert.Nil(t, err)
+
+	// IPv6 bindings are filed by DUID and survive prune.
+	assert.Nil(t, dt.ReconcileSeeds(seeds, true))
+	wilma := dt.Subnets["wilma"]
+	assert.Equal(t, 1, len(wilma.Bindings))
+	assert.NotNil(t, wilma.Bindings["00:03:00:01:52:54:00:00:00:01"])
+
+	revision := wilma.Revision
+	assert.Nil(t, dt.ReconcileSeeds(seeds, true))
+	assert.Equal(t, 1, len(wilma.Bindings))
+	assert.Equal(t, revision, wilma.Revision)
+}
+
+func TestCheckSeeds(t *testing.T) {
+	dt, _ := simpleSetup()
+	inside := strings.Replace(seedYaml, "192.168.129", "192.168.128", -1)
+	dir := seed_dir(t, map[string]string{"barney.yml": inside})
+	defer os.RemoveAll(dir)
+	seeds, err := readSeedDir(dir)
+	assert.Nil(t, err)
+
+	// barney lands on fred, unless pruning removes fred.
+	err = dt.CheckSeeds(seeds, false)
+	assert.NotNil(t, err)
+	assert.Equal(t, "barney: overlaps with subnet fred", err.Error())
+	assert.Nil(t, dt.CheckSeeds(seeds, true))
+	assert.Nil(t, dt.Subnets["barney"], "checking changes nothing")
+
+	seeds[0].Bindings = []*Binding{{Mac: "aa:bb:cc:dd:ee:ff", Ip: net.ParseIP("fd00::5")}}
+	assert.NotNil(t, dt.CheckSeeds(seeds, true))
+}
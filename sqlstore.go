@@ -0,0 +1,592 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+/*
+ * SQL backend (SQLite or PostgreSQL)
+ *
+ * Subnets, their options, bindings, binding options and leases (with
+ * delegated prefixes) are rows in their own tables, so they can be
+ * queried directly.  A change to one subnet saves only that subnet,
+ * writing the rows that changed since its last save in a single
+ * transaction.  The schema is created and
+ * upgraded by the migrations below, tracked in schema_version.
+ */
+
+var sqlMigrations = [][]string{
+	// 1: Initial schema
+	{
+		`CREATE TABLE subnets (
+			name TEXT PRIMARY KEY,
+			subnet TEXT NOT NULL,
+			next_server TEXT,
+			active_start TEXT NOT NULL,
+			active_end TEXT NOT NULL,
+			active_lease_time INTEGER NOT NULL,
+			reserved_lease_time INTEGER NOT NULL,
+			delegated_prefix TEXT NOT NULL,
+			delegated_length INTEGER NOT NULL,
+			alert_thresholds TEXT,
+			forward_zone TEXT NOT NULL,
+			reverse_zone TEXT NOT NULL,
+			hostname_template TEXT NOT NULL,
+			tftp_root TEXT NOT NULL,
+			boot_template TEXT NOT NULL,
+			boot_class_templates TEXT
+		)`,
+		`CREATE TABLE options (
+			subnet TEXT NOT NULL,
+			code INTEGER NOT NULL,
+			value TEXT NOT NULL,
+			PRIMARY KEY (subnet, code)
+		)`,
+		`CREATE TABLE bindings (
+			subnet TEXT NOT NULL,
+			id TEXT NOT NULL,
+			ip TEXT,
+			mac TEXT NOT NULL,
+			duid TEXT NOT NULL,
+			next_server TEXT,
+			hostname TEXT NOT NULL,
+			boot_template TEXT NOT NULL,
+			PRIMARY KEY (subnet, id)
+		)`,
+		`CREATE TABLE binding_options (
+			subnet TEXT NOT NULL,
+			binding TEXT NOT NULL,
+			code INTEGER NOT NULL,
+			value TEXT NOT NULL,
+			PRIMARY KEY (subnet, binding, code)
+		)`,
+		`CREATE TABLE leases (
+			subnet TEXT NOT NULL,
+			kind TEXT NOT NULL,
+			id TEXT NOT NULL,
+			ip TEXT NOT NULL,
+			mac TEXT NOT NULL,
+			duid TEXT NOT NULL,
+			iaid BIGINT NOT NULL,
+			prefix_len INTEGER NOT NULL,
+			valid BOOLEAN NOT NULL,
+			expire_time TIMESTAMP NOT NULL,
+			hostname TEXT NOT NULL,
+			client_fqdn TEXT NOT NULL,
+			client_fqdn_flags INTEGER NOT NULL,
+			client_fqdn_sent BOOLEAN NOT NULL,
+			vendor_class TEXT NOT NULL,
+			user_class TEXT NOT NULL,
+			PRIMARY KEY (subnet, kind, id)
+		)`,
+		`CREATE INDEX leases_ip ON leases (ip)`,
+	},
+	// 2: Client id and relay details
+	{
+		`ALTER TABLE leases ADD COLUMN client_id TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE leases ADD COLUMN relay_addr TEXT`,
+		`ALTER TABLE leases ADD COLUMN circuit_id TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE leases ADD COLUMN remote_id TEXT NOT NULL DEFAULT ''`,
+	},
+	// 3: Subnet revisions
+	{
+		`ALTER TABLE subnets ADD COLUMN revision BIGINT NOT NULL DEFAULT 0`,
+	},
+	// 4: Last revision handed out, across all subnets
+	{
+		`CREATE TABLE revisions (revision BIGINT NOT NULL)`,
+		`INSERT INTO revisions (revision) VALUES (0)`,
+	},
+}
+
+// Lease kinds
+const (
+	sqlLeaseAddress = "address"
+	sqlLeasePrefix  = "prefix" // DHCPv6 delegated prefix
+)
+
+type sqlTable struct {
+	name    string
+	columns []string
+	keys    int // Leading columns that make up the primary key
+}
+
+// In write order.  Deletes go in reverse.
+var sqlTables = []sqlTable{
+	{"subnets", []string{"name", "subnet", "next_server", "active_start", "active_end",
+		"active_lease_time", "reserved_lease_time", "delegated_prefix", "delegated_length",
+		"alert_thresholds", "forward_zone", "reverse_zone", "hostname_template", "tftp_root",
+		"boot_template", "boot_class_templates", "revision"}, 1},
+	{"options", []string{"subnet", "code", "value"}, 2},
+	{"bindings", []string{"subnet", "id", "ip", "mac", "duid", "next_server", "hostname",
+		"boot_template"}, 2},
+	{"binding_options", []string{"subnet", "binding", "code", "value"}, 3},
+	{"leases", []string{"subnet", "kind", "id", "ip", "mac", "duid", "iaid", "prefix_len",
+		"valid", "expire_time", "hostname", "client_fqdn", "client_fqdn_flags",
+		"client_fqdn_sent", "vendor_class", "user_class", "client_id", "relay_addr",
+		"circuit_id", "remote_id"}, 3},
+}
+
+type sqlRow struct {
+	table  int // Index in sqlTables
+	values []interface{}
+}
+
+func (r sqlRow) key() string {
+	return fmt.Sprint(r.table, r.values[:sqlTables[r.table].keys])
+}
+
+// same compares values directly.  They are all strings, numbers,
+// bools, UTC times or nil.
+func (r sqlRow) same(o sqlRow) bool {
+	if len(r.values) != len(o.values) {
+		return false
+	}
+	for i, v := range r.values {
+		if v != o.values[i] {
+			return false
+		}
+	}
+	return true
+}
+
+type SQLStore struct {
+	db       *sql.DB
+	lock     sync.Mutex                   // Serializes saves
+	written  map[string]map[string]sqlRow // Subnet -> rows as of its last save, by key
+	revision uint64                       // DataTracker.Revision as of the last save
+}
+
+// NewSQLStore opens the database and brings its schema up to date.
+// driver is sqlite3 or postgres.
+func NewSQLStore(driver, dsn string) (*SQLStore, error) {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if driver == "sqlite3" {
+		db.SetMaxOpenConns(1) // One writer, and :memory: is per connection
+	}
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLStore{db: db, written: make(map[string]map[string]sqlRow)}, nil
+}
+
+func (ss *SQLStore) Close() error {
+	return ss.db.Close()
+}
+
+// migrate applies the migrations the database hasn't had yet, each in
+// its own transaction.
+func migrate(db *sql.DB) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL)`); err != nil {
+		return err
+	}
+	var version int
+	if err := db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_version`).Scan(&version); err != nil {
+		return err
+	}
+	if version > len(sqlMigrations) {
+		return fmt.Errorf("database schema version %d is newer than this server (%d)", version, len(sqlMigrations))
+	}
+	for ; version < len(sqlMigrations); version++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		for _, stmt := range sqlMigrations[version] {
+			if _, err := tx.Exec(stmt); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("migration %d: %s", version+1, err)
+			}
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_version (version) VALUES ($1)`, version+1); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func nullString(s *string) interface{} {
+	if s == nil {
+		return nil
+	}
+	return *s
+}
+
+func nullJSON(v interface{}, empty bool) interface{} {
+	if empty {
+		return nil
+	}
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+func ipString(ip net.IP) interface{} {
+	if ip == nil {
+		return nil
+	}
+	return ip.String()
+}
+
+func leaseRow(subnet, kind string, l *Lease) sqlRow {
+	return sqlRow{4, []interface{}{subnet, kind, l.key(), l.Ip.String(), l.Mac, l.Duid,
+		int64(l.Iaid), l.PrefixLen, l.Valid, l.ExpireTime.UTC(), l.Hostname, l.ClientFQDN,
+		int(l.ClientFQDNFlags), l.ClientFQDNSent, l.VendorClass, l.UserClass, l.ClientId,
+		ipString(l.RelayAddr), l.CircuitId, l.RemoteId}}
+}
+
+// subnetRows flattens a subnet into its rows.
+func subnetRows(as *ApiSubnet) []sqlRow {
+	rows := []sqlRow{{0, []interface{}{as.Name, as.Subnet, nullString(as.NextServer),
+		as.ActiveStart, as.ActiveEnd, as.ActiveLeaseTime, as.ReservedLeaseTime,
+		as.DelegatedPrefix, as.DelegatedLength,
+		nullJSON(as.AlertThresholds, len(as.AlertThresholds) == 0),
+		as.ForwardZone, as.ReverseZone, as.HostnameTemplate, as.TftpRoot, as.BootTemplate,
+		nullJSON(as.BootClassTemplates, len(as.BootClassTemplates) == 0), int64(as.Revision)}}}
+	for _, o := range as.Options {
+		rows = append(rows, sqlRow{1, []interface{}{as.Name, int(o.Code), o.Value}})
+	}
+	for _, b := range as.Bindings {
+		rows = append(rows, sqlRow{2, []interface{}{as.Name, b.key(), ipString(b.Ip), b.Mac,
+			b.Duid, nullString(b.NextServer), b.Hostname, b.BootTemplate}})
+		for _, o := range b.Options {
+			rows = append(rows, sqlRow{3, []interface{}{as.Name, b.key(), int(o.Code), o.Value}})
+		}
+	}
+	for _, l := range as.Leases {
+		rows = append(rows, leaseRow(as.Name, sqlLeaseAddress, l))
+	}
+	for _, l := range as.Delegations {
+		rows = append(rows, leaseRow(as.Name, sqlLeasePrefix, l))
+	}
+	return rows
+}
+
+// rows flattens s, or nothing for a removed subnet.
+func (ss *SQLStore) rows(s *Subnet) map[string]sqlRow {
+	rows := make(map[string]sqlRow)
+	if s == nil {
+		return rows
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for _, r := range subnetRows(convertSubnetToApiSubnet(s)) {
+		rows[r.key()] = r
+	}
+	return rows
+}
+
+func upsertSQL(t sqlTable) string {
+	params := make([]string, len(t.columns))
+	for i := range params {
+		params[i] = fmt.Sprintf("$%d", i+1)
+	}
+	updates := make([]string, 0)
+	for _, c := range t.columns[t.keys:] {
+		updates = append(updates, c+" = excluded."+c)
+	}
+	return fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) ON CONFLICT (%s) DO UPDATE SET %s",
+		t.name, strings.Join(t.columns, ", "), strings.Join(params, ", "),
+		strings.Join(t.columns[:t.keys], ", "), strings.Join(updates, ", "))
+}
+
+func deleteSQL(t sqlTable) string {
+	where := make([]string, t.keys)
+	for i, c := range t.columns[:t.keys] {
+		where[i] = fmt.Sprintf("%s = $%d", c, i+1)
+	}
+	return fmt.Sprintf("DELETE FROM %s WHERE %s", t.name, strings.Join(where, " AND "))
+}
+
+// Save writes the changed rows of every subnet in one transaction.
+func (ss *SQLStore) Save(dt *DataTracker) error {
+	return ss.save(dt, nil)
+}
+
+// SaveSubnet writes the changed rows of just the named subnets.
+func (ss *SQLStore) SaveSubnet(dt *DataTracker, names ...string) error {
+	return ss.save(dt, names)
+}
+
+// save writes the named subnets, or all of them and any removed since
+// the last save when names is nil.  dt is only locked to look them up.
+func (ss *SQLStore) save(dt *DataTracker, names []string) error {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+
+	subnets := make(map[string]*Subnet)
+	dt.Lock()
+	revision := dt.Revision
+	if names == nil {
+		for name, s := range dt.Subnets {
+			subnets[name] = s
+		}
+		for name := range ss.written {
+			if _, ok := subnets[name]; !ok {
+				subnets[name] = nil
+			}
+		}
+	} else {
+		for _, name := range names {
+			subnets[name] = dt.Subnets[name]
+		}
+	}
+	dt.Unlock()
+
+	saved := make(map[string]map[string]sqlRow)
+	upserts := make([]sqlRow, 0)
+	deletes := make([]sqlRow, 0)
+	for name, s := range subnets {
+		rows := ss.rows(s)
+		written := ss.written[name]
+		for k, r := range rows {
+			if old, ok := written[k]; !ok || !old.same(r) {
+				upserts = append(upserts, r)
+			}
+		}
+		for k, r := range written {
+			if _, ok := rows[k]; !ok {
+				deletes = append(deletes, r)
+			}
+		}
+		saved[name] = rows
+	}
+	if len(upserts) == 0 && len(deletes) == 0 && revision == ss.revision {
+		return nil
+	}
+	sort.SliceStable(upserts, func(i, j int) bool { return upserts[i].table < upserts[j].table })
+	sort.SliceStable(deletes, func(i, j int) bool { return deletes[i].table > deletes[j].table })
+
+	tx, err := ss.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, r := range upserts {
+		if _, err := tx.Exec(upsertSQL(sqlTables[r.table]), r.values...); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	for _, r := range deletes {
+		t := sqlTables[r.table]
+		if _, err := tx.Exec(deleteSQL(t), r.values[:t.keys]...); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if revision != ss.revision {
+		if _, err := tx.Exec(`UPDATE revisions SET revision = $1`, int64(revision)); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	ss.revision = revision
+	for name, rows := range saved {
+		if len(rows) == 0 {
+			delete(ss.written, name)
+		} else {
+			ss.written[name] = rows
+		}
+	}
+	return nil
+}
+
+func (ss *SQLStore) Load(dt *DataTracker) error {
+	subnets, err := ss.load()
+	if err != nil {
+		return err
+	}
+	var revision int64
+	if err := ss.db.QueryRow(`SELECT revision FROM revisions`).Scan(&revision); err != nil {
+		return err
+	}
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	dt.Lock()
+	defer dt.Unlock()
+	for _, as := range subnets {
+		data, err := json.Marshal(as)
+		if err != nil {
+			return err
+		}
+		s := NewSubnet()
+		if err := json.Unmarshal(data, s); err != nil {
+			return fmt.Errorf("subnet %s: %s", as.Name, err)
+		}
+		dt.Subnets[s.Name] = s
+	}
+	dt.Revision = uint64(revision)
+	ss.revision = dt.Revision
+	for name, s := range dt.Subnets {
+		ss.written[name] = ss.rows(s)
+	}
+	return nil
+}
+
+// load reads every table back into API subnets.
+func (ss *SQLStore) load() (map[string]*ApiSubnet, error) {
+	subnets := make(map[string]*ApiSubnet)
+	rows, err := ss.db.Query(`SELECT name, subnet, next_server, active_start, active_end,
+		active_lease_time, reserved_lease_time, delegated_prefix, delegated_length,
+		alert_thresholds, forward_zone, reverse_zone, hostname_template, tftp_root,
+		boot_template, boot_class_templates, revision FROM subnets`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		as := NewApiSubnet()
+		var nextServer, thresholds, classTemplates sql.NullString
+		var revision int64
+		if err := rows.Scan(&as.Name, &as.Subnet, &nextServer, &as.ActiveStart, &as.ActiveEnd,
+			&as.ActiveLeaseTime, &as.ReservedLeaseTime, &as.DelegatedPrefix, &as.DelegatedLength,
+			&thresholds, &as.ForwardZone, &as.ReverseZone, &as.HostnameTemplate, &as.TftpRoot,
+			&as.BootTemplate, &classTemplates, &revision); err != nil {
+			return nil, err
+		}
+		as.Revision = uint64(revision)
+		if nextServer.Valid {
+			as.NextServer = &nextServer.String
+		}
+		if thresholds.Valid {
+			if err := json.Unmarshal([]byte(thresholds.String), &as.AlertThresholds); err != nil {
+				return nil, fmt.Errorf("subnet %s alert_thresholds: %s", as.Name, err)
+			}
+		}
+		if classTemplates.Valid {
+			if err := json.Unmarshal([]byte(classTemplates.String), &as.BootClassTemplates); err != nil {
+				return nil, fmt.Errorf("subnet %s boot_class_templates: %s", as.Name, err)
+			}
+		}
+		subnets[as.Name] = as
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	err = ss.each(`SELECT subnet, code, value FROM options`, func(rows *sql.Rows) error {
+		var subnet string
+		o := &Option{}
+		if err := rows.Scan(&subnet, &o.Code, &o.Value); err != nil {
+			return err
+		}
+		if as := subnets[subnet]; as != nil {
+			as.Options = append(as.Options, o)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	bindings := make(map[string]*Binding)
+	err = ss.each(`SELECT subnet, id, ip, mac, duid, next_server, hostname, boot_template FROM bindings`, func(rows *sql.Rows) error {
+		var subnet, id string
+		var ip, nextServer sql.NullString
+		b := &Binding{}
+		if err := rows.Scan(&subnet, &id, &ip, &b.Mac, &b.Duid, &nextServer, &b.Hostname, &b.BootTemplate); err != nil {
+			return err
+		}
+		if ip.Valid {
+			b.Ip = net.ParseIP(ip.String)
+		}
+		if nextServer.Valid {
+			b.NextServer = &nextServer.String
+		}
+		if as := subnets[subnet]; as != nil {
+			as.Bindings = append(as.Bindings, b)
+			bindings[subnet+"\x00"+id] = b
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = ss.each(`SELECT subnet, binding, code, value FROM binding_options`, func(rows *sql.Rows) error {
+		var subnet, binding string
+		o := &Option{}
+		if err := rows.Scan(&subnet, &binding, &o.Code, &o.Value); err != nil {
+			return err
+		}
+		if b := bindings[subnet+"\x00"+binding]; b != nil {
+			b.Options = append(b.Options, o)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = ss.each(`SELECT subnet, kind, ip, mac, duid, iaid, prefix_len, valid, expire_time,
+		hostname, client_fqdn, client_fqdn_flags, client_fqdn_sent, vendor_class, user_class,
+		client_id, relay_addr, circuit_id, remote_id
+		FROM leases`, func(rows *sql.Rows) error {
+		var subnet, kind, ip string
+		var relayAddr sql.NullString
+		var iaid int64
+		var flags int
+		l := &Lease{}
+		if err := rows.Scan(&subnet, &kind, &ip, &l.Mac, &l.Duid, &iaid, &l.PrefixLen, &l.Valid,
+			&l.ExpireTime, &l.Hostname, &l.ClientFQDN, &flags, &l.ClientFQDNSent,
+			&l.VendorClass, &l.UserClass, &l.ClientId, &relayAddr, &l.CircuitId,
+			&l.RemoteId); err != nil {
+			return err
+		}
+		l.Ip = net.ParseIP(ip)
+		if relayAddr.Valid {
+			l.RelayAddr = net.ParseIP(relayAddr.String)
+		}
+		l.Iaid = uint32(iaid)
+		l.ClientFQDNFlags = byte(flags)
+		l.ExpireTime = l.ExpireTime.In(time.Local)
+		as := subnets[subnet]
+		if as == nil {
+			return nil
+		}
+		if kind == sqlLeasePrefix {
+			as.Delegations = append(as.Delegations, l)
+		} else {
+			as.Leases = append(as.Leases, l)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return subnets, nil
+}
+
+func (ss *SQLStore) each(query string, fn func(*sql.Rows) error) error {
+	rows, err := ss.db.Query(query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := fn(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
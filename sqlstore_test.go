@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	dhcp "github.com/krolaw/dhcp4"
+	"github.com/stretchr/testify/assert"
+)
+
+func sqlTracker(t *testing.T, path string) (*DataTracker, *SQLStore) {
+	ss, err := NewSQLStore("sqlite3", path)
+	assert.Nil(t, err)
+	t.Cleanup(func() { ss.Close() })
+	dt := NewDataTracker(ss)
+	dt.load_data()
+	return dt, ss
+}
+
+func sqlChanges(t *testing.T, ss *SQLStore) int {
+	var n int
+	assert.Nil(t, ss.db.QueryRow(`SELECT total_changes()`).Scan(&n))
+	return n
+}
+
+func TestSQLStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rebar-dhcp-sql")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dhcp.db")
+
+	dt, ss := sqlTracker(t, path)
+	s := NewSubnet()
+	assert.Nil(t, json.Unmarshal([]byte(`{
+		"name": "fred",
+		"subnet": "192.168.128.0/24",
+		"active_start": "192.168.128.10",
+		"active_end": "192.168.128.20",
+		"active_lease_time": 3600,
+		"reserved_lease_time": 7200,
+		"alert_thresholds": [90],
+		"options": [{"id": 3, "value": "192.168.128.1"}],
+		"bindings": [{"mac": "52:54:00:00:00:02", "ip": "192.168.128.15",
+			"options": [{"id": 67, "value": "pxelinux.0"}]}]
+	}`), s))
+	dt.AddSubnet(s)
+	lease, _ := s.find_or_get_info(dt, "52:54:00:00:00:01", nil)
+	lease.Hostname = "barney"
+	lease.RelayAddr = net.ParseIP("10.0.0.1")
+	lease.CircuitId = "eth0"
+	s.update_lease_time(dt, lease, time.Hour)
+
+	// Reports can query the tables directly.
+	var ip, hostname string
+	assert.Nil(t, ss.db.QueryRow(`SELECT ip, hostname FROM leases WHERE mac = $1`,
+		"52:54:00:00:00:01").Scan(&ip, &hostname))
+	assert.Equal(t, "192.168.128.10", ip)
+	assert.Equal(t, "barney", hostname)
+
+	// A renewal rewrites only the lease row.
+	before := sqlChanges(t, ss)
+	s.update_lease_time(dt, lease, 2*time.Hour)
+	assert.Equal(t, before+1, sqlChanges(t, ss))
+	dt.save_data()
+	assert.Equal(t, before+1, sqlChanges(t, ss))
+
+	// Another server process reads the same state back.
+	dt2, _ := sqlTracker(t, path)
+	s2 := dt2.Subnets["fred"]
+	assert.NotNil(t, s2)
+	assert.Equal(t, uint64(1), s2.Revision)
+	assert.Equal(t, []int{90}, s2.AlertThresholds)
+	assert.Equal(t, "192.168.128.1", net.IP(s2.Options[dhcp.OptionRouter]).String())
+	b := s2.Bindings["52:54:00:00:00:02"]
+	assert.Equal(t, "192.168.128.15", b.Ip.String())
+	assert.Equal(t, "pxelinux.0", b.Options[0].Value)
+	l := s2.Leases["52:54:00:00:00:01"]
+	assert.Equal(t, "barney", l.Hostname)
+	assert.Equal(t, "10.0.0.1", l.RelayAddr.String())
+	assert.Equal(t, "eth0", l.CircuitId)
+	assert.True(t, l.ExpireTime.Equal(lease.ExpireTime.Round(0)))
+	bit, _ := s2.active_bit(l.Ip)
+	assert.True(t, s2.ActiveBits.Test(bit))
+
+	// Removing a binding removes its options.
+	dt.DeleteBinding("fred", "52:54:00:00:00:02")
+	var n int
+	assert.Nil(t, ss.db.QueryRow(`SELECT COUNT(*) FROM binding_options`).Scan(&n))
+	assert.Equal(t, 0, n)
+
+	dt.RemoveSubnet("fred")
+	for _, table := range []string{"subnets", "options", "bindings", "leases"} {
+		assert.Nil(t, ss.db.QueryRow(`SELECT COUNT(*) FROM `+table).Scan(&n))
+		assert.Equal(t, 0, n, table)
+	}
+}
+
+func TestSQLStoreSavesTouchedSubnet(t *testing.T) {
+	dt, ss := sqlTracker(t, ":memory:")
+	fred := newSubnet(dt, "fred", "192.168.128.0/24")
+	barney := newSubnet(dt, "barney", "192.168.129.0/24")
+	dt.AddSubnet(fred)
+	dt.AddSubnet(barney)
+
+	// A change to fred that wasn't saved stays out of barney's save.
+	fred.HostnameTemplate = "node-{ip-dashed}"
+	dt.AddBinding("barney", Binding{Ip: net.ParseIP("192.168.129.5").To4(), Mac: "52:54:00:00:00:01"})
+	var template string
+	assert.Nil(t, ss.db.QueryRow(`SELECT hostname_template FROM subnets WHERE name = 'fred'`).Scan(&template))
+	assert.Equal(t, "", template)
+
+	dt.save_data()
+	assert.Nil(t, ss.db.QueryRow(`SELECT hostname_template FROM subnets WHERE name = 'fred'`).Scan(&template))
+	assert.Equal(t, "node-{ip-dashed}", template)
+}
+
+func TestSQLStoreBadJSON(t *testing.T) {
+	dt, ss := sqlTracker(t, ":memory:")
+	dt.AddSubnet(newSubnet(dt, "fred", "192.168.128.0/24"))
+
+	ss.db.Exec(`UPDATE subnets SET alert_thresholds = '[90' WHERE name = 'fred'`)
+	assert.NotNil(t, ss.Load(NewDataTracker(ss)))
+
+	ss.db.Exec(`UPDATE subnets SET alert_thresholds = NULL, boot_class_templates = 'x' WHERE name = 'fred'`)
+	assert.NotNil(t, ss.Load(NewDataTracker(ss)))
+}
+
+func TestSQLStoreDelegations(t *testing.T) {
+	h, s := v6Setup()
+	dt, ss := sqlTracker(t, ":memory:")
+	h.info.store = ss
+	h.info.save_data()
+	pd := s.find_or_get_prefix(h.info, "00:03:00:01:52:54:00:00:00:01")
+	s.update_prefix_time(h.info, pd, time.Hour)
+
+	dt.load_data()
+	s2 := dt.Subnets["wilma"]
+	assert.NotNil(t, s2)
+	assert.Equal(t, "fd00:20::", s2.Delegations["00:03:00:01:52:54:00:00:00:01"].Ip.String())
+	assert.True(t, s2.DelegatedBits.Test(0))
+}
+
+func TestSQLMigrations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rebar-dhcp-sql")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dhcp.db")
+
+	_, ss := sqlTracker(t, path)
+	var version int
+	assert.Nil(t, ss.db.QueryRow(`SELECT MAX(version) FROM schema_version`).Scan(&version))
+	assert.Equal(t, len(sqlMigrations), version)
+	ss.Close()
+
+	// Reopening applies nothing twice.
+	_, ss = sqlTracker(t, path)
+	var n int
+	assert.Nil(t, ss.db.QueryRow(`SELECT COUNT(*) FROM schema_version`).Scan(&n))
+	assert.Equal(t, len(sqlMigrations), n)
+
+	// A schema from a newer server is refused.
+	ss.db.Exec(`INSERT INTO schema_version (version) VALUES ($1)`, len(sqlMigrations)+1)
+	ss.Close()
+	_, err = NewSQLStore("sqlite3", path)
+	assert.NotNil(t, err)
+}
+
+func TestSQLStoreRevision(t *testing.T) {
+	dt, ss := sqlTracker(t, ":memory:")
+	dt.AddSubnet(newSubnet(dt, "fred", "192.168.128.0/24"))
+	rev := dt.Subnets["fred"].Revision
+	dt.RemoveSubnet("fred")
+
+	dt2 := NewDataTracker(ss)
+	assert.Nil(t, ss.Load(dt2))
+	assert.Equal(t, rev, dt2.Revision)
+	dt2.AddSubnet(newSubnet(dt2, "fred", "192.168.128.0/24"))
+	assert.True(t, dt2.Subnets["fred"].Revision > rev, "a recreated subnet doesn't reuse revisions")
+}
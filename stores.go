@@ -12,6 +12,12 @@ type LoadSaver interface {
 	Load(*DataTracker) error
 }
 
+// SubnetSaver is a store that can save a few subnets without the
+// rest.  save_subnet uses it when the store has it.
+type SubnetSaver interface {
+	SaveSubnet(dt *DataTracker, names ...string) error
+}
+
 type FileStore struct {
 	backingDatabase string
 }
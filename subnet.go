@@ -4,41 +4,95 @@ package main
 import (
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	dhcp "github.com/krolaw/dhcp4"
 	"github.com/willf/bitset"
 	"log"
+	"math/big"
 	"net"
 	"sync"
 	"time"
 )
 
+// maxActiveRange bounds the addresses ActiveBits tracks.  An IPv4 /8
+// fits; an IPv6 active range must be carved out of the /64.
+const maxActiveRange = 1 << 24
+
 type Subnet struct {
-	lock              sync.RWMutex
-	Name              string
-	Subnet            *MyIPNet
-	NextServer        *net.IP `"json:,omitempty"`
-	ActiveStart       net.IP
-	ActiveEnd         net.IP
-	ActiveLeaseTime   time.Duration
-	ActiveBits        *bitset.BitSet
-	ReservedLeaseTime time.Duration
-	Leases            map[string]*Lease
-	Bindings          map[string]*Binding
-	Options           dhcp.Options // Options to send to DHCP Clients
+	lock               sync.RWMutex
+	Name               string
+	Subnet             *MyIPNet
+	NextServer         *net.IP `"json:,omitempty"`
+	ActiveStart        net.IP
+	ActiveEnd          net.IP
+	ActiveLeaseTime    time.Duration
+	ActiveBits         *bitset.BitSet
+	ReservedLeaseTime  time.Duration
+	Leases             map[string]*Lease
+	Bindings           map[string]*Binding
+	Options            dhcp.Options      // Options to send to DHCP Clients
+	AlertThresholds    []int             // Utilization percents that trigger alerts
+	ForwardZone        string            // DDNS zone for A records
+	ReverseZone        string            // DDNS zone for PTR records
+	HostnameTemplate   string            // e.g. node-{ip-dashed}
+	TftpRoot           string            // Overrides the TFTP server root
+	BootTemplate       string            // Boot script template name
+	BootClassTemplates map[string]string // Client class -> template name
+	DelegatedPrefix    *MyIPNet          // IPv6 prefix delegation pool
+	DelegatedLength    int               // Length of each delegated prefix
+	DelegatedBits      *bitset.BitSet
+	Delegations        map[string]*Lease // DUID -> delegated prefix
+	Revision           uint64            // Set by each API change from DataTracker.next_revision, for ETags
 }
 
 func NewSubnet() *Subnet {
 	return &Subnet{
-		Leases:     make(map[string]*Lease),
-		Bindings:   make(map[string]*Binding),
-		Options:    make(dhcp.Options),
-		ActiveBits: bitset.New(0),
+		Leases:        make(map[string]*Lease),
+		Bindings:      make(map[string]*Binding),
+		Delegations:   make(map[string]*Lease),
+		Options:       make(dhcp.Options),
+		ActiveBits:    bitset.New(0),
+		DelegatedBits: bitset.New(0),
 	}
 }
 
+// MarshalJSON holds the read lock until the leases are encoded, so
+// the store and the API can read while handlers and the failover
+// partner change them.
 func (s *Subnet) MarshalJSON() ([]byte, error) {
-	as := convertSubnetToApiSubnet(s)
-	return json.Marshal(as)
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return json.Marshal(convertSubnetToApiSubnet(s))
+}
+
+// assign copies o into s under s's lock.  Stores use it to take in a
+// subnet changed elsewhere without swapping the one readers hold.
+func (s *Subnet) assign(o *Subnet) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.Name = o.Name
+	s.Subnet = o.Subnet
+	s.NextServer = o.NextServer
+	s.ActiveStart = o.ActiveStart
+	s.ActiveEnd = o.ActiveEnd
+	s.ActiveLeaseTime = o.ActiveLeaseTime
+	s.ActiveBits = o.ActiveBits
+	s.ReservedLeaseTime = o.ReservedLeaseTime
+	s.Leases = o.Leases
+	s.Bindings = o.Bindings
+	s.Options = o.Options
+	s.AlertThresholds = o.AlertThresholds
+	s.ForwardZone = o.ForwardZone
+	s.ReverseZone = o.ReverseZone
+	s.HostnameTemplate = o.HostnameTemplate
+	s.TftpRoot = o.TftpRoot
+	s.BootTemplate = o.BootTemplate
+	s.BootClassTemplates = o.BootClassTemplates
+	s.DelegatedPrefix = o.DelegatedPrefix
+	s.DelegatedLength = o.DelegatedLength
+	s.DelegatedBits = o.DelegatedBits
+	s.Delegations = o.Delegations
+	s.Revision = o.Revision
 }
 
 func (s *Subnet) UnmarshalJSON(data []byte) error {
@@ -55,29 +109,180 @@ func (s *Subnet) UnmarshalJSON(data []byte) error {
 	if s.Bindings == nil {
 		s.Bindings = make(map[string]*Binding)
 	}
+	if s.Delegations == nil {
+		s.Delegations = make(map[string]*Lease)
+	}
 	if s.Options == nil {
 		s.Options = make(dhcp.Options)
 	}
 	if s.ActiveBits == nil {
 		s.ActiveBits = bitset.New(0)
 	}
+	if s.DelegatedBits == nil {
+		s.DelegatedBits = bitset.New(0)
+	}
 	_, err = convertApiSubnetToSubnet(&as, s)
 	return err
 }
 
-func (subnet *Subnet) free_lease(dt *DataTracker, nic string) {
+// v6 is true for DHCPv6 subnets, whose leases and bindings are keyed
+// by DUID rather than MAC.
+func (s *Subnet) v6() bool {
+	return s.Subnet != nil && s.Subnet.IP.To4() == nil
+}
+
+// stateless is true for IPv6 subnets without an active range.  Their
+// hosts use SLAAC and ask DHCPv6 only for options.
+func (s *Subnet) stateless() bool {
+	return s.v6() && s.ActiveStart == nil
+}
+
+// key is what a lease is filed under in its subnet.
+func (l *Lease) key() string {
+	if l.Duid != "" {
+		return l.Duid
+	}
+	return l.Mac
+}
+
+func (b *Binding) key() string {
+	if b.Duid != "" {
+		return b.Duid
+	}
+	return b.Mac
+}
+
+// new_lease starts a lease for the client filed under nic.
+func (s *Subnet) new_lease(nic string, ip net.IP) *Lease {
+	lease := &Lease{Ip: ip, Valid: true}
+	if s.v6() {
+		lease.Duid = nic
+	} else {
+		lease.Mac = nic
+	}
+	return lease
+}
+
+// check_binding makes sure a binding fits the subnet's family, and
+// puts its DUID and option codes in the form the subnet uses.
+func (s *Subnet) overlaps(o *Subnet) bool {
+	return s.Subnet.Contains(o.Subnet.IP) || o.Subnet.Contains(s.Subnet.IP)
+}
+
+func (s *Subnet) check_binding(b *Binding) error {
+	if b.Ip != nil && !sameFamily(b.Ip, s.Subnet.IP) {
+		return errors.New("Binding address family does not match subnet")
+	}
+	if !s.v6() {
+		return nil
+	}
+	duid, err := parseDuid(b.Duid)
+	if err != nil {
+		return err
+	}
+	b.Duid = duid
+	for _, o := range b.Options {
+		o.Code = optionCode6(o.Code)
+		if _, err := convertOptionValueToByte6(o.Code, o.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+ * Address arithmetic for both families.  dhcp4's helpers are IPv4 only.
+ */
+
+func ipInt(ip net.IP) *big.Int {
+	if ip4 := ip.To4(); ip4 != nil {
+		return new(big.Int).SetBytes(ip4)
+	}
+	return new(big.Int).SetBytes(ip.To16())
+}
+
+// intIP turns i back into an address of the given family, or nil if it
+// doesn't fit.
+func intIP(i *big.Int, v6 bool) net.IP {
+	size := net.IPv4len
+	if v6 {
+		size = net.IPv6len
+	}
+	b := i.Bytes()
+	if i.Sign() < 0 || len(b) > size {
+		return nil
+	}
+	ip := make(net.IP, size)
+	copy(ip[size-len(b):], b)
+	return ip
+}
+
+func sameFamily(a, b net.IP) bool {
+	return a != nil && b != nil && (a.To4() == nil) == (b.To4() == nil)
+}
+
+// rangeSize is the number of addresses from start to end inclusive.  It
+// is 0 for an empty range, mixed families or more than maxActiveRange.
+func rangeSize(start, end net.IP) uint {
+	if !sameFamily(start, end) {
+		return 0
+	}
+	n := new(big.Int).Sub(ipInt(end), ipInt(start))
+	if n.Sign() < 0 || n.Cmp(big.NewInt(maxActiveRange)) >= 0 {
+		return 0
+	}
+	return uint(n.Uint64()) + 1
+}
+
+func (s *Subnet) active_size() uint {
+	return rangeSize(s.ActiveStart, s.ActiveEnd)
+}
+
+// active_bit is ip's bit in ActiveBits, if ip is in the active range.
+func (s *Subnet) active_bit(ip net.IP) (uint, bool) {
+	size := s.active_size()
+	if size == 0 || !sameFamily(ip, s.ActiveStart) {
+		return 0, false
+	}
+	n := new(big.Int).Sub(ipInt(ip), ipInt(s.ActiveStart))
+	if n.Sign() < 0 || n.Cmp(new(big.Int).SetUint64(uint64(size))) >= 0 {
+		return 0, false
+	}
+	return uint(n.Uint64()), true
+}
+
+func (s *Subnet) active_ip(bit uint) net.IP {
+	n := new(big.Int).Add(ipInt(s.ActiveStart), new(big.Int).SetUint64(uint64(bit)))
+	return intIP(n, s.v6())
+}
+
+// utilization returns the addresses in use and the size of the
+// active range.  Assumes RWLock is held
+func (subnet *Subnet) utilization() (uint, uint) {
+	if subnet.ActiveStart == nil || subnet.ActiveEnd == nil {
+		return 0, 0
+	}
+	return subnet.ActiveBits.Count(), subnet.active_size()
+}
+
+// free_lease removes the lease for nic, publishing eventType if there
+// was one.
+func (subnet *Subnet) free_lease(dt *DataTracker, nic, eventType string) *Lease {
 	subnet.lock.Lock()
 	lease := subnet.Leases[nic]
 	if lease != nil {
-		if dhcp.IPInRange(subnet.ActiveStart, subnet.ActiveEnd, lease.Ip) {
-			subnet.ActiveBits.Clear(uint(dhcp.IPRange(lease.Ip, subnet.ActiveStart) - 1))
+		if bit, ok := subnet.active_bit(lease.Ip); ok {
+			subnet.ActiveBits.Clear(bit)
 		}
 		delete(subnet.Leases, nic)
 		subnet.lock.Unlock()
-		dt.save_data()
+		dt.save_subnet(subnet.Name)
+		dt.publish(eventType, subnet.Name, lease, nil)
+		dt.alerter.Check(dt, subnet)
 	} else {
 		subnet.lock.Unlock()
 	}
+	return lease
 }
 
 func (subnet *Subnet) find_info(dt *DataTracker, nic string) (*Lease, *Binding) {
@@ -97,32 +302,39 @@ func firstClearBit(bs *bitset.BitSet) (uint, bool) {
 	return 0, false
 }
 
-// Assumes RWLock is held
-func (subnet *Subnet) getFreeIP() (*net.IP, bool) {
-	bit, success := firstClearBit(subnet.ActiveBits)
-	if success {
-		subnet.ActiveBits.Set(bit)
-		ip := dhcp.IPAdd(subnet.ActiveStart, int(bit))
-		return &ip, true
-	}
-
-	// Free invalid or expired leases
-	save_me := false
-	now := time.Now()
+// expire_leases frees the leases that expired before now and reports
+// whether there were any.  Assumes RWLock is held.
+func (subnet *Subnet) expire_leases(dt *DataTracker, now time.Time) bool {
+	expired := false
 	for k, lease := range subnet.Leases {
 		if now.After(lease.ExpireTime) {
-			if dhcp.IPInRange(subnet.ActiveStart, subnet.ActiveEnd, lease.Ip) {
-				subnet.ActiveBits.Clear(uint(dhcp.IPRange(lease.Ip, subnet.ActiveStart) - 1))
+			if bit, ok := subnet.active_bit(lease.Ip); ok {
+				subnet.ActiveBits.Clear(bit)
 			}
 			delete(subnet.Leases, k)
-			save_me = true
+			dt.publish(EventLeaseExpired, subnet.Name, lease, nil)
+			expired = true
 		}
 	}
+	return expired
+}
 
-	bit, success = firstClearBit(subnet.ActiveBits)
+// Assumes RWLock is held
+func (subnet *Subnet) getFreeIP(dt *DataTracker) (*net.IP, bool) {
+	bit, success := dt.failover.firstFreeBit(subnet.ActiveBits)
 	if success {
 		subnet.ActiveBits.Set(bit)
-		ip := dhcp.IPAdd(subnet.ActiveStart, int(bit))
+		ip := subnet.active_ip(bit)
+		return &ip, true
+	}
+
+	// Free expired leases the reaper hasn't got to yet
+	save_me := subnet.expire_leases(dt, time.Now())
+
+	bit, success = dt.failover.firstFreeBit(subnet.ActiveBits)
+	if success {
+		subnet.ActiveBits.Set(bit)
+		ip := subnet.active_ip(bit)
 		return &ip, true
 	}
 
@@ -138,13 +350,10 @@ func (subnet *Subnet) find_or_get_info(dt *DataTracker, nic string, suggest net.
 
 	var theip *net.IP
 
-	if binding != nil {
-		theip = &binding.Ip
-	}
-
-	// Resolve potential conflicts.
+	// Resolve potential conflicts.  A binding without an address only
+	// carries options.
 	if lease != nil && binding != nil {
-		if lease.Ip.Equal(binding.Ip) {
+		if binding.Ip == nil || lease.Ip.Equal(binding.Ip) {
 			subnet.lock.RUnlock()
 			return lease, binding
 		}
@@ -158,63 +367,92 @@ func (subnet *Subnet) find_or_get_info(dt *DataTracker, nic string, suggest net.
 		subnet.lock.Lock()
 		lease = subnet.Leases[nic]
 		binding = subnet.Bindings[nic]
-		theip = nil
-		if binding != nil {
+		if binding != nil && binding.Ip != nil {
 			theip = &binding.Ip
 		}
 		// Resolve potential conflicts.
-		if lease != nil && binding != nil {
-			if lease.Ip.Equal(binding.Ip) {
-				subnet.lock.Unlock()
-				return lease, binding
-			}
+		if lease != nil && (binding == nil || binding.Ip == nil || lease.Ip.Equal(binding.Ip)) {
+			subnet.lock.Unlock()
+			return lease, binding
 		}
 
 		if theip == nil {
 			var save_me bool
-			theip, save_me = subnet.getFreeIP()
+			theip, save_me = subnet.getFreeIP(dt)
 			if theip == nil {
 				subnet.lock.Unlock()
 				if save_me {
-					dt.save_data()
+					dt.save_subnet(subnet.Name)
 				}
+				dt.alerter.Check(dt, subnet)
 				return nil, nil
 			}
 		}
-		lease = &Lease{
-			Ip:    *theip,
-			Mac:   nic,
-			Valid: true,
-		}
+		lease = subnet.new_lease(nic, *theip)
 		subnet.Leases[nic] = lease
 		subnet.lock.Unlock()
-		dt.save_data()
+		dt.save_subnet(subnet.Name)
+		if binding == nil {
+			dt.publish(EventMacUnknown, subnet.Name, lease, nil)
+		}
+		dt.alerter.Check(dt, subnet)
 	}
 
 	return lease, binding
 }
 
+// record_client keeps what the client sent on its lease.  Stores and
+// the API read leases under the subnet's lock.
+func (s *Subnet) record_client(lease *Lease, options dhcp.Options, ri relayInfo) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	lease.record_client_names(options)
+	lease.record_client_class(options)
+	lease.record_client_id(options)
+	lease.record_relay(ri)
+}
+
 func (s *Subnet) update_lease_time(dt *DataTracker, lease *Lease, d time.Duration) {
-	lease.ExpireTime = time.Now().Add(d)
-	dt.save_data()
+	now := time.Now()
+	s.lock.Lock()
+	renewal := now.Before(lease.ExpireTime)
+	lease.ExpireTime = now.Add(d)
+	s.lock.Unlock()
+	dt.save_subnet(s.Name)
+	if renewal {
+		dt.publish(EventLeaseRenewed, s.Name, lease, nil)
+		return
+	}
+	dt.publish(EventLeaseBound, s.Name, lease, nil)
+
+	s.lock.RLock()
+	binding := s.Bindings[lease.key()]
+	s.lock.RUnlock()
+	if binding != nil {
+		dt.publish(EventBindingBound, s.Name, lease, binding)
+	}
 }
 
-func (s *Subnet) build_options(lease *Lease, binding *Binding) (dhcp.Options, time.Duration) {
-	var lt time.Duration
+// lease_time is ReservedLeaseTime for bound clients, ActiveLeaseTime
+// for the rest.
+func (s *Subnet) lease_time(binding *Binding) time.Duration {
 	if binding == nil {
-		lt = s.ActiveLeaseTime
-	} else {
-		lt = s.ReservedLeaseTime
+		return s.ActiveLeaseTime
 	}
+	return s.ReservedLeaseTime
+}
+
+func (s *Subnet) build_options(lease *Lease, binding *Binding) (dhcp.Options, time.Duration) {
+	lt := s.lease_time(binding)
 
 	opts := make(dhcp.Options)
 
 	// Build renewal / rebinding time options
 	b := make([]byte, 4)
-	binary.BigEndian.PutUint32(b, uint32(lt)/2)
+	binary.BigEndian.PutUint32(b, uint32(lt/time.Second)/2)
 	opts[dhcp.OptionRenewalTimeValue] = b
 	b = make([]byte, 4)
-	binary.BigEndian.PutUint32(b, uint32(lt)*3/4)
+	binary.BigEndian.PutUint32(b, uint32(lt/time.Second)*3/4)
 	opts[dhcp.OptionRebindingTimeValue] = b
 
 	// fold in subnet options
@@ -234,5 +472,8 @@ func (s *Subnet) build_options(lease *Lease, binding *Binding) (dhcp.Options, ti
 		}
 	}
 
+	s.hostname_options(opts, lease, binding)
+	s.boot_options(opts, lease, binding)
+
 	return opts, lt
 }
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"encoding/binary"
+	dhcp "github.com/krolaw/dhcp4"
 	"github.com/stretchr/testify/assert"
 	"github.com/willf/bitset"
 	"testing"
+	"time"
 )
 
 func TestNewSubnet(t *testing.T) {
@@ -35,7 +38,7 @@ func TestFreeLeaseNoMatch(t *testing.T) {
 
 	s.Leases["one"] = &Lease{}
 
-	s.free_lease(dt, "two")
+	s.free_lease(dt, "two", EventLeaseReleased)
 
 	assert.NotNil(t, s.Leases["one"], "Lease one should not be nil")
 	assert.Nil(t, s.Leases["two"], "Lease two should be nil")
@@ -51,7 +54,7 @@ func TestFreeLeaseMatch(t *testing.T) {
 	}
 	s.ActiveBits.Set(0)
 
-	s.free_lease(dt, "two")
+	s.free_lease(dt, "two", EventLeaseReleased)
 
 	assert.NotNil(t, s.Leases["one"], "Lease one should not be nil")
 	assert.Nil(t, s.Leases["two"], "Lease two should be nil")
@@ -130,3 +133,33 @@ func TestFirstClearBitLastBit(t *testing.T) {
 	assert.Equal(t, i, uint(2), "First bit should be 2")
 	assert.True(t, s, "Success should be true")
 }
+
+func TestBuildOptionsRenewalTimes(t *testing.T) {
+	s := NewSubnet()
+	s.ActiveLeaseTime = time.Hour
+	opts, lt := s.build_options(&Lease{}, nil)
+	assert.Equal(t, time.Hour, lt)
+	assert.Equal(t, uint32(1800), binary.BigEndian.Uint32(opts[dhcp.OptionRenewalTimeValue]))
+	assert.Equal(t, uint32(2700), binary.BigEndian.Uint32(opts[dhcp.OptionRebindingTimeValue]))
+}
+
+func TestRecordClientLocked(t *testing.T) {
+	dt, s := tempSetup(t)
+	s.ActiveBits = bitset.New(21)
+	lease, _ := s.find_or_get_info(dt, "52:54:00:00:00:01", nil)
+	options := dhcp.Options{dhcp.OptionHostName: []byte("barney")}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			s.record_client(lease, options, relayInfo{})
+			s.update_lease_time(dt, lease, time.Hour)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		s.MarshalJSON()
+	}
+	<-done
+	assert.Equal(t, "barney", lease.Hostname)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pin/tftp"
+)
+
+/*
+ * Read-only TFTP server (RFC 1350, with RFC 2348 blksize and RFC 2349
+ * tsize) for PXE boot files.  Files are served from the client's
+ * subnet's tftp_root if it has one, otherwise from the global root.
+ */
+
+type TftpServer struct {
+	dt     *DataTracker
+	root   string
+	server *tftp.Server
+}
+
+func NewTftpServer(dt *DataTracker, root string) *TftpServer {
+	ts := &TftpServer{dt: dt, root: root}
+	ts.server = tftp.NewServer(ts.read, nil)
+	return ts
+}
+
+// Serve answers requests on an already open conn.
+func (ts *TftpServer) Serve(conn *net.UDPConn) {
+	ts.server.Serve(conn)
+}
+
+func (ts *TftpServer) ListenAndServe(addr string) error {
+	return ts.server.ListenAndServe(addr)
+}
+
+// rootFor picks the directory to serve a client from.
+func (ts *TftpServer) rootFor(ip net.IP) string {
+	if s := ts.dt.FindSubnet(ip); s != nil && s.TftpRoot != "" {
+		return s.TftpRoot
+	}
+	return ts.root
+}
+
+func (ts *TftpServer) read(filename string, rf io.ReaderFrom) error {
+	var client net.IP
+	ot, ok := rf.(tftp.OutgoingTransfer)
+	if ok {
+		addr := ot.RemoteAddr()
+		client = addr.IP
+	}
+	path, err := tftpPath(ts.rootFor(client), filename)
+	if err != nil {
+		log.Println("TFTP: refusing ", filename, " for ", client, ": ", err)
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		log.Println("TFTP: ", client, " requested ", filename, ": ", err)
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return errors.New("not a file")
+	}
+	if ok {
+		ot.SetSize(fi.Size())
+	}
+	n, err := rf.ReadFrom(f)
+	if err != nil {
+		log.Println("TFTP: sending ", path, " to ", client, " failed: ", err)
+		return err
+	}
+	log.Println("TFTP: sent ", path, " (", n, " bytes) to ", client)
+	return nil
+}
+
+// tftpPath maps a requested name into root.  PXE clients sometimes
+// send DOS separators, and nothing may escape root.
+func tftpPath(root, filename string) (string, error) {
+	if root == "" {
+		return "", errors.New("no root configured")
+	}
+	name := strings.Replace(filename, "\\", "/", -1)
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", errors.New("path escapes root")
+		}
+	}
+	return filepath.Join(root, filepath.Clean("/"+name)), nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pin/tftp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTftpPath(t *testing.T) {
+	p, err := tftpPath("/srv/tftp", "pxelinux.0")
+	assert.Nil(t, err)
+	assert.Equal(t, "/srv/tftp/pxelinux.0", p)
+
+	p, err = tftpPath("/srv/tftp", "/pxelinux.cfg\\default")
+	assert.Nil(t, err)
+	assert.Equal(t, "/srv/tftp/pxelinux.cfg/default", p)
+
+	_, err = tftpPath("/srv/tftp", "../etc/passwd")
+	assert.NotNil(t, err)
+	_, err = tftpPath("/srv/tftp", "a\\..\\..\\etc\\passwd")
+	assert.NotNil(t, err)
+	_, err = tftpPath("", "pxelinux.0")
+	assert.NotNil(t, err)
+}
+
+func tftpGet(t *testing.T, addr, name string) ([]byte, error) {
+	c, err := tftp.NewClient(addr)
+	assert.Nil(t, err)
+	wt, err := c.Receive(name, "octet")
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	_, err = wt.WriteTo(&buf)
+	return buf.Bytes(), err
+}
+
+func TestTftpServer(t *testing.T) {
+	root, err := ioutil.TempDir("", "rebar-dhcp-tftp")
+	assert.Nil(t, err)
+	defer os.RemoveAll(root)
+	loRoot, err := ioutil.TempDir("", "rebar-dhcp-tftp-lo")
+	assert.Nil(t, err)
+	defer os.RemoveAll(loRoot)
+
+	big := bytes.Repeat([]byte("0123456789abcdef"), 1000)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(root, "pxelinux.0"), big, 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(loRoot, "pxelinux.0"), []byte("lo"), 0644))
+
+	dt, _ := tempSetup(t)
+	loDt, _ := tempSetup(t)
+	lo, _, _ := addNewSubnet(loDt, "lo", "127.0.0.0/24")
+	lo.TftpRoot = loRoot
+	loDt.AddSubnet(lo)
+
+	ts := NewTftpServer(dt, root)
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	assert.Nil(t, err)
+	// Not shut down, the library's Shutdown races Serve.
+	go ts.Serve(conn)
+	addr := conn.LocalAddr().String()
+
+	data, err := tftpGet(t, addr, "pxelinux.0")
+	assert.Nil(t, err)
+	assert.Equal(t, big, data)
+
+	// blksize and tsize are acknowledged
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	c.WriteTo([]byte("\x00\x01pxelinux.0\x00octet\x00blksize\x001428\x00tsize\x000\x00"), conn.LocalAddr())
+	oack := make([]byte, 512)
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, from, err := c.ReadFrom(oack)
+	if assert.Nil(t, err) {
+		assert.Equal(t, []byte{0, 6}, oack[:2])
+		assert.Contains(t, string(oack[2:n]), "blksize\x001428\x00")
+		assert.Contains(t, string(oack[2:n]), "tsize\x0016000\x00")
+		c.WriteTo([]byte("\x00\x05\x00\x00done\x00"), from)
+	}
+	c.Close()
+
+	_, err = tftpGet(t, addr, "missing")
+	assert.NotNil(t, err)
+	_, err = tftpGet(t, addr, "../../etc/passwd")
+	assert.NotNil(t, err)
+
+	// Clients in a subnet with its own root are served from it
+	ts2 := NewTftpServer(loDt, root)
+	conn2, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	assert.Nil(t, err)
+	go ts2.Serve(conn2)
+	data, err = tftpGet(t, conn2.LocalAddr().String(), "pxelinux.0")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("lo"), data)
+}
+
+func TestSubnetTftpRootNeedsServer(t *testing.T) {
+	as := &ApiSubnet{Name: "fred", Subnet: "192.168.128.0/24", ActiveStart: "192.168.128.10",
+		ActiveEnd: "192.168.128.20", TftpRoot: "/srv/tftp"}
+	_, err := convertApiSubnetToSubnet(as, nil)
+	assert.NotNil(t, err, "no server would serve the subnet's root")
+
+	tftp_enabled = true
+	defer func() { tftp_enabled = false }()
+	s, err := convertApiSubnetToSubnet(as, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "/srv/tftp", s.TftpRoot)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"sync"
+)
+
+/*
+ * API TLS
+ *
+ * The cert, key and client CA are re-read when their files change, so
+ * they can be rotated without a restart.  A client cert signed by the
+ * client CA logs in as the [user] with a matching cert-subject or
+ * cert-san.
+ */
+
+type tlsFiles struct {
+	fe *Frontend
+
+	lock      sync.Mutex
+	cert      *tls.Certificate
+	certStamp string // Paths, sizes and times the cert was read at
+	pool      *x509.CertPool
+	poolStamp string
+}
+
+func fileStamp(paths ...string) (string, error) {
+	stamp := ""
+	for _, p := range paths {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return "", err
+		}
+		stamp += fmt.Sprintf("%s:%d:%d;", p, fi.Size(), fi.ModTime().UnixNano())
+	}
+	return stamp, nil
+}
+
+// certificate serves the current cert.  A cert that fails to load,
+// say half way through being replaced, leaves the last good one.
+func (tf *tlsFiles) certificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	tf.lock.Lock()
+	defer tf.lock.Unlock()
+	stamp, err := fileStamp(tf.fe.cert_pem, tf.fe.key_pem)
+	if err == nil && stamp != tf.certStamp {
+		var cert tls.Certificate
+		if cert, err = tls.LoadX509KeyPair(tf.fe.cert_pem, tf.fe.key_pem); err == nil {
+			tf.cert, tf.certStamp = &cert, stamp
+			log.Println("Loaded API certificate", tf.fe.cert_pem)
+		}
+	}
+	if err != nil {
+		if tf.cert == nil {
+			return nil, err
+		}
+		log.Println("Keeping the last API certificate: ", err)
+	}
+	return tf.cert, nil
+}
+
+func (tf *tlsFiles) clientCAs(path string) (*x509.CertPool, error) {
+	tf.lock.Lock()
+	defer tf.lock.Unlock()
+	stamp, err := fileStamp(path)
+	if err == nil && stamp != tf.poolStamp {
+		var data []byte
+		if data, err = ioutil.ReadFile(path); err == nil {
+			pool := x509.NewCertPool()
+			if pool.AppendCertsFromPEM(data) {
+				tf.pool, tf.poolStamp = pool, stamp
+				log.Println("Loaded API client CA", path)
+			} else {
+				err = errors.New("no certificates in " + path)
+			}
+		}
+	}
+	if err != nil {
+		if tf.pool == nil {
+			return nil, err
+		}
+		log.Println("Keeping the last API client CA: ", err)
+	}
+	return tf.pool, nil
+}
+
+// tlsConfig asks for client certs when a client CA is configured.
+// The CA is looked up on each handshake, so reloads pick it up.
+func (fe *Frontend) tlsConfig() (*tls.Config, error) {
+	tf := &tlsFiles{fe: fe}
+	if _, err := tf.certificate(nil); err != nil {
+		return nil, err
+	}
+	base := &tls.Config{GetCertificate: tf.certificate}
+	base.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		cfg := fe.config()
+		if cfg.Tls.ClientCa == "" {
+			return nil, nil
+		}
+		pool, err := tf.clientCAs(cfg.Tls.ClientCa)
+		if err != nil {
+			log.Println("API client CA: ", err)
+			return nil, err
+		}
+		c := base.Clone()
+		c.GetConfigForClient = nil
+		c.ClientCAs = pool
+		c.ClientAuth = tls.VerifyClientCertIfGiven
+		if cfg.Tls.RequireClientCert {
+			c.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+		return c, nil
+	}
+	return base, nil
+}
+
+// certNames are what a cert-san can match.
+func certNames(cert *x509.Certificate) []string {
+	names := append([]string{}, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	for _, u := range cert.URIs {
+		names = append(names, u.String())
+	}
+	return names
+}
+
+// certUser finds the user a verified client cert belongs to.
+// cert-subject matches the whole subject, as in
+// "CN=ci,O=Example", or just the common name.
+func certUser(cfg Config, cert *x509.Certificate) (string, bool) {
+	subject := cert.Subject.String()
+	names := certNames(cert)
+	users := make([]string, 0, len(cfg.User))
+	for name := range cfg.User {
+		users = append(users, name)
+	}
+	sort.Strings(users)
+	for _, name := range users {
+		uc := cfg.User[name]
+		for _, s := range uc.CertSubject {
+			if s == subject || s == cert.Subject.CommonName {
+				return name, true
+			}
+		}
+		for _, s := range uc.CertSan {
+			for _, n := range names {
+				if s == n {
+					return name, true
+				}
+			}
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pair tls.Certificate
+}
+
+// issue makes a cert signed by parent, or self-signed without one.
+func issue(t *testing.T, serial int64, template *x509.Certificate, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	template.SerialNumber = big.NewInt(serial)
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	signer, signKey := template, key
+	if parent != nil {
+		signer, signKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signKey)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+	return &testCert{cert: cert, key: key, pair: tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}}
+}
+
+func (c *testCert) write(t *testing.T, certPath, keyPath string) {
+	assert.Nil(t, ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw}), 0600))
+	if keyPath != "" {
+		der, err := x509.MarshalECPrivateKey(c.key)
+		assert.Nil(t, err)
+		assert.Nil(t, ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600))
+	}
+}
+
+func caTemplate(name string) *x509.Certificate {
+	return &x509.Certificate{Subject: pkix.Name{CommonName: name}, IsCA: true,
+		BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign}
+}
+
+func TestClientCertAuth(t *testing.T) {
+	fe, handler := authFrontend(t)
+	dir, err := ioutil.TempDir("", "rebar-dhcp-tls")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	ca := issue(t, 1, caTemplate("Test CA"), nil)
+	server := issue(t, 2, &x509.Certificate{Subject: pkix.Name{CommonName: "dhcp"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}}, ca)
+	client := issue(t, 3, &x509.Certificate{Subject: pkix.Name{CommonName: "ci", Organization: []string{"Example"}},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}, ca)
+	robot := issue(t, 4, &x509.Certificate{Subject: pkix.Name{CommonName: "robot"},
+		DNSNames:    []string{"robot.example.com"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}, ca)
+	stranger := issue(t, 5, &x509.Certificate{Subject: pkix.Name{CommonName: "ci"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}, issue(t, 6, caTemplate("Other CA"), nil))
+
+	fe.cert_pem = filepath.Join(dir, "cert.pem")
+	fe.key_pem = filepath.Join(dir, "key.pem")
+	server.write(t, fe.cert_pem, fe.key_pem)
+	ca.write(t, filepath.Join(dir, "ca.pem"), "")
+	fe.cfg.Tls.ClientCa = filepath.Join(dir, "ca.pem")
+	fe.cfg.User["ci"] = &UserConfig{Role: RoleAdmin, CertSubject: []string{"CN=ci,O=Example"}}
+	fe.cfg.User["robot"] = &UserConfig{Role: RoleReadOnly, CertSan: []string{"robot.example.com"}}
+
+	tlsConfig, err := fe.tlsConfig()
+	assert.Nil(t, err)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	assert.Nil(t, err)
+	srv := &http.Server{Handler: handler}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	get := func(cert *testCert, method, auth string) (int, error) {
+		c := &tls.Config{RootCAs: roots}
+		if cert != nil {
+			c.Certificates = []tls.Certificate{cert.pair}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: c}}
+		req, _ := http.NewRequest(method, "https://"+l.Addr().String()+"/subnets/fred", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+
+	code, err := get(client, "GET", "")
+	assert.Nil(t, err)
+	assert.Equal(t, 200, code)
+	code, _ = get(robot, "GET", "")
+	assert.Equal(t, 200, code)
+	code, _ = get(robot, "DELETE", "")
+	assert.Equal(t, 403, code)
+	// Certs from other CAs aren't sent, or fail the handshake.
+	code, err = get(stranger, "GET", "")
+	assert.True(t, err != nil || code == 401)
+
+	// Without a cert, basic auth until it's turned off.
+	code, _ = get(nil, "GET", basic("fred", "rules"))
+	assert.Equal(t, 200, code)
+	fe.cfg.Network.DisableBasicAuth = true
+	code, _ = get(nil, "GET", basic("fred", "rules"))
+	assert.Equal(t, 401, code)
+
+	// A new cert is served without a restart.
+	rotated := issue(t, 7, &x509.Certificate{Subject: pkix.Name{CommonName: "dhcp"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}}, ca)
+	rotated.write(t, fe.cert_pem, fe.key_pem)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(fe.cert_pem, later, later)
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{RootCAs: roots})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(7), conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64())
+	conn.Close()
+
+	// A broken one keeps the last.
+	assert.Nil(t, ioutil.WriteFile(fe.cert_pem, []byte("junk"), 0600))
+	conn, err = tls.Dial("tcp", l.Addr().String(), &tls.Config{RootCAs: roots})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(7), conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64())
+	conn.Close()
+}
+
+func TestClientCertConfig(t *testing.T) {
+	cfg := Config{}
+	cfg.Network.Port = 6755
+	cfg.Network.DisableBasicAuth = true
+	cfg.Storage.DataDir = "/tmp/dhcp"
+	cfg.Tls.RequireClientCert = true
+	cfg.User = map[string]*UserConfig{"ci": {Role: RoleAdmin, CertSan: []string{"ci.example.com"}}}
+	assert.Equal(t, ConfigError{
+		`user "ci" cert-subject and cert-san need tls.client-ca`,
+		"tls.require-client-cert needs tls.client-ca",
+		"network.disable-basic-auth needs tls.client-ca",
+	}, cfg.validate())
+
+	// Cert users need no password.
+	cfg.Tls.Cert = "/tmp/cert.pem"
+	cfg.Tls.Key = "/tmp/key.pem"
+	cfg.Tls.ClientCa = "/tmp/ca.pem"
+	assert.Nil(t, cfg.validate())
+}
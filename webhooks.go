@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * Outbound webhooks
+ *
+ * Events from the DataTracker are matched against each configured
+ * endpoint and queued.  The queue is saved next to database.json by
+ * the delivery loop, off the DHCP path, and an entry is only removed
+ * once the endpoint answers 2xx, so delivery is at-least-once across
+ * restarts.  Each endpoint is delivered by its own goroutine and backs
+ * off on its own.  Queues are capped and entries dropped after too
+ * many failures.
+ *
+ * Bodies are signed with HMAC-SHA256 of the endpoint secret and sent
+ * as "X-Rebar-Signature: sha256=<hex>".
+ */
+
+type WebhookEndpoint struct {
+	Name     string
+	Url      string
+	Secret   string
+	Events   []string // Event types, "lease.*" style prefixes allowed. Empty is all.
+	Subnets  []string // Empty is all
+	Attempts int      // Before a delivery is dropped, 0 is the default
+}
+
+func (ep *WebhookEndpoint) match(e *Event) bool {
+	if len(ep.Subnets) > 0 {
+		found := false
+		for _, s := range ep.Subnets {
+			if s == e.Subnet {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(ep.Events) == 0 {
+		return true
+	}
+	for _, t := range ep.Events {
+		if t == e.Type {
+			return true
+		}
+		if strings.HasSuffix(t, ".*") && strings.HasPrefix(e.Type, strings.TrimSuffix(t, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+type webhookDelivery struct {
+	Id       string `json:"id"`
+	Endpoint string `json:"endpoint"`
+	Event    *Event `json:"event"`
+	Attempts int    `json:"attempts"`
+}
+
+// webhookTarget is an endpoint with its own queue and retry schedule,
+// so an endpoint that is down only delays its own deliveries.
+type webhookTarget struct {
+	ep       *WebhookEndpoint
+	queue    []*webhookDelivery
+	busy     bool      // A goroutine is delivering the queue
+	failures int       // Consecutive failures, drives the backoff
+	next     time.Time // No attempts before this
+}
+
+const (
+	webhookMaxQueue    = 10000 // Per endpoint, the oldest are dropped past this
+	webhookMaxAttempts = 20
+)
+
+type Webhooks struct {
+	lock        sync.Mutex
+	path        string // Persistent queue file
+	targets     map[string]*webhookTarget
+	dirty       bool // Queue changed since it was last saved
+	wake        chan struct{}
+	client      *http.Client
+	backoff     time.Duration // First retry delay, doubled per failure
+	maxBackoff  time.Duration
+	maxQueue    int
+	maxAttempts int
+}
+
+// NewWebhooks loads any queue left at path by a previous run.
+// Deliveries for endpoints no longer configured are dropped.
+func NewWebhooks(path string, endpoints []*WebhookEndpoint) (*Webhooks, error) {
+	wh := &Webhooks{
+		path:        path,
+		targets:     make(map[string]*webhookTarget),
+		wake:        make(chan struct{}, 1),
+		client:      &http.Client{Timeout: 10 * time.Second},
+		backoff:     time.Second,
+		maxBackoff:  10 * time.Minute,
+		maxQueue:    webhookMaxQueue,
+		maxAttempts: webhookMaxAttempts,
+	}
+	for _, ep := range endpoints {
+		wh.targets[ep.Name] = &webhookTarget{ep: ep, queue: make([]*webhookDelivery, 0)}
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil && len(data) > 0 {
+		saved := make([]*webhookDelivery, 0)
+		if err := json.Unmarshal(data, &saved); err != nil {
+			return nil, err
+		}
+		for _, d := range saved {
+			t := wh.targets[d.Endpoint]
+			if t == nil {
+				log.Println("Dropping queued webhook for removed endpoint ", d.Endpoint)
+				continue
+			}
+			wh.push(t, d)
+		}
+	}
+	return wh, nil
+}
+
+// Enqueue queues e for every matching endpoint.  It is called on the
+// DHCP path, so the queue is saved later by Run.
+func (wh *Webhooks) Enqueue(e *Event) {
+	if wh == nil {
+		return
+	}
+	wh.lock.Lock()
+	added := false
+	for name, t := range wh.targets {
+		if !t.ep.match(e) {
+			continue
+		}
+		wh.push(t, &webhookDelivery{Id: newDeliveryId(), Endpoint: name, Event: e})
+		added = true
+	}
+	wh.lock.Unlock()
+
+	if added {
+		wh.poke()
+	}
+}
+
+// push adds d to t's queue, dropping the oldest entry when it is
+// full.  Assumes lock is held
+func (wh *Webhooks) push(t *webhookTarget, d *webhookDelivery) {
+	if len(t.queue) >= wh.maxQueue {
+		log.Printf("Webhook queue for %s is full, dropping %s", t.ep.Name, t.queue[0].Id)
+		t.queue = t.queue[1:]
+	}
+	t.queue = append(t.queue, d)
+	wh.dirty = true
+}
+
+func (wh *Webhooks) poke() {
+	select {
+	case wh.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run saves the queue and starts deliveries until stop is closed.
+func (wh *Webhooks) Run(stop <-chan struct{}) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-stop:
+			wh.flush()
+			return
+		case <-wh.wake:
+		case <-timer.C:
+		}
+
+		next := wh.deliverDue()
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(next)
+	}
+}
+
+// deliverDue saves the queue, starts a delivery goroutine for every
+// idle endpoint that is due and returns how long until the next one
+// is.
+func (wh *Webhooks) deliverDue() time.Duration {
+	wh.flush()
+
+	now := time.Now()
+	next := wh.maxBackoff
+	wh.lock.Lock()
+	defer wh.lock.Unlock()
+	for _, t := range wh.targets {
+		if t.busy || len(t.queue) == 0 {
+			continue
+		}
+		if wait := t.next.Sub(now); wait > 0 {
+			if wait < next {
+				next = wait
+			}
+			continue
+		}
+		t.busy = true
+		go wh.deliverTo(t)
+	}
+	return next
+}
+
+// deliverTo sends t's queue in order until it is empty or a send
+// fails, then backs the endpoint off.
+func (wh *Webhooks) deliverTo(t *webhookTarget) {
+	defer wh.poke()
+	for {
+		wh.lock.Lock()
+		if len(t.queue) == 0 {
+			t.busy = false
+			wh.lock.Unlock()
+			return
+		}
+		d := t.queue[0]
+		wh.lock.Unlock()
+
+		err := wh.send(t.ep, d)
+
+		wh.lock.Lock()
+		wh.dirty = true
+		if err == nil {
+			t.failures = 0
+			wh.remove(t, d.Id)
+			wh.lock.Unlock()
+			wh.poke()
+			continue
+		}
+		d.Attempts++
+		t.failures++
+		delay := wh.backoff << uint(t.failures-1)
+		if delay > wh.maxBackoff || delay <= 0 {
+			delay = wh.maxBackoff
+		}
+		t.next = time.Now().Add(delay)
+		max := wh.maxAttempts
+		if t.ep.Attempts > 0 {
+			max = t.ep.Attempts
+		}
+		if d.Attempts >= max {
+			log.Printf("Webhook %s to %s failed %d times, dropping it: %s", d.Id, d.Endpoint, d.Attempts, err)
+			wh.remove(t, d.Id)
+		} else {
+			log.Printf("Webhook %s to %s failed (attempt %d), retrying in %s: %s", d.Id, d.Endpoint, d.Attempts, delay, err)
+		}
+		t.busy = false
+		wh.lock.Unlock()
+		return
+	}
+}
+
+func (wh *Webhooks) send(ep *WebhookEndpoint, d *webhookDelivery) error {
+	body, err := json.Marshal(d.Event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", ep.Url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Rebar-Event", d.Event.Type)
+	req.Header.Set("X-Rebar-Delivery", d.Id)
+	if ep.Secret != "" {
+		req.Header.Set("X-Rebar-Signature", "sha256="+signWebhook(ep.Secret, body))
+	}
+
+	resp, err := wh.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// Assumes lock is held
+func (wh *Webhooks) remove(t *webhookTarget, id string) {
+	for i, d := range t.queue {
+		if d.Id == id {
+			t.queue = append(t.queue[:i:i], t.queue[i+1:]...)
+			return
+		}
+	}
+}
+
+// flush writes the queue atomically if it changed.  Only Run calls it,
+// so writes never race each other.
+func (wh *Webhooks) flush() {
+	wh.lock.Lock()
+	if !wh.dirty {
+		wh.lock.Unlock()
+		return
+	}
+	names := make([]string, 0, len(wh.targets))
+	for name := range wh.targets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	all := make([]*webhookDelivery, 0)
+	for _, name := range names {
+		all = append(all, wh.targets[name].queue...)
+	}
+	data, err := json.Marshal(all)
+	wh.dirty = false
+	wh.lock.Unlock()
+
+	if err != nil {
+		log.Println("Unable to marshal webhook queue: ", err)
+		return
+	}
+	tmp := wh.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		log.Println("Unable to save webhook queue: ", err)
+		return
+	}
+	if err := os.Rename(tmp, wh.path); err != nil {
+		log.Println("Unable to save webhook queue: ", err)
+	}
+}
+
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func newDeliveryId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
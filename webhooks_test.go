@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/willf/bitset"
+)
+
+type webhookReceived struct {
+	event     *Event
+	signature string
+}
+
+func webhookReceiver(t *testing.T, failures int32) (*httptest.Server, chan webhookReceived) {
+	received := make(chan webhookReceived, 10)
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) <= failures {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		e := &Event{}
+		assert.Nil(t, json.Unmarshal(body, e))
+		assert.Equal(t, e.Type, r.Header.Get("X-Rebar-Event"))
+		sig := r.Header.Get("X-Rebar-Signature")
+		if sig != "" {
+			assert.Equal(t, "sha256="+signWebhook("sekrit", body), sig)
+		}
+		received <- webhookReceived{e, sig}
+	}))
+	return ts, received
+}
+
+func waitWebhook(t *testing.T, received chan webhookReceived) webhookReceived {
+	select {
+	case r := <-received:
+		return r
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for webhook")
+	}
+	return webhookReceived{}
+}
+
+func webhookQueuePath(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "rebar-dhcp-webhooks")
+	assert.Nil(t, err)
+	return filepath.Join(dir, "webhooks.json")
+}
+
+func TestWebhookEndpointMatch(t *testing.T) {
+	ep := &WebhookEndpoint{Events: []string{"lease.*", EventBindingAdded}, Subnets: []string{"fred"}}
+
+	assert.True(t, ep.match(&Event{Type: EventLeaseBound, Subnet: "fred"}))
+	assert.True(t, ep.match(&Event{Type: EventBindingAdded, Subnet: "fred"}))
+	assert.False(t, ep.match(&Event{Type: EventBindingRemoved, Subnet: "fred"}))
+	assert.False(t, ep.match(&Event{Type: EventLeaseBound, Subnet: "barney"}))
+	assert.True(t, (&WebhookEndpoint{}).match(&Event{Type: EventSubnetDeleted}))
+}
+
+func TestWebhookUnknownMacAndBound(t *testing.T) {
+	ts, received := webhookReceiver(t, 0)
+	defer ts.Close()
+	path := webhookQueuePath(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	wh, err := NewWebhooks(path, []*WebhookEndpoint{
+		{Name: "inventory", Url: ts.URL, Secret: "sekrit", Events: []string{EventMacUnknown, EventBindingBound}},
+	})
+	assert.Nil(t, err)
+	stop := make(chan struct{})
+	defer close(stop)
+	go wh.Run(stop)
+
+	dt, s := tempSetup(t)
+	s.ActiveBits = bitset.New(21)
+	dt.webhooks = wh
+
+	s.find_or_get_info(dt, "11:22:33:44:55:66", nil)
+	r := waitWebhook(t, received)
+	assert.Equal(t, EventMacUnknown, r.event.Type)
+	assert.Equal(t, "11:22:33:44:55:66", r.event.Mac)
+	assert.NotEqual(t, "", r.signature)
+
+	dt.AddBinding("fred", Binding{Ip: net.ParseIP("192.168.128.50").To4(), Mac: "aa:bb:cc:dd:ee:ff"})
+	lease, binding := s.find_or_get_info(dt, "aa:bb:cc:dd:ee:ff", nil)
+	assert.NotNil(t, binding)
+	s.update_lease_time(dt, lease, time.Hour)
+	s.update_lease_time(dt, lease, time.Hour)
+
+	r = waitWebhook(t, received)
+	assert.Equal(t, EventBindingBound, r.event.Type)
+	assert.Equal(t, "aa:bb:cc:dd:ee:ff", r.event.Binding.Mac)
+	assert.Equal(t, 0, len(received))
+}
+
+func TestWebhookRetryAndPersist(t *testing.T) {
+	ts, received := webhookReceiver(t, 1)
+	defer ts.Close()
+	path := webhookQueuePath(t)
+	defer os.RemoveAll(filepath.Dir(path))
+	endpoints := []*WebhookEndpoint{{Name: "inventory", Url: ts.URL}}
+
+	// Queue an event with nothing delivering it.
+	wh, err := NewWebhooks(path, endpoints)
+	assert.Nil(t, err)
+	wh.Enqueue(&Event{Seq: 7, Type: EventBindingAdded, Subnet: "fred"})
+	wh.flush()
+
+	// A new instance picks it up from disk, fails once, then delivers.
+	wh, err = NewWebhooks(path, endpoints)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(wh.targets["inventory"].queue))
+	wh.backoff = time.Millisecond
+	stop := make(chan struct{})
+	defer close(stop)
+	go wh.Run(stop)
+
+	r := waitWebhook(t, received)
+	assert.Equal(t, uint64(7), r.event.Seq)
+	assert.Equal(t, "", r.signature)
+
+	time.Sleep(50 * time.Millisecond)
+	data, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "[]", string(data))
+}
+
+func TestWebhookDropsRemovedEndpoint(t *testing.T) {
+	path := webhookQueuePath(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	wh, _ := NewWebhooks(path, []*WebhookEndpoint{{Name: "old", Url: "http://127.0.0.1:1"}})
+	wh.Enqueue(&Event{Type: EventBindingAdded})
+	wh.flush()
+
+	wh, err := NewWebhooks(path, []*WebhookEndpoint{{Name: "new", Url: "http://127.0.0.1:1"}})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(wh.targets["new"].queue))
+}
+
+func TestWebhookEnqueueDoesNotSave(t *testing.T) {
+	path := webhookQueuePath(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	wh, _ := NewWebhooks(path, []*WebhookEndpoint{{Name: "inventory", Url: "http://127.0.0.1:1"}})
+	wh.Enqueue(&Event{Type: EventBindingAdded})
+	_, err := os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestWebhookQueueCap(t *testing.T) {
+	path := webhookQueuePath(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	wh, _ := NewWebhooks(path, []*WebhookEndpoint{{Name: "inventory", Url: "http://127.0.0.1:1"}})
+	wh.maxQueue = 2
+	for seq := uint64(1); seq <= 3; seq++ {
+		wh.Enqueue(&Event{Seq: seq, Type: EventBindingAdded})
+	}
+	queue := wh.targets["inventory"].queue
+	assert.Equal(t, 2, len(queue))
+	assert.Equal(t, uint64(2), queue[0].Event.Seq)
+	assert.Equal(t, uint64(3), queue[1].Event.Seq)
+}
+
+func TestWebhookMaxAttempts(t *testing.T) {
+	ts, _ := webhookReceiver(t, 1000)
+	defer ts.Close()
+	path := webhookQueuePath(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	wh, _ := NewWebhooks(path, []*WebhookEndpoint{{Name: "inventory", Url: ts.URL}})
+	wh.backoff = time.Millisecond
+	wh.maxBackoff = time.Millisecond
+	wh.maxAttempts = 3
+	stop := make(chan struct{})
+	defer close(stop)
+	go wh.Run(stop)
+
+	wh.Enqueue(&Event{Type: EventBindingAdded})
+	for i := 0; i < 200; i++ {
+		wh.lock.Lock()
+		n := len(wh.targets["inventory"].queue)
+		wh.lock.Unlock()
+		if n == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Delivery was never dropped")
+}
+
+func TestWebhookStuckEndpoint(t *testing.T) {
+	ts, received := webhookReceiver(t, 0)
+	defer ts.Close()
+	release := make(chan struct{})
+	stuck := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer stuck.Close()
+	defer close(release)
+	path := webhookQueuePath(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	wh, _ := NewWebhooks(path, []*WebhookEndpoint{
+		{Name: "stuck", Url: stuck.URL},
+		{Name: "inventory", Url: ts.URL},
+	})
+	stop := make(chan struct{})
+	defer close(stop)
+	go wh.Run(stop)
+
+	// The stuck endpoint holds its own queue, not everyone's.
+	wh.Enqueue(&Event{Seq: 1, Type: EventBindingAdded})
+	wh.Enqueue(&Event{Seq: 2, Type: EventBindingAdded})
+	assert.Equal(t, uint64(1), waitWebhook(t, received).event.Seq)
+	assert.Equal(t, uint64(2), waitWebhook(t, received).event.Seq)
+}